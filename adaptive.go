@@ -0,0 +1,58 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// adaptiveInspection adapts the inspection to the history of each client: clients with a long
+// clean streak are only sampled, recently blocked clients are always inspected and face the lower
+// thresholds of the decision policies.
+type adaptiveInspection struct {
+	cleanStreak int
+	sampleEvery int
+	blockWindow time.Duration
+}
+
+func newAdaptiveInspection(enabled bool, cleanStreak int, sampleRate float64, blockWindow time.Duration) (*adaptiveInspection, error) {
+	if !enabled {
+		return nil, nil
+	}
+	if cleanStreak <= 0 {
+		return nil, fmt.Errorf("adaptiveCleanStreak must be positive")
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("invalid adaptiveSampleRate %v, expected a value in ]0, 1]", sampleRate)
+	}
+	return &adaptiveInspection{
+		cleanStreak: cleanStreak,
+		sampleEvery: int(math.Round(1 / sampleRate)),
+		blockWindow: blockWindow,
+	}, nil
+}
+
+// skipInspection reports whether req can be forwarded to the service without inspection. The
+// requests of greylisted clients are always inspected.
+func (a *Modsecurity) skipInspection(req *http.Request) bool {
+	if a.adaptive == nil || a.greylisted(req) {
+		return false
+	}
+	return a.clientTracker.skipInspection(a.trackingKey(req), a.adaptive.cleanStreak, a.adaptive.sampleEvery, a.adaptive.blockWindow, time.Now())
+}
+
+// recordVerdict records the inspection verdict of req in the history of the client.
+func (a *Modsecurity) recordVerdict(req *http.Request, blocked bool) {
+	if a.adaptive != nil {
+		a.clientTracker.recordVerdict(a.trackingKey(req), blocked, time.Now())
+	}
+}
+
+// recentlyBlocked reports whether the client of req was blocked within adaptiveBlockWindow.
+func (a *Modsecurity) recentlyBlocked(req *http.Request) bool {
+	if a.adaptive == nil {
+		return false
+	}
+	return a.clientTracker.recentlyBlocked(a.trackingKey(req), a.adaptive.blockWindow, time.Now())
+}
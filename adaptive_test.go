@@ -0,0 +1,73 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_AdaptiveInspection(t *testing.T) {
+	var wafCalls int32
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&wafCalls, 1)
+		w.Header().Set("X-Waf-Anomaly-Score", r.URL.Query().Get("score"))
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.AdaptiveInspection = true
+	config.AdaptiveCleanStreak = 3
+	config.AdaptiveSampleRate = 0.5
+	config.Decision = &DecisionConfig{Type: "score", Threshold: 10, RecentlyBlockedThreshold: 3}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(target string) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		serve("/?score=0")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&wafCalls))
+
+	// the clean streak is reached, one request out of two is inspected
+	for i := 0; i < 4; i++ {
+		serve("/?score=0")
+	}
+	assert.Equal(t, int32(5), atomic.LoadInt32(&wafCalls))
+
+	// a block ends the sampling, every request is inspected with the lower threshold
+	calls := atomic.LoadInt32(&wafCalls)
+	for atomic.LoadInt32(&wafCalls) == calls {
+		serve("/?score=20")
+	}
+	assert.Equal(t, http.StatusForbidden, serve("/?score=5"))
+	assert.Equal(t, http.StatusOK, serve("/?score=2"))
+	assert.Equal(t, http.StatusOK, serve("/?score=2"))
+	assert.Equal(t, http.StatusOK, serve("/?score=2"))
+	assert.Equal(t, http.StatusOK, serve("/?score=2"))
+	assert.Equal(t, calls+6, atomic.LoadInt32(&wafCalls))
+}
+
+func TestNewAdaptiveInspection(t *testing.T) {
+	adaptive, err := newAdaptiveInspection(false, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, adaptive)
+
+	adaptive, err = newAdaptiveInspection(true, 100, 0.1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, adaptive.sampleEvery)
+
+	_, err = newAdaptiveInspection(true, 0, 0.1, 0)
+	assert.Error(t, err)
+	_, err = newAdaptiveInspection(true, 100, 1.5, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,295 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agentMaxMessage bounds the size of the messages read from a local agent.
+const agentMaxMessage = 16 << 20
+
+// agentMaxIdle bounds the idle connections kept to a local agent.
+const agentMaxIdle = 16
+
+var (
+	errAgentMalformed = errors.New("malformed agent response")
+	errAgentClosed    = errors.New("agent client closed")
+)
+
+// agentClients holds the clients of the agent backend protocol, one per socket.
+type agentClients struct {
+	mu      sync.Mutex
+	clients map[string]*agentClient
+	closed  bool
+}
+
+// client returns the client of the agent listening at service, e.g. unix:///run/waf-agent.sock.
+func (c *agentClients) client(service string, timeout time.Duration) (*agentClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errAgentClosed
+	}
+	if client, ok := c.clients[service]; ok {
+		return client, nil
+	}
+	socket, err := url.Parse(service)
+	if err != nil {
+		return nil, err
+	}
+	if c.clients == nil {
+		c.clients = make(map[string]*agentClient)
+	}
+	client := &agentClient{socket: socket.Path, timeout: timeout}
+	c.clients[service] = client
+	return client, nil
+}
+
+// close closes the idle connections, the connections in use are closed once their call ends.
+func (c *agentClients) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, client := range c.clients {
+		client.close()
+	}
+}
+
+// agentClient submits requests to a local inspection agent over a Unix socket, in a compact
+// binary framing instead of HTTP: each message is the big-endian 32 bits length of a protobuf
+// message, then the message. A connection carries one call at a time, then goes back to a pool of
+// idle connections. The messages are:
+//
+//	message Header {
+//	  string name = 1;
+//	  string value = 2;
+//	}
+//	message InspectRequest {
+//	  string method = 1;
+//	  string uri = 2;
+//	  string host = 3;
+//	  repeated Header headers = 4;
+//	  bytes body = 5;
+//	}
+//	message InspectResponse {
+//	  uint32 status = 1;
+//	  repeated Header headers = 2;
+//	  bytes body = 3;
+//	}
+//
+// The InspectResponse stands for the response the WAF would return: its status, the rule IDs and
+// anomaly score headers, and the body returned to the blocked clients.
+type agentClient struct {
+	socket  string
+	timeout time.Duration
+	mu      sync.Mutex
+	idle    []net.Conn
+	closed  bool
+}
+
+// Do implements wafDoer, req is the request to submit to the agent.
+func (c *agentClient) Do(req *http.Request) (*http.Response, error) {
+	message, err := encodeInspectRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 4, 4+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	frame = append(frame, message...)
+
+	conn, reused, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.roundTrip(conn, frame)
+	var netErr net.Error
+	if err != nil && reused && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		// the agent may have closed the idle connection
+		if conn, err = c.dial(); err != nil {
+			return nil, err
+		}
+		response, err = c.roundTrip(conn, frame)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeInspectResponse(response)
+}
+
+// roundTrip writes frame on conn and returns the message answered. The connection is closed when
+// the call fails, otherwise it goes back to the idle pool.
+func (c *agentClient) roundTrip(conn net.Conn, frame []byte) ([]byte, error) {
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	response, err := readAgentMessage(conn, frame)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.release(conn)
+	return response, nil
+}
+
+func readAgentMessage(conn net.Conn, frame []byte) ([]byte, error) {
+	if _, err := conn.Write(frame); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > agentMaxMessage {
+		return nil, fmt.Errorf("agent response of %d bytes exceeds %d bytes", length, agentMaxMessage)
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(reader, response); err != nil {
+		return nil, err
+	}
+	if reader.Buffered() > 0 {
+		return nil, errAgentMalformed
+	}
+	return response, nil
+}
+
+// connection returns an idle connection to the agent, and whether it was used before, or dials
+// a new one.
+func (c *agentClient) connection() (net.Conn, bool, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, false, errAgentClosed
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, true, nil
+	}
+	c.mu.Unlock()
+	conn, err := c.dial()
+	return conn, false, err
+}
+
+func (c *agentClient) dial() (net.Conn, error) {
+	return net.DialTimeout("unix", c.socket, c.timeout)
+}
+
+// release puts conn back to the idle pool, or closes it when the pool is full.
+func (c *agentClient) release(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= agentMaxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+func (c *agentClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+}
+
+// encodeInspectRequest encodes the InspectRequest describing proxyReq, the copy of a request
+// prepared for the WAF. Headers are sorted by name, so that the encoding is stable.
+func encodeInspectRequest(proxyReq *http.Request) ([]byte, error) {
+	var message protoBuffer
+	message.string(1, proxyReq.Method)
+	message.string(2, proxyReq.URL.RequestURI())
+	message.string(3, proxyReq.Host)
+	names := make([]string, 0, len(proxyReq.Header))
+	for name := range proxyReq.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range proxyReq.Header[name] {
+			var header protoBuffer
+			header.string(1, name)
+			header.string(2, value)
+			message.bytes(4, header)
+		}
+	}
+	if proxyReq.Body != nil {
+		body, err := ioutil.ReadAll(proxyReq.Body)
+		proxyReq.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		message.bytes(5, body)
+	}
+	return message, nil
+}
+
+// decodeInspectResponse turns an InspectResponse into the equivalent WAF response.
+func decodeInspectResponse(message []byte) (*http.Response, error) {
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+	var body []byte
+	var hasStatus bool
+	err := protoFields(message, func(field int, wireType int, varint uint64, data []byte) error {
+		switch field {
+		case 1:
+			if wireType != 0 || varint < 100 || varint > 599 {
+				return errAgentMalformed
+			}
+			resp.StatusCode = int(varint)
+			hasStatus = true
+		case 2:
+			var name, value string
+			err := protoFields(data, func(field int, wireType int, varint uint64, data []byte) error {
+				switch field {
+				case 1:
+					name = string(data)
+				case 2:
+					value = string(data)
+				}
+				return nil
+			})
+			if err == nil && len(name) > 0 {
+				resp.Header.Add(name, value)
+			}
+			return err
+		case 3:
+			body = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// a verdict is never assumed: an empty or truncated answer would otherwise let the request through
+	if !hasStatus {
+		return nil, errAgentMalformed
+	}
+	if len(body) > 0 {
+		resp.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		resp.ContentLength = int64(len(body))
+	}
+	return resp, nil
+}
@@ -0,0 +1,229 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// agentRequest is an InspectRequest received by the fake agent.
+type agentRequest struct {
+	method string
+	uri    string
+	host   string
+	header http.Header
+	body   string
+}
+
+func decodeAgentRequest(message []byte) (agentRequest, error) {
+	req := agentRequest{header: http.Header{}}
+	err := protoFields(message, func(field int, wireType int, varint uint64, data []byte) error {
+		switch field {
+		case 1:
+			req.method = string(data)
+		case 2:
+			req.uri = string(data)
+		case 3:
+			req.host = string(data)
+		case 4:
+			return addHeaderValueOption(req.header, append([]byte{0x0a, byte(len(data))}, data...))
+		case 5:
+			req.body = string(data)
+		}
+		return nil
+	})
+	return req, err
+}
+
+// newAgent starts a fake agent on a Unix socket answering each request with the InspectResponse
+// returned by respond, nil to close the connection. It returns the agent URL and its connection
+// count.
+func newAgent(tb testing.TB, respond func(agentRequest) []byte) (string, *int32) {
+	socket := filepath.Join(tb.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(tb, err)
+	tb.Cleanup(func() { listener.Close() })
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					header := make([]byte, 4)
+					if _, err := io.ReadFull(reader, header); err != nil {
+						return
+					}
+					message := make([]byte, binary.BigEndian.Uint32(header))
+					if _, err := io.ReadFull(reader, message); err != nil {
+						return
+					}
+					req, err := decodeAgentRequest(message)
+					assert.NoError(tb, err)
+					response := respond(req)
+					if response == nil {
+						return
+					}
+					binary.BigEndian.PutUint32(header, uint32(len(response)))
+					conn.Write(append(header, response...))
+				}
+			}()
+		}
+	}()
+	return "unix://" + socket, &connections
+}
+
+func inspectResponse(status int, header http.Header, body string) []byte {
+	var message protoBuffer
+	message.uint(1, uint64(status))
+	for name, values := range header {
+		for _, value := range values {
+			var h protoBuffer
+			h.string(1, name)
+			h.string(2, value)
+			message.bytes(2, h)
+		}
+	}
+	message.string(3, body)
+	return message
+}
+
+func TestEncodeInspectRequest(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "/items?id=1", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	req.Host = "example.com"
+	req.Header.Set("X-B", "2")
+	req.Header.Add("X-A", "1")
+	req.Header.Add("X-A", "3")
+	message, err := encodeInspectRequest(req)
+	assert.NoError(t, err)
+
+	decoded, err := decodeAgentRequest(message)
+	assert.NoError(t, err)
+	assert.Equal(t, agentRequest{
+		method: http.MethodPost,
+		uri:    "/items?id=1",
+		host:   "example.com",
+		header: http.Header{"X-A": {"1", "3"}, "X-B": {"2"}},
+		body:   "payload",
+	}, decoded)
+	assert.Less(t, strings.Index(string(message), "X-A"), strings.Index(string(message), "X-B"), "headers are sorted by name")
+}
+
+func TestDecodeInspectResponse(t *testing.T) {
+	resp, err := decodeInspectResponse(inspectResponse(http.StatusForbidden, http.Header{"X-Waf-Rule-Ids": {"942100"}}, "blocked"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "942100", resp.Header.Get("X-Waf-Rule-Ids"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "blocked", string(body))
+
+	_, err = decodeInspectResponse(nil)
+	assert.Equal(t, errAgentMalformed, err, "a missing status is malformed")
+	var bodyOnly protoBuffer
+	bodyOnly.bytes(3, []byte("allowed"))
+	_, err = decodeInspectResponse(bodyOnly)
+	assert.Equal(t, errAgentMalformed, err)
+
+	_, err = decodeInspectResponse(inspectResponse(1000, nil, ""))
+	assert.Equal(t, errAgentMalformed, err)
+	_, err = decodeInspectResponse([]byte{0x0a, 0x05})
+	assert.Error(t, err)
+}
+
+func TestModsecurity_Agent(t *testing.T) {
+	var closeNext int32
+	received := make(chan agentRequest, 10)
+	agent, connections := newAgent(t, func(req agentRequest) []byte {
+		if atomic.CompareAndSwapInt32(&closeNext, 1, 0) {
+			return nil
+		}
+		received <- req
+		if strings.Contains(req.body, "attack") {
+			return inspectResponse(http.StatusForbidden, http.Header{"X-Waf-Rule-Ids": {"942100"}}, "")
+		}
+		return inspectResponse(http.StatusOK, nil, "")
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = agent
+	config.BackendProtocol = backendProtocolAgent
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(body string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/items?id=1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusOK, send("hello"))
+	req := <-received
+	assert.Equal(t, http.MethodPost, req.method)
+	assert.Equal(t, "/items?id=1", req.uri)
+	assert.Equal(t, "text/plain", req.header.Get("Content-Type"))
+	assert.Equal(t, "hello", req.body)
+
+	assert.Equal(t, http.StatusForbidden, send("attack"))
+	<-received
+	assert.Equal(t, int32(1), atomic.LoadInt32(connections), "the connection is reused")
+
+	atomic.StoreInt32(&closeNext, 1)
+	assert.Equal(t, http.StatusOK, send("hello"), "a call failing on an idle connection is sent again on a new one")
+	assert.Equal(t, int32(2), atomic.LoadInt32(connections))
+}
+
+// BenchmarkModsecurity_BackendProtocol compares the latency of the HTTP mirroring contract, over
+// the loopback interface, to the agent protocol over a Unix socket.
+func BenchmarkModsecurity_BackendProtocol(b *testing.B) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer wafServer.Close()
+	agent, _ := newAgent(b, func(req agentRequest) []byte {
+		return inspectResponse(http.StatusOK, nil, "")
+	})
+
+	benchmarks := []struct {
+		name     string
+		url      string
+		protocol string
+	}{
+		{name: "http", url: wafServer.URL, protocol: backendProtocolHTTP},
+		{name: "agent", url: agent, protocol: backendProtocolAgent},
+	}
+	body := `{"user":"john","password":"secret"}`
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			config := CreateConfig()
+			config.ModSecurityUrl = bm.url
+			config.BackendProtocol = bm.protocol
+			middleware := newTestModsecurity(b, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/api/login?redirect=%2Fhome", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rw := httptest.NewRecorder()
+				middleware.ServeHTTP(rw, req)
+				if rw.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", rw.Code)
+				}
+			}
+		})
+	}
+}
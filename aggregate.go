@@ -0,0 +1,123 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventAggregator collapses the identical block events, same event, client, path, rules and
+// reason, occurring within a window: the first one is sent right away, the repeats are counted
+// and sent as a single event once the window is over, so that scans don't flood the alerting
+// and the storage. Like clientTracker, it tracks at most maxTrackedClients keys.
+type eventAggregator struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*aggregatedEvent
+}
+
+type aggregatedEvent struct {
+	event auditEvent
+	start time.Time
+	count int
+}
+
+func newEventAggregator(window time.Duration) *eventAggregator {
+	if window <= 0 {
+		return nil
+	}
+	return &eventAggregator{window: window, pending: make(map[string]*aggregatedEvent)}
+}
+
+func aggregationKey(e *auditEvent) string {
+	path := e.URI
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return strings.Join([]string{e.Event, e.Client, path, strings.Join(e.RuleIds, ","), e.Reason}, "\x00")
+}
+
+// add records e and reports whether it must be sent now: it is not the repeat of an event sent
+// within the window.
+func (g *eventAggregator) add(e *auditEvent) bool {
+	if g == nil || !strings.HasSuffix(e.Event, "_block") {
+		return true
+	}
+	key := aggregationKey(e)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if pending, ok := g.pending[key]; ok && e.Time.Sub(pending.start) < g.window {
+		pending.count++
+		return false
+	}
+	if len(g.pending) < maxTrackedClients {
+		g.pending[key] = &aggregatedEvent{event: *e, start: e.Time}
+	}
+	return true
+}
+
+// expire removes the events whose window is over at now, or every event with all set, and
+// returns the summaries of the repeated ones. Count is the number of repeats.
+func (g *eventAggregator) expire(now time.Time, all bool) []*auditEvent {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var summaries []*auditEvent
+	for key, pending := range g.pending {
+		if !all && now.Sub(pending.start) < g.window {
+			continue
+		}
+		delete(g.pending, key)
+		if pending.count > 0 {
+			summary := pending.event
+			summary.Time = now.UTC()
+			summary.Count = pending.count
+			summaries = append(summaries, &summary)
+		}
+	}
+	return summaries
+}
+
+// runEventAggregator sends the summaries of the repeated events every window until ctx is done.
+func (a *Modsecurity) runEventAggregator(ctx context.Context) {
+	ticker := time.NewTicker(a.eventAggregator.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.sendSummaries(a.eventAggregator.expire(now, false))
+		}
+	}
+}
+
+// flushEventAggregator sends the summaries of the events still pending, on Close.
+func (a *Modsecurity) flushEventAggregator() {
+	a.sendSummaries(a.eventAggregator.expire(time.Now(), true))
+}
+
+func (a *Modsecurity) sendSummaries(summaries []*auditEvent) {
+	for _, summary := range summaries {
+		fields := logFields{
+			"event":  summary.Event,
+			"client": summary.Client,
+			"uri":    summary.URI,
+			"status": summary.Status,
+			"rules":  strings.Join(summary.RuleIds, ","),
+			"reason": summary.Reason,
+			"count":  summary.Count,
+		}
+		if a.countryLookup != nil {
+			fields["country"] = summary.Country
+		}
+		if a.asnPolicies != nil {
+			fields["asn"] = summary.Asn
+		}
+		a.logEvent("block_repeated", fields)
+		for _, sink := range a.eventSinks {
+			sink.send(summary)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSink struct {
+	events []*auditEvent
+}
+
+func (s *recordingSink) send(event *auditEvent) {
+	s.events = append(s.events, event)
+}
+
+func TestEventAggregator(t *testing.T) {
+	assert.Nil(t, newEventAggregator(0))
+	assert.True(t, (*eventAggregator)(nil).add(&auditEvent{Event: "waf_block"}))
+
+	now := time.Unix(1700000000, 0)
+	event := func(offset time.Duration, client string, uri string, rules ...string) *auditEvent {
+		return &auditEvent{Time: now.Add(offset), Event: "waf_block", Client: client, URI: uri, Status: http.StatusForbidden, RuleIds: rules}
+	}
+	g := newEventAggregator(time.Minute)
+	assert.True(t, g.add(event(0, "192.0.2.1", "/login", "942100")))
+	assert.False(t, g.add(event(time.Second, "192.0.2.1", "/login?user=1", "942100")), "the query is ignored")
+	assert.False(t, g.add(event(2*time.Second, "192.0.2.1", "/login", "942100")))
+	assert.True(t, g.add(event(2*time.Second, "192.0.2.2", "/login", "942100")), "another client")
+	assert.True(t, g.add(event(2*time.Second, "192.0.2.1", "/search", "942100")), "another path")
+	assert.True(t, g.add(event(2*time.Second, "192.0.2.1", "/login", "920350")), "another rule")
+	assert.True(t, g.add(&auditEvent{Time: now, Event: "honeypot_hit", Client: "192.0.2.1"}))
+	assert.True(t, g.add(&auditEvent{Time: now, Event: "honeypot_hit", Client: "192.0.2.1"}), "only block events are aggregated")
+
+	assert.Empty(t, g.expire(now.Add(30*time.Second), false))
+	summaries := g.expire(now.Add(time.Minute), false)
+	assert.Len(t, summaries, 1)
+	assert.Equal(t, 2, summaries[0].Count)
+	assert.Equal(t, "/login", summaries[0].URI)
+	assert.Equal(t, []string{"942100"}, summaries[0].RuleIds)
+	assert.Len(t, g.pending, 3, "the events seen later are still pending")
+
+	assert.True(t, g.add(event(time.Minute, "192.0.2.1", "/login", "942100")), "a new window starts")
+	assert.False(t, g.add(event(90*time.Second, "192.0.2.1", "/login", "942100")))
+	assert.True(t, g.add(event(2*time.Minute, "192.0.2.1", "/login", "942100")), "the window is over")
+}
+
+func TestModsecurity_EventAggregation(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf.invalid"
+	config.AllowedMethods = []MethodRule{{Path: "^/login$", Methods: []string{"POST"}}}
+	config.EventAggregationWindow = "1h"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+	sink := &recordingSink{}
+	middleware.eventSinks = []eventSink{sink}
+
+	for i := 0; i < 5; i++ {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/login", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code, "repeats are still blocked")
+	}
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, 1, strings.Count(buf.String(), "blockLocally"))
+
+	middleware.flushEventAggregator()
+	assert.Len(t, sink.events, 2)
+	assert.Equal(t, 4, sink.events[1].Count)
+	assert.Equal(t, "local_block", sink.events[1].Event)
+	assert.Contains(t, buf.String(), "block_repeated")
+}
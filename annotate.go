@@ -0,0 +1,63 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Suffixes of the request headers annotating the WAF decision, after accessLogHeaderPrefix.
+const (
+	annotationStatus  = "Status"
+	annotationScore   = "Score"
+	annotationRules   = "Rules"
+	annotationAction  = "Action"
+	annotationCountry = "Country"
+	annotationAsn     = "Asn"
+)
+
+// Values of the action annotation.
+const (
+	annotationActionPass  = "pass"
+	annotationActionFlag  = "flag"
+	annotationActionBlock = "block"
+)
+
+// stripAnnotations removes the annotation headers sent by the client, they are never trusted.
+func (a *Modsecurity) stripAnnotations(req *http.Request) {
+	if len(a.accessLogHeaderPrefix) == 0 {
+		return
+	}
+	for _, suffix := range []string{annotationStatus, annotationScore, annotationRules, annotationAction, annotationCountry, annotationAsn} {
+		req.Header.Del(a.accessLogHeaderPrefix + suffix)
+	}
+}
+
+// annotate sets the WAF decision on the request headers, where the Traefik access logs can capture
+// them with accessLog.fields.headers, for blocked requests as well: Traefik logs the request headers
+// once the middleware returned. The service receives them too.
+func (a *Modsecurity) annotate(req *http.Request, signals Signals, blocked bool) {
+	if len(a.accessLogHeaderPrefix) == 0 {
+		return
+	}
+	action := annotationActionPass
+	if blocked {
+		action = annotationActionBlock
+	} else if a.decision.Blocks(signals) {
+		action = annotationActionFlag
+	}
+	req.Header.Set(a.accessLogHeaderPrefix+annotationStatus, strconv.Itoa(signals.Status))
+	req.Header.Set(a.accessLogHeaderPrefix+annotationAction, action)
+	if signals.HasScore {
+		req.Header.Set(a.accessLogHeaderPrefix+annotationScore, strconv.FormatFloat(signals.Score, 'f', -1, 64))
+	}
+	if len(signals.RuleIds) > 0 {
+		req.Header.Set(a.accessLogHeaderPrefix+annotationRules, strings.Join(signals.RuleIds, ","))
+	}
+	if len(signals.Country) > 0 {
+		req.Header.Set(a.accessLogHeaderPrefix+annotationCountry, signals.Country)
+	}
+	if signals.Asn > 0 {
+		req.Header.Set(a.accessLogHeaderPrefix+annotationAsn, strconv.FormatUint(uint64(signals.Asn), 10))
+	}
+}
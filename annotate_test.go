@@ -0,0 +1,76 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_AccessLogHeaderPrefix(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		wafStatus     int
+		wafHeaders    map[string]string
+		expectCode    int
+		expectHeaders map[string]string
+	}{
+		{
+			name:          "Pass",
+			wafStatus:     http.StatusOK,
+			wafHeaders:    map[string]string{defaultAnomalyScoreHeader: "2"},
+			expectCode:    http.StatusOK,
+			expectHeaders: map[string]string{"X-Waf-Status": "200", "X-Waf-Action": "pass", "X-Waf-Score": "2", "X-Waf-Rules": ""},
+		},
+		{
+			name:          "Block",
+			wafStatus:     http.StatusForbidden,
+			wafHeaders:    map[string]string{defaultRuleIdsHeader: "942100, 949110", defaultAnomalyScoreHeader: "10"},
+			expectCode:    http.StatusForbidden,
+			expectHeaders: map[string]string{"X-Waf-Status": "403", "X-Waf-Action": "block", "X-Waf-Score": "10", "X-Waf-Rules": "942100,949110"},
+		},
+		{
+			name:          "Flag in detect mode",
+			mode:          "detect",
+			wafStatus:     http.StatusForbidden,
+			wafHeaders:    map[string]string{defaultRuleIdsHeader: "942100"},
+			expectCode:    http.StatusOK,
+			expectHeaders: map[string]string{"X-Waf-Status": "403", "X-Waf-Action": "flag", "X-Waf-Score": "", "X-Waf-Rules": "942100"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafAction string
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafAction = r.Header.Get("X-Waf-Action")
+				for name, value := range tt.wafHeaders {
+					w.Header().Set(name, value)
+				}
+				w.WriteHeader(tt.wafStatus)
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.AccessLogHeaderPrefix = "X-Waf-"
+			if len(tt.mode) > 0 {
+				config.Mode = tt.mode
+			}
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Waf-Action", "pass")
+			req.Header.Set("X-Waf-Score", "0")
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectCode, rw.Code)
+			assert.Empty(t, wafAction)
+			for name, value := range tt.expectHeaders {
+				assert.Equal(t, value, req.Header.Get(name), name)
+			}
+		})
+	}
+}
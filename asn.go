@@ -0,0 +1,77 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+)
+
+// Actions accepted in asnPolicies.
+const (
+	asnActionSkip    = "skip"
+	asnActionDetect  = "detect"
+	asnActionEnforce = "enforce"
+	asnActionBlock   = "block"
+)
+
+// AsnPolicy applies Action to the clients whose address belongs to one of the autonomous systems Asns.
+type AsnPolicy struct {
+	Asns   []uint `json:"asns,omitempty" description:"autonomous system numbers"`
+	Action string `json:"action,omitempty" description:"skip, detect, enforce or block"`
+}
+
+// asnPolicies looks up the autonomous system of clients in a MaxMind ASN database, so traffic
+// from hosting or VPN networks can be treated more strictly than residential ISPs.
+type asnPolicies struct {
+	db      *mmdbReader
+	actions map[uint]string
+}
+
+func newAsnPolicies(file string, policies []AsnPolicy) (*asnPolicies, error) {
+	if len(file) == 0 {
+		if len(policies) > 0 {
+			return nil, fmt.Errorf("asnPolicies require asnDatabase")
+		}
+		return nil, nil
+	}
+	db, err := openMMDB(file)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open asnDatabase: %w", err)
+	}
+	p := &asnPolicies{db: db, actions: make(map[uint]string)}
+	for _, policy := range policies {
+		switch policy.Action {
+		case asnActionSkip, asnActionDetect, asnActionEnforce, asnActionBlock:
+		default:
+			return nil, fmt.Errorf("invalid asnPolicies action %q, expected %s, %s, %s or %s", policy.Action, asnActionSkip, asnActionDetect, asnActionEnforce, asnActionBlock)
+		}
+		for _, asn := range policy.Asns {
+			p.actions[asn] = policy.Action
+		}
+	}
+	return p, nil
+}
+
+// asn returns the autonomous system number of ip, zero when it is unknown.
+func (p *asnPolicies) asn(ip net.IP) uint {
+	if p == nil || ip == nil {
+		return 0
+	}
+	record, err := p.db.lookup(ip)
+	if err != nil {
+		return 0
+	}
+	fields, _ := record.(map[string]interface{})
+	asn, _ := fields["autonomous_system_number"].(uint64)
+	return uint(asn)
+}
+
+// action returns the action applying to the clients of asn, enforce when no policy matches.
+func (p *asnPolicies) action(asn uint) string {
+	if p == nil {
+		return asnActionEnforce
+	}
+	if action, ok := p.actions[asn]; ok {
+		return action
+	}
+	return asnActionEnforce
+}
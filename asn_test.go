@@ -0,0 +1,68 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_AsnPolicies(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("attack") == "1" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.AsnDatabase = buildTestMMDB(t, 6, []testAsnNetwork{
+		{cidr: "192.0.2.0/24", asn: 64496, org: "Trusted partner"},
+		{cidr: "198.51.100.0/24", asn: 64497, org: "Residential ISP"},
+		{cidr: "203.0.113.0/24", asn: 64498, org: "Bulletproof hosting"},
+		{cidr: "2001:db8::/32", asn: 64499, org: "Shady VPN"},
+	})
+	config.AsnPolicies = []AsnPolicy{
+		{Asns: []uint{64496}, Action: asnActionSkip},
+		{Asns: []uint{64497}, Action: asnActionDetect},
+		{Asns: []uint{64498, 64499}, Action: asnActionBlock},
+	}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		expectStatus int
+	}{
+		{name: "skip", remoteAddr: "192.0.2.1:1234", expectStatus: http.StatusOK},
+		{name: "detect", remoteAddr: "198.51.100.1:1234", expectStatus: http.StatusOK},
+		{name: "block", remoteAddr: "203.0.113.1:1234", expectStatus: http.StatusForbidden},
+		{name: "block IPv6", remoteAddr: "[2001:db8::1]:1234", expectStatus: http.StatusForbidden},
+		{name: "unknown ASN is enforced", remoteAddr: "10.0.0.1:1234", expectStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?attack=1", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, tt.expectStatus, rw.Code)
+		})
+	}
+}
+
+func TestNewAsnPolicies(t *testing.T) {
+	policies, err := newAsnPolicies("", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, policies)
+	assert.Equal(t, asnActionEnforce, policies.action(64496))
+
+	_, err = newAsnPolicies("", []AsnPolicy{{Asns: []uint{64496}, Action: asnActionBlock}})
+	assert.Error(t, err)
+
+	database := buildTestMMDB(t, 4, []testAsnNetwork{{cidr: "192.0.2.0/24", asn: 64496, org: "Example"}})
+	_, err = newAsnPolicies(database, []AsnPolicy{{Asns: []uint{64496}, Action: "ban"}})
+	assert.Error(t, err)
+}
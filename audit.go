@@ -0,0 +1,60 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"time"
+)
+
+// auditEvent records a request blocked by the WAF or locally, for the event sinks.
+type auditEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Method  string    `json:"method"`
+	Host    string    `json:"host"`
+	URI     string    `json:"uri"`
+	Client  string    `json:"client"`
+	Status  int       `json:"status"`
+	RuleIds []string  `json:"ruleIds,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Country string    `json:"country,omitempty"`
+	Asn     uint      `json:"asn,omitempty"`
+	// Count is the number of identical events a summary stands for, zero for single events.
+	Count int `json:"count,omitempty"`
+}
+
+// eventSink receives the audit events. send must not block the request.
+type eventSink interface {
+	send(event *auditEvent)
+}
+
+// audit sends the audit event of req to every configured sink. It reports false when the block
+// event repeats one sent within eventAggregationWindow: it is then only counted in a summary.
+func (a *Modsecurity) audit(req *http.Request, event string, status int, ruleIds []string, reason string) bool {
+	country, asn := a.clientOrigin(req)
+	if a.countryLookup != nil && event != "honeypot_hit" && event != "panic" {
+		a.metrics.blocksByCountry.inc(country)
+	}
+	if len(a.eventSinks) == 0 && a.eventAggregator == nil {
+		return true
+	}
+	e := &auditEvent{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Method:  req.Method,
+		Host:    req.Host,
+		URI:     a.piiMasker.maskURI(req.RequestURI),
+		Client:  clientKey(remoteIP(req), a.ipv6PrefixLength),
+		Status:  status,
+		RuleIds: ruleIds,
+		Reason:  reason,
+		Country: country,
+		Asn:     asn,
+	}
+	if !a.eventAggregator.add(e) {
+		return false
+	}
+	for _, sink := range a.eventSinks {
+		sink.send(e)
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// maskedBlockBody is the body of every block response when maskBlockResponse is enabled.
+const maskedBlockBody = "Request blocked\n"
+
+// writeBlockResponse returns the WAF block response to the client. With maskBlockResponse, the
+// client only receives the status code and a generic body, so nothing about the WAF internals
+// (server banners, rule hints) leaks. WAF bodies larger than maxWafResponseBytes are replaced by the
+// generic body as well.
+//
+// A decision policy may block on a WAF response which is not an error, e.g. on its anomaly score:
+// the client then receives a 403 instead of the WAF status.
+func (a *Modsecurity) writeBlockResponse(resp *http.Response, rw http.ResponseWriter) {
+	if resp.StatusCode < http.StatusBadRequest {
+		resp.StatusCode = http.StatusForbidden
+	}
+	if !a.maskBlockResponse {
+		if a.boundWafResponse(resp) {
+			forwardResponse(resp, rw)
+			return
+		}
+		a.logEvent("waf_response_too_large", logFields{
+			"status": resp.StatusCode,
+			"limit":  a.maxWafResponseBytes,
+		})
+	} else if a.maxWafResponseBytes > 0 {
+		io.CopyN(ioutil.Discard, resp.Body, a.maxWafResponseBytes)
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(maskedBlockBody)))
+	rw.WriteHeader(resp.StatusCode)
+	io.WriteString(rw, maskedBlockBody)
+}
+
+// boundWafResponse buffers the body of resp when maxWafResponseBytes is set, so a malfunctioning
+// WAF can't stream an enormous body to the client. It reports false when the body exceeds the limit.
+func (a *Modsecurity) boundWafResponse(resp *http.Response) bool {
+	if a.maxWafResponseBytes <= 0 {
+		return true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, a.maxWafResponseBytes+1))
+	if err != nil || int64(len(body)) > a.maxWafResponseBytes {
+		return false
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return true
+}
@@ -0,0 +1,49 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_MaskBlockResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		mask         bool
+		maxBytes     int64
+		expectBody   string
+		expectServer string
+	}{
+		{name: "Forwards the WAF response", expectBody: "<h1>Forbidden by rule 942100</h1>", expectServer: "Apache/2.4"},
+		{name: "Masks the WAF response", mask: true, expectBody: maskedBlockBody},
+		{name: "Forwards WAF responses up to the limit", maxBytes: 33, expectBody: "<h1>Forbidden by rule 942100</h1>", expectServer: "Apache/2.4"},
+		{name: "Masks WAF responses over the limit", maxBytes: 32, expectBody: maskedBlockBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Server", "Apache/2.4")
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("<h1>Forbidden by rule 942100</h1>"))
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.MaskBlockResponse = tt.mask
+			if tt.maxBytes > 0 {
+				config.MaxWafResponseBytes = tt.maxBytes
+			}
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/?id=1%27%20or%201=1", nil))
+
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			assert.Equal(t, tt.expectBody, rw.Body.String())
+			assert.Equal(t, tt.expectServer, rw.Header().Get("Server"))
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// errBodyTooLarge is returned when the request body exceeds the configured limits.
+var errBodyTooLarge = errors.New("http: request body too large")
+
+// bufferedBody is a request body read once and replayed to the WAF and to the service.
+// The first bytes are kept in memory, when spooling is enabled the remainder lives in a temporary file.
+// When the body is truncated, only its first inspected bytes are sent to the WAF and the unread
+// remainder streams to the service.
+// The buffered bytes are never modified once read: the transformations of the WAF copy, such as
+// the body normalization, write to their own buffers. The service receives the exact bytes sent
+// by the client, signature schemes covering the body keep working.
+type bufferedBody struct {
+	mem       []byte
+	file      *os.File
+	size      int64
+	inspected int64
+	rest      io.Reader
+}
+
+// wafReader returns a new reader over the part of the body sent to the WAF.
+func (b *bufferedBody) wafReader() io.Reader {
+	if b.rest != nil {
+		return bytes.NewReader(b.mem[:b.inspected])
+	}
+	return b.reader()
+}
+
+// serviceReader returns the reader over the whole body forwarded to the service.
+// It must be called once: for truncated bodies it consumes the incoming request.
+func (b *bufferedBody) serviceReader() io.Reader {
+	if b.rest != nil {
+		return io.MultiReader(bytes.NewReader(b.mem), b.rest)
+	}
+	return b.reader()
+}
+
+// wafLength returns the length of the part of the body sent to the WAF.
+func (b *bufferedBody) wafLength() int64 {
+	if b.rest != nil {
+		return b.inspected
+	}
+	return b.size
+}
+
+// replay reassigns the body of req so that the service receives the buffered bytes. The
+// Content-Length is set to the buffered size and stale Transfer-Encoding is stripped, except
+// for truncated bodies whose size is unknown and for chunked bodies carrying trailers.
+func (b *bufferedBody) replay(req *http.Request) {
+	req.Body = ioutil.NopCloser(b.serviceReader())
+	if b.truncated() || len(req.Trailer) > 0 {
+		return
+	}
+	req.ContentLength = b.size
+	req.TransferEncoding = nil
+	req.Header.Del("Transfer-Encoding")
+	if b.size == 0 {
+		req.Body = http.NoBody
+		if len(req.Header.Get("Content-Length")) == 0 {
+			return
+		}
+	}
+	if length := strconv.FormatInt(b.size, 10); req.Header.Get("Content-Length") != length {
+		req.Header.Set("Content-Length", length)
+	}
+}
+
+// truncated reports whether only the first bytes of the body are inspected.
+func (b *bufferedBody) truncated() bool {
+	return b.rest != nil
+}
+
+// reader returns a new reader over the whole buffered body.
+func (b *bufferedBody) reader() io.Reader {
+	if b.file == nil {
+		return bytes.NewReader(b.mem)
+	}
+	return io.MultiReader(bytes.NewReader(b.mem), io.NewSectionReader(b.file, 0, b.size-int64(len(b.mem))))
+}
+
+// close removes the temporary file backing the body, if any.
+func (b *bufferedBody) close() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// readBody buffers body. Bodies larger than maxBodySize are rejected with errBodyTooLarge,
+// unless spooling is enabled: the remainder is then written to a temporary file up to spoolMaxSize bytes,
+// or unless inspectFirstNBytes is set: only the first bytes are then inspected. When the temporary
+// file can't be created, spooling falls back to inspectFirstNBytes when it is set.
+func (a *Modsecurity) readBody(rw http.ResponseWriter, body io.Reader) (*bufferedBody, error) {
+	if !a.spoolToDisk && a.inspectFirstNBytes > 0 {
+		return a.readTruncatedBody(body)
+	}
+	if !a.spoolToDisk {
+		mem, err := ioutil.ReadAll(http.MaxBytesReader(rw, ioutil.NopCloser(body), a.maxBodySize))
+		if err != nil && err.Error() == errBodyTooLarge.Error() {
+			return nil, errBodyTooLarge
+		}
+		return &bufferedBody{mem: mem, size: int64(len(mem))}, err
+	}
+
+	mem, err := ioutil.ReadAll(io.LimitReader(body, a.maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	buffered := &bufferedBody{mem: mem, size: int64(len(mem))}
+	if buffered.size < a.maxBodySize {
+		return buffered, nil
+	}
+
+	// the body may be larger than the memory limit, spool the remainder to disk.
+	next, err := peekByte(body)
+	if err == io.EOF {
+		return buffered, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buffered.file, err = ioutil.TempFile(a.tempDirectory, "modsecurity-body-")
+	if err != nil {
+		if a.inspectFirstNBytes > 0 {
+			// the disk is full or read-only, fall back to the inspection of the first bytes
+			buffered.file = nil
+			buffered.truncate(a.inspectFirstNBytes, io.MultiReader(bytes.NewReader(next), body))
+			return buffered, nil
+		}
+		return nil, err
+	}
+	written, err := io.Copy(buffered.file, io.LimitReader(io.MultiReader(bytes.NewReader(next), body), a.spoolMaxSize+1))
+	buffered.size += written
+	if err != nil {
+		buffered.close()
+		return nil, err
+	}
+	if written > a.spoolMaxSize {
+		buffered.close()
+		return nil, errBodyTooLarge
+	}
+	return buffered, nil
+}
+
+// readTruncatedBody buffers up to maxBodySize bytes of body. When the body is larger, the first
+// inspectFirstNBytes bytes are sent to the WAF and the remainder streams untouched to the service.
+func (a *Modsecurity) readTruncatedBody(body io.Reader) (*bufferedBody, error) {
+	mem, err := ioutil.ReadAll(io.LimitReader(body, a.maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	buffered := &bufferedBody{mem: mem, size: int64(len(mem))}
+	if buffered.size < a.maxBodySize {
+		return buffered, nil
+	}
+
+	next, err := peekByte(body)
+	if err == io.EOF {
+		return buffered, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buffered.truncate(a.inspectFirstNBytes, io.MultiReader(bytes.NewReader(next), body))
+	return buffered, nil
+}
+
+// truncate limits the inspection of b to its first inspected bytes, rest streaming to the service.
+func (b *bufferedBody) truncate(inspected int64, rest io.Reader) {
+	b.inspected = inspected
+	if b.inspected > b.size {
+		b.inspected = b.size
+	}
+	b.rest = rest
+}
+
+// peekByte reads the next byte of body, returning io.EOF when the body is fully read.
+func peekByte(body io.Reader) ([]byte, error) {
+	var next [1]byte
+	n, err := io.ReadFull(body, next[:])
+	if n == 0 {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return next[:], nil
+}
@@ -0,0 +1,284 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_HeadersOnlyPaths(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		expectWafBody string
+	}{
+		{name: "Inspects body on regular routes", path: "/api/items", expectWafBody: "payload"},
+		{name: "Skips body on headers-only routes", path: "/uploads/file", expectWafBody: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafBody := ""
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				wafBody = string(body)
+			}))
+			defer wafServer.Close()
+
+			serviceBody := ""
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.HeadersOnlyPaths = []string{"^/uploads/"}
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				serviceBody = string(body)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader("payload"))
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.expectWafBody, wafBody)
+			assert.Equal(t, "payload", serviceBody)
+		})
+	}
+}
+
+func TestModsecurity_HeadersOnlyPathsIgnoresBodyLimit(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.MaxBodySize = 4
+	config.HeadersOnlyPaths = []string{"^/uploads/"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPut, "/uploads/file", bytes.NewReader(make([]byte, 1024))))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestModsecurity_SpoolToDisk(t *testing.T) {
+	tests := []struct {
+		name         string
+		bodySize     int
+		expectStatus int
+	}{
+		{name: "Keeps small bodies in memory", bodySize: 8, expectStatus: http.StatusOK},
+		{name: "Spools bodies larger than maxBodySize", bodySize: 64, expectStatus: http.StatusOK},
+		{name: "Rejects bodies larger than the disk cap", bodySize: 200, expectStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := strings.Repeat("a", tt.bodySize)
+
+			wafBody := ""
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				wafBody = string(body)
+			}))
+			defer wafServer.Close()
+
+			serviceBody := ""
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.MaxBodySize = 16
+			config.SpoolToDisk = true
+			config.SpoolMaxSize = 100
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				serviceBody = string(body)
+			}))
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload)))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			if tt.expectStatus == http.StatusOK {
+				assert.Equal(t, payload, wafBody)
+				assert.Equal(t, payload, serviceBody)
+			}
+		})
+	}
+}
+
+func TestBufferedBody_closeRemovesSpoolFile(t *testing.T) {
+	middleware := &Modsecurity{maxBodySize: 4, spoolToDisk: true, spoolMaxSize: 1024}
+
+	body, err := middleware.readBody(httptest.NewRecorder(), strings.NewReader("spooled body"))
+	assert.NoError(t, err)
+	assert.NotNil(t, body.file)
+
+	content, _ := io.ReadAll(body.reader())
+	assert.Equal(t, "spooled body", string(content))
+
+	name := body.file.Name()
+	body.close()
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestModsecurity_readBodySpoolFallback(t *testing.T) {
+	unwritable := filepath.Join(t.TempDir(), "missing")
+	middleware := &Modsecurity{maxBodySize: 4, spoolToDisk: true, spoolMaxSize: 1024, tempDirectory: unwritable, inspectFirstNBytes: 2}
+
+	body, err := middleware.readBody(httptest.NewRecorder(), strings.NewReader("spooled body"))
+	assert.NoError(t, err, "the inspection falls back to the first bytes when the body can't be spooled")
+	assert.Nil(t, body.file)
+	assert.True(t, body.truncated())
+	content, _ := io.ReadAll(body.wafReader())
+	assert.Equal(t, "sp", string(content))
+	content, _ = io.ReadAll(body.serviceReader())
+	assert.Equal(t, "spooled body", string(content))
+
+	middleware.inspectFirstNBytes = 0
+	_, err = middleware.readBody(httptest.NewRecorder(), strings.NewReader("spooled body"))
+	assert.Error(t, err)
+}
+
+func TestModsecurity_InspectFirstNBytes(t *testing.T) {
+	tests := []struct {
+		name          string
+		payload       string
+		expectWafBody string
+	}{
+		{name: "Inspects small bodies entirely", payload: "0123456789", expectWafBody: "0123456789"},
+		{name: "Inspects the first bytes of large bodies", payload: strings.Repeat("0123456789", 10), expectWafBody: "01234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafBody := ""
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				wafBody = string(body)
+			}))
+			defer wafServer.Close()
+
+			serviceBody := ""
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.MaxBodySize = 16
+			config.InspectFirstNBytes = 5
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				serviceBody = string(body)
+			}))
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.payload)))
+
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, tt.expectWafBody, wafBody)
+			assert.Equal(t, tt.payload, serviceBody)
+		})
+	}
+}
+
+func TestModsecurity_ReplayedContentLength(t *testing.T) {
+	var wafContentLength int64
+	var wafTransferEncoding []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafContentLength = r.ContentLength
+		wafTransferEncoding = r.TransferEncoding
+	}))
+	defer wafServer.Close()
+
+	var serviceRequest *http.Request
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.MaxBodySize = 16
+	config.SpoolToDisk = true
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceRequest = r
+	}))
+
+	payload := strings.Repeat("a", 64)
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(payload)))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	req.Header.Set("Transfer-Encoding", "chunked")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, int64(64), wafContentLength)
+	assert.Nil(t, wafTransferEncoding)
+	assert.Equal(t, int64(64), serviceRequest.ContentLength)
+	assert.Nil(t, serviceRequest.TransferEncoding)
+	assert.Equal(t, "", serviceRequest.Header.Get("Transfer-Encoding"))
+	assert.Equal(t, "64", serviceRequest.Header.Get("Content-Length"))
+}
+
+func TestModsecurity_ForwardsOriginalBytes(t *testing.T) {
+	form := "a=%2527%20or%201%3D1&a=2&b=caf%C3%A9+%00\r\n"
+	json := "{ \"name\" : \"john\",\r\n\t\"tags\" : [ 1, 2 ] }\n"
+	binary := string([]byte{0x00, 0xff, 0xfe, '\r', '\n', 0x80, 'a', 0x1f, '%', '2', '0'})
+	tests := []struct {
+		name        string
+		contentType string
+		payload     string
+		configure   func(config *Config)
+		chunked     bool
+		expectWaf   string
+	}{
+		{name: "Form normalized for the WAF", contentType: "application/x-www-form-urlencoded", payload: form, configure: func(config *Config) {
+			config.NormalizeFormBody = true
+			config.CollapseDuplicateParams = true
+		}, expectWaf: "a=' or 1=1,2&b=café \x00\r\n"},
+		{name: "JSON canonicalized for the WAF", contentType: "application/json", payload: json, configure: func(config *Config) {
+			config.CanonicalizeJson = true
+		}, expectWaf: `{"name":"john","tags":[1,2]}`},
+		{name: "Binary", contentType: "application/octet-stream", payload: binary, configure: func(config *Config) {}, expectWaf: binary},
+		{name: "Chunked", contentType: "application/octet-stream", payload: binary, chunked: true, configure: func(config *Config) {}, expectWaf: binary},
+		{name: "Spooled to disk", contentType: "application/octet-stream", payload: strings.Repeat(binary, 10), configure: func(config *Config) {
+			config.MaxBodySize = 16
+			config.SpoolToDisk = true
+		}, expectWaf: strings.Repeat(binary, 10)},
+		{name: "Truncated", contentType: "application/octet-stream", payload: strings.Repeat(binary, 10), configure: func(config *Config) {
+			config.MaxBodySize = 16
+			config.InspectFirstNBytes = 8
+		}, expectWaf: binary[:8]},
+		{name: "Two-phase inspection", contentType: "application/json", payload: json, configure: func(config *Config) {
+			config.TwoPhaseInspection = true
+			config.CanonicalizeJson = true
+		}, expectWaf: `{"name":"john","tags":[1,2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafBody []byte
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.ContentLength != 0 {
+					wafBody, _ = io.ReadAll(r.Body)
+				}
+			}))
+			defer wafServer.Close()
+
+			var serviceBody []byte
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			tt.configure(config)
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serviceBody, _ = io.ReadAll(r.Body)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.payload))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.chunked {
+				req.Body = io.NopCloser(strings.NewReader(tt.payload))
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, []byte(tt.payload), serviceBody)
+			assert.Equal(t, tt.expectWaf, string(wafBody))
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// botScoreHeader carries the bot score computed by the bot-detection service to the WAF,
+// so WAF rules can combine it with their own findings.
+const botScoreHeader = "X-Bot-Score"
+
+// botScorer calls an external bot-detection service before the WAF inspection.
+//
+// The service receives a GET request carrying the original headers, method (X-Original-Method)
+// and request URI (X-Original-Uri), and is expected to answer 200 with a JSON body like {"score": 0.93}.
+type botScorer struct {
+	url       string
+	client    *http.Client
+	failOpen  bool
+	threshold float64
+}
+
+type botScoreResponse struct {
+	Score *float64 `json:"score"`
+}
+
+func newBotScorer(url string, timeout time.Duration, failOpen bool, threshold float64) *botScorer {
+	if len(url) == 0 {
+		return nil
+	}
+	return &botScorer{
+		url:       url,
+		client:    &http.Client{Timeout: timeout},
+		failOpen:  failOpen,
+		threshold: threshold,
+	}
+}
+
+// score asks the bot-detection service for the score of req.
+func (b *botScorer) score(req *http.Request) (float64, error) {
+	scoreReq, err := http.NewRequest(http.MethodGet, b.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	scoreReq.Header = req.Header.Clone()
+	scoreReq.Header.Set("X-Original-Method", req.Method)
+	scoreReq.Header.Set("X-Original-Uri", req.RequestURI)
+
+	resp, err := b.client.Do(scoreReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var body botScoreResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body); err != nil {
+		return 0, fmt.Errorf("invalid response: %s", err.Error())
+	}
+	if body.Score == nil {
+		return 0, fmt.Errorf("invalid response: missing score")
+	}
+	return *body.Score, nil
+}
+
+// isBot reports whether score reaches the configured blocking threshold.
+// A threshold of zero disables blocking, the score is then only forwarded to the WAF.
+func (b *botScorer) isBot(score float64) bool {
+	return b.threshold > 0 && score >= b.threshold
+}
+
+func formatBotScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
@@ -0,0 +1,88 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_BotScore(t *testing.T) {
+	tests := []struct {
+		name         string
+		botResponse  string
+		botStatus    int
+		failOpen     bool
+		expectStatus int
+		expectHeader string
+	}{
+		{
+			name:         "Forwards the score to the WAF",
+			botResponse:  `{"score": 0.2}`,
+			botStatus:    http.StatusOK,
+			expectStatus: http.StatusOK,
+			expectHeader: "0.2",
+		},
+		{
+			name:         "Blocks scores above the threshold",
+			botResponse:  `{"score": 0.95}`,
+			botStatus:    http.StatusOK,
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "Fails open when the service is broken",
+			botStatus:    http.StatusInternalServerError,
+			failOpen:     true,
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "Fails closed when the service is broken",
+			botStatus:    http.StatusInternalServerError,
+			expectStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			botServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/login", r.Header.Get("X-Original-Uri"))
+				w.WriteHeader(tt.botStatus)
+				w.Write([]byte(tt.botResponse))
+			}))
+			defer botServer.Close()
+
+			wafHeader := ""
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafHeader = r.Header.Get(botScoreHeader)
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.BotScoreUrl = botServer.URL
+			config.BotScoreFailOpen = tt.failOpen
+			config.BotScoreThreshold = 0.9
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, "/login", nil)
+			req.Header.Set(botScoreHeader, "0")
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectHeader, wafHeader, "the score sent by the client is dropped")
+		})
+	}
+}
+
+func TestBotScorer_Timeout(t *testing.T) {
+	botServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer botServer.Close()
+
+	scorer := newBotScorer(botServer.URL, 10*time.Millisecond, true, 0)
+	_, err := scorer.score(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Error(t, err)
+}
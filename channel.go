@@ -0,0 +1,239 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// channelMaxFrame bounds the size of the frames read from a channel agent.
+const channelMaxFrame = 16 << 20
+
+var errChannelClosed = errors.New("channel closed")
+
+// channelClients holds the persistent connections of the channel backend protocol, one per agent.
+type channelClients struct {
+	mu      sync.Mutex
+	clients map[string]*channelClient
+	closed  bool
+}
+
+// client returns the client of the agent at service, e.g. channel://waf-agent:9000.
+func (c *channelClients) client(service string, timeout time.Duration) (*channelClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errChannelClosed
+	}
+	if client, ok := c.clients[service]; ok {
+		return client, nil
+	}
+	agent, err := url.Parse(service)
+	if err != nil {
+		return nil, err
+	}
+	if c.clients == nil {
+		c.clients = make(map[string]*channelClient)
+	}
+	client := &channelClient{address: agent.Host, timeout: timeout}
+	c.clients[service] = client
+	return client, nil
+}
+
+// close closes the connections, the calls in flight fail.
+func (c *channelClients) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, client := range c.clients {
+		client.close()
+	}
+}
+
+// channelClient submits requests to a WAF agent over a persistent connection, saving the cost of
+// an HTTP exchange per request. Requests are multiplexed: each is sent in a frame of its own and
+// the agent may answer them in any order. A frame is the big-endian 32 bits length of the rest of
+// the frame, the big-endian 32 bits non-zero stream ID of the request, then the request as an
+// HTTP/1.1 message. The agent answers with a frame of the same stream ID holding the HTTP/1.1
+// response. A broken connection fails the calls in flight and is dialed again by the next call.
+type channelClient struct {
+	address string
+	timeout time.Duration
+	mu      sync.Mutex
+	conn    *channelConn
+	closed  bool
+}
+
+// Do implements wafDoer, req is the request to submit to the agent.
+func (c *channelClient) Do(req *http.Request) (*http.Response, error) {
+	var message bytes.Buffer
+	if err := req.Write(&message); err != nil {
+		return nil, err
+	}
+	conn, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := conn.roundTrip(req.Context(), message.Bytes(), c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), req)
+}
+
+// connection returns the connection to the agent, dialing it when there is none or it broke.
+func (c *channelClient) connection() (*channelConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errChannelClosed
+	}
+	if c.conn != nil && c.conn.failure() == nil {
+		return c.conn, nil
+	}
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = &channelConn{conn: conn, pending: make(map[uint32]chan []byte)}
+	go c.conn.readLoop()
+	return c.conn, nil
+}
+
+func (c *channelClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.fail(errChannelClosed)
+	}
+}
+
+// channelConn is a connection to an agent and its calls waiting for a response.
+type channelConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan []byte
+	err     error
+}
+
+// roundTrip sends payload in a new stream and returns the payload of its response.
+func (cc *channelConn) roundTrip(ctx context.Context, payload []byte, timeout time.Duration) ([]byte, error) {
+	response := make(chan []byte, 1)
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, cc.err
+	}
+	cc.nextID++
+	if cc.nextID == 0 {
+		// stream ID 0 is reserved
+		cc.nextID++
+	}
+	id := cc.nextID
+	cc.pending[id] = response
+	cc.mu.Unlock()
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.pending, id)
+		cc.mu.Unlock()
+	}()
+
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(4+len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], id)
+	frame = append(frame, payload...)
+	cc.writeMu.Lock()
+	if timeout > 0 {
+		cc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := cc.conn.Write(frame)
+	cc.writeMu.Unlock()
+	if err != nil {
+		// a partly written frame corrupts the stream
+		cc.fail(err)
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case payload, ok := <-response:
+		if !ok {
+			return nil, cc.failure()
+		}
+		return payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-expired:
+		return nil, fmt.Errorf("no response from the channel agent within %s: %w", timeout, os.ErrDeadlineExceeded)
+	}
+}
+
+// readLoop dispatches the responses to the calls waiting for them, until the connection breaks.
+func (cc *channelConn) readLoop() {
+	reader := bufio.NewReader(cc.conn)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			cc.fail(err)
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length < 4 || length > channelMaxFrame {
+			cc.fail(fmt.Errorf("invalid channel frame length %d", length))
+			return
+		}
+		payload := make([]byte, length-4)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			cc.fail(err)
+			return
+		}
+		cc.mu.Lock()
+		response := cc.pending[binary.BigEndian.Uint32(header[4:])]
+		delete(cc.pending, binary.BigEndian.Uint32(header[4:]))
+		cc.mu.Unlock()
+		if response != nil {
+			// responses of calls which gave up are dropped
+			response <- payload
+		}
+	}
+}
+
+// fail breaks the connection with err, the calls waiting for a response fail.
+func (cc *channelConn) fail(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.err != nil {
+		return
+	}
+	cc.err = err
+	cc.conn.Close()
+	for id, response := range cc.pending {
+		close(response)
+		delete(cc.pending, id)
+	}
+}
+
+// failure returns the error which broke the connection, nil while it works.
+func (cc *channelConn) failure() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err
+}
@@ -0,0 +1,137 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newChannelAgent starts a fake channel agent answering each request with respond, concurrently
+// so that responses come back in any order. It returns the agent URL and its connection count.
+func newChannelAgent(t *testing.T, respond func(*http.Request) *http.Response) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			go func() {
+				defer conn.Close()
+				var writeMu sync.Mutex
+				reader := bufio.NewReader(conn)
+				for {
+					header := make([]byte, 8)
+					if _, err := io.ReadFull(reader, header); err != nil {
+						return
+					}
+					payload := make([]byte, binary.BigEndian.Uint32(header)-4)
+					if _, err := io.ReadFull(reader, payload); err != nil {
+						return
+					}
+					go func() {
+						req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+						assert.NoError(t, err)
+						resp := respond(req)
+						if resp == nil {
+							return
+						}
+						var message bytes.Buffer
+						resp.Write(&message)
+						frame := make([]byte, 8)
+						binary.BigEndian.PutUint32(frame, uint32(4+message.Len()))
+						copy(frame[4:], header[4:])
+						writeMu.Lock()
+						defer writeMu.Unlock()
+						conn.Write(append(frame, message.Bytes()...))
+					}()
+				}
+			}()
+		}
+	}()
+	return "channel://" + listener.Addr().String(), &connections
+}
+
+func TestModsecurity_Channel(t *testing.T) {
+	agent, connections := newChannelAgent(t, func(req *http.Request) *http.Response {
+		body, _ := io.ReadAll(req.Body)
+		switch {
+		case req.URL.Path == "/hang":
+			return nil
+		case req.URL.Path == "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case strings.Contains(string(body), "attack"):
+			return &http.Response{StatusCode: http.StatusForbidden, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{"X-Waf-Rule-Ids": {"942100"}}}
+		}
+		return &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1}
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = agent
+	config.BackendProtocol = backendProtocolChannel
+	config.WafTimeout = "500ms"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(method string, target string, body string) int {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rw.Code
+	}
+	var wg sync.WaitGroup
+	var slow int
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		slow = send(http.MethodGet, "/slow", "")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/items", "attack"), "answered before the slow request")
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, slow)
+	assert.Equal(t, int32(1), atomic.LoadInt32(connections), "the requests share the connection")
+
+	assert.Equal(t, http.StatusBadGateway, send(http.MethodGet, "/hang", ""), "the calls time out")
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/items", ""))
+
+	middleware.channels.clients[agent].conn.conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/items", ""), "a broken connection is dialed again")
+	assert.Equal(t, int32(2), atomic.LoadInt32(connections))
+}
+
+func TestChannelClients_close(t *testing.T) {
+	agent, _ := newChannelAgent(t, func(req *http.Request) *http.Response {
+		return nil
+	})
+	clients := &channelClients{}
+	client, err := clients.client(agent, time.Second)
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "http://waf/items", nil)
+	req.RequestURI = ""
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Do(req)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	clients.close()
+	assert.Equal(t, errChannelClosed, <-done, "the calls in flight fail")
+	_, err = clients.client(agent, time.Second)
+	assert.Equal(t, errChannelClosed, err)
+}
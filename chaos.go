@@ -0,0 +1,96 @@
+package traefik_modsecurity_plugin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errChaosDropped is the error of the WAF calls whose connection is dropped by the chaos mode.
+var errChaosDropped = errors.New("chaos: connection to the WAF dropped")
+
+// chaosTransport injects faults in the WAF calls: added latency, 5xx answers and dropped
+// connections, so that operators can rehearse the fail-open and fail-closed behaviors before
+// relying on them. It must never be enabled in production.
+type chaosTransport struct {
+	next      http.RoundTripper
+	latency   time.Duration
+	errorRate float64
+	dropRate  float64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newChaosTransport(next http.RoundTripper, latency time.Duration, errorRate float64, dropRate float64) (*chaosTransport, error) {
+	if errorRate < 0 || errorRate > 1 {
+		return nil, fmt.Errorf("invalid chaosErrorRate %v, expected a value in [0, 1]", errorRate)
+	}
+	if dropRate < 0 || dropRate > 1 {
+		return nil, fmt.Errorf("invalid chaosDropRate %v, expected a value in [0, 1]", dropRate)
+	}
+	if latency <= 0 && errorRate == 0 && dropRate == 0 {
+		return nil, nil
+	}
+	return &chaosTransport{
+		next:      next,
+		latency:   latency,
+		errorRate: errorRate,
+		dropRate:  dropRate,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+func (c *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	fault := c.rand.Float64()
+	c.mu.Unlock()
+
+	if c.latency > 0 {
+		timer := time.NewTimer(c.latency)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			closeRequestBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+	switch {
+	case fault < c.dropRate:
+		closeRequestBody(req)
+		return nil, errChaosDropped
+	case fault < c.dropRate+c.errorRate:
+		closeRequestBody(req)
+		return &http.Response{
+			Status:     "502 Bad Gateway",
+			StatusCode: http.StatusBadGateway,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Server": []string{"chaos"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return c.next.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport.
+func (c *chaosTransport) CloseIdleConnections() {
+	if closer, ok := c.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// closeRequestBody closes the body of req, as RoundTrip must even when the request is not sent.
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,69 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewChaosTransport(t *testing.T) {
+	chaos, err := newChaosTransport(http.DefaultTransport, 0, 0, 0)
+	assert.Nil(t, chaos)
+	assert.NoError(t, err)
+
+	_, err = newChaosTransport(http.DefaultTransport, 0, 1.5, 0)
+	assert.Error(t, err)
+
+	_, err = newChaosTransport(http.DefaultTransport, 0, 0, -1)
+	assert.Error(t, err)
+}
+
+func TestModsecurity_Chaos(t *testing.T) {
+	tests := []struct {
+		name             string
+		latency          string
+		errorRate        float64
+		dropRate         float64
+		interruptOnError bool
+		expectStatus     int
+		expectServed     bool
+	}{
+		{name: "Injects 5xx answers", errorRate: 1, expectStatus: http.StatusBadGateway},
+		{name: "Fails open on dropped connections", dropRate: 1, expectStatus: http.StatusOK, expectServed: true},
+		{name: "Fails closed on dropped connections", dropRate: 1, interruptOnError: true, expectStatus: http.StatusBadGateway},
+		{name: "Injects latency beyond the WAF timeout", latency: "1s", interruptOnError: true, expectStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafCalls := 0
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafCalls++
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.WafTimeout = "50ms"
+			config.InterruptOnError = tt.interruptOnError
+			config.ChaosLatency = tt.latency
+			config.ChaosErrorRate = tt.errorRate
+			config.ChaosDropRate = tt.dropRate
+			served := false
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = true
+			}))
+
+			start := time.Now()
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectServed, served)
+			assert.Equal(t, 0, wafCalls)
+			assert.Less(t, int64(time.Since(start)), int64(time.Second))
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bloomFilter is a set of strings answering membership with false positives, in a fixed amount
+// of memory.
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+// newBloomFilter returns a filter holding capacity strings with the falsePositiveRate probability
+// of false positives.
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	size := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if size < 64 {
+		size = 64
+	}
+	hashes := int(math.Round(float64(size) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+}
+
+// positions calls fn with the bit positions of s, computed by double hashing.
+func (f *bloomFilter) positions(s string, fn func(uint64)) {
+	hash := fnv.New64a()
+	hash.Write([]byte(s))
+	sum := hash.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	for i := 0; i < f.hashes; i++ {
+		fn((h1 + uint64(i)*h2) % f.size)
+	}
+}
+
+func (f *bloomFilter) add(s string) {
+	f.positions(s, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (f *bloomFilter) contains(s string) bool {
+	found := true
+	f.positions(s, func(bit uint64) {
+		found = found && f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+	return found
+}
+
+// cleanShapes remembers the shapes of the GET requests which repeatedly passed the inspection,
+// their path and the names and kinds of their query parameters, in Bloom filters rotated every
+// interval. Only one request out of sampleEvery of a known clean shape is still inspected. A shape
+// is known clean once two of its requests passed the inspection, within the same interval or the
+// previous one. A block verdict on a known clean shape forgets every shape, until they pass again.
+type cleanShapes struct {
+	capacity          int
+	falsePositiveRate float64
+	sampleEvery       int
+	mu                sync.Mutex
+	seen              *bloomFilter
+	clean             *bloomFilter
+	previous          *bloomFilter
+	requests          int
+}
+
+func newCleanShapes(enabled bool, sampleRate float64, falsePositiveRate float64, capacity int) (*cleanShapes, error) {
+	if !enabled {
+		return nil, nil
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("invalid cleanShapeSampleRate %v, expected a value in ]0, 1]", sampleRate)
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("invalid cleanShapeFpRate %v, expected a value in ]0, 1[", falsePositiveRate)
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("cleanShapeCapacity must be positive")
+	}
+	s := &cleanShapes{
+		capacity:          capacity,
+		falsePositiveRate: falsePositiveRate,
+		sampleEvery:       int(math.Round(1 / sampleRate)),
+	}
+	s.reset()
+	return s, nil
+}
+
+// reset forgets every shape. It must be called with mu held.
+func (s *cleanShapes) reset() {
+	s.seen = newBloomFilter(s.capacity, s.falsePositiveRate)
+	s.clean = newBloomFilter(s.capacity, s.falsePositiveRate)
+	s.previous = newBloomFilter(s.capacity, s.falsePositiveRate)
+}
+
+// requestShape returns the shape of req, false when it doesn't qualify: only GET and HEAD requests
+// without a body, whose path and parameter names are made of plain characters and whose parameter
+// values are empty, numbers or words do. The other requests are always inspected.
+func requestShape(req *http.Request) (string, bool) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || hasBody(req) {
+		return "", false
+	}
+	path := req.URL.EscapedPath()
+	if !isPlainShape(path, "/") || strings.Contains(path, "..") {
+		return "", false
+	}
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return "", false
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var shape strings.Builder
+	shape.WriteString(req.Method + " " + path)
+	for _, name := range names {
+		if !isPlainShape(name, "") {
+			return "", false
+		}
+		shape.WriteString(" " + name + "=")
+		for _, value := range query[name] {
+			switch {
+			case len(value) == 0:
+				shape.WriteByte('e')
+			case strings.Trim(value, "0123456789") == "":
+				shape.WriteByte('n')
+			case isPlainShape(value, ""):
+				shape.WriteByte('w')
+			default:
+				return "", false
+			}
+		}
+	}
+	return shape.String(), true
+}
+
+// isPlainShape reports whether s only holds letters, digits, the characters "-_.~" and extra.
+func isPlainShape(s string, extra string) bool {
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.~"+extra, c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// skips reports whether the inspection of req can be skipped: its shape is known clean and it is
+// not the sampled request.
+func (s *cleanShapes) skips(req *http.Request) bool {
+	if s == nil {
+		return false
+	}
+	shape, ok := requestShape(req)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.clean.contains(shape) && !s.previous.contains(shape) {
+		return false
+	}
+	s.requests++
+	return s.requests%s.sampleEvery != 0
+}
+
+// record records the inspection verdict of req.
+func (s *cleanShapes) record(req *http.Request, blocked bool) {
+	if s == nil {
+		return
+	}
+	shape, ok := requestShape(req)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	known := s.clean.contains(shape) || s.previous.contains(shape)
+	switch {
+	case blocked && known:
+		s.reset()
+	case blocked:
+	case known || s.seen.contains(shape):
+		s.clean.add(shape)
+	default:
+		s.seen.add(shape)
+	}
+}
+
+// rotate starts a new interval: the shapes known clean in the previous one are kept for one more
+// interval, the others are forgotten.
+func (s *cleanShapes) rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.previous = s.clean
+	s.seen = newBloomFilter(s.capacity, s.falsePositiveRate)
+	s.clean = newBloomFilter(s.capacity, s.falsePositiveRate)
+}
+
+// run rotates the filters every interval until ctx is done.
+func (s *cleanShapes) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.rotate()
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.add(fmt.Sprintf("GET /items/%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.contains(fmt.Sprintf("GET /items/%d", i)))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.contains(fmt.Sprintf("GET /other/%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300, "the false positive rate stays close to its budget")
+}
+
+func TestNewCleanShapes(t *testing.T) {
+	shapes, err := newCleanShapes(false, 0.1, 0.001, 1000)
+	assert.NoError(t, err)
+	assert.Nil(t, shapes)
+	_, err = newCleanShapes(true, 0, 0.001, 1000)
+	assert.EqualError(t, err, "invalid cleanShapeSampleRate 0, expected a value in ]0, 1]")
+	_, err = newCleanShapes(true, 0.1, 1, 1000)
+	assert.EqualError(t, err, "invalid cleanShapeFpRate 1, expected a value in ]0, 1[")
+	_, err = newCleanShapes(true, 0.1, 0.001, 0)
+	assert.EqualError(t, err, "cleanShapeCapacity must be positive")
+}
+
+func TestRequestShape(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		body   string
+		expect string
+	}{
+		{method: http.MethodGet, target: "/items/list?page=2&sort=name&q=", expect: "GET /items/list page=n q=e sort=w"},
+		{method: http.MethodGet, target: "/items/list?sort=price&page=10", expect: "GET /items/list page=n sort=w"},
+		{method: http.MethodHead, target: "/static/app.js", expect: "HEAD /static/app.js"},
+		{method: http.MethodGet, target: "/search?q=a%20b"},
+		{method: http.MethodGet, target: "/search?q=1'or'1"},
+		{method: http.MethodGet, target: "/files/../etc/passwd"},
+		{method: http.MethodGet, target: "/files/%2e%2e/etc"},
+		{method: http.MethodGet, target: "/search?q[]=1"},
+		{method: http.MethodPost, target: "/items/list"},
+		{method: http.MethodGet, target: "/items/list", body: "payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com"+tt.target, strings.NewReader(tt.body))
+			shape, ok := requestShape(req)
+			assert.Equal(t, len(tt.expect) > 0, ok)
+			assert.Equal(t, tt.expect, shape)
+		})
+	}
+}
+
+func TestCleanShapes(t *testing.T) {
+	shapes, err := newCleanShapes(true, 0.5, 0.001, 1000)
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/items?page=1", nil)
+	other := httptest.NewRequest(http.MethodGet, "/items?page=2", nil)
+
+	shapes.record(req, false)
+	assert.False(t, shapes.skips(req), "a shape is known clean once it passed twice")
+	shapes.record(req, false)
+	assert.True(t, shapes.skips(other), "requests of the same shape are sampled")
+	assert.False(t, shapes.skips(other), "one request out of sampleEvery is inspected")
+
+	shapes.rotate()
+	assert.True(t, shapes.skips(req), "known clean shapes survive one rotation")
+	shapes.skips(req)
+	shapes.rotate()
+	assert.False(t, shapes.skips(req), "shapes not seen during an interval are forgotten")
+
+	shapes.record(req, false)
+	shapes.record(req, false)
+	shapes.record(other, true)
+	assert.False(t, shapes.skips(req), "a block on a known clean shape forgets every shape")
+
+	var disabled *cleanShapes
+	disabled.record(req, false)
+	assert.False(t, disabled.skips(req))
+}
+
+func TestModsecurity_CleanShapeCache(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.CleanShapeCache = true
+	config.CleanShapeSampleRate = 0.25
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 10; i++ {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/items?page=%d", i), nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+	assert.Equal(t, 4, wafCalls, "two inspections teach the shape, then one request out of four is inspected")
+
+	wafCalls = 0
+	for i := 0; i < 3; i++ {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items?page=1'or'1", nil))
+	}
+	assert.Equal(t, 3, wafCalls, "requests with unusual values are always inspected")
+}
@@ -0,0 +1,84 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// remoteIP returns the IP address of the client connection, or nil when it can't be parsed.
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		// drop the IPv6 zone
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// parseCIDRs parses a list of IP addresses and CIDR ranges coming from the configuration option
+// named option. Single addresses are turned into a range of one address.
+func parseCIDRs(option string, values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s address %q", option, value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s range %q: %s", option, value, err.Error())
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports whether ip belongs to one of networks.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKey identifies the client with address ip in per-client state such as bans. IPv6 addresses
+// are aggregated to their first ipv6PrefixLength bits: a client usually holds a whole /64 and would
+// otherwise evade bans by rotating addresses within it. IPv4-mapped IPv6 addresses are keyed as IPv4.
+func clientKey(ip net.IP, ipv6PrefixLength int) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	prefix := &net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6PrefixLength, 128)), Mask: net.CIDRMask(ipv6PrefixLength, 128)}
+	return prefix.String()
+}
+
+func validateIpv6PrefixLength(length int) error {
+	if length < 1 || length > 128 {
+		return fmt.Errorf("invalid ipv6PrefixLength %d, expected a value between 1 and 128", length)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteIP(t *testing.T) {
+	for _, tt := range []struct {
+		remoteAddr string
+		expect     string
+	}{
+		{remoteAddr: "192.0.2.1:1234", expect: "192.0.2.1"},
+		{remoteAddr: "[2001:db8::1]:1234", expect: "2001:db8::1"},
+		{remoteAddr: "[fe80::1%eth0]:1234", expect: "fe80::1"},
+		{remoteAddr: "192.0.2.1", expect: "192.0.2.1"},
+		{remoteAddr: "invalid", expect: "<nil>"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		assert.Equal(t, tt.expect, remoteIP(req).String(), tt.remoteAddr)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs("test", []string{"192.0.2.1", "10.0.0.0/8", "2001:db8::/32"})
+	assert.NoError(t, err)
+
+	assert.True(t, containsIP(networks, net.ParseIP("192.0.2.1")))
+	assert.False(t, containsIP(networks, net.ParseIP("192.0.2.2")))
+	assert.True(t, containsIP(networks, net.ParseIP("10.20.30.40")))
+	assert.True(t, containsIP(networks, net.ParseIP("2001:db8:1::1")))
+	assert.False(t, containsIP(networks, nil))
+
+	_, err = parseCIDRs("test", []string{"not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestClientKey(t *testing.T) {
+	for _, tt := range []struct {
+		ip     string
+		prefix int
+		expect string
+	}{
+		{ip: "192.0.2.1", prefix: 64, expect: "192.0.2.1"},
+		{ip: "::ffff:192.0.2.1", prefix: 64, expect: "192.0.2.1"},
+		{ip: "2001:db8:1:2:aaaa::1", prefix: 64, expect: "2001:db8:1:2::/64"},
+		{ip: "2001:db8:1:2:bbbb::2", prefix: 64, expect: "2001:db8:1:2::/64"},
+		{ip: "2001:db8:1:2:bbbb::2", prefix: 48, expect: "2001:db8:1::/48"},
+		{ip: "2001:db8::1", prefix: 128, expect: "2001:db8::1/128"},
+	} {
+		assert.Equal(t, tt.expect, clientKey(net.ParseIP(tt.ip), tt.prefix), tt.ip)
+	}
+	assert.Equal(t, "", clientKey(nil, 64))
+}
+
+func TestModsecurity_IpAllowlist(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.IpAllowlist = []string{"192.0.2.0/24", "2001:db8:1::/48"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for remoteAddr, expect := range map[string]int{
+		"192.0.2.10:1234":           http.StatusOK,
+		"[::ffff:192.0.2.10]:1234":  http.StatusOK,
+		"[2001:db8:1:ffff::1]:1234": http.StatusOK,
+		"[fe80::1%eth0]:1234":       http.StatusForbidden,
+		"198.51.100.1:1234":         http.StatusForbidden,
+		"[2001:db8:2::1]:1234":      http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		assert.Equal(t, expect, rw.Code, remoteAddr)
+	}
+}
+
+func TestValidateIpv6PrefixLength(t *testing.T) {
+	assert.NoError(t, validateIpv6PrefixLength(64))
+	assert.Error(t, validateIpv6PrefixLength(0))
+	assert.Error(t, validateIpv6PrefixLength(129))
+}
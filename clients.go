@@ -0,0 +1,361 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the memory used by per-client state. Once it is reached, tracking a new
+// client evicts the least recently seen of clientEvictionSample clients, preferably not banned.
+const maxTrackedClients = 100000
+
+// clientEvictionSample is the number of clients considered for eviction.
+const clientEvictionSample = 64
+
+// clientJanitorInterval is how often stale client state is expired. Clients idle for longer are forgotten.
+const clientJanitorInterval = 10 * time.Minute
+
+// clientTracker keeps per-client state, such as bans, keyed by trackingKey.
+type clientTracker struct {
+	mu      sync.Mutex
+	clients map[string]*clientState
+}
+
+type clientState struct {
+	bannedUntil time.Time
+	firstSeen   time.Time
+	lastSeen    time.Time
+	// flaggedAt is the first time the client was banned or its risk raised.
+	flaggedAt time.Time
+	// risk accumulates the suspicious behaviors of the client.
+	risk float64
+	// decoyed is set once the client received decoy headers.
+	decoyed bool
+	// cleanStreak counts the consecutive inspections without a block verdict.
+	cleanStreak int
+	lastBlocked time.Time
+	// skipped counts the requests of the client since its last sampled inspection.
+	skipped int
+	// requests counts the requests of the client while it is greylisted.
+	requests int
+}
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{clients: make(map[string]*clientState)}
+}
+
+// trackingKey identifies the client of req in the per-client state: its session, the value of the
+// clientKeyCookie cookie or of the clientKeyHeader header, when configured and present, so that
+// the users sharing the address of a CGNAT or corporate proxy are told apart; its address otherwise.
+// Session values are hashed, they are not kept in memory.
+func (a *Modsecurity) trackingKey(req *http.Request) string {
+	if len(a.clientKeyCookie) > 0 {
+		if cookie, err := req.Cookie(a.clientKeyCookie); err == nil && len(cookie.Value) > 0 {
+			return "session:" + sessionKey(cookie.Value)
+		}
+	}
+	if len(a.clientKeyHeader) > 0 {
+		if value := req.Header.Get(a.clientKeyHeader); len(value) > 0 {
+			return "session:" + sessionKey(value)
+		}
+	}
+	return clientKey(remoteIP(req), a.ipv6PrefixLength)
+}
+
+// addressKey identifies the address of the client of req in the per-client state.
+func (a *Modsecurity) addressKey(req *http.Request) string {
+	return clientKey(remoteIP(req), a.ipv6PrefixLength)
+}
+
+// banClient bans the client of req until the given time. The bans of sessions apply to their
+// address too, see sessionBanned. It reports whether the client is tracked.
+func (a *Modsecurity) banClient(req *http.Request, until time.Time, now time.Time) bool {
+	key, address := a.trackingKey(req), a.addressKey(req)
+	if key != address {
+		a.clientTracker.ban(address, until, now)
+	}
+	return a.clientTracker.ban(key, until, now)
+}
+
+// clientBanned reports whether the client of req is banned at now.
+func (a *Modsecurity) clientBanned(req *http.Request, now time.Time) bool {
+	key, address := a.trackingKey(req), a.addressKey(req)
+	if key == address {
+		return a.clientTracker.banned(key, now)
+	}
+	return a.clientTracker.sessionBanned(key, address, now)
+}
+
+// addClientRisk raises the risk score of the client of req, and of its address for sessions, and
+// returns the new score.
+func (a *Modsecurity) addClientRisk(req *http.Request, increment float64, now time.Time) float64 {
+	key, address := a.trackingKey(req), a.addressKey(req)
+	if key == address {
+		return a.clientTracker.addRisk(key, increment, now)
+	}
+	a.clientTracker.addRisk(address, increment, now)
+	a.clientTracker.addRisk(key, increment, now)
+	return a.clientTracker.sessionRisk(key, address, now)
+}
+
+// clientRisk returns the risk score of the client of req.
+func (a *Modsecurity) clientRisk(req *http.Request, now time.Time) float64 {
+	key, address := a.trackingKey(req), a.addressKey(req)
+	if key == address {
+		return a.clientTracker.risk(key, now)
+	}
+	return a.clientTracker.sessionRisk(key, address, now)
+}
+
+// state returns the state of the client key, creating it when create is set.
+// It must be called with mu held and returns nil for untracked clients.
+func (t *clientTracker) state(key string, create bool, now time.Time) *clientState {
+	if len(key) == 0 {
+		return nil
+	}
+	state, ok := t.clients[key]
+	if !ok {
+		if !create {
+			return nil
+		}
+		if len(t.clients) >= maxTrackedClients {
+			t.evict(now)
+		}
+		state = &clientState{firstSeen: now}
+		t.clients[key] = state
+	}
+	state.lastSeen = now
+	return state
+}
+
+// evict forgets the least recently seen of clientEvictionSample clients, preferably not banned.
+// It must be called with mu held.
+func (t *clientTracker) evict(now time.Time) {
+	var victim string
+	var victimState *clientState
+	sampled := 0
+	for key, state := range t.clients {
+		if victimState == nil || evictsFirst(state, victimState, now) {
+			victim, victimState = key, state
+		}
+		if sampled++; sampled >= clientEvictionSample {
+			break
+		}
+	}
+	delete(t.clients, victim)
+}
+
+// evictsFirst reports whether the client state a is evicted before b: the clients not banned go
+// first, then the least recently seen.
+func evictsFirst(a *clientState, b *clientState, now time.Time) bool {
+	aBanned, bBanned := now.Before(a.bannedUntil), now.Before(b.bannedUntil)
+	if aBanned != bBanned {
+		return bBanned
+	}
+	return a.lastSeen.Before(b.lastSeen)
+}
+
+// inherits reports whether the state of a session inherits the bans and risk of the state of its
+// address: the sessions first seen once the address was flagged are likely the flagged client
+// with a new session, while the older ones belong to other users behind the same address.
+func inherits(session *clientState, address *clientState) bool {
+	return address != nil && !address.flaggedAt.IsZero() && (session == nil || !session.firstSeen.Before(address.flaggedAt))
+}
+
+// sessionBanned reports whether the session key, of a client at address, is banned at now. The
+// session is tracked from its first request, to tell it apart from the sessions started later.
+func (t *clientTracker) sessionBanned(key string, address string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	session := t.state(key, true, now)
+	if session != nil && now.Before(session.bannedUntil) {
+		return true
+	}
+	addressState := t.state(address, false, now)
+	return inherits(session, addressState) && now.Before(addressState.bannedUntil)
+}
+
+// sessionRisk returns the risk score of the session key, of a client at address.
+func (t *clientTracker) sessionRisk(key string, address string, now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var risk float64
+	session := t.state(key, false, now)
+	if session != nil {
+		risk = session.risk
+	}
+	if addressState := t.state(address, false, now); inherits(session, addressState) && addressState.risk > risk {
+		risk = addressState.risk
+	}
+	return risk
+}
+
+// ban bans the client key until the given time. It reports whether the client is tracked.
+func (t *clientTracker) ban(key string, until time.Time, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, true, now)
+	if state == nil {
+		return false
+	}
+	if until.After(state.bannedUntil) {
+		state.bannedUntil = until
+	}
+	if state.flaggedAt.IsZero() {
+		state.flaggedAt = now
+	}
+	return true
+}
+
+// banned reports whether the client key is banned at now.
+func (t *clientTracker) banned(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, false, now)
+	return state != nil && now.Before(state.bannedUntil)
+}
+
+// markDecoyed records that the client key received decoy headers.
+func (t *clientTracker) markDecoyed(key string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state := t.state(key, true, now); state != nil {
+		state.decoyed = true
+	}
+}
+
+// decoyed reports whether the client key received decoy headers.
+func (t *clientTracker) decoyed(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, false, now)
+	return state != nil && state.decoyed
+}
+
+// addRisk raises the risk score of the client key and returns the new score.
+func (t *clientTracker) addRisk(key string, increment float64, now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, true, now)
+	if state == nil {
+		return 0
+	}
+	state.risk += increment
+	if state.flaggedAt.IsZero() {
+		state.flaggedAt = now
+	}
+	return state.risk
+}
+
+// risk returns the risk score of the client key.
+func (t *clientTracker) risk(key string, now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state := t.state(key, false, now); state != nil {
+		return state.risk
+	}
+	return 0
+}
+
+// recordVerdict updates the inspection history of the client key.
+func (t *clientTracker) recordVerdict(key string, blocked bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, true, now)
+	if state == nil {
+		return
+	}
+	if blocked {
+		state.cleanStreak = 0
+		state.lastBlocked = now
+		return
+	}
+	state.cleanStreak++
+}
+
+// recentlyBlocked reports whether the client key was blocked within window.
+func (t *clientTracker) recentlyBlocked(key string, window time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, false, now)
+	return state != nil && !state.lastBlocked.IsZero() && now.Sub(state.lastBlocked) < window
+}
+
+// skipInspection reports whether the inspection of a request of the client key can be
+// skipped: clients with a clean streak of at least cleanStreak inspections, which were not blocked
+// within window, are only inspected once every sampleEvery requests.
+func (t *clientTracker) skipInspection(key string, cleanStreak int, sampleEvery int, window time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, false, now)
+	if state == nil || state.cleanStreak < cleanStreak {
+		return false
+	}
+	if !state.lastBlocked.IsZero() && now.Sub(state.lastBlocked) < window {
+		return false
+	}
+	state.skipped++
+	if state.skipped >= sampleEvery {
+		state.skipped = 0
+		return false
+	}
+	return true
+}
+
+// admit counts a request of the client key and reports whether it is one of its
+// first requests requests. Clients which can't be tracked are not greylisted.
+func (t *clientTracker) admit(key string, requests int, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, true, now)
+	if state == nil || state.requests > requests {
+		return false
+	}
+	state.requests++
+	return state.requests <= requests
+}
+
+// greylisted reports whether the last request admitted for the client key is one of
+// its first requests requests.
+func (t *clientTracker) greylisted(key string, requests int, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(key, false, now)
+	return state != nil && state.requests > 0 && state.requests <= requests
+}
+
+// graduate ends the greylisting of the client key.
+func (t *clientTracker) graduate(key string, requests int, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state := t.state(key, true, now); state != nil {
+		state.requests = requests + 1
+	}
+}
+
+// expire forgets the clients neither banned nor seen since idleTimeout.
+func (t *clientTracker) expire(now time.Time, idleTimeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, state := range t.clients {
+		if now.After(state.bannedUntil) && now.Sub(state.lastSeen) > idleTimeout {
+			delete(t.clients, key)
+		}
+	}
+}
+
+// run expires stale clients every interval until ctx is done.
+func (t *clientTracker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.expire(now, interval)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientTracker_ban(t *testing.T) {
+	tracker := newClientTracker()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := "192.0.2.1"
+
+	assert.False(t, tracker.banned(key, now))
+	assert.True(t, tracker.ban(key, now.Add(time.Hour), now))
+	assert.True(t, tracker.banned(key, now.Add(time.Minute)))
+	assert.False(t, tracker.banned("192.0.2.2", now))
+	assert.False(t, tracker.banned(key, now.Add(time.Hour)))
+
+	tracker.ban(key, now.Add(time.Minute), now)
+	assert.True(t, tracker.banned(key, now.Add(30*time.Minute)), "shorter bans don't shorten the current one")
+	assert.False(t, tracker.ban("", now.Add(time.Hour), now))
+}
+
+func TestClientTracker_expire(t *testing.T) {
+	tracker := newClientTracker()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tracker.ban("192.0.2.1", now.Add(time.Minute), now)
+	tracker.ban("192.0.2.2", now.Add(time.Hour), now)
+
+	tracker.expire(now.Add(20*time.Minute), 10*time.Minute)
+
+	assert.Len(t, tracker.clients, 1)
+	assert.Contains(t, tracker.clients, "192.0.2.2")
+}
+
+func TestClientTracker_evict(t *testing.T) {
+	tracker := newClientTracker()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < maxTrackedClients; i++ {
+		tracker.clients[strconv.Itoa(i)] = &clientState{lastSeen: now}
+	}
+	banned := &clientState{lastSeen: now.Add(-time.Hour), bannedUntil: now.Add(time.Hour)}
+	tracker.clients["banned"] = banned
+
+	assert.True(t, tracker.ban("192.0.2.1", now.Add(time.Hour), now), "new clients are tracked once the limit is reached")
+	assert.True(t, tracker.banned("192.0.2.1", now))
+	assert.Len(t, tracker.clients, maxTrackedClients+1, "a client was evicted")
+	assert.Same(t, banned, tracker.clients["banned"], "banned clients are evicted last")
+}
+
+func TestClientTracker_sessionBanned(t *testing.T) {
+	tracker := newClientTracker()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tracker.state("session:old", true, now)
+	tracker.ban("192.0.2.1", now.Add(time.Hour), now.Add(time.Minute))
+
+	assert.False(t, tracker.sessionBanned("session:old", "192.0.2.1", now.Add(2*time.Minute)), "older sessions don't inherit the ban of their address")
+	assert.True(t, tracker.sessionBanned("session:new", "192.0.2.1", now.Add(2*time.Minute)), "new sessions do")
+	assert.False(t, tracker.sessionBanned("session:new", "192.0.2.2", now.Add(2*time.Minute)))
+
+	tracker.addRisk("192.0.2.2", 3, now)
+	tracker.addRisk("session:other", 1, now)
+	assert.Equal(t, 3.0, tracker.sessionRisk("session:rotated", "192.0.2.2", now.Add(time.Minute)))
+	assert.Equal(t, 1.0, tracker.sessionRisk("session:other", "192.0.2.3", now.Add(time.Minute)))
+}
+
+func TestModsecurity_TrackingKey(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.HoneypotPaths = []string{`^/\.env$`}
+	config.ClientKeyCookie = "sid"
+	config.ClientKeyHeader = "X-Api-Key"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr string, path string, cookie string, apiKey string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if len(cookie) > 0 {
+			req.AddCookie(&http.Cookie{Name: "sid", Value: cookie})
+		}
+		if len(apiKey) > 0 {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", "/", "victim", ""))
+	serve("192.0.2.1:1234", "/.env", "attacker", "")
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234", "/", "attacker", ""))
+	assert.Equal(t, http.StatusForbidden, serve("198.51.100.1:1234", "/", "attacker", ""), "the session is banned from any address")
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", "/", "victim", ""), "older sessions behind the same address are not")
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234", "/", "", ""), "dropping the session doesn't escape the ban")
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234", "/", "rotated", ""), "nor rotating it")
+
+	assert.Equal(t, http.StatusOK, serve("192.0.2.2:1234", "/", "", "key2"))
+	serve("192.0.2.2:1234", "/.env", "", "key1")
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.3:1234", "/", "", "key1"))
+	assert.Equal(t, http.StatusOK, serve("192.0.2.2:1234", "/", "", "key2"))
+
+	serve("203.0.113.1:1234", "/.env", "", "")
+	assert.Equal(t, http.StatusForbidden, serve("203.0.113.1:1234", "/", "", ""), "clients without session are keyed by address")
+
+	for key := range middleware.clientTracker.clients {
+		assert.NotContains(t, key, "attacker", "session values are hashed")
+	}
+}
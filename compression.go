@@ -0,0 +1,92 @@
+package traefik_modsecurity_plugin
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Values accepted in wafBodyCompression.
+const (
+	wafCompressionOff    = "off"
+	wafCompressionAuto   = "auto"
+	wafCompressionAlways = "always"
+)
+
+// wafCompression gzip-compresses the large bodies sent to the WAF. Servers advertise the content
+// codings they accept in requests with the Accept-Encoding header of their responses (RFC 7694):
+// in auto mode, bodies are compressed once a WAF response listed gzip, and no longer once the WAF
+// answered a compressed body with 415 Unsupported Media Type.
+type wafCompression struct {
+	always  bool
+	minSize int64
+	// supported is 1 once the WAF advertised gzip
+	supported int32
+}
+
+func newWafCompression(mode string, minSize int64) (*wafCompression, error) {
+	switch mode {
+	case "", wafCompressionOff:
+		return nil, nil
+	case wafCompressionAuto, wafCompressionAlways:
+	default:
+		return nil, fmt.Errorf("invalid wafBodyCompression %q, expected %s, %s or %s", mode, wafCompressionOff, wafCompressionAuto, wafCompressionAlways)
+	}
+	if minSize < 0 {
+		return nil, fmt.Errorf("wafCompressionMinSize can't be negative")
+	}
+	return &wafCompression{always: mode == wafCompressionAlways, minSize: minSize}, nil
+}
+
+// compress replaces the body of proxyReq with its gzip compression, when it's large enough and the
+// WAF accepts it. It reports whether the body was compressed. The body is compressed while it is
+// sent, so that large bodies are not held twice in memory.
+func (c *wafCompression) compress(proxyReq *http.Request) bool {
+	if c == nil || proxyReq.Body == nil || proxyReq.Body == http.NoBody || proxyReq.ContentLength < c.minSize {
+		return false
+	}
+	if !c.always && atomic.LoadInt32(&c.supported) == 0 {
+		return false
+	}
+	if len(proxyReq.Header.Get("Content-Encoding")) > 0 {
+		// already encoded by the client
+		return false
+	}
+	body := proxyReq.Body
+	reader, writer := io.Pipe()
+	go func() {
+		compressor, _ := gzip.NewWriterLevel(writer, gzip.BestSpeed)
+		_, err := io.Copy(compressor, body)
+		if err == nil {
+			err = compressor.Close()
+		}
+		body.Close()
+		writer.CloseWithError(err)
+	}()
+	proxyReq.Body = reader
+	proxyReq.ContentLength = -1
+	proxyReq.Header.Set("Content-Encoding", "gzip")
+	return true
+}
+
+// observe updates the support of the WAF from its response to a request. It reports whether the
+// request must be sent again uncompressed, the WAF having refused its compressed body.
+func (c *wafCompression) observe(resp *http.Response, compressed bool) bool {
+	if c == nil {
+		return false
+	}
+	if compressed && resp.StatusCode == http.StatusUnsupportedMediaType {
+		atomic.StoreInt32(&c.supported, 0)
+		return !c.always
+	}
+	for _, accepted := range strings.Split(strings.Join(resp.Header.Values("Accept-Encoding"), ","), ",") {
+		if strings.EqualFold(strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0]), "gzip") {
+			atomic.StoreInt32(&c.supported, 1)
+			break
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewWafCompression(t *testing.T) {
+	compression, err := newWafCompression(wafCompressionOff, 1024)
+	assert.NoError(t, err)
+	assert.Nil(t, compression)
+	_, err = newWafCompression("deflate", 1024)
+	assert.EqualError(t, err, `invalid wafBodyCompression "deflate", expected off, auto or always`)
+	_, err = newWafCompression(wafCompressionAuto, -1)
+	assert.Error(t, err)
+}
+
+func TestWafCompression_observe(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		accept     []string
+		compressed bool
+		supported  int32
+		retry      bool
+	}{
+		{name: "No advertisement", status: http.StatusOK},
+		{name: "Gzip", status: http.StatusOK, accept: []string{"gzip"}, supported: 1},
+		{name: "List", status: http.StatusOK, accept: []string{"br, GZIP;q=0.5"}, supported: 1},
+		{name: "Other coding", status: http.StatusOK, accept: []string{"br"}},
+		{name: "Refused", status: http.StatusUnsupportedMediaType, compressed: true, retry: true},
+		{name: "Not compressed", status: http.StatusUnsupportedMediaType, accept: []string{"gzip"}, supported: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compression := &wafCompression{}
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{"Accept-Encoding": tt.accept}}
+			assert.Equal(t, tt.retry, compression.observe(resp, tt.compressed))
+			assert.Equal(t, tt.supported, compression.supported)
+		})
+	}
+	assert.False(t, (&wafCompression{always: true}).observe(&http.Response{StatusCode: http.StatusUnsupportedMediaType}, true), "the refusals are returned in always mode")
+}
+
+func TestModsecurity_WafBodyCompression(t *testing.T) {
+	var encodings []string
+	accept := "gzip"
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		var body []byte
+		if encoding == "gzip" {
+			reader, err := gzip.NewReader(r.Body)
+			assert.NoError(t, err)
+			body, _ = ioutil.ReadAll(reader)
+		} else {
+			body, _ = ioutil.ReadAll(r.Body)
+		}
+		assert.Equal(t, 1024, len(body))
+		if len(accept) == 0 && encoding == "gzip" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Accept-Encoding", accept)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.WafBodyCompression = wafCompressionAuto
+	config.WafCompressionMinSize = 512
+	var served []byte
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	send := func(body string) int {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body)))
+		return rw.Code
+	}
+	large := strings.Repeat("a", 1024)
+	assert.Equal(t, http.StatusOK, send(large))
+	assert.Equal(t, http.StatusOK, send(large))
+	assert.Equal(t, []string{"", "gzip"}, encodings, "bodies are compressed once the WAF advertised gzip")
+	assert.True(t, bytes.Equal([]byte(large), served), "the service receives the original body")
+
+	encodings, accept = nil, ""
+	assert.Equal(t, http.StatusOK, send(large))
+	assert.Equal(t, http.StatusOK, send(large))
+	assert.Equal(t, []string{"gzip", "", ""}, encodings, "refused bodies are sent again uncompressed")
+}
@@ -0,0 +1,22 @@
+package traefik_modsecurity_plugin
+
+import "net/http"
+
+// isConditionalRevalidation reports whether req is a cache revalidation: a GET request with an
+// If-None-Match or an If-Modified-Since header. These headers are set by the client, so requests
+// with a body or a query string never qualify, they would otherwise reach the service uninspected.
+func isConditionalRevalidation(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+		return false
+	}
+	if len(req.URL.RawQuery) > 0 || req.URL.ForceQuery {
+		return false
+	}
+	return len(req.Header.Get("If-None-Match")) > 0 || len(req.Header.Get("If-Modified-Since")) > 0
+}
+
+// skipsRevalidation reports whether req is a cache revalidation of one of the bypassConditionalPaths,
+// forwarded without inspection.
+func (a *Modsecurity) skipsRevalidation(req *http.Request) bool {
+	return len(a.revalidationPaths) > 0 && isConditionalRevalidation(req) && matchAny(a.revalidationPaths, req.URL.Path)
+}
@@ -0,0 +1,91 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsConditionalRevalidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		body    string
+		expect  bool
+	}{
+		{name: "If-None-Match", method: http.MethodGet, target: "/style.css", headers: map[string]string{"If-None-Match": `"abc"`}, expect: true},
+		{name: "If-Modified-Since", method: http.MethodGet, target: "/style.css", headers: map[string]string{"If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"}, expect: true},
+		{name: "Unconditional", method: http.MethodGet, target: "/style.css"},
+		{name: "With a query", method: http.MethodGet, target: "/search?q=1", headers: map[string]string{"If-None-Match": `"abc"`}},
+		{name: "With an empty query", method: http.MethodGet, target: "/search?", headers: map[string]string{"If-None-Match": `"abc"`}},
+		{name: "Other method", method: http.MethodPost, target: "/style.css", headers: map[string]string{"If-None-Match": `"abc"`}},
+		{name: "With a body", method: http.MethodGet, target: "/style.css", headers: map[string]string{"If-None-Match": `"abc"`}, body: "payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			assert.Equal(t, tt.expect, isConditionalRevalidation(req))
+		})
+	}
+}
+
+func TestModsecurity_BypassConditionalRequests(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	for _, bypass := range []bool{false, true} {
+		wafCalls = 0
+		config := CreateConfig()
+		config.ModSecurityUrl = wafServer.URL
+		config.BypassConditionalRequests = bypass
+		if bypass {
+			config.BypassConditionalPaths = []string{`^/static/`}
+		}
+		middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotModified)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/static/style.css", nil)
+		req.Header.Set("If-None-Match", `"abc"`)
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		if bypass {
+			assert.Equal(t, http.StatusNotModified, rw.Code)
+			assert.Equal(t, 0, wafCalls)
+		} else {
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			assert.Equal(t, 1, wafCalls)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/static/style.css?test=../etc", nil)
+		req.Header.Set("If-None-Match", `"abc"`)
+		rw = httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusForbidden, rw.Code, "requests with a query are always inspected")
+
+		req = httptest.NewRequest(http.MethodGet, "/admin/../etc/passwd", nil)
+		req.Header.Set("If-None-Match", `"abc"`)
+		rw = httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusForbidden, rw.Code, "the other paths are always inspected")
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.BypassConditionalRequests = true
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err, "the bypass requires its paths")
+}
@@ -0,0 +1,103 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Values accepted in controlCharPolicy.
+const (
+	controlCharPolicySanitize = "sanitize"
+	controlCharPolicyReject   = "reject"
+)
+
+func validateControlCharPolicy(policy string) error {
+	switch policy {
+	case "", controlCharPolicySanitize, controlCharPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("invalid controlCharPolicy %q, expected %s or %s", policy, controlCharPolicySanitize, controlCharPolicyReject)
+}
+
+// isControlChar reports whether c can't appear unescaped in a request target or header value.
+// Horizontal tabs are allowed in header values.
+func isControlChar(c byte) bool {
+	return (c < 0x20 && c != '\t') || c == 0x7f
+}
+
+func containsControlChar(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if isControlChar(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasControlChars reports whether the request target or a header of req contains control characters,
+// such as CR/LF used to inject headers in the request sent to the WAF.
+func hasControlChars(req *http.Request) bool {
+	if containsControlChar(req.RequestURI) {
+		return true
+	}
+	for name, values := range req.Header {
+		if containsControlChar(name) {
+			return true
+		}
+		for _, value := range values {
+			if containsControlChar(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// escapeControlChars percent-encodes the control characters and spaces of a request target.
+func escapeControlChars(uri string) string {
+	if !strings.ContainsAny(uri, " \x7f") && !containsControlChar(uri) {
+		return uri
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(uri); i++ {
+		c := uri[i]
+		if c == ' ' || c == '\t' || isControlChar(c) {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+			continue
+		}
+		escaped.WriteByte(c)
+	}
+	return escaped.String()
+}
+
+// stripControlChars removes the control characters from the header copy sent to the WAF.
+// Headers whose name contains control characters are dropped. The value slices are replaced,
+// not modified, as they may be shared with the original request.
+func stripControlChars(header http.Header) {
+	for name, values := range header {
+		if containsControlChar(name) {
+			delete(header, name)
+			continue
+		}
+		for i, value := range values {
+			if !containsControlChar(value) {
+				continue
+			}
+			stripped := make([]string, len(values))
+			copy(stripped, values)
+			for j := i; j < len(stripped); j++ {
+				stripped[j] = strings.Map(dropControlChar, stripped[j])
+			}
+			header[name] = stripped
+			break
+		}
+	}
+}
+
+func dropControlChar(r rune) rune {
+	if r < 0x80 && isControlChar(byte(r)) {
+		return -1
+	}
+	return r
+}
@@ -0,0 +1,82 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeControlChars(t *testing.T) {
+	assert.Equal(t, "/search?q=1", escapeControlChars("/search?q=1"))
+	assert.Equal(t, "/a%0D%0AX-Injected:%201", escapeControlChars("/a\r\nX-Injected: 1"))
+	assert.Equal(t, "/%00%7F%09", escapeControlChars("/\x00\x7f\t"))
+}
+
+func TestStripControlChars(t *testing.T) {
+	original := http.Header{
+		"Accept":  []string{"*/*"},
+		"X-Value": []string{"ok", "a\r\nX-Injected: 1"},
+		"X-\nBad": []string{"value"},
+	}
+	header := make(http.Header)
+	for name, values := range original {
+		header[name] = values
+	}
+
+	stripControlChars(header)
+
+	assert.Equal(t, http.Header{
+		"Accept":  []string{"*/*"},
+		"X-Value": []string{"ok", "aX-Injected: 1"},
+	}, header)
+	assert.Equal(t, "a\r\nX-Injected: 1", original["X-Value"][1], "the original header must not be modified")
+}
+
+func TestModsecurity_ControlChars(t *testing.T) {
+	var wafURI, wafHeader string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafURI = r.RequestURI
+		wafHeader = r.Header.Get("X-Value")
+	}))
+	defer wafServer.Close()
+
+	tests := []struct {
+		policy       string
+		expectStatus int
+	}{
+		{policy: "", expectStatus: http.StatusOK},
+		{policy: controlCharPolicyReject, expectStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			wafURI, wafHeader = "", ""
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.ControlCharPolicy = tt.policy
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RequestURI = "/a\r\nX-Injected: 1"
+			req.Header.Set("X-Value", "v\r\nX-Injected: 1")
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			if tt.expectStatus == http.StatusOK {
+				assert.Equal(t, "/a%0D%0AX-Injected:%201", wafURI)
+				assert.Equal(t, "vX-Injected: 1", wafHeader)
+			} else {
+				assert.Equal(t, "", wafURI, "rejected requests must not reach the WAF")
+			}
+		})
+	}
+}
+
+func TestValidateControlCharPolicy(t *testing.T) {
+	assert.NoError(t, validateControlCharPolicy(""))
+	assert.NoError(t, validateControlCharPolicy(controlCharPolicySanitize))
+	assert.Error(t, validateControlCharPolicy("drop"))
+}
@@ -0,0 +1,82 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// cookieFilter rewrites the cookies of the request sent to the WAF into a single Cookie header.
+// Excluded cookies, e.g. analytics cookies covered by privacy rules, are removed and, with
+// normalize, the values are unquoted and percent-decoded so that the rules inspecting
+// REQUEST_COOKIES see the payloads. The service receives the original cookies.
+type cookieFilter struct {
+	normalize bool
+	// exclude holds cookie names, a trailing * matches the names starting with the prefix.
+	exclude []string
+}
+
+func newCookieFilter(normalize bool, exclude []string) *cookieFilter {
+	if !normalize && len(exclude) == 0 {
+		return nil
+	}
+	return &cookieFilter{normalize: normalize, exclude: exclude}
+}
+
+func (f *cookieFilter) excluded(name string) bool {
+	for _, pattern := range f.exclude {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// apply rewrites the Cookie headers of header. Cookies are split by hand: net/http drops the
+// cookies whose value isn't valid, which would hide their payload from the WAF.
+func (f *cookieFilter) apply(header http.Header) {
+	if f == nil || len(header["Cookie"]) == 0 {
+		return
+	}
+	var cookies []string
+	for _, line := range header["Cookie"] {
+		for _, pair := range strings.Split(line, ";") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) == 0 {
+				continue
+			}
+			name, value := pair, ""
+			if i := strings.IndexByte(pair, '='); i >= 0 {
+				name, value = strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+			}
+			if f.excluded(name) {
+				continue
+			}
+			if f.normalize {
+				pair = name + "=" + normalizeCookieValue(value)
+			}
+			cookies = append(cookies, pair)
+		}
+	}
+	if len(cookies) == 0 {
+		header.Del("Cookie")
+		return
+	}
+	header["Cookie"] = []string{strings.Join(cookies, "; ")}
+}
+
+// normalizeCookieValue removes the quotes around value and decodes its percent-encoding.
+// Malformed escapes are kept as is.
+func normalizeCookieValue(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	if decoded, err := url.PathUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
@@ -0,0 +1,61 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieFilter_apply(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize bool
+		exclude   []string
+		cookies   []string
+		expect    []string
+	}{
+		{name: "Exclusions", exclude: []string{"_ga*", "_fbp"}, cookies: []string{"_ga=GA1.2.3; session=abc; _gat=1", "_fbp=fb.1; theme=dark"}, expect: []string{"session=abc; theme=dark"}},
+		{name: "Everything excluded", exclude: []string{"_ga*"}, cookies: []string{"_ga=GA1.2.3; _gat=1"}},
+		{name: "Exact names only", exclude: []string{"_fbp"}, cookies: []string{"_fbp_id=1"}, expect: []string{"_fbp_id=1"}},
+		{name: "Normalize", normalize: true, cookies: []string{`session = "abc" ;id=1%27%20OR%201%3D1;;flag`, "bad=%zz"}, expect: []string{"session=abc; id=1' OR 1=1; flag=; bad=%zz"}},
+		{name: "Normalize and exclude", normalize: true, exclude: []string{"_ga*"}, cookies: []string{"_ga=1; q=%3Cscript%3E"}, expect: []string{"q=<script>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Cookie": tt.cookies}
+			newCookieFilter(tt.normalize, tt.exclude).apply(header)
+			assert.Equal(t, tt.expect, header["Cookie"])
+		})
+	}
+
+	assert.Nil(t, newCookieFilter(false, nil))
+}
+
+func TestModsecurity_ExcludedCookies(t *testing.T) {
+	var wafCookies []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCookies = r.Header["Cookie"]
+	}))
+	defer wafServer.Close()
+
+	var serviceCookies []string
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.NormalizeCookies = true
+	config.ExcludedCookies = []string{"_ga*"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceCookies = r.Header["Cookie"]
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Cookie", "_ga=GA1.2.3; session=%22abc%22")
+	req.Header.Add("Cookie", "theme=dark")
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, []string{`session="abc"; theme=dark`}, wafCookies)
+	assert.Equal(t, []string{"_ga=GA1.2.3; session=%22abc%22", "theme=dark"}, serviceCookies)
+}
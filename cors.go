@@ -0,0 +1,13 @@
+package traefik_modsecurity_plugin
+
+import "net/http"
+
+// isCorsPreflight reports whether req is a CORS preflight request: an OPTIONS request with an
+// Origin and an Access-Control-Request-Method header. Requests with a body never qualify, a
+// preflight has none and the body would otherwise reach the service uninspected.
+func isCorsPreflight(req *http.Request) bool {
+	if req.Method != http.MethodOptions || req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+		return false
+	}
+	return len(req.Header.Get("Origin")) > 0 && len(req.Header.Get("Access-Control-Request-Method")) > 0
+}
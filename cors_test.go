@@ -0,0 +1,72 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCorsPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		body    string
+		expect  bool
+	}{
+		{name: "Preflight", method: http.MethodOptions, headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PUT"}, expect: true},
+		{name: "Without origin", method: http.MethodOptions, headers: map[string]string{"Access-Control-Request-Method": "PUT"}},
+		{name: "Without requested method", method: http.MethodOptions, headers: map[string]string{"Origin": "https://app.example.com"}},
+		{name: "Plain OPTIONS", method: http.MethodOptions},
+		{name: "Other method", method: http.MethodGet, headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PUT"}},
+		{name: "With a body", method: http.MethodOptions, headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PUT"}, body: "payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api", strings.NewReader(tt.body))
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			assert.Equal(t, tt.expect, isCorsPreflight(req))
+		})
+	}
+}
+
+func TestModsecurity_BypassCorsPreflight(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	for _, bypass := range []bool{false, true} {
+		wafCalls = 0
+		config := CreateConfig()
+		config.ModSecurityUrl = wafServer.URL
+		config.BypassCorsPreflight = bypass
+		middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		req := httptest.NewRequest(http.MethodOptions, "/api", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		if bypass {
+			assert.Equal(t, http.StatusNoContent, rw.Code)
+			assert.Equal(t, 0, wafCalls)
+		} else {
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			assert.Equal(t, 1, wafCalls)
+		}
+
+		rw = httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodOptions, "/api", nil))
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+	}
+}
@@ -0,0 +1,130 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// debugDumpMaxBody is the number of bytes of each body written in a debug dump.
+const debugDumpMaxBody = 64 * 1024
+
+// debugDumper writes sanitized request and WAF response pairs to a dedicated file, for a limited
+// number of requests selected with a trusted header or client IP, to debug mysterious blocks
+// without permanently verbose logging.
+type debugDumper struct {
+	file      string
+	header    string
+	token     string
+	networks  []*net.IPNet
+	remaining int64
+	mu        sync.Mutex
+}
+
+type debugDump struct {
+	Time           time.Time   `json:"time"`
+	Method         string      `json:"method"`
+	URI            string      `json:"uri"`
+	Host           string      `json:"host"`
+	RemoteAddr     string      `json:"remoteAddr"`
+	RequestHeaders http.Header `json:"requestHeaders"`
+	RequestBody    string      `json:"requestBody"`
+	WafStatus      int         `json:"wafStatus"`
+	WafHeaders     http.Header `json:"wafHeaders"`
+	WafBody        string      `json:"wafBody"`
+}
+
+func newDebugDumper(file string, header string, token string, ips []string, limit int) (*debugDumper, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	networks, err := parseCIDRs("debugDumpIps", ips)
+	if err != nil {
+		return nil, err
+	}
+	if (len(header) == 0 || len(token) == 0) && len(networks) == 0 {
+		return nil, fmt.Errorf("debugDumpFile requires debugDumpHeader and debugDumpToken, or debugDumpIps")
+	}
+	return &debugDumper{
+		file:      file,
+		header:    header,
+		token:     token,
+		networks:  networks,
+		remaining: int64(limit),
+	}, nil
+}
+
+// selects reports whether req must be dumped, consuming one of the remaining dumps.
+func (d *debugDumper) selects(req *http.Request) bool {
+	if d == nil {
+		return false
+	}
+	trusted := len(d.header) > 0 && len(d.token) > 0 && req.Header.Get(d.header) == d.token
+	if !trusted && !containsIP(d.networks, remoteIP(req)) {
+		return false
+	}
+	return atomic.AddInt64(&d.remaining, -1) >= 0
+}
+
+// stripTrigger removes the trusted debug header from the copy of the request sent to the WAF.
+func (d *debugDumper) stripTrigger(header http.Header) {
+	if d != nil && len(d.header) > 0 {
+		header.Del(d.header)
+	}
+}
+
+// dump writes req, its body and the WAF response resp, masked by masker. The beginning of the WAF
+// response body is read to be dumped, resp.Body is replaced so that it can still be forwarded.
+func (d *debugDumper) dump(req *http.Request, body *bufferedBody, resp *http.Response, masker *piiMasker) error {
+	entry := debugDump{
+		Time:           time.Now(),
+		Method:         req.Method,
+		URI:            masker.maskURI(req.RequestURI),
+		Host:           req.Host,
+		RemoteAddr:     req.RemoteAddr,
+		RequestHeaders: masker.maskHeader(sanitizeHeader(req.Header, d.header)),
+		WafStatus:      resp.StatusCode,
+		WafHeaders:     sanitizeHeader(resp.Header),
+	}
+	if body != nil {
+		requestBody, _ := ioutil.ReadAll(io.LimitReader(body.wafReader(), debugDumpMaxBody))
+		entry.RequestBody = string(masker.maskBody(req.Header.Get("Content-Type"), requestBody))
+	}
+	wafBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, debugDumpMaxBody))
+	resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(wafBody), resp.Body), Closer: resp.Body}
+	if err != nil {
+		return err
+	}
+	entry.WafBody = masker.mask(string(wafBody))
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.OpenFile(d.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readCloser combines a reader with the closer of another one.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
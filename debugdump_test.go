@@ -0,0 +1,81 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_DebugDump(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", r.Header.Get("X-Debug-Dump"), "the debug token must not reach the WAF")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("blocked by 942100"))
+	}))
+	defer wafServer.Close()
+
+	file := filepath.Join(t.TempDir(), "dump.jsonl")
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.DebugDumpFile = file
+	config.DebugDumpHeader = "X-Debug-Dump"
+	config.DebugDumpToken = "s3cr3t"
+	config.DebugDumpLimit = 1
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=1' or 1=1"))
+		req.Header.Set("X-Debug-Dump", "s3cr3t")
+		req.Header.Set("Authorization", "Bearer token")
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.Equal(t, "blocked by 942100", rw.Body.String(), "dumping must not consume the forwarded body")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/untrusted", nil)
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 1)
+
+	var dump debugDump
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &dump))
+	assert.Equal(t, "/search", dump.URI)
+	assert.Equal(t, "q=1' or 1=1", dump.RequestBody)
+	assert.Equal(t, redacted, dump.RequestHeaders.Get("Authorization"))
+	assert.Equal(t, redacted, dump.RequestHeaders.Get("X-Debug-Dump"))
+	assert.Equal(t, http.StatusForbidden, dump.WafStatus)
+	assert.Equal(t, "blocked by 942100", dump.WafBody)
+}
+
+func TestDebugDumper_selectsTrustedIps(t *testing.T) {
+	dumper, err := newDebugDumper("dump.jsonl", "", "", []string{"10.0.0.0/8", "2001:db8::1"}, 10)
+	assert.NoError(t, err)
+
+	for _, tt := range []struct {
+		remoteAddr string
+		expect     bool
+	}{
+		{remoteAddr: "10.1.2.3:1234", expect: true},
+		{remoteAddr: "[2001:db8::1]:1234", expect: true},
+		{remoteAddr: "192.168.1.1:1234", expect: false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		assert.Equal(t, tt.expect, dumper.selects(req), tt.remoteAddr)
+	}
+}
+
+func TestNewDebugDumper_RequiresTrigger(t *testing.T) {
+	_, err := newDebugDumper("dump.jsonl", "X-Debug-Dump", "", nil, 10)
+	assert.Error(t, err)
+}
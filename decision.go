@@ -0,0 +1,201 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAnomalyScoreHeader is the WAF response header carrying the inbound anomaly score of the
+// request. As for the rule IDs, the WAF has to be configured to set it.
+const defaultAnomalyScoreHeader = "X-Waf-Anomaly-Score"
+
+const (
+	decisionStatus = "status"
+	decisionScore  = "score"
+	decisionRisk   = "risk"
+	decisionAny    = "any"
+	decisionAll    = "all"
+)
+
+// Signals are the inputs a DecisionPolicy bases its verdict on.
+type Signals struct {
+	// Status is the status code answered by the WAF.
+	Status int
+	// Score is the anomaly score reported by the WAF, HasScore is false when it did not report one.
+	Score    float64
+	HasScore bool
+	// RuleIds are the IDs of the rules which triggered.
+	RuleIds []string
+	// BotScore is the score of the bot-detection service, HasBotScore is false when it is not enabled.
+	BotScore    float64
+	HasBotScore bool
+	// Asn is the autonomous system number of the client, zero when asnDatabase is not configured
+	// or the client is unknown.
+	Asn uint
+	// Country is the ISO 3166-1 code of the country of the client, empty when countryDatabase is
+	// not configured or the client is unknown.
+	Country string
+	// Risk is the risk score accumulated by the client, e.g. by exploiting decoy headers, plus the
+	// score of the threat feeds matching the request and of the DNS blocklists listing the client.
+	Risk float64
+	// RecentlyBlocked is set when adaptive inspection is enabled and the client was recently blocked.
+	RecentlyBlocked bool
+	// Greylisted is set when greylisting is enabled and the request is one of the first requests of the client.
+	Greylisted bool
+	Method     string
+	Path       string
+}
+
+// DecisionPolicy decides whether a request is blocked, based on the WAF verdict and the local signals.
+type DecisionPolicy interface {
+	Blocks(signals Signals) bool
+}
+
+// StatusThresholdPolicy blocks when the WAF answers a status code greater or equal to Threshold.
+// This is the historical behavior, with a threshold of 400.
+type StatusThresholdPolicy struct {
+	Threshold int
+}
+
+// Blocks implements DecisionPolicy.
+func (p StatusThresholdPolicy) Blocks(signals Signals) bool {
+	return signals.Status >= p.Threshold
+}
+
+// ScoreThresholdPolicy blocks when the anomaly score reported by the WAF is greater or equal to
+// Threshold, or to RecentlyBlockedThreshold when it is set and the client was recently blocked,
+// or to GreylistedThreshold when it is set and the client is greylisted. The lowest applicable
+// threshold wins. Requests without a score are not blocked.
+type ScoreThresholdPolicy struct {
+	Threshold                float64
+	RecentlyBlockedThreshold float64
+	GreylistedThreshold      float64
+}
+
+// Blocks implements DecisionPolicy.
+func (p ScoreThresholdPolicy) Blocks(signals Signals) bool {
+	threshold := p.Threshold
+	if signals.RecentlyBlocked && p.RecentlyBlockedThreshold > 0 {
+		threshold = p.RecentlyBlockedThreshold
+	}
+	if signals.Greylisted && p.GreylistedThreshold > 0 && p.GreylistedThreshold < threshold {
+		threshold = p.GreylistedThreshold
+	}
+	return signals.HasScore && signals.Score >= threshold
+}
+
+// RiskThresholdPolicy blocks when the risk score of the client is greater or equal to Threshold.
+type RiskThresholdPolicy struct {
+	Threshold float64
+}
+
+// Blocks implements DecisionPolicy.
+func (p RiskThresholdPolicy) Blocks(signals Signals) bool {
+	return signals.Risk >= p.Threshold
+}
+
+// CompositePolicy combines policies: with RequireAll it blocks when every policy blocks,
+// otherwise when any of them does.
+type CompositePolicy struct {
+	Policies   []DecisionPolicy
+	RequireAll bool
+}
+
+// Blocks implements DecisionPolicy.
+func (p CompositePolicy) Blocks(signals Signals) bool {
+	if len(p.Policies) == 0 {
+		return false
+	}
+	for _, policy := range p.Policies {
+		if policy.Blocks(signals) != p.RequireAll {
+			return !p.RequireAll
+		}
+	}
+	return p.RequireAll
+}
+
+// DecisionConfig configures the built-in decision policies.
+// Type is one of status, score, risk, any or all; any and all combine the nested Policies.
+type DecisionConfig struct {
+	Type      string  `json:"type,omitempty" description:"status, score, risk, any or all"`
+	Threshold float64 `json:"threshold,omitempty" description:"threshold of the status, score or risk"`
+	// RecentlyBlockedThreshold is the score threshold of recently blocked clients, with adaptive inspection.
+	RecentlyBlockedThreshold float64 `json:"recentlyBlockedThreshold,omitempty" description:"score threshold of recently blocked clients"`
+	// GreylistedThreshold is the score threshold of greylisted clients, with greylistRequests.
+	GreylistedThreshold float64          `json:"greylistedThreshold,omitempty" description:"score threshold of greylisted clients"`
+	Policies            []DecisionConfig `json:"policies,omitempty" description:"policies combined by any and all"`
+}
+
+// newDecisionPolicy builds the policy described by config. A nil config keeps the historical behavior.
+func newDecisionPolicy(config *DecisionConfig) (DecisionPolicy, error) {
+	if config == nil {
+		return StatusThresholdPolicy{Threshold: http.StatusBadRequest}, nil
+	}
+	switch config.Type {
+	case decisionStatus:
+		threshold := int(config.Threshold)
+		if threshold == 0 {
+			threshold = http.StatusBadRequest
+		}
+		if threshold < 100 || threshold > 599 {
+			return nil, fmt.Errorf("invalid decision status threshold %v", config.Threshold)
+		}
+		return StatusThresholdPolicy{Threshold: threshold}, nil
+	case decisionScore:
+		if config.Threshold <= 0 {
+			return nil, fmt.Errorf("decision score threshold must be positive")
+		}
+		return ScoreThresholdPolicy{Threshold: config.Threshold, RecentlyBlockedThreshold: config.RecentlyBlockedThreshold, GreylistedThreshold: config.GreylistedThreshold}, nil
+	case decisionRisk:
+		if config.Threshold <= 0 {
+			return nil, fmt.Errorf("decision risk threshold must be positive")
+		}
+		return RiskThresholdPolicy{Threshold: config.Threshold}, nil
+	case decisionAny, decisionAll:
+		if len(config.Policies) == 0 {
+			return nil, fmt.Errorf("decision policy %q requires nested policies", config.Type)
+		}
+		composite := CompositePolicy{RequireAll: config.Type == decisionAll}
+		for i := range config.Policies {
+			policy, err := newDecisionPolicy(&config.Policies[i])
+			if err != nil {
+				return nil, err
+			}
+			composite.Policies = append(composite.Policies, policy)
+		}
+		return composite, nil
+	default:
+		return nil, fmt.Errorf("invalid decision policy type %q, expected %s, %s, %s, %s or %s", config.Type, decisionStatus, decisionScore, decisionRisk, decisionAny, decisionAll)
+	}
+}
+
+// signals collects the inputs of the decision policy for the WAF response to req.
+func (a *Modsecurity) signals(req *http.Request, resp *http.Response, botScore string) Signals {
+	signals := Signals{
+		Status:          resp.StatusCode,
+		RuleIds:         a.ruleIds(resp),
+		RecentlyBlocked: a.recentlyBlocked(req),
+		Greylisted:      a.greylisted(req),
+		Method:          req.Method,
+		Path:            req.URL.Path,
+	}
+	signals.Country, signals.Asn = a.clientOrigin(req)
+	if a.trackClients {
+		signals.Risk = a.clientRisk(req, time.Now())
+	}
+	signals.Risk += a.threatFeeds.risk(req) + a.dnsbl.risk(req)
+	if value := strings.TrimSpace(resp.Header.Get(a.anomalyScoreHeader)); len(value) > 0 {
+		if score, err := strconv.ParseFloat(value, 64); err == nil {
+			signals.Score, signals.HasScore = score, true
+		}
+	}
+	if len(botScore) > 0 {
+		if score, err := strconv.ParseFloat(botScore, 64); err == nil {
+			signals.BotScore, signals.HasBotScore = score, true
+		}
+	}
+	return signals
+}
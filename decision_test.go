@@ -0,0 +1,91 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  DecisionPolicy
+		signals Signals
+		expect  bool
+	}{
+		{name: "status below threshold", policy: StatusThresholdPolicy{Threshold: 400}, signals: Signals{Status: 200}, expect: false},
+		{name: "status at threshold", policy: StatusThresholdPolicy{Threshold: 400}, signals: Signals{Status: 403}, expect: true},
+		{name: "score without header", policy: ScoreThresholdPolicy{Threshold: 5}, signals: Signals{Status: 403}, expect: false},
+		{name: "score below threshold", policy: ScoreThresholdPolicy{Threshold: 5}, signals: Signals{Score: 3, HasScore: true}, expect: false},
+		{name: "score at threshold", policy: ScoreThresholdPolicy{Threshold: 5}, signals: Signals{Score: 5, HasScore: true}, expect: true},
+		{name: "lower score threshold for recently blocked clients", policy: ScoreThresholdPolicy{Threshold: 5, RecentlyBlockedThreshold: 2}, signals: Signals{Score: 3, HasScore: true, RecentlyBlocked: true}, expect: true},
+		{name: "score threshold for other clients", policy: ScoreThresholdPolicy{Threshold: 5, RecentlyBlockedThreshold: 2}, signals: Signals{Score: 3, HasScore: true}, expect: false},
+		{name: "risk below threshold", policy: RiskThresholdPolicy{Threshold: 3}, signals: Signals{Risk: 2}, expect: false},
+		{name: "risk at threshold", policy: RiskThresholdPolicy{Threshold: 3}, signals: Signals{Risk: 3}, expect: true},
+		{
+			name:    "any",
+			policy:  CompositePolicy{Policies: []DecisionPolicy{StatusThresholdPolicy{Threshold: 400}, ScoreThresholdPolicy{Threshold: 5}}},
+			signals: Signals{Status: 200, Score: 8, HasScore: true},
+			expect:  true,
+		},
+		{
+			name:    "all",
+			policy:  CompositePolicy{RequireAll: true, Policies: []DecisionPolicy{StatusThresholdPolicy{Threshold: 400}, ScoreThresholdPolicy{Threshold: 5}}},
+			signals: Signals{Status: 403, Score: 3, HasScore: true},
+			expect:  false,
+		},
+		{name: "empty composite", policy: CompositePolicy{RequireAll: true}, signals: Signals{Status: 403}, expect: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, tt.policy.Blocks(tt.signals))
+		})
+	}
+}
+
+func TestNewDecisionPolicy(t *testing.T) {
+	policy, err := newDecisionPolicy(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusThresholdPolicy{Threshold: 400}, policy)
+
+	policy, err = newDecisionPolicy(&DecisionConfig{Type: "all", Policies: []DecisionConfig{{Type: "status"}, {Type: "score", Threshold: 5}}})
+	assert.NoError(t, err)
+	assert.Equal(t, CompositePolicy{RequireAll: true, Policies: []DecisionPolicy{StatusThresholdPolicy{Threshold: 400}, ScoreThresholdPolicy{Threshold: 5}}}, policy)
+
+	for _, config := range []DecisionConfig{
+		{Type: "unknown"},
+		{Type: "status", Threshold: 1000},
+		{Type: "score"},
+		{Type: "risk"},
+		{Type: "any"},
+		{Type: "any", Policies: []DecisionConfig{{Type: "score"}}},
+	} {
+		_, err := newDecisionPolicy(&config)
+		assert.Error(t, err, config.Type)
+	}
+}
+
+func TestModsecurity_ScoreDecision(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a WAF in detection-only mode always answers 200 and reports the anomaly score
+		w.Header().Set("X-Waf-Anomaly-Score", r.URL.Query().Get("score"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.Decision = &DecisionConfig{Type: "score", Threshold: 5}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for score, expect := range map[string]int{"2": http.StatusNoContent, "5": http.StatusForbidden, "": http.StatusNoContent} {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/?score="+score, nil))
+		assert.Equal(t, expect, rw.Code, score)
+	}
+}
@@ -0,0 +1,44 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"time"
+)
+
+// applyDecoys injects the fake technology headers into the block response to req, and remembers
+// the client received them. The decoy values win over the headers of the WAF response.
+func (a *Modsecurity) applyDecoys(rw http.ResponseWriter, req *http.Request, resp *http.Response) {
+	if len(a.decoyHeaders) == 0 {
+		return
+	}
+	for name, value := range a.decoyHeaders {
+		resp.Header.Del(name)
+		rw.Header().Set(name, value)
+	}
+	a.clientTracker.markDecoyed(a.trackingKey(req), time.Now())
+}
+
+// checkDecoyFollowUp raises the risk score of clients which received decoy headers and now send
+// requests targeting the fake technologies: they are actively exploiting what they discovered.
+// Clients whose risk reaches riskBanThreshold are banned.
+func (a *Modsecurity) checkDecoyFollowUp(req *http.Request) {
+	if len(a.decoyPatterns) == 0 || !matchAny(a.decoyPatterns, req.RequestURI) {
+		return
+	}
+	now := time.Now()
+	key := a.trackingKey(req)
+	if !a.clientTracker.decoyed(key, now) {
+		return
+	}
+	risk := a.addClientRisk(req, a.decoyRiskIncrement, now)
+	fields := logFields{
+		"client": clientKey(remoteIP(req), a.ipv6PrefixLength),
+		"risk":   risk,
+	}
+	if a.riskBanThreshold > 0 && risk >= a.riskBanThreshold && a.banDuration > 0 {
+		until := now.Add(a.banDuration)
+		a.banClient(req, until, now)
+		fields["banned_until"] = until.UTC().Format(time.RFC3339)
+	}
+	a.logEvent("decoy_followup", a.requestFields(req, fields))
+}
@@ -0,0 +1,50 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_DecoyHeaders(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "ModSecurity")
+		if r.URL.Query().Get("attack") == "1" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.DecoyHeaders = map[string]string{"X-Powered-By": "PHP/5.4.45"}
+	config.DecoyPatterns = []string{`\.php\b`}
+	config.RiskBanThreshold = 2
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// a client probing the fake technology without having seen it isn't suspicious
+	assert.Equal(t, http.StatusOK, serve("198.51.100.1:1234", "/index.php").Code)
+	assert.Equal(t, 0.0, middleware.clientTracker.risk("198.51.100.1", time.Now()))
+
+	rw := serve("192.0.2.1:1234", "/?attack=1")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "PHP/5.4.45", rw.Header().Get("X-Powered-By"))
+
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", "/index.php").Code)
+	assert.Equal(t, 1.0, middleware.clientTracker.risk("192.0.2.1", time.Now()))
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", "/").Code)
+
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234", "/phpinfo.php").Code, "the client is banned once its risk reaches the threshold")
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234", "/").Code)
+}
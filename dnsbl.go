@@ -0,0 +1,214 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDnsblHeader is the request header listing the DNS blocklists the client is listed on, for
+// the WAF and the service. A value sent by the client is never trusted.
+const defaultDnsblHeader = "X-Dnsbl-Listed"
+
+// dnsblFailureTtl is how long a failed lookup is cached as not listed, so that slow or failing
+// resolvers are not queried for every request.
+const dnsblFailureTtl = time.Minute
+
+// dnsResolver resolves the blocklist queries, net.DefaultResolver in production.
+type dnsResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsblChecker queries DNS blocklists for the client addresses and caches the answers. Lookups
+// fail open: a client whose lookup times out or fails is considered not listed.
+type dnsblChecker struct {
+	zones    []string
+	score    float64
+	timeout  time.Duration
+	cacheTtl time.Duration
+	header   string
+	resolver dnsResolver
+
+	mu    sync.Mutex
+	cache map[string]*dnsblEntry
+}
+
+type dnsblEntry struct {
+	listed  []string
+	expires time.Time
+}
+
+func newDnsblChecker(zones []string, score float64, timeout time.Duration, cacheTtl time.Duration, header string) *dnsblChecker {
+	if len(zones) == 0 {
+		return nil
+	}
+	c := &dnsblChecker{
+		score:    score,
+		timeout:  timeout,
+		cacheTtl: cacheTtl,
+		header:   header,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]*dnsblEntry),
+	}
+	for _, zone := range zones {
+		c.zones = append(c.zones, strings.Trim(strings.TrimSpace(zone), "."))
+	}
+	return c
+}
+
+// dnsblQuery returns the name queried in zone for ip: its reversed octets, or nibbles for IPv6.
+func dnsblQuery(ip net.IP, zone string) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip4[i])))
+			b.WriteByte('.')
+		}
+	} else {
+		ip16 := ip.To16()
+		for i := len(ip16) - 1; i >= 0; i-- {
+			b.WriteString(strconv.FormatUint(uint64(ip16[i]&0xf), 16))
+			b.WriteByte('.')
+			b.WriteString(strconv.FormatUint(uint64(ip16[i]>>4), 16))
+			b.WriteByte('.')
+		}
+	}
+	b.WriteString(zone)
+	return b.String()
+}
+
+// dnsblListed reports whether the answer addrs of a blocklist query lists the client. Blocklists
+// answer 127.0.0.0/8 addresses; 127.255.255.0/24 are error codes, e.g. refused queries from open
+// resolvers, not listings.
+func dnsblListed(addrs []string) bool {
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr).To4()
+		if ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the zones listing ip, querying them in parallel within timeout on a cache miss.
+// It reports false when one of the queries failed.
+func (c *dnsblChecker) lookup(ctx context.Context, ip net.IP, now time.Time) ([]string, bool) {
+	key := ip.String()
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.listed, true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	type answer struct {
+		zone   string
+		listed bool
+		err    error
+	}
+	answers := make(chan answer, len(c.zones))
+	for _, zone := range c.zones {
+		go func(zone string) {
+			addrs, err := c.resolver.LookupHost(ctx, dnsblQuery(ip, zone))
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				err = nil
+			}
+			answers <- answer{zone: zone, listed: err == nil && dnsblListed(addrs), err: err}
+		}(zone)
+	}
+	var listed []string
+	succeeded := true
+	for range c.zones {
+		a := <-answers
+		if a.err != nil {
+			succeeded = false
+		}
+		if a.listed {
+			listed = append(listed, a.zone)
+		}
+	}
+
+	ttl := c.cacheTtl
+	if !succeeded && len(listed) == 0 {
+		ttl = dnsblFailureTtl
+	}
+	c.mu.Lock()
+	if _, ok := c.cache[key]; ok || len(c.cache) < maxTrackedClients {
+		c.cache[key] = &dnsblEntry{listed: listed, expires: now.Add(ttl)}
+	}
+	c.mu.Unlock()
+	return listed, succeeded
+}
+
+// cached returns the zones listing ip according to the cache, without querying them.
+func (c *dnsblChecker) cached(ip net.IP, now time.Time) []string {
+	if c == nil || ip == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.cache[ip.String()]; ok && now.Before(entry.expires) {
+		return entry.listed
+	}
+	return nil
+}
+
+// risk returns the risk added to the requests of a client listed on zones blocklists.
+func (c *dnsblChecker) risk(req *http.Request) float64 {
+	if c == nil {
+		return 0
+	}
+	return c.score * float64(len(c.cached(remoteIP(req), time.Now())))
+}
+
+// expire removes the expired answers.
+func (c *dnsblChecker) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.cache {
+		if !now.Before(entry.expires) {
+			delete(c.cache, key)
+		}
+	}
+}
+
+// run expires the cached answers every interval until ctx is done.
+func (c *dnsblChecker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.expire(now)
+		}
+	}
+}
+
+// checkDnsbl looks up the client of req in the blocklists and lists the ones it is listed on in
+// the blocklists header. Failed lookups are logged and the request goes on.
+func (a *Modsecurity) checkDnsbl(req *http.Request) {
+	ip := remoteIP(req)
+	var listed []string
+	// private addresses are never listed, their lookups would leak the internal addressing to the resolvers
+	if ip != nil && !ip.IsLoopback() && !ip.IsPrivate() {
+		var ok bool
+		if listed, ok = a.dnsbl.lookup(req.Context(), ip, time.Now()); !ok {
+			a.logSampled("dnsbl_lookup_failed", a.requestFields(req, logFields{"client": ip.String()}))
+		}
+	}
+	if len(a.dnsbl.header) == 0 {
+		return
+	}
+	req.Header.Del(a.dnsbl.header)
+	if len(listed) > 0 {
+		req.Header.Set(a.dnsbl.header, strings.Join(listed, ","))
+	}
+}
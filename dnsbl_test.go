@@ -0,0 +1,128 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver answers the blocklist queries from answers, NXDOMAIN for unknown names, and blocks
+// until the context is done for the names of slow.
+type fakeResolver struct {
+	answers map[string][]string
+	slow    map[string]bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	r.queries = append(r.queries, host)
+	r.mu.Unlock()
+	if r.slow[host] {
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+	}
+	if addrs, ok := r.answers[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+func TestDnsblQuery(t *testing.T) {
+	assert.Equal(t, "2.0.0.127.zen.example", dnsblQuery(net.ParseIP("127.0.0.2"), "zen.example"))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example", dnsblQuery(net.ParseIP("2001:db8::1"), "zen.example"))
+	assert.True(t, dnsblListed([]string{"127.0.0.2"}))
+	assert.False(t, dnsblListed([]string{"127.255.255.254"}), "error codes are not listings")
+	assert.False(t, dnsblListed([]string{"192.0.2.1"}))
+	assert.False(t, dnsblListed(nil))
+}
+
+func TestDnsblChecker_lookup(t *testing.T) {
+	assert.Nil(t, newDnsblChecker(nil, 10, time.Second, time.Hour, defaultDnsblHeader))
+
+	resolver := &fakeResolver{
+		answers: map[string][]string{
+			"1.2.0.192.zen.example":   {"127.0.0.2"},
+			"1.2.0.192.other.example": {"127.0.0.4"},
+		},
+		slow: map[string]bool{"2.2.0.192.other.example": true},
+	}
+	checker := newDnsblChecker([]string{"zen.example", ".other.example."}, 10, 50*time.Millisecond, time.Hour, defaultDnsblHeader)
+	checker.resolver = resolver
+	now := time.Now()
+
+	listed, ok := checker.lookup(context.Background(), net.ParseIP("192.0.2.1"), now)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{"zen.example", "other.example"}, listed)
+	assert.Equal(t, 2, resolver.count())
+	listed, ok = checker.lookup(context.Background(), net.ParseIP("192.0.2.1"), now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Len(t, listed, 2)
+	assert.Equal(t, 2, resolver.count(), "answers are cached")
+	assert.Len(t, checker.cached(net.ParseIP("192.0.2.1"), now), 2)
+
+	start := time.Now()
+	listed, ok = checker.lookup(context.Background(), net.ParseIP("192.0.2.2"), now)
+	assert.False(t, ok)
+	assert.Empty(t, listed, "lookups fail open")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	checker.lookup(context.Background(), net.ParseIP("192.0.2.2"), now.Add(dnsblFailureTtl/2))
+	assert.Equal(t, 4, resolver.count(), "failures are cached")
+	checker.lookup(context.Background(), net.ParseIP("192.0.2.2"), now.Add(dnsblFailureTtl))
+	assert.Equal(t, 6, resolver.count(), "failures are cached briefly")
+
+	checker.expire(now.Add(2 * time.Hour))
+	assert.Empty(t, checker.cache)
+}
+
+func TestModsecurity_Dnsbl(t *testing.T) {
+	var wafListed []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafListed = append(wafListed, r.Header.Get(defaultDnsblHeader))
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.DnsblZones = []string{"zen.example"}
+	config.DnsblTimeout = "50ms"
+	config.Decision = &DecisionConfig{Type: "any", Policies: []DecisionConfig{{Type: "status"}, {Type: "risk", Threshold: 10}}}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	middleware.dnsbl.resolver = &fakeResolver{
+		answers: map[string][]string{"1.2.0.192.zen.example": {"127.0.0.2"}},
+		slow:    map[string]bool{"3.2.0.192.zen.example": true},
+	}
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(defaultDnsblHeader, "forged")
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234"), "listed clients reach the risk threshold")
+	assert.Equal(t, http.StatusOK, serve("192.0.2.2:1234"))
+	assert.Equal(t, http.StatusOK, serve("192.0.2.3:1234"), "slow resolvers fail open")
+	assert.Equal(t, []string{"zen.example", "", ""}, wafListed)
+	assert.Contains(t, buf.String(), "event=dnsbl_lookup_failed")
+}
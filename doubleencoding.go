@@ -0,0 +1,62 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Values accepted in doubleEncodingPolicy.
+const (
+	doubleEncodingPolicyOff    = "off"
+	doubleEncodingPolicyDecode = "decode"
+	doubleEncodingPolicyReject = "reject"
+)
+
+func validateDoubleEncodingPolicy(policy string) error {
+	switch policy {
+	case "", doubleEncodingPolicyOff, doubleEncodingPolicyDecode, doubleEncodingPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("invalid doubleEncodingPolicy %q, expected %s, %s or %s", policy, doubleEncodingPolicyOff, doubleEncodingPolicyDecode, doubleEncodingPolicyReject)
+}
+
+// isDoubleEncoded reports whether uri holds a percent-encoded percent-encoding, e.g. %252e: once
+// decoded by the WAF it is still encoded, and slips past the rules decoding the target once.
+func isDoubleEncoded(uri string) bool {
+	for i := strings.Index(uri, "%25"); i >= 0; i = strings.Index(uri, "%25") {
+		uri = uri[i+3:]
+		if len(uri) >= 2 && isHex(uri[0]) && isHex(uri[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// collapseEncoding decodes the nested percent-encodings of uri down to a single one, e.g.
+// %25252e to %2e, so that the WAF decoding the target once sees the payload.
+func collapseEncoding(uri string) string {
+	for isDoubleEncoded(uri) {
+		var collapsed strings.Builder
+		for i := 0; i < len(uri); i++ {
+			if strings.HasPrefix(uri[i:], "%25") && i+4 < len(uri) && isHex(uri[i+3]) && isHex(uri[i+4]) {
+				collapsed.WriteByte('%')
+				i += 2
+				continue
+			}
+			collapsed.WriteByte(uri[i])
+		}
+		uri = collapsed.String()
+	}
+	return uri
+}
+
+// checkDoubleEncoding rejects the requests whose target is double encoded, with the reject
+// doubleEncodingPolicy. It reports whether the request was rejected.
+func (a *Modsecurity) checkDoubleEncoding(rw http.ResponseWriter, req *http.Request) bool {
+	if a.doubleEncodingPolicy != doubleEncodingPolicyReject || !isDoubleEncoded(wafRequestURI(req)) {
+		return false
+	}
+	a.blockLocally(rw, req, "double percent-encoding", http.StatusBadRequest)
+	return true
+}
@@ -0,0 +1,64 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollapseEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		uri    string
+		double bool
+		expect string
+	}{
+		{name: "Plain", uri: "/a/b?c=d", expect: "/a/b?c=d"},
+		{name: "Single encoding", uri: "/a%2Fb?q=100%25", expect: "/a%2Fb?q=100%25"},
+		{name: "Double encoded traversal", uri: "/files/%252e%252e%252fetc", double: true, expect: "/files/%2e%2e%2fetc"},
+		{name: "Triple encoding", uri: "/q?id=%2525273", double: true, expect: "/q?id=%273"},
+		{name: "Encoded percent sign", uri: "/q?discount=50%25off", expect: "/q?discount=50%25off"},
+		{name: "Truncated", uri: "/q?a=%252", expect: "/q?a=%252"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.double, isDoubleEncoded(tt.uri))
+			assert.Equal(t, tt.expect, collapseEncoding(tt.uri))
+		})
+	}
+}
+
+func TestModsecurity_DoubleEncodingPolicy(t *testing.T) {
+	var wafURI string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafURI = r.RequestURI
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.DoubleEncodingPolicy = doubleEncodingPolicyDecode
+	var serviceURI string
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceURI = r.RequestURI
+	}))
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/files/%252e%252e%252fetc", nil))
+	assert.Equal(t, "/files/%2e%2e%2fetc", wafURI)
+	assert.Equal(t, "/files/%252e%252e%252fetc", serviceURI, "the service receives the original target")
+
+	config.DoubleEncodingPolicy = doubleEncodingPolicyReject
+	middleware = newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/q?id=%2527", nil))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/q?id=100%25", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	config.DoubleEncodingPolicy = "log"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.EqualError(t, err, `invalid doubleEncodingPolicy "log", expected off, decode or reject`)
+}
@@ -0,0 +1,121 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Degraded modes accepted in errorBudgetMode.
+const (
+	errorBudgetFailOpen = "fail-open"
+	errorBudgetDetect   = "detect"
+	errorBudgetBypass   = "bypass"
+)
+
+// Transitions returned by errorBudget.
+const (
+	errorBudgetExhausted = "error_budget_exhausted"
+	errorBudgetRestored  = "error_budget_restored"
+)
+
+// errorBudget tracks the rate of the requests failing in the plugin itself (panics, WAF failures
+// and timeouts) over fixed windows. Once a window holding at least minRequests exceeds the budget,
+// the middleware switches to the degraded mode: WAF failures forward the requests (fail-open),
+// blocks are only logged (detect) or requests are forwarded without inspection (bypass). It
+// switches back at the end of the first window within the budget.
+type errorBudget struct {
+	budget      float64
+	window      time.Duration
+	minRequests int64
+	mode        string
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int64
+	failures    int64
+	// exhausted is read without the lock by the requests.
+	exhausted int32
+}
+
+func newErrorBudget(budget float64, window time.Duration, minRequests int, mode string) (*errorBudget, error) {
+	if budget == 0 {
+		return nil, nil
+	}
+	if budget < 0 || budget >= 1 {
+		return nil, fmt.Errorf("invalid errorBudget %v, expected a value in ]0, 1[", budget)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("errorBudgetWindow must be positive")
+	}
+	if minRequests < 0 {
+		return nil, fmt.Errorf("errorBudgetMinRequests can't be negative")
+	}
+	switch mode {
+	case errorBudgetFailOpen, errorBudgetDetect, errorBudgetBypass:
+	default:
+		return nil, fmt.Errorf("invalid errorBudgetMode %q, expected %s, %s or %s", mode, errorBudgetFailOpen, errorBudgetDetect, errorBudgetBypass)
+	}
+	return &errorBudget{budget: budget, window: window, minRequests: int64(minRequests), mode: mode}, nil
+}
+
+// record counts a request, failed or not, and returns the transition it caused, empty when the
+// mode is unchanged, with the requests and failures of the window which caused it.
+func (b *errorBudget) record(failed bool, now time.Time) (string, int64, int64) {
+	if b == nil {
+		return "", 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Sub(b.windowStart) >= b.window {
+		requests, failures := b.requests, b.failures
+		b.windowStart, b.requests, b.failures = now, 0, 0
+		if atomic.LoadInt32(&b.exhausted) == 1 && !b.overBudget(requests, failures) {
+			atomic.StoreInt32(&b.exhausted, 0)
+			return errorBudgetRestored, requests, failures
+		}
+	}
+	if failed {
+		// the request was counted when it came in
+		b.failures++
+	} else {
+		b.requests++
+	}
+	if atomic.LoadInt32(&b.exhausted) == 0 && b.overBudget(b.requests, b.failures) {
+		atomic.StoreInt32(&b.exhausted, 1)
+		return errorBudgetExhausted, b.requests, b.failures
+	}
+	return "", 0, 0
+}
+
+// overBudget reports whether a window of requests with failures exceeds the budget.
+func (b *errorBudget) overBudget(requests int64, failures int64) bool {
+	return requests > 0 && requests >= b.minRequests && float64(failures)/float64(requests) > b.budget
+}
+
+// degraded reports whether the budget is exhausted and its degraded mode is mode.
+func (b *errorBudget) degraded(mode string) bool {
+	return b != nil && b.mode == mode && atomic.LoadInt32(&b.exhausted) == 1
+}
+
+// recordBudget records a request in the error budget, announcing the mode switches in the logs
+// and on the chat webhook.
+func (a *Modsecurity) recordBudget(failed bool) {
+	transition, requests, failures := a.errorBudget.record(failed, time.Now())
+	if len(transition) == 0 {
+		return
+	}
+	a.metrics.incErrorBudgetSwitch()
+	a.logEvent(transition, logFields{
+		"mode":     a.errorBudget.mode,
+		"budget":   a.errorBudget.budget,
+		"requests": requests,
+		"failures": failures,
+	})
+	text := fmt.Sprintf("ModSecurity middleware %s exhausted its error budget (%d failures out of %d requests), switching to %s", a.name, failures, requests, a.errorBudget.mode)
+	if transition == errorBudgetRestored {
+		text = fmt.Sprintf("ModSecurity middleware %s is back within its error budget (%d failures out of %d requests), leaving %s", a.name, failures, requests, a.errorBudget.mode)
+	}
+	a.ruleNotifier.announce(text)
+}
@@ -0,0 +1,81 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewErrorBudget(t *testing.T) {
+	budget, err := newErrorBudget(0, time.Minute, 100, errorBudgetFailOpen)
+	assert.NoError(t, err)
+	assert.Nil(t, budget)
+	assert.False(t, budget.degraded(errorBudgetFailOpen))
+	_, err = newErrorBudget(1, time.Minute, 100, errorBudgetFailOpen)
+	assert.EqualError(t, err, "invalid errorBudget 1, expected a value in ]0, 1[")
+	_, err = newErrorBudget(0.1, 0, 100, errorBudgetFailOpen)
+	assert.EqualError(t, err, "errorBudgetWindow must be positive")
+	_, err = newErrorBudget(0.1, time.Minute, 100, "enforce")
+	assert.EqualError(t, err, `invalid errorBudgetMode "enforce", expected fail-open, detect or bypass`)
+}
+
+func TestErrorBudget_record(t *testing.T) {
+	budget, err := newErrorBudget(0.2, time.Minute, 5, errorBudgetBypass)
+	assert.NoError(t, err)
+	now := time.Now()
+
+	for i := 0; i < 4; i++ {
+		transition, _, _ := budget.record(false, now)
+		assert.Empty(t, transition)
+	}
+	transition, _, _ := budget.record(true, now)
+	transition, _, _ = budget.record(true, now)
+	assert.Empty(t, transition, "windows with less than minRequests are never over budget")
+
+	transition, requests, failures := budget.record(false, now)
+	assert.Equal(t, errorBudgetExhausted, transition)
+	assert.Equal(t, int64(5), requests)
+	assert.Equal(t, int64(2), failures)
+	assert.True(t, budget.degraded(errorBudgetBypass))
+	assert.False(t, budget.degraded(errorBudgetDetect))
+
+	transition, _, _ = budget.record(true, now.Add(30*time.Second))
+	assert.Empty(t, transition, "the mode holds until the end of the window")
+
+	transition, requests, failures = budget.record(false, now.Add(time.Minute))
+	assert.Empty(t, transition, "the window ended over budget")
+	for i := 0; i < 9; i++ {
+		transition, _, _ = budget.record(false, now.Add(90*time.Second))
+		assert.Empty(t, transition)
+	}
+	transition, requests, failures = budget.record(false, now.Add(2*time.Minute))
+	assert.Equal(t, errorBudgetRestored, transition)
+	assert.Equal(t, int64(10), requests)
+	assert.Equal(t, int64(0), failures)
+	assert.False(t, budget.degraded(errorBudgetBypass))
+}
+
+func TestModsecurity_ErrorBudget(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.ErrorBudget = 0.5
+	config.ErrorBudgetMinRequests = 2
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes = append(codes, rw.Code)
+	}
+	assert.Equal(t, []int{http.StatusBadGateway, http.StatusOK, http.StatusOK}, codes, "WAF failures fail open once the budget is exhausted")
+	assert.Contains(t, buf.String(), "event=error_budget_exhausted")
+	assert.Equal(t, int64(1), middleware.metrics.snapshot()["error_budget_switches"])
+}
@@ -0,0 +1,114 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// Values accepted in errorResponseFormat.
+const (
+	errorResponseEmpty = "empty"
+	errorResponseJSON  = "json"
+	errorResponseHTML  = "html"
+)
+
+// defaultCorrelationIdHeader carries the correlation ID of the error responses when
+// correlationIdHeader is not set.
+const defaultCorrelationIdHeader = "X-Correlation-Id"
+
+// maxCorrelationIdLength bounds the correlation IDs taken from the requests.
+const maxCorrelationIdLength = 128
+
+const defaultErrorTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>The request could not be processed. Please retry later, or contact the site administrator with the correlation ID <code>{{.CorrelationId}}</code>.</p>
+</body>
+</html>
+`
+
+// errorResponseData is the data of the errorResponseTemplate.
+type errorResponseData struct {
+	Status        int    `json:"status"`
+	StatusText    string `json:"error"`
+	CorrelationId string `json:"correlation_id"`
+}
+
+// errorResponder writes the body of the errors raised by the plugin itself, e.g. a WAF failure
+// or a body over the limit, with the correlation ID logged with the error so that it can be traced.
+// The ID is the value of the correlationIdHeader of the request when it has one, a random one
+// otherwise, and is also sent in that header of the response.
+type errorResponder struct {
+	format   string
+	template *template.Template
+	header   string
+}
+
+func newErrorResponder(format string, tmpl string, header string) (*errorResponder, error) {
+	switch format {
+	case "", errorResponseEmpty:
+		return nil, nil
+	case errorResponseJSON, errorResponseHTML:
+	default:
+		return nil, fmt.Errorf("invalid errorResponseFormat %q, expected %s, %s or %s", format, errorResponseEmpty, errorResponseJSON, errorResponseHTML)
+	}
+	r := &errorResponder{format: format, header: http.CanonicalHeaderKey(header)}
+	if len(r.header) == 0 {
+		r.header = defaultCorrelationIdHeader
+	}
+	if format == errorResponseHTML {
+		if len(tmpl) == 0 {
+			tmpl = defaultErrorTemplate
+		}
+		parsed, err := template.New("error").Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid errorResponseTemplate: %w", err)
+		}
+		r.template = parsed
+	}
+	return r, nil
+}
+
+// correlationID returns the correlation ID of req.
+func (r *errorResponder) correlationID(req *http.Request) string {
+	if id := req.Header.Get(r.header); len(id) > 0 && len(id) <= maxCorrelationIdLength && !containsControlChar(id) {
+		return id
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(random)
+}
+
+// write answers code to req and returns the correlation ID. A nil responder answers an empty body.
+func (r *errorResponder) write(rw http.ResponseWriter, req *http.Request, code int) string {
+	if r == nil {
+		http.Error(rw, "", code)
+		return ""
+	}
+	data := errorResponseData{Status: code, StatusText: http.StatusText(code), CorrelationId: r.correlationID(req)}
+	var body bytes.Buffer
+	contentType := "application/json"
+	if r.format == errorResponseHTML {
+		contentType = "text/html; charset=utf-8"
+		if err := r.template.Execute(&body, data); err != nil {
+			body.Reset()
+		}
+	} else {
+		json.NewEncoder(&body).Encode(data)
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Set(r.header, data.CorrelationId)
+	rw.WriteHeader(code)
+	rw.Write(body.Bytes())
+	return data.CorrelationId
+}
@@ -0,0 +1,88 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewErrorResponder(t *testing.T) {
+	responder, err := newErrorResponder("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, responder, "errors have an empty body by default")
+	responder, err = newErrorResponder(errorResponseEmpty, "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, responder)
+	_, err = newErrorResponder("xml", "", "")
+	assert.EqualError(t, err, `invalid errorResponseFormat "xml", expected empty, json or html`)
+	_, err = newErrorResponder(errorResponseHTML, "{{.Status", "")
+	assert.Error(t, err)
+	responder, err = newErrorResponder(errorResponseJSON, "", "x-request-id")
+	assert.NoError(t, err)
+	assert.Equal(t, "X-Request-Id", responder.header)
+}
+
+func TestErrorResponder_write(t *testing.T) {
+	rw := httptest.NewRecorder()
+	assert.Empty(t, (*errorResponder)(nil).write(rw, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusBadGateway))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, "\n", rw.Body.String())
+
+	responder, _ := newErrorResponder(errorResponseJSON, "", "X-Request-Id")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "req-42")
+	rw = httptest.NewRecorder()
+	assert.Equal(t, "req-42", responder.write(rw, req, http.StatusRequestEntityTooLarge))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "req-42", rw.Header().Get("X-Request-Id"))
+	var data errorResponseData
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &data))
+	assert.Equal(t, errorResponseData{Status: 413, StatusText: "Request Entity Too Large", CorrelationId: "req-42"}, data)
+
+	rw = httptest.NewRecorder()
+	id := responder.write(rw, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusBadGateway)
+	assert.Len(t, id, 32, "a random ID is generated for the requests without one")
+	assert.NotEqual(t, id, responder.write(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), http.StatusBadGateway))
+
+	req.Header.Set("X-Request-Id", strings.Repeat("a", maxCorrelationIdLength+1))
+	assert.Len(t, responder.write(httptest.NewRecorder(), req, http.StatusBadGateway), 32, "oversized IDs are replaced")
+}
+
+func TestErrorResponder_writeHTML(t *testing.T) {
+	responder, err := newErrorResponder(errorResponseHTML, "", "")
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(defaultCorrelationIdHeader, "<script>")
+	rw := httptest.NewRecorder()
+	responder.write(rw, req, http.StatusBadGateway)
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), "<h1>502 Bad Gateway</h1>")
+	assert.Contains(t, rw.Body.String(), "&lt;script&gt;", "the ID taken from the request is escaped")
+
+	responder, err = newErrorResponder(errorResponseHTML, "error {{.Status}}: {{.CorrelationId}}", "")
+	assert.NoError(t, err)
+	req.Header.Set(defaultCorrelationIdHeader, "abc")
+	rw = httptest.NewRecorder()
+	responder.write(rw, req, http.StatusServiceUnavailable)
+	assert.Equal(t, "error 503: abc", rw.Body.String())
+}
+
+func TestModsecurity_ErrorResponseFormat(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.ErrorResponseFormat = errorResponseJSON
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	var data errorResponseData
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &data))
+	assert.Equal(t, http.StatusBadGateway, data.Status)
+	assert.Equal(t, rw.Header().Get(defaultCorrelationIdHeader), data.CorrelationId)
+}
@@ -0,0 +1,156 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Categories of failures when calling the WAF, used in logs, metrics and errorPolicy.
+const (
+	errorCategoryTimeout = "timeout"
+	errorCategoryRefused = "refused"
+	errorCategoryDNS     = "dns"
+	errorCategoryTLS     = "tls"
+	errorCategoryQueue   = "queue"
+	errorCategoryRequest = "request"
+	errorCategoryOther   = "other"
+)
+
+var errorCategories = []string{
+	errorCategoryTimeout,
+	errorCategoryRefused,
+	errorCategoryDNS,
+	errorCategoryTLS,
+	errorCategoryQueue,
+	errorCategoryRequest,
+	errorCategoryOther,
+}
+
+// Values accepted in errorPolicy.
+const (
+	errorPolicyInterrupt = "interrupt"
+	errorPolicyContinue  = "continue"
+)
+
+// wafError is a failure to get a verdict from the WAF.
+type wafError struct {
+	category string
+	message  string
+	err      error
+}
+
+func newWafError(message string, err error) *wafError {
+	return &wafError{category: classifyError(err), message: message, err: err}
+}
+
+func (e *wafError) Error() string {
+	return fmt.Sprintf("%s: %s", e.message, e.err.Error())
+}
+
+func (e *wafError) Unwrap() error {
+	return e.err
+}
+
+// classifyError maps err to one of the error categories, following the Go net error taxonomy.
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case err == errWafQueueFull:
+		return errorCategoryQueue
+	case errors.As(err, &dnsErr):
+		return errorCategoryDNS
+	case errors.As(err, &recordHeaderErr), errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &certificateInvalidErr):
+		return errorCategoryTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return errorCategoryTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorCategoryTimeout
+	// Yaegi has no syscall package to compare with ECONNREFUSED, the dial error is matched by its
+	// message, "connection refused" on Unix and "actively refused" on Windows
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Err != nil && strings.Contains(opErr.Err.Error(), "refused"):
+		return errorCategoryRefused
+	}
+	return errorCategoryOther
+}
+
+// newErrorPolicy validates the errorPolicy configuration: a map of error category to the
+// action taken when the WAF fails with an error of that category.
+func newErrorPolicy(policy map[string]string) (map[string]bool, error) {
+	interrupt := make(map[string]bool, len(policy))
+	for category, action := range policy {
+		if !isErrorCategory(category) {
+			return nil, fmt.Errorf("invalid errorPolicy category %q", category)
+		}
+		switch action {
+		case errorPolicyInterrupt:
+			interrupt[category] = true
+		case errorPolicyContinue:
+			interrupt[category] = false
+		default:
+			return nil, fmt.Errorf("invalid errorPolicy action %q for %s, expected %s or %s", action, category, errorPolicyInterrupt, errorPolicyContinue)
+		}
+	}
+	return interrupt, nil
+}
+
+func isErrorCategory(category string) bool {
+	for _, c := range errorCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWafError handles a failure to get a verdict from the WAF, applying the policy of its category.
+func (a *Modsecurity) handleWafError(rw http.ResponseWriter, req *http.Request, err error) {
+	code, interrupt := a.wafErrorPolicy(req, err)
+	a.interruptOrContinue(rw, req, code, interrupt)
+}
+
+// wafErrorPolicy records the WAF error err and returns the status code of the error response and
+// whether the request must be interrupted.
+func (a *Modsecurity) wafErrorPolicy(req *http.Request, err error) (int, bool) {
+	category := errorCategoryOther
+	var wafErr *wafError
+	if errors.As(err, &wafErr) {
+		category = wafErr.category
+	}
+	a.metrics.incWafError(category)
+
+	interrupt, ok := a.errorPolicy[category]
+	if !ok {
+		interrupt = a.interruptOnError
+	}
+	a.recordBudget(true)
+	if a.errorBudget.degraded(errorBudgetFailOpen) {
+		interrupt = false
+	}
+
+	a.logSampled("waf_error", a.requestFields(req, logFields{
+		"category":  category,
+		"error":     err.Error(),
+		"interrupt": interrupt,
+	}))
+
+	code := http.StatusBadGateway
+	if category == errorCategoryQueue {
+		code = http.StatusServiceUnavailable
+	}
+	return code, interrupt
+}
@@ -0,0 +1,91 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	_, refusedErr := net.Dial("tcp", closedAddr)
+	_, dnsErr := net.LookupHost("does-not-exist.invalid")
+
+	tests := []struct {
+		name   string
+		err    error
+		expect string
+	}{
+		{name: "Connection refused", err: refusedErr, expect: errorCategoryRefused},
+		{name: "Refused message outside a dial", err: &net.OpError{Op: "read", Err: errors.New("connection refused")}, expect: errorCategoryOther},
+		{name: "DNS failure", err: dnsErr, expect: errorCategoryDNS},
+		{name: "Deadline exceeded", err: context.DeadlineExceeded, expect: errorCategoryTimeout},
+		{name: "Queue full", err: errWafQueueFull, expect: errorCategoryQueue},
+		{name: "Unknown", err: assert.AnError, expect: errorCategoryOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, classifyError(tt.err))
+		})
+	}
+}
+
+func TestNewErrorPolicy(t *testing.T) {
+	policy, err := newErrorPolicy(map[string]string{"timeout": "continue", "tls": "interrupt"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"timeout": false, "tls": true}, policy)
+
+	_, err = newErrorPolicy(map[string]string{"unknown": "continue"})
+	assert.Error(t, err)
+	_, err = newErrorPolicy(map[string]string{"timeout": "ignore"})
+	assert.Error(t, err)
+}
+
+func TestModsecurity_ErrorPolicy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	refusedUrl := "http://" + listener.Addr().String()
+	listener.Close()
+
+	slowWaf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slowWaf.Close()
+
+	tests := []struct {
+		name           string
+		url            string
+		policy         map[string]string
+		expectStatus   int
+		expectCategory string
+	}{
+		{name: "Falls back to interruptOnError", url: refusedUrl, expectStatus: http.StatusBadGateway, expectCategory: errorCategoryRefused},
+		{name: "Continues on refused connections", url: refusedUrl, policy: map[string]string{"refused": "continue"}, expectStatus: http.StatusOK, expectCategory: errorCategoryRefused},
+		{name: "Continues on timeouts", url: slowWaf.URL, policy: map[string]string{"timeout": "continue"}, expectStatus: http.StatusOK, expectCategory: errorCategoryTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = tt.url
+			config.ErrorPolicy = tt.policy
+			config.WafTimeout = "100ms"
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, int64(1), middleware.metrics.snapshot()["waf_errors_"+tt.expectCategory])
+		})
+	}
+}
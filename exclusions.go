@@ -0,0 +1,119 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultExclusionsHeader is the request header telling the WAF which CRS exclusion packs to
+// enable. The WAF has to be configured to honor it, e.g. by setting tx.crs_exclusions_wordpress
+// when it contains wordpress, or by enabling the matching CRS rule exclusion plugin.
+const defaultExclusionsHeader = "X-Crs-Exclusions"
+
+// exclusionPacks are the exclusion packs accepted in ExclusionPackRule, named after the CRS
+// application exclusions.
+var exclusionPacks = map[string]bool{
+	"drupal":    true,
+	"grafana":   true,
+	"nextcloud": true,
+	"wordpress": true,
+}
+
+// ExclusionPackRule enables exclusion packs on the requests whose path matches Path, and ignores
+// the verdicts made only of IgnoreRuleIds there, on top of the global ignoreRuleIds.
+type ExclusionPackRule struct {
+	Path          string   `json:"path" description:"path pattern"`
+	Packs         []string `json:"packs,omitempty" description:"drupal, grafana, nextcloud or wordpress"`
+	IgnoreRuleIds []string `json:"ignoreRuleIds,omitempty" description:"rule IDs whose blocks are ignored on the matching paths"`
+}
+
+type compiledExclusionPackRule struct {
+	path          *regexp.Regexp
+	packs         string
+	ignoreRuleIds map[string]bool
+}
+
+// exclusions maps request paths to the exclusion packs communicated to the WAF. The first rule
+// whose path matches applies.
+type exclusions struct {
+	header string
+	rules  []compiledExclusionPackRule
+}
+
+func newExclusions(header string, rules []ExclusionPackRule) (*exclusions, error) {
+	e := &exclusions{header: header}
+	for _, rule := range rules {
+		paths, err := compileRegexps("exclusionPacks", []string{rule.Path})
+		if err != nil {
+			return nil, err
+		}
+		packs := make([]string, 0, len(rule.Packs))
+		for _, pack := range rule.Packs {
+			pack = strings.ToLower(strings.TrimSpace(pack))
+			if !exclusionPacks[pack] {
+				return nil, fmt.Errorf("invalid exclusion pack %q, expected one of %s", pack, strings.Join(exclusionPackNames(), ", "))
+			}
+			packs = append(packs, pack)
+		}
+		e.rules = append(e.rules, compiledExclusionPackRule{
+			path:          paths[0],
+			packs:         strings.Join(packs, ","),
+			ignoreRuleIds: newRuleIdSet(rule.IgnoreRuleIds),
+		})
+	}
+	return e, nil
+}
+
+func exclusionPackNames() []string {
+	names := make([]string, 0, len(exclusionPacks))
+	for name := range exclusionPacks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *exclusions) rule(path string) *compiledExclusionPackRule {
+	for i, rule := range e.rules {
+		if rule.path.MatchString(path) {
+			return &e.rules[i]
+		}
+	}
+	return nil
+}
+
+// apply sets the exclusions header of the WAF request. A value sent by the client is never trusted.
+func (e *exclusions) apply(path string, header http.Header) {
+	if len(e.header) == 0 {
+		return
+	}
+	header.Del(e.header)
+	if rule := e.rule(path); rule != nil && len(rule.packs) > 0 {
+		header.Set(e.header, rule.packs)
+	}
+}
+
+// ignoresRules reports whether rule IDs are ignored on some paths.
+func (e *exclusions) ignoresRules() bool {
+	if e == nil {
+		return false
+	}
+	for _, rule := range e.rules {
+		if len(rule.ignoreRuleIds) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored reports whether the rule id is ignored on path.
+func (e *exclusions) ignored(path string, id string) bool {
+	if e == nil {
+		return false
+	}
+	rule := e.rule(path)
+	return rule != nil && rule.ignoreRuleIds[id]
+}
@@ -0,0 +1,74 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExclusions(t *testing.T) {
+	_, err := newExclusions(defaultExclusionsHeader, []ExclusionPackRule{{Path: "^/", Packs: []string{"joomla"}}})
+	assert.EqualError(t, err, `invalid exclusion pack "joomla", expected one of drupal, grafana, nextcloud, wordpress`)
+
+	_, err = newExclusions(defaultExclusionsHeader, []ExclusionPackRule{{Path: "(", Packs: []string{"wordpress"}}})
+	assert.Error(t, err)
+}
+
+func TestExclusions_apply(t *testing.T) {
+	e, err := newExclusions(defaultExclusionsHeader, []ExclusionPackRule{
+		{Path: "^/blog/", Packs: []string{"WordPress"}},
+		{Path: "^/cloud/", Packs: []string{"nextcloud", "grafana"}},
+		{Path: "^/api/", IgnoreRuleIds: []string{"942100"}},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		path   string
+		expect string
+	}{
+		{path: "/blog/wp-admin", expect: "wordpress"},
+		{path: "/cloud/files", expect: "nextcloud,grafana"},
+		{path: "/api/users"},
+		{path: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			header := http.Header{defaultExclusionsHeader: []string{"forged"}}
+			e.apply(tt.path, header)
+			assert.Equal(t, tt.expect, header.Get(defaultExclusionsHeader))
+		})
+	}
+
+	assert.True(t, e.ignoresRules())
+	assert.True(t, e.ignored("/api/users", "942100"))
+	assert.False(t, e.ignored("/blog/", "942100"))
+	var none *exclusions
+	assert.False(t, none.ignoresRules())
+}
+
+func TestModsecurity_ExclusionPacks(t *testing.T) {
+	var wafExclusions string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafExclusions = r.Header.Get(defaultExclusionsHeader)
+		w.Header().Set("X-Waf-Rule-Ids", "942100")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ExclusionPacks = []ExclusionPackRule{{Path: "^/grafana/", Packs: []string{"grafana"}, IgnoreRuleIds: []string{"942100"}}}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/grafana/api/ds/query", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "grafana", wafExclusions)
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/login", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Empty(t, wafExclusions)
+}
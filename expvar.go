@@ -0,0 +1,49 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"expvar"
+	"runtime/pprof"
+	"sync"
+)
+
+// expvarName is the expvar variable holding the counters of every middleware instance, by name.
+const expvarName = "traefik_modsecurity"
+
+// expvarRegistry maps the middleware names to the metrics published under expvarName. It is
+// updated when a configuration reload creates a new instance, expvar variables can't be unpublished.
+var expvarRegistry = struct {
+	sync.Mutex
+	once    sync.Once
+	metrics map[string]*metrics
+}{metrics: map[string]*metrics{}}
+
+// publishExpvar publishes m under expvarName, as the counters of the middleware named name.
+func publishExpvar(name string, m *metrics) {
+	expvarRegistry.once.Do(func() {
+		expvar.Publish(expvarName, expvar.Func(expvarSnapshot))
+	})
+	expvarRegistry.Lock()
+	defer expvarRegistry.Unlock()
+	expvarRegistry.metrics[name] = m
+}
+
+func expvarSnapshot() interface{} {
+	expvarRegistry.Lock()
+	defer expvarRegistry.Unlock()
+	snapshot := make(map[string]map[string]int64, len(expvarRegistry.metrics))
+	for name, m := range expvarRegistry.metrics {
+		snapshot[name] = m.snapshot()
+	}
+	return snapshot
+}
+
+// withPprofLabels runs f with pprof labels identifying the middleware and the phase, so that CPU
+// profiles tell where time goes inside the middleware.
+func (a *Modsecurity) withPprofLabels(ctx context.Context, phase string, f func(context.Context)) {
+	if !a.pprofLabels {
+		f(ctx)
+		return
+	}
+	pprof.Do(ctx, pprof.Labels("middleware", a.name, "phase", phase), f)
+}
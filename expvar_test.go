@@ -0,0 +1,53 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ExpvarMetrics(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ExpvarMetrics = true
+	// a configuration reload creates the middleware again with the same name
+	newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	variable := expvar.Get(expvarName)
+	assert.NotNil(t, variable)
+	var published map[string]map[string]int64
+	assert.NoError(t, json.Unmarshal([]byte(variable.String()), &published))
+	assert.Equal(t, int64(1), published["modsecurity-middleware"][`waf_duration_ms_count{route="other"}`])
+}
+
+func TestModsecurity_WithPprofLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels bool
+		expect string
+	}{
+		{name: "Disabled", expect: ""},
+		{name: "Enabled", labels: true, expect: "waf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Modsecurity{name: "waf", pprofLabels: tt.labels}
+			var phase string
+			a.withPprofLabels(context.Background(), "waf", func(ctx context.Context) {
+				phase, _ = pprof.Label(ctx, "phase")
+			})
+			assert.Equal(t, tt.expect, phase)
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocols accepted in backendProtocol.
+const (
+	backendProtocolHTTP     = "http"
+	backendProtocolExtAuthz = "ext_authz"
+	backendProtocolIcap     = "icap"
+	backendProtocolChannel  = "channel"
+	backendProtocolAgent    = "agent"
+)
+
+// extAuthzCheckPath is the gRPC method of the Envoy ext_authz v3 API.
+const extAuthzCheckPath = "/envoy.service.auth.v3.Authorization/Check"
+
+// extAuthzMaxResponse bounds the size of the CheckResponse messages read from the service.
+const extAuthzMaxResponse = 1024 * 1024
+
+// errExtAuthzMalformed is returned for gRPC responses which are not a valid CheckResponse.
+var errExtAuthzMalformed = errors.New("ext_authz: malformed response")
+
+func validateBackendProtocol(protocol string, url string) error {
+	switch protocol {
+	case "", backendProtocolHTTP:
+		return nil
+	case backendProtocolExtAuthz:
+		// the standard library, the only one available to plugins, speaks HTTP/2 over TLS only
+		if !strings.HasPrefix(strings.ToLower(url), "https://") {
+			return fmt.Errorf("backendProtocol %s requires an https URL, HTTP/2 is only negotiated over TLS", protocol)
+		}
+		return nil
+	case backendProtocolIcap:
+		if !strings.HasPrefix(strings.ToLower(url), "icap://") {
+			return fmt.Errorf("backendProtocol %s requires an icap URL", protocol)
+		}
+		return nil
+	case backendProtocolChannel:
+		if !strings.HasPrefix(strings.ToLower(url), "channel://") {
+			return fmt.Errorf("backendProtocol %s requires a channel URL", protocol)
+		}
+		return nil
+	case backendProtocolAgent:
+		if !strings.HasPrefix(strings.ToLower(url), "unix://") {
+			return fmt.Errorf("backendProtocol %s requires a unix URL", protocol)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid backendProtocol %q, expected %s, %s, %s, %s or %s", protocol, backendProtocolHTTP, backendProtocolExtAuthz, backendProtocolIcap, backendProtocolChannel, backendProtocolAgent)
+	}
+}
+
+// checkExtAuthz submits proxyReq, the copy of req prepared for the WAF, to the Envoy ext_authz
+// gRPC service at baseURL. The CheckResponse is turned into the equivalent WAF response: 200 when
+// the request is allowed, the status, headers and body of the denied response otherwise, so that
+// the rest of the plugin handles both protocols alike.
+func (a *Modsecurity) checkExtAuthz(baseURL string, req *http.Request, proxyReq *http.Request) (*http.Response, error) {
+	message, err := a.extAuthzCheckRequest(req, proxyReq)
+	if err != nil {
+		return nil, &wafError{category: errorCategoryRequest, message: "fail to prepare ext_authz request", err: err}
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	grpcReq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(baseURL, "/")+extAuthzCheckPath, bytes.NewReader(frame))
+	if err != nil {
+		return nil, &wafError{category: errorCategoryRequest, message: "fail to prepare ext_authz request", err: err}
+	}
+	grpcReq.Header.Set("Content-Type", "application/grpc")
+	grpcReq.Header.Set("Te", "trailers")
+	resp, err := a.sendToWaf(req, grpcReq, a.httpClient)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	verdict, err := readExtAuthzResponse(resp)
+	if err != nil {
+		return nil, newWafError("fail to check the request with ext_authz", err)
+	}
+	return verdict, nil
+}
+
+// extAuthzCheckRequest encodes the CheckRequest describing proxyReq. Bodies larger than maxBodySize
+// are truncated, which is flagged with the x-envoy-auth-partial-body header as Envoy does.
+func (a *Modsecurity) extAuthzCheckRequest(req *http.Request, proxyReq *http.Request) ([]byte, error) {
+	var body []byte
+	partial := false
+	if proxyReq.Body != nil && proxyReq.Body != http.NoBody {
+		// spooled bodies may exceed maxBodySize, they are not sent whole in a single message
+		var reader io.Reader = proxyReq.Body
+		if a.maxBodySize > 0 {
+			reader = io.LimitReader(reader, a.maxBodySize+1)
+		}
+		var err error
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+		if a.maxBodySize > 0 && int64(len(body)) > a.maxBodySize {
+			body, partial = body[:a.maxBodySize], true
+		}
+	}
+
+	var httpReq protoBuffer
+	httpReq.string(2, proxyReq.Method)
+	for _, name := range sortedHeaderNames(proxyReq.Header) {
+		var entry protoBuffer
+		entry.string(1, strings.ToLower(name))
+		entry.string(2, strings.Join(proxyReq.Header[name], ","))
+		httpReq.bytes(3, entry)
+	}
+	if partial {
+		var entry protoBuffer
+		entry.string(1, "x-envoy-auth-partial-body")
+		entry.string(2, "true")
+		httpReq.bytes(3, entry)
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	httpReq.string(4, a.wafURI(req))
+	httpReq.string(5, req.Host)
+	httpReq.string(6, scheme)
+	size := int64(len(body))
+	if partial || proxyReq.ContentLength < 0 {
+		size = -1
+	}
+	httpReq.uint(9, uint64(size))
+	httpReq.string(10, req.Proto)
+	httpReq.bytes(12, body)
+
+	now := time.Now()
+	var timestamp protoBuffer
+	timestamp.uint(1, uint64(now.Unix()))
+	timestamp.uint(2, uint64(now.Nanosecond()))
+	var request protoBuffer
+	request.bytes(1, timestamp)
+	request.bytes(2, httpReq)
+
+	var attributes protoBuffer
+	attributes.bytes(1, extAuthzPeer(req.RemoteAddr))
+	attributes.bytes(4, request)
+	var check protoBuffer
+	check.bytes(1, attributes)
+	return check, nil
+}
+
+// extAuthzPeer encodes the Peer whose socket address is addr.
+func extAuthzPeer(addr string) protoBuffer {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	var socket protoBuffer
+	socket.string(2, host)
+	if portValue, err := strconv.ParseUint(port, 10, 32); err == nil {
+		socket.uint(3, portValue)
+	}
+	var address protoBuffer
+	address.bytes(1, socket)
+	var peer protoBuffer
+	peer.bytes(1, address)
+	return peer
+}
+
+// readExtAuthzResponse decodes the CheckResponse answered in resp.
+func readExtAuthzResponse(resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(resp.Body, extAuthzMaxResponse))
+	if err != nil {
+		return nil, err
+	}
+	// the status is in the trailers, or in the headers of trailers-only responses
+	status := resp.Trailer.Get("Grpc-Status")
+	if len(status) == 0 {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if len(message) == 0 {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return nil, fmt.Errorf("grpc-status %s: %s", status, message)
+	}
+	if len(payload) < 5 || payload[0] != 0 || int(binary.BigEndian.Uint32(payload[1:5])) != len(payload)-5 {
+		return nil, errExtAuthzMalformed
+	}
+	return parseCheckResponse(payload[5:])
+}
+
+// parseCheckResponse turns a CheckResponse into the equivalent WAF response. The headers of the
+// ok or denied response become its headers, they carry e.g. the rule IDs and the anomaly score.
+func parseCheckResponse(message []byte) (*http.Response, error) {
+	var code uint64
+	var denied, ok []byte
+	err := protoFields(message, func(field int, wireType int, varint uint64, data []byte) error {
+		switch field {
+		case 1:
+			return protoFields(data, func(field int, wireType int, varint uint64, data []byte) error {
+				if field == 1 && wireType == 0 {
+					code = varint
+				}
+				return nil
+			})
+		case 2:
+			denied = data
+		case 3:
+			ok = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+	if code == 0 {
+		err = protoFields(ok, func(field int, wireType int, varint uint64, data []byte) error {
+			if field == 2 {
+				return addHeaderValueOption(resp.Header, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	resp.StatusCode = http.StatusForbidden
+	var body string
+	err = protoFields(denied, func(field int, wireType int, varint uint64, data []byte) error {
+		switch field {
+		case 1:
+			return protoFields(data, func(field int, wireType int, varint uint64, data []byte) error {
+				if field == 1 && wireType == 0 && varint >= 100 && varint <= 599 {
+					resp.StatusCode = int(varint)
+				}
+				return nil
+			})
+		case 2:
+			return addHeaderValueOption(resp.Header, data)
+		case 3:
+			body = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		resp.Body = ioutil.NopCloser(strings.NewReader(body))
+		resp.ContentLength = int64(len(body))
+	}
+	return resp, nil
+}
+
+// addHeaderValueOption adds the header of a HeaderValueOption message to header.
+func addHeaderValueOption(header http.Header, option []byte) error {
+	return protoFields(option, func(field int, wireType int, varint uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var key, value string
+		err := protoFields(data, func(field int, wireType int, varint uint64, data []byte) error {
+			switch field {
+			case 1:
+				key = string(data)
+			case 2, 3:
+				value = string(data)
+			}
+			return nil
+		})
+		if err == nil && len(key) > 0 {
+			header.Add(key, value)
+		}
+		return err
+	})
+}
+
+// protoBuffer encodes a protobuf message. Only the wire types used by the ext_authz API are
+// supported, and zero values are omitted as proto3 does.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+// uint encodes a varint field.
+func (b *protoBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+// bytes encodes a length-delimited field: bytes, string or embedded message.
+func (b *protoBuffer) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+// protoFields calls f with the fields of the protobuf message b, in order. varint holds the value
+// of varint fields and data the content of length-delimited fields, fixed-size fields are skipped.
+func protoFields(b []byte, f func(field int, wireType int, varint uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errExtAuthzMalformed
+		}
+		b = b[n:]
+		field, wireType := int(key>>3), int(key&7)
+		var varint uint64
+		var data []byte
+		switch wireType {
+		case 0:
+			if varint, n = binary.Uvarint(b); n <= 0 {
+				return errExtAuthzMalformed
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return errExtAuthzMalformed
+			}
+			b = b[size:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errExtAuthzMalformed
+			}
+			data, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return errExtAuthzMalformed
+		}
+		if err := f(field, wireType, varint, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBackendProtocol(t *testing.T) {
+	assert.NoError(t, validateBackendProtocol("", "http://waf"))
+	assert.NoError(t, validateBackendProtocol(backendProtocolHTTP, "http://waf"))
+	assert.NoError(t, validateBackendProtocol(backendProtocolExtAuthz, "https://authz:9001"))
+	assert.EqualError(t, validateBackendProtocol(backendProtocolExtAuthz, "http://authz:9001"), "backendProtocol ext_authz requires an https URL, HTTP/2 is only negotiated over TLS")
+	assert.NoError(t, validateBackendProtocol(backendProtocolIcap, "icap://waf:1344/reqmod"))
+	assert.EqualError(t, validateBackendProtocol(backendProtocolIcap, "http://waf"), "backendProtocol icap requires an icap URL")
+	assert.NoError(t, validateBackendProtocol(backendProtocolChannel, "channel://waf-agent:9000"))
+	assert.EqualError(t, validateBackendProtocol(backendProtocolChannel, "http://waf"), "backendProtocol channel requires a channel URL")
+	assert.NoError(t, validateBackendProtocol(backendProtocolAgent, "unix:///run/waf-agent.sock"))
+	assert.EqualError(t, validateBackendProtocol(backendProtocolAgent, "http://waf"), "backendProtocol agent requires a unix URL")
+	assert.EqualError(t, validateBackendProtocol("soap", "http://waf"), `invalid backendProtocol "soap", expected http, ext_authz, icap, channel or agent`)
+}
+
+// extAuthzRequest is the part of a CheckRequest decoded by the fake ext_authz service.
+type extAuthzRequest struct {
+	method  string
+	path    string
+	host    string
+	headers map[string]string
+	body    string
+	source  string
+}
+
+// protoField returns the content of the length-delimited field at path, each number selecting a
+// field of the message nested in the previous one.
+func protoField(t *testing.T, message []byte, path ...int) []byte {
+	for _, number := range path {
+		var found []byte
+		assert.NoError(t, protoFields(message, func(field int, wireType int, varint uint64, data []byte) error {
+			if field == number && found == nil {
+				found = data
+			}
+			return nil
+		}))
+		message = found
+	}
+	return message
+}
+
+func decodeCheckRequest(t *testing.T, message []byte) extAuthzRequest {
+	decoded := extAuthzRequest{
+		headers: map[string]string{},
+		source:  string(protoField(t, message, 1, 1, 1, 1, 2)),
+	}
+	httpReq := protoField(t, message, 1, 4, 2)
+	assert.NoError(t, protoFields(httpReq, func(field int, wireType int, varint uint64, data []byte) error {
+		switch field {
+		case 2:
+			decoded.method = string(data)
+		case 3:
+			decoded.headers[string(protoField(t, data, 1))] = string(protoField(t, data, 2))
+		case 4:
+			decoded.path = string(data)
+		case 5:
+			decoded.host = string(data)
+		case 12:
+			decoded.body = string(data)
+		}
+		return nil
+	}))
+	return decoded
+}
+
+func headerValueOption(key string, value string) protoBuffer {
+	var header protoBuffer
+	header.string(1, key)
+	header.string(2, value)
+	var option protoBuffer
+	option.bytes(1, header)
+	return option
+}
+
+// newExtAuthzServer starts a fake ext_authz service over HTTP/2, denying the requests to /admin
+// with rule 942100 and allowing the others with an anomaly score of 2.
+func newExtAuthzServer(t *testing.T, requests chan<- extAuthzRequest) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		assert.Equal(t, extAuthzCheckPath, r.URL.Path)
+		assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+		frame, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		check := decodeCheckRequest(t, frame[5:])
+		requests <- check
+
+		var response protoBuffer
+		if strings.HasPrefix(check.path, "/admin") {
+			var code protoBuffer
+			code.uint(1, 7)
+			var status protoBuffer
+			status.uint(1, http.StatusNotAcceptable)
+			var denied protoBuffer
+			denied.bytes(1, status)
+			denied.bytes(2, headerValueOption(defaultRuleIdsHeader, "942100"))
+			denied.string(3, "denied")
+			response.bytes(1, code)
+			response.bytes(2, denied)
+		} else {
+			var ok protoBuffer
+			ok.bytes(2, headerValueOption(defaultAnomalyScoreHeader, "2"))
+			response.bytes(3, ok)
+		}
+		reply := make([]byte, 5, 5+len(response))
+		binary.BigEndian.PutUint32(reply[1:], uint32(len(response)))
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(append(reply, response...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestModsecurity_ExtAuthz(t *testing.T) {
+	requests := make(chan extAuthzRequest, 1)
+	server := newExtAuthzServer(t, requests)
+
+	var result *InspectionResult
+	config := CreateConfig()
+	config.ModSecurityUrl = server.URL
+	config.BackendProtocol = backendProtocolExtAuthz
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, _ = InspectionResultFromContext(r.Context())
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, `{"user":"john"}`, string(body))
+	}))
+	middleware.httpClient = server.Client()
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/users?page=2", strings.NewReader(`{"user":"john"}`))
+	req.Header.Set("Content-Type", "application/json")
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, extAuthzRequest{
+		method:  http.MethodPost,
+		path:    "/api/users?page=2",
+		host:    "example.com",
+		headers: map[string]string{"content-length": "15", "content-type": "application/json"},
+		body:    `{"user":"john"}`,
+		source:  "192.0.2.1",
+	}, <-requests)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, 2.0, result.Score)
+	}
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	<-requests
+	assert.Equal(t, http.StatusNotAcceptable, rw.Code)
+	assert.Equal(t, "denied", rw.Body.String())
+	assert.Equal(t, "942100", rw.Header().Get(defaultRuleIdsHeader))
+}
+
+func TestReadExtAuthzResponse_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		header  http.Header
+		trailer http.Header
+		body    string
+		expect  string
+	}{
+		{name: "HTTP error", status: http.StatusServiceUnavailable, expect: "unexpected status 503"},
+		{name: "gRPC error", status: http.StatusOK, header: http.Header{"Grpc-Status": {"14"}, "Grpc-Message": {"unavailable"}}, expect: "grpc-status 14: unavailable"},
+		{name: "gRPC error in trailers", status: http.StatusOK, trailer: http.Header{"Grpc-Status": {"16"}}, expect: "grpc-status 16: "},
+		{name: "Malformed frame", status: http.StatusOK, header: http.Header{"Grpc-Status": {"0"}}, body: "\x00\x00\x00\x00\x09abc", expect: errExtAuthzMalformed.Error()},
+		{name: "Malformed message", status: http.StatusOK, header: http.Header{"Grpc-Status": {"0"}}, body: "\x00\x00\x00\x00\x02\x12\x05", expect: errExtAuthzMalformed.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.header == nil {
+				tt.header = http.Header{}
+			}
+			_, err := readExtAuthzResponse(&http.Response{
+				StatusCode: tt.status,
+				Header:     tt.header,
+				Trailer:    tt.trailer,
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			})
+			assert.EqualError(t, err, tt.expect)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"strings"
+)
+
+// requestFailures collects the failures of the subsystems involved in one request, so that
+// several failures (e.g. the bot-detection service and the WAF both timing out) are reported
+// together instead of only the first one.
+type requestFailures struct {
+	failures []failure
+}
+
+type failure struct {
+	subsystem string
+	err       error
+}
+
+func (f *requestFailures) add(subsystem string, err error) {
+	f.failures = append(f.failures, failure{subsystem: subsystem, err: err})
+}
+
+// Error returns every cause, in order of occurrence.
+func (f *requestFailures) Error() string {
+	causes := make([]string, 0, len(f.failures))
+	for _, failure := range f.failures {
+		causes = append(causes, failure.subsystem+": "+failure.err.Error())
+	}
+	return strings.Join(causes, "; ")
+}
+
+func (f *requestFailures) subsystems() string {
+	subsystems := make([]string, 0, len(f.failures))
+	for _, failure := range f.failures {
+		subsystems = append(subsystems, failure.subsystem)
+	}
+	return strings.Join(subsystems, ",")
+}
+
+// logFailures reports the failures of req in a single event when several subsystems failed.
+// Single failures are already reported by the event of their subsystem.
+func (a *Modsecurity) logFailures(req *http.Request, failures *requestFailures) {
+	if len(failures.failures) < 2 {
+		return
+	}
+	a.logEvent("request_failures", a.requestFields(req, logFields{
+		"count":      len(failures.failures),
+		"subsystems": failures.subsystems(),
+		"causes":     failures.Error(),
+	}))
+}
@@ -0,0 +1,55 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestFailures(t *testing.T) {
+	failures := &requestFailures{}
+	failures.add("botscore", errors.New("connection refused"))
+	failures.add("waf", newWafError("fail to send HTTP request to modsec", errors.New("timeout")))
+
+	assert.Equal(t, "botscore: connection refused; waf: fail to send HTTP request to modsec: timeout", failures.Error())
+	assert.Equal(t, "botscore,waf", failures.subsystems())
+}
+
+func TestModsecurity_AggregatesFailures(t *testing.T) {
+	slowWaf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slowWaf.Close()
+	botScoreServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer botScoreServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = slowWaf.URL
+	config.WafTimeout = "20ms"
+	config.BotScoreUrl = botScoreServer.URL
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var logs bytes.Buffer
+	middleware.logger = log.New(&logs, "", 0)
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var aggregated []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.HasPrefix(line, "ModSecurity event=request_failures ") {
+			aggregated = append(aggregated, line)
+		}
+	}
+	assert.Len(t, aggregated, 1)
+	assert.Contains(t, aggregated[0], "count=2")
+	assert.Contains(t, aggregated[0], "subsystems=botscore,waf")
+	assert.Contains(t, aggregated[0], "unexpected status 500")
+}
@@ -0,0 +1,107 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// writableDir returns an error when no file can be created in dir, e.g. on the read-only root
+// filesystem of a distroless Traefik image. The empty dir is the temporary directory of the system.
+func writableDir(dir string) error {
+	probe, err := ioutil.TempFile(dir, ".modsecurity-probe-")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	probe.Close()
+	return os.Remove(name)
+}
+
+// spoolDir returns the directory of the spooled bodies.
+func (a *Modsecurity) spoolDir() string {
+	if len(a.tempDirectory) > 0 {
+		return a.tempDirectory
+	}
+	return os.TempDir()
+}
+
+// applyStatelessMode disables the features using the local disk, for read-only deployments:
+// spooling, the debug dumps, the replay export to a directory, the metrics state file and the
+// watch of the TLS files, whose content loaded on startup is kept. The disabled features are
+// logged in an event=stateless_mode line.
+func (a *Modsecurity) applyStatelessMode() {
+	var disabled []string
+	if a.spoolToDisk {
+		a.spoolToDisk = false
+		disabled = append(disabled, "spoolToDisk")
+	}
+	if a.debugDumper != nil {
+		atomic.StoreInt64(&a.debugDumper.remaining, 0)
+		disabled = append(disabled, "debugDumpFile")
+	}
+	if a.replayExporter != nil && len(a.replayExporter.dir) > 0 {
+		a.dropReplayExportDir()
+		disabled = append(disabled, "replayExportDir")
+	}
+	if a.metricsState != nil {
+		a.metricsState = nil
+		disabled = append(disabled, "metricsStateFile")
+	}
+	if a.tlsReloader != nil {
+		disabled = append(disabled, "tlsFileWatch")
+	}
+	if len(disabled) == 0 {
+		disabled = append(disabled, "none")
+	}
+	a.logEvent("stateless_mode", logFields{"disabled": strings.Join(disabled, ",")})
+}
+
+// checkFileFeatures disables the features writing to a directory which isn't writable, with an
+// event=file_feature_disabled line each, instead of failing the requests using them. The files
+// read on startup, such as the threat feeds or the OpenAPI specification, fail the configuration
+// when they can't be read.
+func (a *Modsecurity) checkFileFeatures() {
+	if a.spoolToDisk {
+		if err := writableDir(a.spoolDir()); err != nil {
+			a.spoolToDisk = false
+			a.disableFileFeature("spoolToDisk", a.spoolDir(), err)
+		}
+	}
+	if a.debugDumper != nil {
+		if err := writableDir(filepath.Dir(a.debugDumper.file)); err != nil {
+			// the trigger header is still stripped from the WAF copy
+			atomic.StoreInt64(&a.debugDumper.remaining, 0)
+			a.disableFileFeature("debugDumpFile", a.debugDumper.file, err)
+		}
+	}
+	if a.replayExporter != nil && len(a.replayExporter.dir) > 0 {
+		if err := writableDir(a.replayExporter.dir); err != nil {
+			a.disableFileFeature("replayExportDir", a.replayExporter.dir, err)
+			a.dropReplayExportDir()
+		}
+	}
+	if a.metricsState != nil {
+		if err := writableDir(filepath.Dir(a.metricsState.path)); err != nil {
+			// the saved counters are still restored
+			a.metricsState.readOnly = true
+			a.disableFileFeature("metricsStateFile", a.metricsState.path, err)
+		}
+	}
+}
+
+// dropReplayExportDir stops exporting the requests to replayExportDir, they are still uploaded
+// to replayExportUrl when it is set.
+func (a *Modsecurity) dropReplayExportDir() {
+	if len(a.replayExporter.url) == 0 {
+		a.replayExporter = nil
+		return
+	}
+	a.replayExporter.dir = ""
+}
+
+func (a *Modsecurity) disableFileFeature(feature string, path string, err error) {
+	a.logEvent("file_feature_disabled", logFields{"feature": feature, "path": path, "error": err.Error()})
+}
@@ -0,0 +1,103 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritableDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, writableDir(dir))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files, "the probe file is removed")
+	assert.Error(t, writableDir(filepath.Join(dir, "missing")))
+}
+
+func TestModsecurity_checkFileFeatures(t *testing.T) {
+	unwritable := filepath.Join(t.TempDir(), "missing")
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.SpoolToDisk = true
+	config.TempDirectory = unwritable
+	config.MetricsStateFile = filepath.Join(unwritable, "metrics.json")
+	config.DebugDumpFile = filepath.Join(unwritable, "dump.jsonl")
+	config.DebugDumpHeader = "X-Debug"
+	config.DebugDumpToken = "secret"
+	middleware := newTestModsecurity(t, config, nil)
+	defer middleware.Close()
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+	assert.False(t, middleware.spoolToDisk, "the file features are checked on startup")
+
+	middleware.spoolToDisk = true
+	middleware.checkFileFeatures()
+	assert.False(t, middleware.spoolToDisk)
+	assert.True(t, middleware.metricsState.readOnly)
+	assert.Equal(t, int64(0), middleware.debugDumper.remaining)
+	assert.Contains(t, buf.String(), "event=file_feature_disabled")
+	assert.Contains(t, buf.String(), "feature=spoolToDisk")
+	assert.Contains(t, buf.String(), "feature=debugDumpFile")
+	assert.Contains(t, buf.String(), "feature=metricsStateFile")
+	assert.NoError(t, middleware.metricsState.save(middleware.metrics, time.Now()), "the read-only states are not saved")
+
+	middleware.replayExporter = &replayExporter{dir: unwritable, url: "http://store"}
+	middleware.checkFileFeatures()
+	assert.Contains(t, buf.String(), "feature=replayExportDir")
+	if assert.NotNil(t, middleware.replayExporter, "the requests are still uploaded to replayExportUrl") {
+		assert.Empty(t, middleware.replayExporter.dir)
+		assert.Equal(t, "http://store", middleware.replayExporter.url)
+	}
+	middleware.replayExporter = &replayExporter{dir: unwritable}
+	middleware.checkFileFeatures()
+	assert.Nil(t, middleware.replayExporter)
+}
+
+func TestModsecurity_StatelessMode(t *testing.T) {
+	dir := t.TempDir()
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.StatelessMode = true
+	config.SpoolToDisk = true
+	config.MetricsStateFile = filepath.Join(dir, "metrics.json")
+	config.ReplayExportDir = dir
+	middleware := newTestModsecurity(t, config, nil)
+	middleware.Close()
+	assert.False(t, middleware.spoolToDisk)
+	assert.Nil(t, middleware.metricsState)
+	assert.Nil(t, middleware.replayExporter)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files, "nothing is written to disk")
+
+	var uploads int32
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&uploads, 1)
+	}))
+	defer store.Close()
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+	config.ModSecurityUrl = wafServer.URL
+	config.ReplayExportUrl = store.URL
+	middleware = newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	assert.Empty(t, middleware.replayExporter.dir)
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	middleware.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&uploads), "the requests are still uploaded to replayExportUrl")
+	files, _ = ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+
+	var buf bytes.Buffer
+	middleware = &Modsecurity{spoolToDisk: true, logger: log.New(&buf, "", 0)}
+	middleware.applyStatelessMode()
+	assert.Equal(t, "ModSecurity event=stateless_mode disabled=spoolToDisk\n", buf.String())
+}
@@ -0,0 +1,73 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultFingerprintHeader is the request header carrying the client fingerprint to the WAF.
+const defaultFingerprintHeader = "X-Client-Fingerprint"
+
+// userAgentFamilies maps User-Agent substrings to a family, in evaluation order.
+var userAgentFamilies = []struct {
+	token  string
+	family string
+}{
+	{"bot", "bot"},
+	{"spider", "bot"},
+	{"crawl", "bot"},
+	{"curl/", "curl"},
+	{"wget/", "wget"},
+	{"python", "python"},
+	{"go-http-client", "go"},
+	{"java/", "java"},
+	{"edg/", "edge"},
+	{"opr/", "opera"},
+	{"firefox/", "firefox"},
+	{"chrome/", "chrome"},
+	{"safari/", "safari"},
+	{"mozilla/", "mozilla"},
+}
+
+// userAgentFamily returns the family of a User-Agent, "other" when unknown and "none" when empty.
+func userAgentFamily(userAgent string) string {
+	if len(userAgent) == 0 {
+		return "none"
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, f := range userAgentFamilies {
+		if strings.Contains(userAgent, f.token) {
+			return f.family
+		}
+	}
+	return "other"
+}
+
+// clientFingerprint computes a lightweight fingerprint of the client from the set of header
+// names it sent, its primary Accept-Language and its User-Agent family.
+//
+// net/http does not keep the order in which headers were received, so the set of header names
+// is hashed instead of their order.
+func clientFingerprint(req *http.Request) string {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	language := strings.TrimSpace(strings.SplitN(req.Header.Get("Accept-Language"), ",", 2)[0])
+	if i := strings.IndexByte(language, ';'); i >= 0 {
+		language = language[:i]
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(strings.Join(names, ",")))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strings.ToLower(language)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(userAgentFamily(req.UserAgent())))
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
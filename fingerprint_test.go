@@ -0,0 +1,55 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAgentFamily(t *testing.T) {
+	assert.Equal(t, "chrome", userAgentFamily("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0 Safari/537.36"))
+	assert.Equal(t, "edge", userAgentFamily("Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 Chrome/91.0 Safari/537.36 Edg/91.0"))
+	assert.Equal(t, "bot", userAgentFamily("Googlebot/2.1"))
+	assert.Equal(t, "curl", userAgentFamily("curl/7.68.0"))
+	assert.Equal(t, "none", userAgentFamily(""))
+	assert.Equal(t, "other", userAgentFamily("custom-agent"))
+}
+
+func TestClientFingerprint(t *testing.T) {
+	newRequest := func(headers map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req
+	}
+
+	browser := clientFingerprint(newRequest(map[string]string{"User-Agent": "Firefox/89.0", "Accept-Language": "fr-FR,fr;q=0.9"}))
+
+	assert.Len(t, browser, 16)
+	assert.Equal(t, browser, clientFingerprint(newRequest(map[string]string{"User-Agent": "Firefox/90.0", "Accept-Language": "fr-FR"})))
+	assert.NotEqual(t, browser, clientFingerprint(newRequest(map[string]string{"User-Agent": "Firefox/89.0", "Accept-Language": "en-US"})))
+	assert.NotEqual(t, browser, clientFingerprint(newRequest(map[string]string{"User-Agent": "Firefox/89.0", "Accept-Language": "fr-FR", "X-Extra": "1"})))
+}
+
+func TestModsecurity_ClientFingerprint(t *testing.T) {
+	wafFingerprint := ""
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafFingerprint = r.Header.Get(defaultFingerprintHeader)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ClientFingerprint = true
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(defaultFingerprintHeader, "spoofed")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.NotEqual(t, "spoofed", wafFingerprint)
+	assert.Equal(t, clientFingerprint(req), wafFingerprint)
+}
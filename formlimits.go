@@ -0,0 +1,130 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Policies accepted in formDuplicateKeys.
+const (
+	formDuplicatesAllow  = "allow"
+	formDuplicatesReject = "reject"
+)
+
+// formMaxTrackedKey bounds the bytes of a parameter name kept to detect duplicates. Longer names
+// are compared on their first bytes.
+const formMaxTrackedKey = 1024
+
+// formLimits enforces limits on the application/x-www-form-urlencoded bodies before they are sent
+// to the WAF, cheaply mitigating hash-collision and parameter-pollution attacks: the number of
+// parameters, the decoded length of their names and values and the duplicated names. Limits set
+// to zero are disabled. With the reject duplicates policy, the names ending with [] may repeat,
+// they are the arrays of PHP and similar frameworks.
+type formLimits struct {
+	maxParams        int
+	maxKeyLength     int
+	maxValueLength   int
+	rejectDuplicates bool
+}
+
+func newFormLimits(maxParams int, maxKeyLength int, maxValueLength int, duplicateKeys string) (*formLimits, error) {
+	if maxParams < 0 || maxKeyLength < 0 || maxValueLength < 0 {
+		return nil, fmt.Errorf("formMaxParams, formMaxKeyLength and formMaxValueLength can't be negative")
+	}
+	switch duplicateKeys {
+	case "", formDuplicatesAllow, formDuplicatesReject:
+	default:
+		return nil, fmt.Errorf("invalid formDuplicateKeys %q, expected %s or %s", duplicateKeys, formDuplicatesAllow, formDuplicatesReject)
+	}
+	l := &formLimits{
+		maxParams:        maxParams,
+		maxKeyLength:     maxKeyLength,
+		maxValueLength:   maxValueLength,
+		rejectDuplicates: duplicateKeys == formDuplicatesReject,
+	}
+	if *l == (formLimits{}) {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// check returns the limit exceeded by the form body of req, nil when it has none. Of truncated
+// bodies, only the inspected part is checked.
+func (l *formLimits) check(req *http.Request, body *bufferedBody) error {
+	if l == nil || body == nil || body.size == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+	return l.scan(bufio.NewReader(body.wafReader()))
+}
+
+// scan reads the form a byte at a time, without holding its values in memory. Lengths are counted
+// in decoded bytes: a percent-encoded byte counts for one.
+func (l *formLimits) scan(reader *bufio.Reader) error {
+	seen := make(map[string]bool)
+	var key []byte
+	inValue := false
+	params, keyLength, valueLength := 0, 0, 0
+	for {
+		c, err := reader.ReadByte()
+		if err != nil || c == '&' {
+			if keyLength > 0 || inValue {
+				params++
+				if l.maxParams > 0 && params > l.maxParams {
+					return fmt.Errorf("more than %d parameters", l.maxParams)
+				}
+				if l.rejectDuplicates {
+					name, unescapeErr := url.QueryUnescape(string(key))
+					if unescapeErr != nil {
+						name = string(key)
+					}
+					if seen[name] && !strings.HasSuffix(name, "[]") {
+						if len(name) > 64 {
+							name = name[:64]
+						}
+						return fmt.Errorf("duplicate parameter %q", name)
+					}
+					seen[name] = true
+				}
+			}
+			if err != nil {
+				return nil
+			}
+			key, inValue, keyLength, valueLength = key[:0], false, 0, 0
+			continue
+		}
+		if c == '=' && !inValue {
+			inValue = true
+			continue
+		}
+
+		raw := []byte{c}
+		if c == '%' {
+			// the two hexadecimal digits of the encoded byte
+			next, _ := reader.Peek(2)
+			reader.Discard(len(next))
+			raw = append(raw, next...)
+		}
+		if inValue {
+			valueLength++
+			if l.maxValueLength > 0 && valueLength > l.maxValueLength {
+				return fmt.Errorf("parameter value longer than %d bytes", l.maxValueLength)
+			}
+			continue
+		}
+		keyLength++
+		if l.maxKeyLength > 0 && keyLength > l.maxKeyLength {
+			return fmt.Errorf("parameter name longer than %d bytes", l.maxKeyLength)
+		}
+		if l.rejectDuplicates && len(key) < formMaxTrackedKey {
+			key = append(key, raw...)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFormLimits(t *testing.T) {
+	limits, err := newFormLimits(0, 0, 0, "")
+	assert.NoError(t, err)
+	assert.Nil(t, limits, "no limit is enforced by default")
+	limits, err = newFormLimits(0, 0, 0, formDuplicatesAllow)
+	assert.NoError(t, err)
+	assert.Nil(t, limits)
+	_, err = newFormLimits(-1, 0, 0, "")
+	assert.Error(t, err)
+	_, err = newFormLimits(0, 0, 0, "last")
+	assert.EqualError(t, err, `invalid formDuplicateKeys "last", expected allow or reject`)
+}
+
+func TestFormLimits_scan(t *testing.T) {
+	limits := &formLimits{maxParams: 3, maxKeyLength: 8, maxValueLength: 10, rejectDuplicates: true}
+	tests := []struct {
+		name string
+		form string
+		err  string
+	}{
+		{name: "Within limits", form: "name=alice&age=30&city=Paris"},
+		{name: "Empty", form: ""},
+		{name: "Empty segments", form: "a=1&&b=2&"},
+		{name: "Encoded value", form: "q=%41%42%43%44%45%46%47%48%49%4a"},
+		{name: "Too many parameters", form: "a=1&b=2&c=3&d=4", err: "more than 3 parameters"},
+		{name: "Long name", form: "username1=alice", err: "parameter name longer than 8 bytes"},
+		{name: "Long value", form: "q=0123456789a", err: "parameter value longer than 10 bytes"},
+		{name: "Duplicate", form: "role=user&role=admin", err: `duplicate parameter "role"`},
+		{name: "Encoded duplicate", form: "role=user&r%6Fle=admin", err: `duplicate parameter "role"`},
+		{name: "Array", form: "ids[]=1&ids[]=2"},
+		{name: "Names without value", form: "a&b&c&d", err: "more than 3 parameters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := limits.scan(bufio.NewReader(strings.NewReader(tt.form)))
+			if len(tt.err) > 0 {
+				assert.EqualError(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+	assert.NoError(t, (&formLimits{}).scan(bufio.NewReader(strings.NewReader("a=1&a=2"))), "duplicates are allowed by default")
+}
+
+func TestModsecurity_FormLimits(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.FormMaxParams = 2
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		contentType string
+		body        string
+		expect      int
+	}{
+		{contentType: "application/x-www-form-urlencoded", body: "a=1&b=2", expect: http.StatusOK},
+		{contentType: "application/x-www-form-urlencoded; charset=utf-8", body: "a=1&b=2&c=3", expect: http.StatusBadRequest},
+		{contentType: "text/plain", body: "a=1&b=2&c=3", expect: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		assert.Equal(t, tt.expect, rw.Code, tt.contentType)
+	}
+	assert.Equal(t, 2, wafCalls, "the forms exceeding the limits don't reach the WAF")
+}
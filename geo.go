@@ -0,0 +1,112 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// countryLookup looks up the country of clients in a MaxMind country or city database, to enrich
+// the verdict events with the origin of the clients.
+type countryLookup struct {
+	db *mmdbReader
+}
+
+func newCountryLookup(file string) (*countryLookup, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	db, err := openMMDB(file)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open countryDatabase: %w", err)
+	}
+	return &countryLookup{db: db}, nil
+}
+
+// country returns the ISO 3166-1 code of the country of ip, falling back to the country where
+// the network is registered, or an empty string when it is unknown.
+func (c *countryLookup) country(ip net.IP) string {
+	if c == nil || ip == nil {
+		return ""
+	}
+	record, err := c.db.lookup(ip)
+	if err != nil {
+		return ""
+	}
+	fields, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]interface{})
+		if code, _ := country["iso_code"].(string); len(code) > 0 {
+			return code
+		}
+	}
+	return ""
+}
+
+// clientOrigin returns the country and the autonomous system number of the client of req, empty
+// when countryDatabase, respectively asnDatabase, is not configured or the client is unknown.
+func (a *Modsecurity) clientOrigin(req *http.Request) (string, uint) {
+	if a.countryLookup == nil && a.asnPolicies == nil {
+		return "", 0
+	}
+	ip := remoteIP(req)
+	return a.countryLookup.country(ip), a.asnPolicies.asn(ip)
+}
+
+// originFields adds the country and the autonomous system number of the client of req to fields,
+// when the databases are configured.
+func (a *Modsecurity) originFields(req *http.Request, fields logFields) {
+	country, asn := a.clientOrigin(req)
+	if a.countryLookup != nil {
+		fields["country"] = country
+	}
+	if a.asnPolicies != nil {
+		fields["asn"] = asn
+	}
+}
+
+// metricsCountryUnknown is the country of the clients missing from countryDatabase in the metrics.
+const metricsCountryUnknown = "unknown"
+
+// countryCounters counts the blocked requests by country of the client. Countries are a bounded
+// set, the map only grows up to a few hundred entries.
+type countryCounters struct {
+	mu     sync.RWMutex
+	counts map[string]*int64
+}
+
+func (c *countryCounters) inc(country string) {
+	c.add(country, 1)
+}
+
+// add adds n to the counter of country.
+func (c *countryCounters) add(country string, n int64) {
+	if len(country) == 0 {
+		country = metricsCountryUnknown
+	}
+	c.mu.RLock()
+	count, ok := c.counts[country]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if c.counts == nil {
+			c.counts = make(map[string]*int64)
+		}
+		if count, ok = c.counts[country]; !ok {
+			count = new(int64)
+			c.counts[country] = count
+		}
+		c.mu.Unlock()
+	}
+	atomic.AddInt64(count, n)
+}
+
+func (c *countryCounters) snapshot(snapshot map[string]int64, name string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for country, count := range c.counts {
+		snapshot[name+"_"+country] = atomic.LoadInt64(count)
+	}
+}
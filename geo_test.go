@@ -0,0 +1,97 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountryLookup(t *testing.T) {
+	lookup, err := newCountryLookup("")
+	assert.NoError(t, err)
+	assert.Nil(t, lookup)
+	assert.Empty(t, lookup.country(net.ParseIP("192.0.2.1")))
+
+	_, err = newCountryLookup("/does/not/exist.mmdb")
+	assert.Error(t, err)
+
+	lookup, err = newCountryLookup(buildTestMMDB(t, 6, []testAsnNetwork{
+		{cidr: "192.0.2.0/24", asn: 64496, org: "Example Hosting", country: "FR"},
+		{cidr: "198.51.100.0/24", asn: 64497, org: "Example ISP"},
+		{cidr: "2001:db8::/32", asn: 64499, org: "Example VPN", country: "NL"},
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "FR", lookup.country(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, "NL", lookup.country(net.ParseIP("2001:db8::1")))
+	assert.Empty(t, lookup.country(net.ParseIP("198.51.100.1")), "network without country")
+	assert.Empty(t, lookup.country(net.ParseIP("203.0.113.1")), "unknown network")
+	assert.Empty(t, lookup.country(nil))
+}
+
+func TestModsecurity_ClientOrigin(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("attack") == "1" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer wafServer.Close()
+
+	database := buildTestMMDB(t, 6, []testAsnNetwork{
+		{cidr: "192.0.2.0/24", asn: 64496, org: "Example Hosting", country: "FR"},
+	})
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.CountryDatabase = database
+	config.AsnDatabase = database
+	config.AccessLogHeaderPrefix = "X-Waf-"
+	config.AllowedMethods = []MethodRule{{Path: "^/readonly$", Methods: []string{"GET"}}}
+	var result *InspectionResult
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, _ = InspectionResultFromContext(r.Context())
+	}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+	sink := &recordingSink{}
+	middleware.eventSinks = []eventSink{sink}
+
+	serve := func(method string, target string, remoteAddr string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Waf-Country", "forged")
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+		return req
+	}
+
+	req := serve(http.MethodGet, "/", "192.0.2.1:1234")
+	assert.Equal(t, "FR", result.Country)
+	assert.Equal(t, uint(64496), result.Asn)
+	assert.Equal(t, "FR", req.Header.Get("X-Waf-Country"))
+	assert.Equal(t, "64496", req.Header.Get("X-Waf-Asn"))
+
+	req = serve(http.MethodGet, "/?attack=1", "198.51.100.1:1234")
+	assert.Empty(t, req.Header.Get("X-Waf-Country"), "unknown clients have no country")
+	serve(http.MethodPost, "/readonly", "192.0.2.1:1234")
+	assert.Len(t, sink.events, 2)
+	assert.Equal(t, "waf_block", sink.events[0].Event)
+	assert.Empty(t, sink.events[0].Country)
+	assert.Equal(t, "local_block", sink.events[1].Event)
+	assert.Equal(t, "FR", sink.events[1].Country)
+	assert.Equal(t, uint(64496), sink.events[1].Asn)
+
+	snapshot := middleware.metrics.snapshot()
+	assert.Equal(t, int64(1), snapshot["blocked_requests_country_FR"])
+	assert.Equal(t, int64(1), snapshot["blocked_requests_country_"+metricsCountryUnknown])
+
+	fields := middleware.requestFields(req, logFields{})
+	assert.Equal(t, "", fields["country"])
+	assert.Equal(t, uint(0), fields["asn"])
+	req.RemoteAddr = "192.0.2.1:1234"
+	fields = middleware.requestFields(req, logFields{})
+	assert.Equal(t, "FR", fields["country"])
+	assert.Equal(t, uint(64496), fields["asn"])
+}
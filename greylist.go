@@ -0,0 +1,114 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// greylistCookie is the cookie set by the challenge page. Its value proves that the client ran the
+// JavaScript of the page, it is bound to the trackingKey of the client.
+const greylistCookie = "waf_greylist"
+
+// greylist treats the clients never seen before more strictly for their first requests: they are
+// always fully inspected, possibly at a higher paranoia level and against the lower thresholds of
+// the decision policies, and browsers may have to pass a JavaScript challenge. Clients graduate
+// to the normal policy after requests requests or once they passed the challenge.
+type greylist struct {
+	requests      int
+	paranoiaLevel int
+	challenge     bool
+	secret        []byte
+}
+
+func newGreylist(requests int, paranoiaLevel int, challenge bool) (*greylist, error) {
+	if requests < 0 {
+		return nil, fmt.Errorf("greylistRequests must not be negative")
+	}
+	if requests == 0 {
+		return nil, nil
+	}
+	if paranoiaLevel != 0 {
+		if err := validateParanoiaLevel(paranoiaLevel); err != nil {
+			return nil, err
+		}
+	}
+	g := &greylist{requests: requests, paranoiaLevel: paranoiaLevel, challenge: challenge}
+	if challenge {
+		g.secret = make([]byte, 32)
+		if _, err := rand.Read(g.secret); err != nil {
+			return nil, fmt.Errorf("fail to generate the greylist challenge secret: %s", err.Error())
+		}
+	}
+	return g, nil
+}
+
+// token returns the value of greylistCookie for the client with key.
+func (g *greylist) token(key string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// admitClient counts the request req of its client and reports whether the client is greylisted.
+func (a *Modsecurity) admitClient(req *http.Request) bool {
+	if a.greylist == nil {
+		return false
+	}
+	return a.clientTracker.admit(a.trackingKey(req), a.greylist.requests, time.Now())
+}
+
+// greylisted reports whether the client of req, already admitted, is still greylisted.
+func (a *Modsecurity) greylisted(req *http.Request) bool {
+	if a.greylist == nil {
+		return false
+	}
+	return a.clientTracker.greylisted(a.trackingKey(req), a.greylist.requests, time.Now())
+}
+
+// challengeGreylisted serves the challenge page to the greylisted browsers which did not pass it
+// yet, and graduates the ones which did. It reports whether the page was served. Other requests,
+// e.g. API calls, can't run the challenge and go on with the stricter inspection.
+func (a *Modsecurity) challengeGreylisted(rw http.ResponseWriter, req *http.Request) bool {
+	if !a.greylist.challenge {
+		return false
+	}
+	key := a.trackingKey(req)
+	token := a.greylist.token(key)
+	if cookie, err := req.Cookie(greylistCookie); err == nil && hmac.Equal([]byte(cookie.Value), []byte(token)) {
+		a.clientTracker.graduate(key, a.greylist.requests, time.Now())
+		return false
+	}
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	a.logSampled("greylist_challenge", a.requestFields(req, logFields{}))
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, `<!DOCTYPE html><html><head><meta charset="utf-8"><title>Checking your browser</title></head>`+
+		`<body><noscript>Please enable JavaScript to continue.</noscript>`+
+		`<script>document.cookie=%s;location.reload();</script></body></html>`,
+		strconv.Quote(greylistCookie+"="+token+"; path=/; SameSite=Lax"))
+	return true
+}
+
+// greylistParanoiaLevel raises the paranoia level header of the WAF request of greylisted clients
+// to greylistParanoiaLevel.
+func (a *Modsecurity) greylistParanoiaLevel(req *http.Request, header http.Header) {
+	if a.greylist == nil || a.greylist.paranoiaLevel == 0 || len(a.paranoiaLevels.header) == 0 {
+		return
+	}
+	if level, _ := strconv.Atoi(header.Get(a.paranoiaLevels.header)); level >= a.greylist.paranoiaLevel {
+		return
+	}
+	if a.greylisted(req) {
+		header.Set(a.paranoiaLevels.header, strconv.Itoa(a.greylist.paranoiaLevel))
+	}
+}
@@ -0,0 +1,130 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientTracker_Greylist(t *testing.T) {
+	tracker := newClientTracker()
+	key := "192.0.2.1"
+	now := time.Now()
+
+	assert.False(t, tracker.greylisted(key, 2, now), "unknown clients were not admitted")
+	assert.True(t, tracker.admit(key, 2, now))
+	assert.True(t, tracker.greylisted(key, 2, now))
+	assert.True(t, tracker.admit(key, 2, now))
+	assert.True(t, tracker.greylisted(key, 2, now))
+	assert.False(t, tracker.admit(key, 2, now), "the client graduated")
+	assert.False(t, tracker.greylisted(key, 2, now))
+	assert.False(t, tracker.admit(key, 2, now))
+
+	other := "192.0.2.2"
+	assert.True(t, tracker.admit(other, 2, now))
+	tracker.graduate(other, 2, now)
+	assert.False(t, tracker.greylisted(other, 2, now))
+	assert.False(t, tracker.admit(other, 2, now))
+}
+
+func TestNewGreylist(t *testing.T) {
+	g, err := newGreylist(0, 4, true)
+	assert.NoError(t, err)
+	assert.Nil(t, g)
+	_, err = newGreylist(-1, 0, false)
+	assert.Error(t, err)
+	_, err = newGreylist(10, 5, false)
+	assert.Error(t, err)
+	g, err = newGreylist(10, 3, true)
+	assert.NoError(t, err)
+	assert.Len(t, g.secret, 32)
+	assert.NotEqual(t, g.token("192.0.2.1"), g.token("192.0.2.2"))
+}
+
+func TestModsecurity_Greylist(t *testing.T) {
+	var paranoia []string
+	var bodies []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paranoia = append(paranoia, r.Header.Get(defaultParanoiaLevelHeader))
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Header().Set(defaultAnomalyScoreHeader, "3")
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ParanoiaLevel = 1
+	config.HeadersOnlyPaths = []string{"^/upload$"}
+	config.Decision = &DecisionConfig{Type: "score", Threshold: 5, GreylistedThreshold: 3}
+	config.GreylistRequests = 2
+	config.GreylistParanoiaLevel = 3
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("payload"))
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234"), "lower threshold")
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234"))
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234"), "the client graduated")
+	assert.Equal(t, []string{"3", "3", "1"}, paranoia)
+	assert.Equal(t, []string{"payload", "payload", ""}, bodies, "greylisted clients are fully inspected")
+}
+
+func TestModsecurity_GreylistChallenge(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.GreylistRequests = 10
+	config.GreylistChallenge = true
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(accept string, cookie string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Accept", accept)
+		if len(cookie) > 0 {
+			req.Header.Set("Cookie", cookie)
+		}
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := serve("text/html,application/xhtml+xml", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, 0, wafCalls)
+	token := regexp.MustCompile(greylistCookie + `=([0-9a-f]+)`).FindStringSubmatch(rw.Body.String())
+	assert.Len(t, token, 2)
+
+	serve("application/json", "")
+	assert.Equal(t, 1, wafCalls, "API calls can't run the challenge")
+	serve("text/html", greylistCookie+"=forged")
+	assert.Equal(t, 1, wafCalls, "forged tokens are challenged again")
+
+	rw = serve("text/html", greylistCookie+"="+token[1])
+	assert.Equal(t, 2, wafCalls)
+	assert.Empty(t, rw.Header().Get("Cache-Control"))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.False(t, middleware.greylisted(req), "the client graduated")
+	serve("text/html", "")
+	assert.Equal(t, 3, wafCalls, "graduated clients are not challenged")
+}
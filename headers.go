@@ -0,0 +1,111 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// headerFilter decides which request headers are copied into the request sent to the WAF.
+// When forward is not empty, only the listed headers are copied. Headers listed in drop are
+// never copied, even if they are also listed in forward.
+type headerFilter struct {
+	forward map[string]bool
+	drop    map[string]bool
+}
+
+func newHeaderFilter(forward []string, drop []string) *headerFilter {
+	return &headerFilter{
+		forward: canonicalHeaderSet(forward),
+		drop:    canonicalHeaderSet(drop),
+	}
+}
+
+func canonicalHeaderSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
+
+// filter returns a copy of header containing only the headers allowed by the filter.
+func (f *headerFilter) filter(header http.Header) http.Header {
+	filtered := make(http.Header, len(header))
+	if len(f.forward) == 0 && len(f.drop) == 0 {
+		for h, val := range header {
+			filtered[h] = val
+		}
+		return filtered
+	}
+	for h, val := range header {
+		key := http.CanonicalHeaderKey(h)
+		if len(f.forward) > 0 && !f.forward[key] {
+			continue
+		}
+		if f.drop[key] {
+			continue
+		}
+		filtered[h] = val
+	}
+	return filtered
+}
+
+// Values accepted in forwardedHeadersPolicy.
+const (
+	forwardedHeadersPassthrough = "passthrough"
+	forwardedHeadersOverwrite   = "overwrite"
+	forwardedHeadersStrip       = "strip"
+)
+
+// forwardedHeaders are the proxy headers handled by forwardedHeadersPolicy. Clients can forge them
+// to poison the IP-based rules of the WAF.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Server",
+	"X-Real-Ip",
+}
+
+func validateForwardedHeadersPolicy(policy string) error {
+	switch policy {
+	case "", forwardedHeadersPassthrough, forwardedHeadersOverwrite, forwardedHeadersStrip:
+		return nil
+	}
+	return fmt.Errorf("invalid forwardedHeadersPolicy %q, expected %s, %s or %s", policy, forwardedHeadersPassthrough, forwardedHeadersOverwrite, forwardedHeadersStrip)
+}
+
+// applyForwardedHeadersPolicy updates the proxy headers of header, the copy of the headers of req
+// sent to the WAF. With the overwrite policy they are replaced with the values of the connection
+// Traefik received, with the strip policy they are removed.
+func applyForwardedHeadersPolicy(policy string, req *http.Request, header http.Header) {
+	if policy != forwardedHeadersOverwrite && policy != forwardedHeadersStrip {
+		return
+	}
+	for _, name := range forwardedHeaders {
+		header.Del(name)
+	}
+	if policy == forwardedHeadersStrip {
+		return
+	}
+
+	if ip := remoteIP(req); ip != nil {
+		header.Set("X-Forwarded-For", ip.String())
+		header.Set("X-Real-Ip", ip.String())
+	}
+	proto, port := "http", "80"
+	if req.TLS != nil {
+		proto, port = "https", "443"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	if len(req.Host) > 0 {
+		header.Set("X-Forwarded-Host", req.Host)
+		if _, hostPort, err := net.SplitHostPort(req.Host); err == nil {
+			port = hostPort
+		}
+	}
+	header.Set("X-Forwarded-Port", port)
+}
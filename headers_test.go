@@ -0,0 +1,108 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderFilter_filter(t *testing.T) {
+	header := http.Header{
+		"Accept":          []string{"*/*"},
+		"Authorization":   []string{"Bearer secret"},
+		"X-Internal-Hop":  []string{"10.0.0.1"},
+		"X-Forwarded-For": []string{"1.2.3.4"},
+	}
+
+	tests := []struct {
+		name    string
+		forward []string
+		drop    []string
+		expect  http.Header
+	}{
+		{
+			name:   "Copies every header by default",
+			expect: header,
+		},
+		{
+			name: "Drops listed headers",
+			drop: []string{"authorization", "X-INTERNAL-HOP"},
+			expect: http.Header{
+				"Accept":          []string{"*/*"},
+				"X-Forwarded-For": []string{"1.2.3.4"},
+			},
+		},
+		{
+			name:    "Only forwards listed headers",
+			forward: []string{"accept", "x-forwarded-for"},
+			expect: http.Header{
+				"Accept":          []string{"*/*"},
+				"X-Forwarded-For": []string{"1.2.3.4"},
+			},
+		},
+		{
+			name:    "Drop wins over forward",
+			forward: []string{"Accept", "Authorization"},
+			drop:    []string{"Authorization"},
+			expect: http.Header{
+				"Accept": []string{"*/*"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := newHeaderFilter(tt.forward, tt.drop)
+			assert.Equal(t, tt.expect, filter.filter(header))
+		})
+	}
+}
+
+func TestApplyForwardedHeadersPolicy(t *testing.T) {
+	forged := http.Header{
+		"Accept":            []string{"*/*"},
+		"X-Forwarded-For":   []string{"127.0.0.1, 10.0.0.1"},
+		"X-Forwarded-Host":  []string{"admin.internal"},
+		"X-Forwarded-Proto": []string{"https"},
+		"X-Real-Ip":         []string{"127.0.0.1"},
+		"Forwarded":         []string{"for=127.0.0.1"},
+	}
+	tests := []struct {
+		name   string
+		policy string
+		expect http.Header
+	}{
+		{name: "Passes through by default", expect: forged},
+		{name: "Passes through", policy: forwardedHeadersPassthrough, expect: forged},
+		{name: "Strips", policy: forwardedHeadersStrip, expect: http.Header{"Accept": []string{"*/*"}}},
+		{
+			name:   "Overwrites with the connection values",
+			policy: forwardedHeadersOverwrite,
+			expect: http.Header{
+				"Accept":            []string{"*/*"},
+				"X-Forwarded-For":   []string{"192.0.2.1"},
+				"X-Real-Ip":         []string{"192.0.2.1"},
+				"X-Forwarded-Host":  []string{"example.com:8080"},
+				"X-Forwarded-Port":  []string{"8080"},
+				"X-Forwarded-Proto": []string{"http"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/", nil)
+			req.RemoteAddr = "192.0.2.1:52000"
+			header := (&headerFilter{}).filter(forged)
+			applyForwardedHeadersPolicy(tt.policy, req, header)
+			assert.Equal(t, tt.expect, header)
+			assert.Equal(t, []string{"127.0.0.1, 10.0.0.1"}, forged["X-Forwarded-For"])
+		})
+	}
+}
+
+func TestValidateForwardedHeadersPolicy(t *testing.T) {
+	assert.NoError(t, validateForwardedHeadersPolicy(""))
+	assert.NoError(t, validateForwardedHeadersPolicy(forwardedHeadersOverwrite))
+	assert.Error(t, validateForwardedHeadersPolicy("rewrite"))
+}
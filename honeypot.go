@@ -0,0 +1,32 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// honeypotDecoyBody is the body of the responses to honeypot paths. It looks like an empty page,
+// so scanners don't learn the request was flagged.
+const honeypotDecoyBody = "<html><head></head><body></body></html>\n"
+
+// serveHoneypot answers a request to a honeypot path: the client is banned for banDuration
+// and receives a decoy response. The WAF is not called.
+func (a *Modsecurity) serveHoneypot(rw http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	fields := logFields{"client": clientKey(remoteIP(req), a.ipv6PrefixLength)}
+	if a.banDuration > 0 {
+		until := now.Add(a.banDuration)
+		if a.banClient(req, until, now) {
+			fields["banned_until"] = until.UTC().Format(time.RFC3339)
+		}
+	}
+	a.logEvent("honeypot_hit", a.requestFields(req, fields))
+	a.audit(req, "honeypot_hit", http.StatusOK, nil, "")
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(honeypotDecoyBody)))
+	rw.WriteHeader(http.StatusOK)
+	io.WriteString(rw, honeypotDecoyBody)
+}
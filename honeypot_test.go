@@ -0,0 +1,59 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_Honeypot(t *testing.T) {
+	var wafCalls int32
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&wafCalls, 1)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.HoneypotPaths = []string{`^/admin\.bak$`, `^/\.git/`}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := serve("[2001:db8:1:2::1]:1234", "/.git/config")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, honeypotDecoyBody, rw.Body.String())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&wafCalls), "honeypot paths are not inspected")
+
+	assert.Equal(t, http.StatusForbidden, serve("[2001:db8:1:2::1]:1234", "/").Code)
+	assert.Equal(t, http.StatusForbidden, serve("[2001:db8:1:2:ffff::2]:1234", "/").Code, "bans cover the /64 of the client")
+	assert.Equal(t, http.StatusOK, serve("[2001:db8:1:3::1]:1234", "/").Code)
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", "/admin").Code)
+}
+
+func TestModsecurity_HoneypotWithoutBan(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.HoneypotPaths = []string{`^/admin\.bak$`}
+	config.BanDuration = "0s"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, path := range []string{"/admin.bak", "/"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code, path)
+	}
+}
@@ -0,0 +1,194 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icapDefaultPort is the port of the ICAP services whose URL has none.
+const icapDefaultPort = "1344"
+
+// icapChunkSize is the size of the chunks of the encapsulated bodies.
+const icapChunkSize = 32 * 1024
+
+// icapClient submits requests to an ICAP (RFC 3507) REQMOD service, e.g. a content-inspection
+// appliance or c-icap with ModSecurity. The ICAP verdict is turned into the equivalent WAF
+// response: 200 when the service answers 204 No Content or returns the request, the encapsulated
+// HTTP response otherwise. The rule IDs and anomaly score headers of the ICAP response are copied
+// to it. Each call opens its own connection.
+type icapClient struct {
+	service         string
+	timeout         time.Duration
+	metadataHeaders []string
+}
+
+func (a *Modsecurity) icapClient(service string) *icapClient {
+	return &icapClient{
+		service:         service,
+		timeout:         a.httpClient.Timeout,
+		metadataHeaders: []string{a.ruleIdsHeader, a.anomalyScoreHeader},
+	}
+}
+
+// Do implements wafDoer, req is the request to submit to the service.
+func (c *icapClient) Do(req *http.Request) (*http.Response, error) {
+	service, err := url.Parse(c.service)
+	if err != nil {
+		return nil, err
+	}
+	host := service.Host
+	if len(service.Port()) == 0 {
+		host = net.JoinHostPort(service.Hostname(), icapDefaultPort)
+	}
+	conn, err := net.DialTimeout("tcp", host, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	if err := c.writeRequest(conn, service, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := c.readResponse(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// writeRequest writes the REQMOD request encapsulating req to w.
+func (c *icapClient) writeRequest(w io.Writer, service *url.URL, req *http.Request) error {
+	var head strings.Builder
+	fmt.Fprintf(&head, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	req.Header.Write(&head)
+	head.WriteString("\r\n")
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	encapsulated := "req-hdr=0, null-body=" + strconv.Itoa(head.Len())
+	if hasBody {
+		encapsulated = "req-hdr=0, req-body=" + strconv.Itoa(head.Len())
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "REQMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nConnection: close\r\nEncapsulated: %s\r\n\r\n", service.String(), service.Host, encapsulated)
+	bw.WriteString(head.String())
+	if hasBody {
+		chunk := make([]byte, icapChunkSize)
+		for {
+			n, err := req.Body.Read(chunk)
+			if n > 0 {
+				fmt.Fprintf(bw, "%x\r\n", n)
+				bw.Write(chunk[:n])
+				bw.WriteString("\r\n")
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		bw.WriteString("0\r\n\r\n")
+	}
+	return bw.Flush()
+}
+
+// readResponse reads the ICAP response from conn. The body of the returned response reads the
+// encapsulated body and closes conn.
+func (c *icapClient) readResponse(conn net.Conn) (*http.Response, error) {
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	status, err := parseStatusLine(line, "ICAP/")
+	if err != nil {
+		return nil, err
+	}
+	icapHeader, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+	switch {
+	case status == http.StatusNoContent:
+		conn.Close()
+	case status == http.StatusOK && strings.Contains(icapHeader.Get("Encapsulated"), "res-hdr"):
+		// the ICAP service answers in place of the backend: the request is blocked
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode, err = parseStatusLine(line, "HTTP/"); err != nil {
+			return nil, err
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return nil, err
+		}
+		resp.Header = http.Header(header)
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Transfer-Encoding")
+		resp.ContentLength = -1
+		if strings.Contains(icapHeader.Get("Encapsulated"), "res-body") {
+			resp.Body = &icapBody{Reader: httputil.NewChunkedReader(br), conn: conn}
+		} else {
+			conn.Close()
+		}
+	case status == http.StatusOK:
+		// the request is returned, possibly adapted: it is allowed, the adaptations are ignored
+		conn.Close()
+	default:
+		return nil, fmt.Errorf("icap: unexpected status %d", status)
+	}
+	for _, name := range c.metadataHeaders {
+		for _, value := range icapHeader[textproto.CanonicalMIMEHeaderKey(name)] {
+			resp.Header.Add(name, value)
+		}
+	}
+	return resp, nil
+}
+
+// icapBody is the encapsulated body of an ICAP response, closing the connection when closed.
+type icapBody struct {
+	io.Reader
+	conn net.Conn
+}
+
+func (b *icapBody) Close() error {
+	return b.conn.Close()
+}
+
+// parseStatusLine returns the status code of an ICAP or HTTP status line starting with prefix.
+func parseStatusLine(line string, prefix string) (int, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], prefix) {
+		return 0, fmt.Errorf("icap: malformed status line %q", line)
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("icap: malformed status line %q", line)
+	}
+	return status, nil
+}
@@ -0,0 +1,115 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// icapRequest is a REQMOD request received by the fake ICAP service.
+type icapRequest struct {
+	line         string
+	encapsulated string
+	request      *http.Request
+	body         string
+}
+
+// newIcapServer starts a fake ICAP service answering with the raw response returned by respond.
+func newIcapServer(t *testing.T, respond func(icapRequest) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				tp := textproto.NewReader(br)
+				var received icapRequest
+				received.line, _ = tp.ReadLine()
+				header, _ := tp.ReadMIMEHeader()
+				received.encapsulated = header.Get("Encapsulated")
+				received.request, _ = http.ReadRequest(br)
+				if strings.Contains(received.encapsulated, "req-body") {
+					body, _ := io.ReadAll(httputil.NewChunkedReader(br))
+					received.body = string(body)
+				}
+				io.WriteString(conn, respond(received))
+			}()
+		}
+	}()
+	return "icap://" + listener.Addr().String() + "/reqmod"
+}
+
+func TestModsecurity_Icap(t *testing.T) {
+	received := make(chan icapRequest, 1)
+	service := newIcapServer(t, func(req icapRequest) string {
+		received <- req
+		if strings.Contains(req.body, "eicar") {
+			return "ICAP/1.0 200 OK\r\nX-Waf-Rule-Ids: 990100\r\nEncapsulated: res-hdr=0, res-body=45\r\n\r\n" +
+				"HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\n\r\n" +
+				"7\r\nblocked\r\n0\r\n\r\n"
+		}
+		return "ICAP/1.0 204 No Content\r\nX-Waf-Anomaly-Score: 3\r\n\r\n"
+	})
+
+	var result *InspectionResult
+	config := CreateConfig()
+	config.ModSecurityUrl = service
+	config.BackendProtocol = backendProtocolIcap
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, _ = InspectionResultFromContext(r.Context())
+	}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/files?id=1", nil))
+	req := <-received
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "REQMOD "+service+" ICAP/1.0", req.line)
+	assert.True(t, strings.HasPrefix(req.encapsulated, "req-hdr=0, null-body="))
+	assert.Equal(t, "/files?id=1", req.request.RequestURI)
+	assert.Equal(t, "example.com", req.request.Host)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, 3.0, result.Score)
+	}
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("eicar test file")))
+	req = <-received
+	assert.Equal(t, "eicar test file", req.body)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "blocked", rw.Body.String())
+	assert.Equal(t, "990100", rw.Header().Get(defaultRuleIdsHeader))
+}
+
+func TestIcapClient_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		expect   string
+	}{
+		{name: "ICAP error", response: "ICAP/1.0 500 Server Error\r\n\r\n", expect: "icap: unexpected status 500"},
+		{name: "Malformed status line", response: "HTTP/1.1 200 OK\r\n\r\n", expect: `icap: malformed status line "HTTP/1.1 200 OK"`},
+		{name: "Malformed encapsulated response", response: "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=9\r\n\r\nbad\r\n\r\n", expect: `icap: malformed status line "bad"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newIcapServer(t, func(icapRequest) string { return tt.response })
+			client := &icapClient{service: service}
+			_, err := client.Do(httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.EqualError(t, err, tt.expect)
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultJwtStatusHeader is the request header carrying the outcome of the JWT checks to the WAF
+// and to the service. A value sent by the client is never trusted.
+const defaultJwtStatusHeader = "X-Jwt-Status"
+
+// Outcomes of the JWT checks. unverified tokens passed the checks but their signature could not
+// be verified: no JWKS is configured, it is not loaded yet, or the token is signed with HMAC.
+const (
+	jwtStatusValid         = "valid"
+	jwtStatusUnverified    = "unverified"
+	jwtStatusMalformed     = "malformed"
+	jwtStatusExpired       = "expired"
+	jwtStatusNotYetValid   = "not_yet_valid"
+	jwtStatusAlgNotAllowed = "alg_not_allowed"
+	jwtStatusUnknownKey    = "unknown_key"
+	jwtStatusBadSignature  = "bad_signature"
+)
+
+// jwtMinRefreshInterval bounds the JWKS reloads triggered by tokens signed with an unknown key.
+const jwtMinRefreshInterval = time.Minute
+
+// jwtChecker runs sanity checks on the bearer tokens before the WAF inspection: a well-formed
+// JWT, an acceptable algorithm, not expired and, with a JWKS URL, a valid signature.
+type jwtChecker struct {
+	allowedAlgs     map[string]bool
+	clockSkew       time.Duration
+	reject          bool
+	header          string
+	jwksUrl         string
+	refreshInterval time.Duration
+	client          *http.Client
+	keys            atomic.Value
+	refresh         chan struct{}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Exp *float64 `json:"exp"`
+	Nbf *float64 `json:"nbf"`
+}
+
+func newJwtChecker(enabled bool, allowedAlgs []string, clockSkew time.Duration, reject bool, header string, jwksUrl string, refreshInterval time.Duration) *jwtChecker {
+	if !enabled {
+		return nil
+	}
+	c := &jwtChecker{
+		allowedAlgs:     map[string]bool{},
+		clockSkew:       clockSkew,
+		reject:          reject,
+		header:          header,
+		jwksUrl:         jwksUrl,
+		refreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		refresh:         make(chan struct{}, 1),
+	}
+	for _, alg := range allowedAlgs {
+		c.allowedAlgs[alg] = true
+	}
+	c.keys.Store(map[string]crypto.PublicKey(nil))
+	return c
+}
+
+// check returns the outcome of the checks of the bearer token of req, or an empty string when
+// req carries none.
+func (c *jwtChecker) check(req *http.Request, now time.Time) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(authorization[7:]), ".")
+	if len(parts) != 3 {
+		return jwtStatusMalformed
+	}
+	var header jwtHeader
+	var claims jwtClaims
+	if decodeJwtPart(parts[0], &header) != nil || decodeJwtPart(parts[1], &claims) != nil {
+		return jwtStatusMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return jwtStatusMalformed
+	}
+
+	if header.Alg == "none" || len(header.Alg) == 0 || (len(c.allowedAlgs) > 0 && !c.allowedAlgs[header.Alg]) {
+		return jwtStatusAlgNotAllowed
+	}
+	if len(c.jwksUrl) > 0 && strings.HasPrefix(header.Alg, "HS") {
+		// the JWKS holds public keys: an HMAC token can't be verified, forging one takes no secret
+		return jwtStatusAlgNotAllowed
+	}
+	if claims.Exp != nil && now.Add(-c.clockSkew).After(time.Unix(int64(*claims.Exp), 0)) {
+		return jwtStatusExpired
+	}
+	if claims.Nbf != nil && now.Add(c.clockSkew).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return jwtStatusNotYetValid
+	}
+
+	keys, _ := c.keys.Load().(map[string]crypto.PublicKey)
+	if keys == nil || strings.HasPrefix(header.Alg, "HS") {
+		// no JWKS, or not loaded yet
+		return jwtStatusUnverified
+	}
+	key, ok := keys[header.Kid]
+	if !ok && len(header.Kid) == 0 && len(keys) == 1 {
+		for _, only := range keys {
+			key, ok = only, true
+		}
+	}
+	if !ok {
+		c.requestRefresh()
+		return jwtStatusUnknownKey
+	}
+	if !verifyJwtSignature(header.Alg, key, parts[0]+"."+parts[1], signature) {
+		return jwtStatusBadSignature
+	}
+	return jwtStatusValid
+}
+
+// rejects reports whether requests whose token ended with status are rejected.
+func (c *jwtChecker) rejects(status string) bool {
+	return c.reject && len(status) > 0 && status != jwtStatusValid && status != jwtStatusUnverified
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+// verifyJwtSignature verifies the RSA, RSA-PSS or ECDSA signature of signed.
+func verifyJwtSignature(alg string, key crypto.PublicKey, signed string, signature []byte) bool {
+	if len(alg) != 5 {
+		return false
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256([]byte(signed))
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384([]byte(signed))
+		digest = sum[:]
+	default:
+		sum := sha512.Sum512([]byte(signed))
+		digest = sum[:]
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// requestRefresh asks for a reload of the JWKS, e.g. after a key rotation.
+func (c *jwtChecker) requestRefresh() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// runJwksRefresher loads the JWKS, then reloads it every refreshInterval or when a token is signed
+// with an unknown key, until ctx is done.
+func (a *Modsecurity) runJwksRefresher(ctx context.Context) {
+	c := a.jwtChecker
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+	var last time.Time
+	for {
+		if err := c.loadKeys(ctx); err != nil {
+			a.logSampled("jwks_refresh_failed", logFields{"url": c.jwksUrl, "error": err.Error()})
+		}
+		last = time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.refresh:
+			if wait := jwtMinRefreshInterval - time.Since(last); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadKeys fetches the JWKS. Keys of unsupported types are ignored.
+func (c *jwtChecker) loadKeys(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, c.jwksUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&set); err != nil {
+		return fmt.Errorf("invalid JWKS: %s", err.Error())
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Use == "enc" {
+			continue
+		}
+		if public, err := key.publicKey(); err == nil {
+			keys[key.Kid] = public
+		}
+	}
+	c.keys.Store(keys)
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid key exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid key point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
@@ -0,0 +1,178 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWafProfile describes how the fake ModSecurity server answers: each request waits latency
+// plus a random jitter, then is blocked with probability blockRate or fails with a 502 with
+// probability errorRate.
+type fakeWafProfile struct {
+	latency   time.Duration
+	jitter    time.Duration
+	blockRate float64
+	errorRate float64
+}
+
+// fakeWaf is a ModSecurity stand-in serving the verdicts of a profile, counting the requests it received.
+type fakeWaf struct {
+	*httptest.Server
+	profile  fakeWafProfile
+	requests int64
+	mu       sync.Mutex
+	rand     *rand.Rand
+}
+
+func newFakeWaf(tb testing.TB, profile fakeWafProfile) *fakeWaf {
+	tb.Helper()
+	f := &fakeWaf{profile: profile, rand: rand.New(rand.NewSource(1))}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	tb.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeWaf) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&f.requests, 1)
+	io.Copy(io.Discard, r.Body)
+
+	f.mu.Lock()
+	delay := f.profile.latency
+	if f.profile.jitter > 0 {
+		delay += time.Duration(f.rand.Int63n(int64(f.profile.jitter)))
+	}
+	verdict := f.rand.Float64()
+	f.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	switch {
+	case verdict < f.profile.blockRate:
+		w.Header().Set("X-Waf-Rule-Ids", "942100")
+		w.WriteHeader(http.StatusForbidden)
+	case verdict < f.profile.blockRate+f.profile.errorRate:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// loadResult summarizes a load run.
+type loadResult struct {
+	statuses map[int]int
+	p50, p99 time.Duration
+}
+
+// runLoad sends requests through handler from concurrency goroutines, newRequest building each
+// request, and returns the status codes and latency percentiles seen by the clients.
+func runLoad(handler http.Handler, concurrency int, requests int, newRequest func(i int) *http.Request) loadResult {
+	latencies := make([]time.Duration, requests)
+	statuses := make([]int, requests)
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for c := 0; c < concurrency; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= requests {
+					return
+				}
+				rw := httptest.NewRecorder()
+				start := time.Now()
+				handler.ServeHTTP(rw, newRequest(i))
+				latencies[i] = time.Since(start)
+				statuses[i] = rw.Code
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := loadResult{statuses: map[int]int{}}
+	for _, status := range statuses {
+		result.statuses[status]++
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.p50 = latencies[requests/2]
+	result.p99 = latencies[requests*99/100]
+	return result
+}
+
+func newLoadTestModsecurity(tb testing.TB, waf *fakeWaf, configure func(*Config)) *Modsecurity {
+	config := CreateConfig()
+	config.ModSecurityUrl = waf.URL
+	if configure != nil {
+		configure(config)
+	}
+	return newTestModsecurity(tb, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+}
+
+func TestLoadHarness_VerdictDistribution(t *testing.T) {
+	waf := newFakeWaf(t, fakeWafProfile{latency: time.Millisecond, jitter: time.Millisecond, blockRate: 0.2, errorRate: 0.1})
+	middleware := newLoadTestModsecurity(t, waf, nil)
+
+	result := runLoad(middleware, 8, 500, func(i int) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/api", strings.NewReader("payload"))
+	})
+
+	assert.Equal(t, int64(500), atomic.LoadInt64(&waf.requests))
+	assert.Equal(t, 500, result.statuses[http.StatusOK]+result.statuses[http.StatusForbidden]+result.statuses[http.StatusBadGateway])
+	assert.InDelta(t, 100, result.statuses[http.StatusForbidden], 40)
+	assert.InDelta(t, 50, result.statuses[http.StatusBadGateway], 30)
+	assert.GreaterOrEqual(t, int64(result.p50), int64(time.Millisecond))
+	assert.GreaterOrEqual(t, result.p99, result.p50)
+}
+
+// BenchmarkModsecurity_FakeWaf measures the middleware against fake WAF servers of various
+// latencies and verdict distributions, with concurrent clients. Run it with
+// go test -run xxx -bench FakeWaf -benchmem
+func BenchmarkModsecurity_FakeWaf(b *testing.B) {
+	smallBody := []byte(`{"user":"john"}`)
+	largeBody := bytes.Repeat([]byte("a"), 256*1024)
+	benchmarks := []struct {
+		name      string
+		profile   fakeWafProfile
+		body      []byte
+		configure func(*Config)
+	}{
+		{name: "allow", body: smallBody},
+		{name: "allow 1ms", profile: fakeWafProfile{latency: time.Millisecond}, body: smallBody},
+		{name: "mixed verdicts", profile: fakeWafProfile{blockRate: 0.1, errorRate: 0.01}, body: smallBody},
+		{name: "large body", body: largeBody, configure: func(c *Config) { c.MaxBodySize = 1024 * 1024 }},
+		{name: "large body spooled", body: largeBody, configure: func(c *Config) {
+			c.MaxBodySize = 64 * 1024
+			c.SpoolToDisk = true
+		}},
+		{name: "two-phase", profile: fakeWafProfile{latency: time.Millisecond}, body: largeBody, configure: func(c *Config) {
+			c.MaxBodySize = 1024 * 1024
+			c.TwoPhaseInspection = true
+		}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			waf := newFakeWaf(b, bm.profile)
+			middleware := newLoadTestModsecurity(b, waf, bm.configure)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bm.body)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api", bytes.NewReader(bm.body)))
+				}
+			})
+		})
+	}
+}
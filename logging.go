@@ -0,0 +1,56 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// logFields are the key/value pairs of a structured log event.
+type logFields map[string]interface{}
+
+// logEvent writes a structured log line: the event name followed by sorted key=value pairs.
+func (a *Modsecurity) logEvent(event string, fields logFields) {
+	a.logger.Print(formatEvent(event, fields))
+}
+
+// requestFields adds the fields describing req to fields.
+func (a *Modsecurity) requestFields(req *http.Request, fields logFields) logFields {
+	fields["method"] = req.Method
+	fields["uri"] = a.piiMasker.maskURI(req.RequestURI)
+	if len(a.fingerprintHeader) > 0 {
+		fields["fingerprint"] = clientFingerprint(req)
+		fields["ua_family"] = userAgentFamily(req.UserAgent())
+	}
+	a.originFields(req, fields)
+	return fields
+}
+
+func formatEvent(event string, fields logFields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("ModSecurity event=")
+	b.WriteString(event)
+	for _, k := range keys {
+		b.WriteByte(' ')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(formatValue(fields[k]))
+	}
+	return b.String()
+}
+
+func formatValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
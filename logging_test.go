@@ -0,0 +1,17 @@
+package traefik_modsecurity_plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatEvent(t *testing.T) {
+	line := formatEvent("waf_error", logFields{
+		"uri":       "/search?q=a b",
+		"category":  "timeout",
+		"interrupt": true,
+		"error":     "",
+	})
+	assert.Equal(t, `ModSecurity event=waf_error category=timeout error="" interrupt=true uri="/search?q=a b"`, line)
+}
@@ -0,0 +1,49 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Values accepted in bufferedBytesPolicy.
+const (
+	bufferedBytesPolicyReject   = "reject"
+	bufferedBytesPolicySkipBody = "skipBody"
+)
+
+// bufferedBytesInFlight accounts for the request bodies buffered in memory by every middleware
+// instance of the process, updated with sync/atomic. Traefik runs out of memory as a whole.
+var bufferedBytesInFlight int64
+
+func validateBufferedBytesPolicy(policy string) error {
+	switch policy {
+	case "", bufferedBytesPolicyReject, bufferedBytesPolicySkipBody:
+		return nil
+	}
+	return fmt.Errorf("invalid bufferedBytesPolicy %q, expected %s or %s", policy, bufferedBytesPolicyReject, bufferedBytesPolicySkipBody)
+}
+
+// reserveBodyMemory reserves the memory needed to buffer the body of req: its length, at most
+// maxBodySize, or maxBodySize when it is unknown. It returns the reserved bytes, to be released
+// with releaseBodyMemory, and reports false when the reservation would exceed maxBufferedBytes.
+func (a *Modsecurity) reserveBodyMemory(req *http.Request) (int64, bool) {
+	if a.maxBufferedBytes <= 0 || !hasBody(req) {
+		return 0, true
+	}
+	size := a.maxBodySize
+	if req.ContentLength >= 0 && req.ContentLength < size {
+		size = req.ContentLength
+	}
+	if atomic.AddInt64(&bufferedBytesInFlight, size) > a.maxBufferedBytes {
+		atomic.AddInt64(&bufferedBytesInFlight, -size)
+		return 0, false
+	}
+	return size, true
+}
+
+func releaseBodyMemory(size int64) {
+	if size > 0 {
+		atomic.AddInt64(&bufferedBytesInFlight, -size)
+	}
+}
@@ -0,0 +1,94 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBufferedBytesPolicy(t *testing.T) {
+	assert.NoError(t, validateBufferedBytesPolicy(""))
+	assert.NoError(t, validateBufferedBytesPolicy(bufferedBytesPolicyReject))
+	assert.NoError(t, validateBufferedBytesPolicy(bufferedBytesPolicySkipBody))
+	assert.EqualError(t, validateBufferedBytesPolicy("drop"), `invalid bufferedBytesPolicy "drop", expected reject or skipBody`)
+}
+
+func TestModsecurity_reserveBodyMemory(t *testing.T) {
+	a := &Modsecurity{maxBodySize: 100, maxBufferedBytes: 150}
+
+	reserved, ok := a.reserveBodyMemory(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789")))
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), reserved)
+
+	// a body of unknown length reserves maxBodySize
+	chunked := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	chunked.ContentLength = -1
+	unknown, ok := a.reserveBodyMemory(chunked)
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), unknown)
+	assert.Equal(t, int64(110), atomic.LoadInt64(&bufferedBytesInFlight))
+
+	_, ok = a.reserveBodyMemory(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 50))))
+	assert.False(t, ok)
+	assert.Equal(t, int64(110), atomic.LoadInt64(&bufferedBytesInFlight))
+
+	// requests without body are always accepted
+	reserved2, ok := a.reserveBodyMemory(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), reserved2)
+
+	releaseBodyMemory(reserved)
+	releaseBodyMemory(unknown)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&bufferedBytesInFlight))
+}
+
+func TestModsecurity_MaxBufferedBytes(t *testing.T) {
+	var wafBody string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		wafBody = string(b)
+	}))
+	defer wafServer.Close()
+
+	tests := []struct {
+		name         string
+		policy       string
+		expectCode   int
+		expectBody   string
+		expectServed string
+	}{
+		{name: "Reject", policy: bufferedBytesPolicyReject, expectCode: http.StatusServiceUnavailable},
+		{name: "Skip body", policy: bufferedBytesPolicySkipBody, expectCode: http.StatusOK, expectServed: "large upload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafBody = ""
+			var served string
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.MaxBufferedBytes = 8
+			config.BufferedBytesPolicy = tt.policy
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				served = string(b)
+			}))
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("large upload")))
+			assert.Equal(t, tt.expectCode, rw.Code)
+			assert.Equal(t, tt.expectBody, wafBody)
+			assert.Equal(t, tt.expectServed, served)
+
+			rw = httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small")))
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, "small", wafBody)
+			assert.Equal(t, int64(0), atomic.LoadInt64(&bufferedBytesInFlight))
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Actions accepted in meshIdentityAction.
+const (
+	meshActionSkip    = "skip"
+	meshActionHeaders = "headers"
+)
+
+// meshIdentities recognizes the workload-to-workload traffic of a service mesh by the verified
+// SPIFFE ID of the client: the URI SAN of the client certificate, when Traefik verified it with
+// mTLS, or the identity header set by a sidecar proxy listed in proxies. Mesh traffic is trusted
+// more than edge traffic and its inspection is skipped, or reduced to the request line and headers.
+type meshIdentities struct {
+	ids     []string
+	header  string
+	proxies []*net.IPNet
+	action  string
+}
+
+func newMeshIdentities(ids []string, header string, proxies []string, action string) (*meshIdentities, error) {
+	if len(ids) == 0 {
+		if len(header) > 0 || len(proxies) > 0 {
+			return nil, fmt.Errorf("meshIdentityHeader and meshProxyIps require meshIdentities")
+		}
+		return nil, nil
+	}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, "spiffe://") {
+			return nil, fmt.Errorf("invalid meshIdentities %q, expected a spiffe:// ID", id)
+		}
+	}
+	if len(header) > 0 && len(proxies) == 0 {
+		return nil, fmt.Errorf("meshIdentityHeader requires meshProxyIps")
+	}
+	networks, err := parseCIDRs("meshProxyIps", proxies)
+	if err != nil {
+		return nil, err
+	}
+	switch action {
+	case "":
+		action = meshActionSkip
+	case meshActionSkip, meshActionHeaders:
+	default:
+		return nil, fmt.Errorf("invalid meshIdentityAction %q, expected %s or %s", action, meshActionSkip, meshActionHeaders)
+	}
+	return &meshIdentities{ids: ids, header: header, proxies: networks, action: action}, nil
+}
+
+// identity returns the verified SPIFFE ID of the client of req, empty when it has none. The
+// identity header is removed from the requests which don't come from a mesh proxy, a value sent
+// by the client is never trusted.
+func (m *meshIdentities) identity(req *http.Request) string {
+	if len(m.header) > 0 {
+		if containsIP(m.proxies, remoteIP(req)) {
+			if id := req.Header.Get(m.header); len(id) > 0 {
+				return id
+			}
+		} else {
+			req.Header.Del(m.header)
+		}
+	}
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	for _, uri := range req.TLS.PeerCertificates[0].URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
+
+// matches reports whether id is one of the configured IDs, or belongs to one of the configured
+// prefixes ending with a slash, e.g. spiffe://cluster.local/ns/payments/.
+func (m *meshIdentities) matches(id string) bool {
+	for _, allowed := range m.ids {
+		if id == allowed || (strings.HasSuffix(allowed, "/") && strings.HasPrefix(id, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// meshAction returns the action applying to req, empty when it isn't mesh traffic.
+func (a *Modsecurity) meshAction(req *http.Request) string {
+	if a.meshIdentities == nil {
+		return ""
+	}
+	if !a.meshIdentities.matches(a.meshIdentities.identity(req)) {
+		return ""
+	}
+	return a.meshIdentities.action
+}
@@ -0,0 +1,132 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMeshIdentities(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []string
+		header  string
+		proxies []string
+		action  string
+		err     string
+	}{
+		{name: "Disabled"},
+		{name: "Certificates", ids: []string{"spiffe://cluster.local/ns/payments/"}},
+		{name: "Header", ids: []string{"spiffe://cluster.local/ns/payments/"}, header: "X-Spiffe-Id", proxies: []string{"10.0.0.0/8"}, action: meshActionHeaders},
+		{name: "Header without ids", header: "X-Spiffe-Id", err: "meshIdentityHeader and meshProxyIps require meshIdentities"},
+		{name: "Header without proxies", ids: []string{"spiffe://cluster.local/"}, header: "X-Spiffe-Id", err: "meshIdentityHeader requires meshProxyIps"},
+		{name: "Invalid id", ids: []string{"cluster.local/ns/payments"}, err: `invalid meshIdentities "cluster.local/ns/payments", expected a spiffe:// ID`},
+		{name: "Invalid proxy", ids: []string{"spiffe://cluster.local/"}, header: "X-Spiffe-Id", proxies: []string{"mesh"}, err: `invalid meshProxyIps address "mesh"`},
+		{name: "Invalid action", ids: []string{"spiffe://cluster.local/"}, action: "detect", err: `invalid meshIdentityAction "detect", expected skip or headers`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mesh, err := newMeshIdentities(tt.ids, tt.header, tt.proxies, tt.action)
+			if len(tt.err) > 0 {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, len(tt.ids) == 0, mesh == nil)
+		})
+	}
+}
+
+// meshTLS returns the state of a connection whose client presented a certificate with the URI SAN id.
+func meshTLS(id string, verified bool) *tls.ConnectionState {
+	uri, _ := url.Parse(id)
+	cert := &x509.Certificate{URIs: []*url.URL{uri}}
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if verified {
+		state.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return state
+}
+
+func TestMeshIdentities_identity(t *testing.T) {
+	mesh, err := newMeshIdentities([]string{"spiffe://cluster.local/ns/payments/", "spiffe://cluster.local/ns/web/sa/frontend"}, "X-Spiffe-Id", []string{"10.0.0.0/8"}, "")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		tls        *tls.ConnectionState
+		expect     string
+		matches    bool
+		stripped   bool
+	}{
+		{name: "Anonymous", remoteAddr: "192.0.2.1:1234"},
+		{name: "Header from a proxy", remoteAddr: "10.1.2.3:1234", header: "spiffe://cluster.local/ns/payments/sa/api", expect: "spiffe://cluster.local/ns/payments/sa/api", matches: true},
+		{name: "Header from a client", remoteAddr: "192.0.2.1:1234", header: "spiffe://cluster.local/ns/payments/sa/api", stripped: true},
+		{name: "Exact id", remoteAddr: "10.1.2.3:1234", header: "spiffe://cluster.local/ns/web/sa/frontend", expect: "spiffe://cluster.local/ns/web/sa/frontend", matches: true},
+		{name: "Other workload", remoteAddr: "10.1.2.3:1234", header: "spiffe://cluster.local/ns/web/sa/admin", expect: "spiffe://cluster.local/ns/web/sa/admin"},
+		{name: "Verified certificate", remoteAddr: "192.0.2.1:1234", tls: meshTLS("spiffe://cluster.local/ns/payments/sa/api", true), expect: "spiffe://cluster.local/ns/payments/sa/api", matches: true},
+		{name: "Unverified certificate", remoteAddr: "192.0.2.1:1234", tls: meshTLS("spiffe://cluster.local/ns/payments/sa/api", false)},
+		{name: "Certificate without SPIFFE ID", remoteAddr: "192.0.2.1:1234", tls: meshTLS("https://payments.example.com", true)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.TLS = tt.tls
+			if len(tt.header) > 0 {
+				req.Header.Set("X-Spiffe-Id", tt.header)
+			}
+			id := mesh.identity(req)
+			assert.Equal(t, tt.expect, id)
+			assert.Equal(t, tt.matches, mesh.matches(id))
+			if tt.stripped {
+				assert.Empty(t, req.Header.Get("X-Spiffe-Id"), "the identity sent by a client is never trusted")
+			}
+		})
+	}
+}
+
+func TestModsecurity_MeshIdentities(t *testing.T) {
+	var wafBodies []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		wafBodies = append(wafBodies, string(body))
+	}))
+	defer wafServer.Close()
+
+	for _, action := range []string{meshActionSkip, meshActionHeaders} {
+		wafBodies = nil
+		config := CreateConfig()
+		config.ModSecurityUrl = wafServer.URL
+		config.MeshIdentities = []string{"spiffe://cluster.local/ns/payments/"}
+		config.MeshIdentityAction = action
+		var serviceBody string
+		middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			serviceBody = string(body)
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/charge", strings.NewReader("amount=10"))
+		req.TLS = meshTLS("spiffe://cluster.local/ns/payments/sa/api", true)
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "amount=10", serviceBody)
+		if action == meshActionSkip {
+			assert.Empty(t, wafBodies, "mesh requests are not inspected")
+		} else {
+			assert.Equal(t, []string{""}, wafBodies, "only the headers of mesh requests are inspected")
+		}
+
+		wafBodies = nil
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/charge", strings.NewReader("amount=10")))
+		assert.Equal(t, []string{"amount=10"}, wafBodies, "edge requests are fully inspected")
+	}
+}
@@ -0,0 +1,55 @@
+package traefik_modsecurity_plugin
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MethodRule restricts the HTTP methods accepted on paths matching Path.
+type MethodRule struct {
+	Path    string   `json:"path" description:"path pattern"`
+	Methods []string `json:"methods" description:"methods allowed on the matching paths"`
+}
+
+type compiledMethodRule struct {
+	path    *regexp.Regexp
+	methods map[string]bool
+	allow   string
+}
+
+// methodRules enforces AllowedMethods locally. The first rule whose path matches decides.
+type methodRules []compiledMethodRule
+
+func newMethodRules(rules []MethodRule) (methodRules, error) {
+	compiled := make(methodRules, 0, len(rules))
+	for _, rule := range rules {
+		paths, err := compileRegexps("allowedMethods", []string{rule.Path})
+		if err != nil {
+			return nil, err
+		}
+		methods := make(map[string]bool, len(rule.Methods))
+		allow := make([]string, 0, len(rule.Methods))
+		for _, method := range rule.Methods {
+			method = strings.ToUpper(method)
+			methods[method] = true
+			allow = append(allow, method)
+		}
+		compiled = append(compiled, compiledMethodRule{
+			path:    paths[0],
+			methods: methods,
+			allow:   strings.Join(allow, ", "),
+		})
+	}
+	return compiled, nil
+}
+
+// allowed reports whether method is accepted on path. When it is not, the value of the Allow
+// response header is returned as well.
+func (r methodRules) allowed(path string, method string) (bool, string) {
+	for _, rule := range r {
+		if rule.path.MatchString(path) {
+			return rule.methods[method], rule.allow
+		}
+	}
+	return true, ""
+}
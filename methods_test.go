@@ -0,0 +1,57 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMethodRules_allowed(t *testing.T) {
+	rules, err := newMethodRules([]MethodRule{
+		{Path: "^/login$", Methods: []string{"get", "POST"}},
+		{Path: "^/static/", Methods: []string{"GET", "HEAD"}},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		path        string
+		method      string
+		expect      bool
+		expectAllow string
+	}{
+		{name: "Allowed method", path: "/login", method: http.MethodPost, expect: true, expectAllow: "GET, POST"},
+		{name: "Forbidden method", path: "/login", method: http.MethodDelete, expect: false, expectAllow: "GET, POST"},
+		{name: "Second rule", path: "/static/app.js", method: http.MethodPut, expect: false, expectAllow: "GET, HEAD"},
+		{name: "No matching rule", path: "/api", method: http.MethodDelete, expect: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, allow := rules.allowed(tt.path, tt.method)
+			assert.Equal(t, tt.expect, allowed)
+			assert.Equal(t, tt.expectAllow, allow)
+		})
+	}
+}
+
+func TestModsecurity_AllowedMethods(t *testing.T) {
+	wafCalled := false
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalled = true
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.AllowedMethods = []MethodRule{{Path: "^/login$", Methods: []string{"GET", "POST"}}}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPut, "/login", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	assert.Equal(t, "GET, POST", rw.Header().Get("Allow"))
+	assert.False(t, wafCalled)
+}
@@ -0,0 +1,254 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the internal counters of a middleware instance.
+// Fields are updated with sync/atomic.
+type metrics struct {
+	wafInFlight      int64
+	wafQueueLength   int64
+	wafQueueRejected int64
+	verdictCacheHits int64
+	// budgetSwitches counts the switches to and from the degraded mode of errorBudget.
+	budgetSwitches int64
+	// wafErrors counts WAF failures by error category. The map is never modified after
+	// newMetrics, only the counters it points to.
+	wafErrors map[string]*int64
+
+	// routes holds the body size and WAF duration histograms by route. Past maxRoutes routes, when
+	// positive, new routes count as metricsRouteOther.
+	routesMu  sync.RWMutex
+	routes    map[string]*routeHistograms
+	maxRoutes int
+
+	// blocksByCountry counts the blocked requests by country of the client, with countryDatabase.
+	blocksByCountry countryCounters
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		wafErrors: make(map[string]*int64, len(errorCategories)),
+		routes:    make(map[string]*routeHistograms),
+	}
+	for _, category := range errorCategories {
+		m.wafErrors[category] = new(int64)
+	}
+	return m
+}
+
+func (m *metrics) incWafError(category string) {
+	atomic.AddInt64(m.wafErrors[category], 1)
+}
+
+func (m *metrics) incVerdictCacheHit() {
+	atomic.AddInt64(&m.verdictCacheHits, 1)
+}
+
+func (m *metrics) incErrorBudgetSwitch() {
+	atomic.AddInt64(&m.budgetSwitches, 1)
+}
+
+// snapshot returns the current value of every counter.
+func (m *metrics) snapshot() map[string]int64 {
+	snapshot := map[string]int64{
+		"waf_in_flight":            atomic.LoadInt64(&m.wafInFlight),
+		"waf_queue_length":         atomic.LoadInt64(&m.wafQueueLength),
+		"waf_queue_rejected":       atomic.LoadInt64(&m.wafQueueRejected),
+		"verdict_cache_hits":       atomic.LoadInt64(&m.verdictCacheHits),
+		"error_budget_switches":    atomic.LoadInt64(&m.budgetSwitches),
+		"buffered_bytes_in_flight": atomic.LoadInt64(&bufferedBytesInFlight),
+	}
+	for category, count := range m.wafErrors {
+		snapshot["waf_errors_"+category] = atomic.LoadInt64(count)
+	}
+	m.blocksByCountry.snapshot(snapshot, "blocked_requests_country")
+	m.routesMu.RLock()
+	defer m.routesMu.RUnlock()
+	for route, histograms := range m.routes {
+		histograms.bodySize.snapshot(snapshot, "request_body_bytes", route)
+		histograms.wafDuration.snapshot(snapshot, "waf_duration_ms", route)
+	}
+	return snapshot
+}
+
+// Bucket upper bounds of the histograms.
+var (
+	bodySizeBuckets    = []int64{0, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	wafDurationBuckets = []int64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+)
+
+// metricsRouteOther is the route of the requests matching none of metricsRoutes.
+const metricsRouteOther = "other"
+
+// histogram counts observations in cumulative buckets, like Prometheus histograms.
+// Counters are updated with sync/atomic.
+type histogram struct {
+	bounds []int64
+	// counts has one more counter than bounds, for the observations above the last bound.
+	counts []int64
+	count  int64
+	sum    int64
+}
+
+func newHistogram(bounds []int64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(value int64) {
+	i := 0
+	for i < len(h.bounds) && value > h.bounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, value)
+}
+
+// snapshot adds the buckets, count and sum of the histogram named name to snapshot, labelled
+// with route.
+func (h *histogram) snapshot(snapshot map[string]int64, name string, route string) {
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		snapshot[fmt.Sprintf("%s_bucket{route=%q,le=\"%d\"}", name, route, bound)] = cumulative
+	}
+	cumulative += atomic.LoadInt64(&h.counts[len(h.bounds)])
+	snapshot[fmt.Sprintf("%s_bucket{route=%q,le=\"+Inf\"}", name, route)] = cumulative
+	snapshot[fmt.Sprintf("%s_count{route=%q}", name, route)] = atomic.LoadInt64(&h.count)
+	snapshot[fmt.Sprintf("%s_sum{route=%q}", name, route)] = atomic.LoadInt64(&h.sum)
+}
+
+// routeHistograms are the histograms of one route.
+type routeHistograms struct {
+	bodySize    *histogram
+	wafDuration *histogram
+}
+
+// route returns the histograms of route, creating them on first use. The number of routes is
+// bounded by metricsRoutes and metricsPathTemplates, and by maxRoutes for collapsed paths.
+func (m *metrics) route(route string) *routeHistograms {
+	m.routesMu.RLock()
+	histograms, ok := m.routes[route]
+	m.routesMu.RUnlock()
+	if ok {
+		return histograms
+	}
+
+	m.routesMu.Lock()
+	defer m.routesMu.Unlock()
+	if histograms, ok := m.routes[route]; ok {
+		return histograms
+	}
+	if m.maxRoutes > 0 && len(m.routes) >= m.maxRoutes {
+		route = metricsRouteOther
+		if histograms, ok := m.routes[route]; ok {
+			return histograms
+		}
+	}
+	histograms = &routeHistograms{
+		bodySize:    newHistogram(bodySizeBuckets),
+		wafDuration: newHistogram(wafDurationBuckets),
+	}
+	m.routes[route] = histograms
+	return histograms
+}
+
+// observeBodySize records the size of the body sent to the WAF, nil for requests without body.
+func (m *metrics) observeBodySize(route string, body *bufferedBody) {
+	var size int64
+	if body != nil {
+		size = body.wafLength()
+	}
+	m.route(route).bodySize.observe(size)
+}
+
+// observeWafDuration records the time the WAF took to answer.
+func (m *metrics) observeWafDuration(route string, duration time.Duration) {
+	m.route(route).wafDuration.observe(int64(duration / time.Millisecond))
+}
+
+// metricsRoute returns the first of metricsPathTemplates matching path, or the longest of
+// metricsRoutes prefixing path. Other paths are metricsRouteOther, or with metricsCollapseIds
+// the path where identifier segments are replaced by :id.
+func (a *Modsecurity) metricsRoute(path string) string {
+	for _, template := range a.metricsPathTemplates {
+		if template.match(path) {
+			return template.template
+		}
+	}
+	route := metricsRouteOther
+	for _, prefix := range a.metricsRoutes {
+		if strings.HasPrefix(path, prefix) && (route == metricsRouteOther || len(prefix) > len(route)) {
+			route = prefix
+		}
+	}
+	if route == metricsRouteOther && a.metricsCollapseIds {
+		return collapseIdSegments(path)
+	}
+	return route
+}
+
+// metricsIdSegment matches the path segments collapsed by metricsCollapseIds: numbers, UUIDs and
+// long hexadecimal strings.
+var metricsIdSegment = regexp.MustCompile(`^(?:[0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+func collapseIdSegments(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if metricsIdSegment.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// pathTemplate matches paths segment by segment, e.g. /users/:id/orders. A :name segment matches
+// any non-empty segment, a final * segment matches the remainder of the path.
+type pathTemplate struct {
+	template string
+	segments []string
+}
+
+func newPathTemplates(templates []string) ([]pathTemplate, error) {
+	compiled := make([]pathTemplate, 0, len(templates))
+	for _, template := range templates {
+		if !strings.HasPrefix(template, "/") {
+			return nil, fmt.Errorf("invalid metricsPathTemplates template %q, expected a path", template)
+		}
+		segments := strings.Split(template, "/")[1:]
+		for i, segment := range segments {
+			if segment == "*" && i != len(segments)-1 {
+				return nil, fmt.Errorf("invalid metricsPathTemplates template %q, * must be the last segment", template)
+			}
+		}
+		compiled = append(compiled, pathTemplate{template: template, segments: segments})
+	}
+	return compiled, nil
+}
+
+func (t pathTemplate) match(path string) bool {
+	segments := strings.Split(path, "/")[1:]
+	for i, segment := range t.segments {
+		if segment == "*" {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(segment, ":") {
+			if len(segments[i]) == 0 {
+				return false
+			}
+		} else if segment != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(t.segments)
+}
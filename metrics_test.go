@@ -0,0 +1,115 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]int64{10, 100})
+	for _, value := range []int64{0, 10, 11, 100, 1000} {
+		h.observe(value)
+	}
+
+	snapshot := map[string]int64{}
+	h.snapshot(snapshot, "size", "/api")
+	assert.Equal(t, map[string]int64{
+		`size_bucket{route="/api",le="10"}`:   2,
+		`size_bucket{route="/api",le="100"}`:  4,
+		`size_bucket{route="/api",le="+Inf"}`: 5,
+		`size_count{route="/api"}`:            5,
+		`size_sum{route="/api"}`:              1121,
+	}, snapshot)
+}
+
+func TestModsecurity_MetricsRoute(t *testing.T) {
+	a := &Modsecurity{metricsRoutes: []string{"/api", "/api/admin", "/static"}}
+	tests := []struct {
+		path   string
+		expect string
+	}{
+		{path: "/", expect: metricsRouteOther},
+		{path: "/api/users", expect: "/api"},
+		{path: "/api/admin/users", expect: "/api/admin"},
+		{path: "/static/app.js", expect: "/static"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.expect, a.metricsRoute(tt.path))
+		})
+	}
+}
+
+func TestModsecurity_MetricsRouteTemplates(t *testing.T) {
+	templates, err := newPathTemplates([]string{"/users/:id", "/users/:id/orders/:order", "/assets/*"})
+	assert.NoError(t, err)
+	a := &Modsecurity{metricsPathTemplates: templates, metricsRoutes: []string{"/api"}, metricsCollapseIds: true}
+	tests := []struct {
+		path   string
+		expect string
+	}{
+		{path: "/users/123", expect: "/users/:id"},
+		{path: "/users/john/orders/42", expect: "/users/:id/orders/:order"},
+		{path: "/users/", expect: "/users/"},
+		{path: "/users/123/profile", expect: "/users/:id/profile"},
+		{path: "/assets/css/app.css", expect: "/assets/*"},
+		{path: "/api/orders/123", expect: "/api"},
+		{path: "/files/550e8400-e29b-41d4-a716-446655440000/v/0123456789abcdef", expect: "/files/:id/v/:id"},
+		{path: "/about", expect: "/about"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.expect, a.metricsRoute(tt.path))
+		})
+	}
+
+	_, err = newPathTemplates([]string{"users/:id"})
+	assert.EqualError(t, err, `invalid metricsPathTemplates template "users/:id", expected a path`)
+	_, err = newPathTemplates([]string{"/assets/*/app.js"})
+	assert.EqualError(t, err, `invalid metricsPathTemplates template "/assets/*/app.js", * must be the last segment`)
+}
+
+func TestMetrics_maxRoutes(t *testing.T) {
+	m := newMetrics()
+	m.maxRoutes = 2
+	m.observeWafDuration("/a", time.Millisecond)
+	m.observeWafDuration("/b", time.Millisecond)
+	m.observeWafDuration("/c", time.Millisecond)
+	m.observeWafDuration("/a", time.Millisecond)
+
+	snapshot := m.snapshot()
+	assert.Equal(t, int64(2), snapshot[`waf_duration_ms_count{route="/a"}`])
+	assert.Equal(t, int64(1), snapshot[`waf_duration_ms_count{route="/b"}`])
+	assert.Equal(t, int64(1), snapshot[`waf_duration_ms_count{route="other"}`])
+	_, ok := snapshot[`waf_duration_ms_count{route="/c"}`]
+	assert.False(t, ok)
+}
+
+func TestModsecurity_SizeAndDurationMetrics(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(3 * time.Millisecond)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.MetricsRoutes = []string{"/api"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(strings.Repeat("a", 2000))))
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	snapshot := middleware.metrics.snapshot()
+	assert.Equal(t, int64(0), snapshot[`request_body_bytes_bucket{route="/api",le="1024"}`])
+	assert.Equal(t, int64(1), snapshot[`request_body_bytes_bucket{route="/api",le="4096"}`])
+	assert.Equal(t, int64(2000), snapshot[`request_body_bytes_sum{route="/api"}`])
+	assert.Equal(t, int64(1), snapshot[`request_body_bytes_bucket{route="other",le="0"}`])
+	assert.Equal(t, int64(0), snapshot[`waf_duration_ms_bucket{route="/api",le="2"}`])
+	assert.Equal(t, int64(1), snapshot[`waf_duration_ms_count{route="/api"}`])
+	assert.Equal(t, int64(1), snapshot[`waf_duration_ms_count{route="other"}`])
+}
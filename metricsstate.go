@@ -0,0 +1,148 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metricsStateVersion is the version of the metricsStateFile format.
+const metricsStateVersion = 1
+
+// metricsState persists the cumulative counters of a middleware in a file, so that the dynamic
+// configuration reloads of Traefik, which create a new instance, don't reset the counters alerting
+// depends on. Gauges and histograms are not persisted.
+type metricsState struct {
+	path string
+	name string
+	// readOnly is set when the directory of path isn't writable, the counters are then only restored.
+	readOnly bool
+}
+
+// metricsStateFile is the content of the state file.
+type metricsStateFile struct {
+	Version    int              `json:"version"`
+	Middleware string           `json:"middleware"`
+	SavedAt    time.Time        `json:"saved_at"`
+	Counters   map[string]int64 `json:"counters"`
+}
+
+func newMetricsState(path string, name string) *metricsState {
+	if len(path) == 0 {
+		return nil
+	}
+	return &metricsState{path: path, name: name}
+}
+
+// load adds the counters saved in the state file to m. A missing file is not an error, it is
+// created by the first save.
+func (s *metricsState) load(m *metrics) error {
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state metricsStateFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("invalid metrics state file %s: %w", s.path, err)
+	}
+	if state.Version != metricsStateVersion || state.Middleware != s.name {
+		return fmt.Errorf("metrics state file %s holds the counters of middleware %q, version %d", s.path, state.Middleware, state.Version)
+	}
+	m.restore(state.Counters)
+	return nil
+}
+
+// save writes the counters of m to the state file. The content is written to a temporary file
+// renamed over the state file, a crash never leaves a truncated state.
+func (s *metricsState) save(m *metrics, now time.Time) error {
+	if s.readOnly {
+		return nil
+	}
+	content, err := json.Marshal(metricsStateFile{
+		Version:    metricsStateVersion,
+		Middleware: s.name,
+		SavedAt:    now.UTC(),
+		Counters:   m.counters(),
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// counters returns the cumulative counters of m, under their snapshot names.
+func (m *metrics) counters() map[string]int64 {
+	counters := map[string]int64{
+		"waf_queue_rejected":    atomic.LoadInt64(&m.wafQueueRejected),
+		"verdict_cache_hits":    atomic.LoadInt64(&m.verdictCacheHits),
+		"error_budget_switches": atomic.LoadInt64(&m.budgetSwitches),
+	}
+	for category, count := range m.wafErrors {
+		counters["waf_errors_"+category] = atomic.LoadInt64(count)
+	}
+	m.blocksByCountry.snapshot(counters, "blocked_requests_country")
+	return counters
+}
+
+// restore adds counters, as returned by counters, to m. Unknown counters are ignored.
+func (m *metrics) restore(counters map[string]int64) {
+	for name, value := range counters {
+		switch {
+		case name == "waf_queue_rejected":
+			atomic.AddInt64(&m.wafQueueRejected, value)
+		case name == "verdict_cache_hits":
+			atomic.AddInt64(&m.verdictCacheHits, value)
+		case name == "error_budget_switches":
+			atomic.AddInt64(&m.budgetSwitches, value)
+		case strings.HasPrefix(name, "waf_errors_"):
+			if count, ok := m.wafErrors[strings.TrimPrefix(name, "waf_errors_")]; ok {
+				atomic.AddInt64(count, value)
+			}
+		case strings.HasPrefix(name, "blocked_requests_country_"):
+			m.blocksByCountry.add(strings.TrimPrefix(name, "blocked_requests_country_"), value)
+		}
+	}
+}
+
+// runMetricsState saves the counters every interval, until ctx is done.
+func (a *Modsecurity) runMetricsState(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.saveMetricsState()
+		}
+	}
+}
+
+func (a *Modsecurity) saveMetricsState() {
+	if err := a.metricsState.save(a.metrics, time.Now()); err != nil {
+		a.logEvent("metrics_state_error", logFields{"file": a.metricsState.path, "error": err.Error()})
+	}
+}
@@ -0,0 +1,59 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	state := newMetricsState(path, "waf")
+	assert.Nil(t, newMetricsState("", "waf"))
+
+	m := newMetrics()
+	assert.NoError(t, state.load(m), "a missing file is created by the first save")
+	m.incWafError(errorCategoryTimeout)
+	m.incVerdictCacheHit()
+	m.blocksByCountry.inc("FR")
+	m.blocksByCountry.inc("FR")
+	m.wafInFlight = 3
+	assert.NoError(t, state.save(m, time.Now()))
+
+	restored := newMetrics()
+	restored.incWafError(errorCategoryTimeout)
+	assert.NoError(t, state.load(restored))
+	snapshot := restored.snapshot()
+	assert.Equal(t, int64(2), snapshot["waf_errors_timeout"], "saved counters are added to the current ones")
+	assert.Equal(t, int64(1), snapshot["verdict_cache_hits"])
+	assert.Equal(t, int64(2), snapshot["blocked_requests_country_FR"])
+	assert.Equal(t, int64(0), snapshot["waf_in_flight"], "gauges are not persisted")
+
+	assert.EqualError(t, newMetricsState(path, "other").load(newMetrics()), `metrics state file `+path+` holds the counters of middleware "waf", version 1`)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	assert.Error(t, state.load(newMetrics()))
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1, "no temporary file is left behind")
+}
+
+func TestModsecurity_MetricsStateFile(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.MetricsStateFile = filepath.Join(t.TempDir(), "metrics.json")
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.NoError(t, err)
+	middleware.(*Modsecurity).metrics.incWafError(errorCategoryRefused)
+	assert.NoError(t, middleware.(*Modsecurity).Close())
+
+	reloaded, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.NoError(t, err)
+	defer reloaded.(*Modsecurity).Close()
+	assert.Equal(t, int64(1), reloaded.(*Modsecurity).metrics.snapshot()["waf_errors_refused"], "the counters survive a reload")
+}
@@ -0,0 +1,259 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata section at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSeparator is the size of the zeroed section between the search tree and the data section.
+const mmdbDataSeparator = 16
+
+var errMmdbInvalid = errors.New("invalid MaxMind DB")
+
+// mmdbReader is a minimal reader of the MaxMind DB format (https://maxmind.github.io/MaxMind-DB/),
+// enough to look up records such as the ones of the GeoLite2 ASN database. The whole file is
+// loaded in memory.
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	ipv4Start  uint
+}
+
+func openMMDB(file string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	start := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", errMmdbInvalid)
+	}
+	metadataStart := uint(start + len(mmdbMetadataMarker))
+	decoded, _, err := (&mmdbReader{buf: buf}).decode(metadataStart, metadataStart)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errMmdbInvalid)
+	}
+	r := &mmdbReader{buf: buf}
+	for key, field := range map[string]*uint{"node_count": &r.nodeCount, "record_size": &r.recordSize, "ip_version": &r.ipVersion} {
+		value, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%w: missing %s", errMmdbInvalid, key)
+		}
+		*field = uint(value)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", errMmdbInvalid, r.recordSize)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	if r.treeSize+mmdbDataSeparator > uint(start) {
+		return nil, fmt.Errorf("%w: search tree larger than the file", errMmdbInvalid)
+	}
+
+	// IPv4 addresses live in the ::/96 subtree of IPv6 databases
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := r.buf[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buf[offset : offset+4]))
+	}
+}
+
+// lookup returns the record of the network containing ip, or nil when there is none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	if bits == nil {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-uint(i%8))&1))
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("%w: search tree deeper than the address", errMmdbInvalid)
+	}
+	dataStart := r.treeSize + mmdbDataSeparator
+	value, _, err := r.decode(dataStart, dataStart+node-r.nodeCount-mmdbDataSeparator)
+	return value, err
+}
+
+// decode decodes the field at offset of the section starting at base, against which pointers are
+// resolved. It returns the value and the offset of the next field.
+func (r *mmdbReader) decode(base uint, offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(r.buf)) {
+		return nil, 0, fmt.Errorf("%w: offset out of range", errMmdbInvalid)
+	}
+	ctrl := r.buf[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == 0 {
+		if offset >= uint(len(r.buf)) {
+			return nil, 0, fmt.Errorf("%w: truncated field", errMmdbInvalid)
+		}
+		kind = 7 + uint(r.buf[offset])
+		offset++
+	}
+
+	if kind == 1 {
+		// pointer
+		ss := uint(ctrl>>3) & 0x3
+		bs, err := r.bytes(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		pointer := uint(0)
+		if ss < 3 {
+			pointer = uint(ctrl & 0x7)
+		}
+		for _, b := range bs {
+			pointer = pointer<<8 | uint(b)
+		}
+		pointer += [...]uint{0, 2048, 526336, 0}[ss]
+		value, _, err := r.decode(base, base+pointer)
+		return value, offset + ss + 1, err
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		bs, err := r.bytes(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = 0
+		for _, b := range bs {
+			size = size<<8 | uint(b)
+		}
+		size += [...]uint{0, 29, 285, 65821}[extra]
+		offset += extra
+	}
+
+	switch kind {
+	case 7:
+		// map
+		value := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := r.decode(base, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", errMmdbInvalid)
+			}
+			value[name], offset, err = r.decode(base, next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case 11:
+		// array
+		value := make([]interface{}, size)
+		for i := range value {
+			var err error
+			value[i], offset, err = r.decode(base, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case 14:
+		// boolean, its value is the size
+		return size != 0, offset, nil
+	}
+
+	bs, err := r.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case 2:
+		return string(bs), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: invalid double size", errMmdbInvalid)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(bs)), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: invalid float size", errMmdbInvalid)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(bs))), offset, nil
+	case 4, 10:
+		// bytes, and uint128 which doesn't fit a uint64
+		return bs, offset, nil
+	case 5, 6, 9:
+		value := uint64(0)
+		for _, b := range bs {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+	case 8:
+		value := int32(0)
+		for _, b := range bs {
+			value = value<<8 | int32(b)
+		}
+		return int64(value), offset, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unsupported data type %d", errMmdbInvalid, kind)
+}
+
+func (r *mmdbReader) bytes(offset uint, size uint) ([]byte, error) {
+	if offset+size > uint(len(r.buf)) {
+		return nil, fmt.Errorf("%w: truncated field", errMmdbInvalid)
+	}
+	return r.buf[offset : offset+size], nil
+}
@@ -0,0 +1,170 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAsnNetwork struct {
+	cidr string
+	asn  uint32
+	org  string
+	// country is the ISO code of the country of the network, omitted from the record when empty.
+	country string
+}
+
+func mmdbControl(kind byte, size int) []byte {
+	if size < 29 {
+		return []byte{kind<<5 | byte(size)}
+	}
+	return []byte{kind<<5 | 29, byte(size - 29)}
+}
+
+func mmdbString(s string) []byte {
+	return append(mmdbControl(2, len(s)), s...)
+}
+
+func mmdbUint(kind byte, size int, value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return append(mmdbControl(kind, size), buf[4-size:]...)
+}
+
+// buildTestMMDB writes a MaxMind ASN database with 24 bits records holding networks.
+// The records after the first one refer to the organization key of the first one with a pointer.
+// IPv6 networks are skipped in IPv4 databases. Networks with a country also hold the country
+// fields of the MaxMind country databases.
+func buildTestMMDB(t *testing.T, ipVersion int, networks []testAsnNetwork) string {
+	t.Helper()
+
+	type record struct {
+		node int
+		data int
+	}
+	nodes := [][2]record{{{node: -1, data: -1}, {node: -1, data: -1}}}
+	var data []byte
+	var recordOffsets []int
+	orgKeyOffset := -1
+	for i, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		assert.NoError(t, err)
+		ones, _ := ipNet.Mask.Size()
+		bits := []byte(ipNet.IP.To16())
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			bits = ip4
+			if ipVersion == 6 {
+				bits = append(make([]byte, 12), ip4...)
+				ones += 96
+			}
+		} else if ipVersion == 4 {
+			recordOffsets = append(recordOffsets, -1)
+			continue
+		}
+
+		recordOffsets = append(recordOffsets, len(data))
+		if len(network.country) > 0 {
+			data = append(data, mmdbControl(7, 3)...)
+			data = append(data, mmdbString("country")...)
+			data = append(data, mmdbControl(7, 1)...)
+			data = append(data, mmdbString("iso_code")...)
+			data = append(data, mmdbString(network.country)...)
+		} else {
+			data = append(data, mmdbControl(7, 2)...)
+		}
+		data = append(data, mmdbString("autonomous_system_number")...)
+		data = append(data, mmdbUint(6, 4, network.asn)...)
+		if orgKeyOffset < 0 {
+			orgKeyOffset = len(data)
+			data = append(data, mmdbString("autonomous_system_organization")...)
+		} else {
+			data = append(data, 1<<5|byte(orgKeyOffset>>8), byte(orgKeyOffset))
+		}
+		data = append(data, mmdbString(network.org)...)
+
+		node := 0
+		for depth := 0; depth < ones; depth++ {
+			bit := bits[depth/8] >> (7 - uint(depth%8)) & 1
+			if depth == ones-1 {
+				nodes[node][bit] = record{node: -1, data: i}
+				break
+			}
+			if nodes[node][bit].node < 0 {
+				nodes = append(nodes, [2]record{{node: -1, data: -1}, {node: -1, data: -1}})
+				nodes[node][bit] = record{node: len(nodes) - 1, data: -1}
+			}
+			node = nodes[node][bit].node
+		}
+	}
+
+	var file []byte
+	nodeCount := len(nodes)
+	for _, n := range nodes {
+		for _, r := range n {
+			value := nodeCount
+			switch {
+			case r.node >= 0:
+				value = r.node
+			case r.data >= 0:
+				value = nodeCount + mmdbDataSeparator + recordOffsets[r.data]
+			}
+			file = append(file, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	file = append(file, make([]byte, mmdbDataSeparator)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, mmdbControl(7, 3)...)
+	file = append(file, mmdbString("node_count")...)
+	file = append(file, mmdbUint(6, 4, uint32(nodeCount))...)
+	file = append(file, mmdbString("record_size")...)
+	file = append(file, mmdbUint(5, 2, 24)...)
+	file = append(file, mmdbString("ip_version")...)
+	file = append(file, mmdbUint(5, 2, uint32(ipVersion))...)
+
+	path := filepath.Join(t.TempDir(), "asn.mmdb")
+	assert.NoError(t, ioutil.WriteFile(path, file, 0600))
+	return path
+}
+
+func TestMMDBReader_lookup(t *testing.T) {
+	networks := []testAsnNetwork{
+		{cidr: "192.0.2.0/24", asn: 64496, org: "Example Hosting"},
+		{cidr: "2001:db8::/32", asn: 64497, org: "Example VPN"},
+		{cidr: "198.51.100.0/25", asn: 64498, org: "Example ISP"},
+	}
+	for _, ipVersion := range []int{4, 6} {
+		db, err := openMMDB(buildTestMMDB(t, ipVersion, networks))
+		assert.NoError(t, err)
+
+		tests := []struct {
+			ip     string
+			expect interface{}
+		}{
+			{ip: "192.0.2.1", expect: map[string]interface{}{"autonomous_system_number": uint64(64496), "autonomous_system_organization": "Example Hosting"}},
+			{ip: "198.51.100.127", expect: map[string]interface{}{"autonomous_system_number": uint64(64498), "autonomous_system_organization": "Example ISP"}},
+			{ip: "198.51.100.128", expect: nil},
+			{ip: "203.0.113.1", expect: nil},
+		}
+		if ipVersion == 6 {
+			tests = append(tests, struct {
+				ip     string
+				expect interface{}
+			}{ip: "2001:db8:1::1", expect: map[string]interface{}{"autonomous_system_number": uint64(64497), "autonomous_system_organization": "Example VPN"}})
+		}
+		for _, tt := range tests {
+			record, err := db.lookup(net.ParseIP(tt.ip))
+			assert.NoError(t, err, tt.ip)
+			assert.Equal(t, tt.expect, record, "%s in IPv%d database", tt.ip, ipVersion)
+		}
+	}
+}
+
+func TestNewMMDBReader_invalid(t *testing.T) {
+	_, err := newMMDBReader([]byte("not a database"))
+	assert.ErrorIs(t, err, errMmdbInvalid)
+}
@@ -6,24 +6,240 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 )
 
-// Net client is a custom client to timeout after 2 seconds if the service is not ready
-var httpClient = &http.Client{
-	Timeout: time.Second * 2,
+// newWafClient returns the client calling the WAF. Every plugin instance owns its client, so
+// instances with different WAF URLs and timeouts don't share settings or connection pools.
+func newWafClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: newTransport(),
+	}
+}
+
+// newTransport returns the transport used to call the WAF. It keeps more idle connections per host
+// than the default transport, so that warmed connections are not dropped.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+	return transport
 }
 
 // Config the plugin configuration.
 type Config struct {
-	ModSecurityUrl   string `json:"modSecurityUrl,omitempty"`
-	MaxBodySize      int64  `json:"maxBodySize"`
-	InterruptOnError bool   `json:"InterruptOnError"`
-	Ignore500Error   bool   `json:"Ignore500Error"`
+	ModSecurityUrl          string              `json:"modSecurityUrl,omitempty" description:"URL of the ModSecurity server"`
+	MaxBodySize             int64               `json:"maxBodySize" description:"maximum size in bytes of the request bodies buffered for inspection"`
+	InterruptOnError        bool                `json:"interruptOnError" description:"answer with an error instead of forwarding the request when the WAF fails"`
+	Ignore500Error          bool                `json:"ignore500Error" description:"forward the request when the WAF answers with a 5xx"`
+	MaskBlockResponse       bool                `json:"maskBlockResponse,omitempty" description:"answer blocked requests with a generic body instead of the WAF response"`
+	Mode                    string              `json:"mode,omitempty" description:"enforce to block requests, detect to only log the WAF verdicts"`
+	Schedules               []Schedule          `json:"schedules,omitempty" description:"time windows overriding the mode"`
+	ScheduleTimezone        string              `json:"scheduleTimezone,omitempty" description:"IANA time zone of the schedules"`
+	ClientFingerprint       bool                `json:"clientFingerprint,omitempty" description:"send a client fingerprint to the WAF"`
+	FingerprintHeader       string              `json:"fingerprintHeader,omitempty" description:"header carrying the client fingerprint"`
+	ParanoiaLevel           int                 `json:"paranoiaLevel,omitempty" description:"CRS paranoia level requested from the WAF"`
+	ParanoiaLevels          []ParanoiaLevelRule `json:"paranoiaLevels,omitempty" description:"paranoia levels by path"`
+	ParanoiaLevelHeader     string              `json:"paranoiaLevelHeader,omitempty" description:"header carrying the paranoia level"`
+	RuleIdsHeader           string              `json:"ruleIdsHeader,omitempty" description:"WAF response header listing the matched rule IDs"`
+	IgnoreRuleIds           []string            `json:"ignoreRuleIds,omitempty" description:"rule IDs whose blocks are ignored"`
+	ForwardHeaders          []string            `json:"forwardHeaders,omitempty" description:"only these request headers are sent to the WAF"`
+	DropHeaders             []string            `json:"dropHeaders,omitempty" description:"request headers never sent to the WAF"`
+	UserAgentAllow          []string            `json:"userAgentAllow,omitempty" description:"user agent patterns bypassing the inspection"`
+	UserAgentAllowSources   []string            `json:"userAgentAllowSources,omitempty" description:"client IPs and ranges userAgentAllow applies to"`
+	UserAgentDeny           []string            `json:"userAgentDeny,omitempty" description:"user agent patterns blocked without inspection"`
+	SpoolToDisk             bool                `json:"spoolToDisk,omitempty" description:"spool bodies larger than maxBodySize to a temporary file"`
+	SpoolMaxSize            int64               `json:"spoolMaxSize,omitempty" description:"maximum size in bytes of the spooled bodies"`
+	InspectFirstNBytes      int64               `json:"inspectFirstNBytes,omitempty" description:"inspect only the first bytes of bodies larger than maxBodySize"`
+	TwoPhaseInspection      bool                `json:"twoPhaseInspection,omitempty" description:"inspect the headers while the body is being read"`
+	WarmConnections         int                 `json:"warmConnections,omitempty" description:"number of connections to the WAF opened on startup"`
+	WarmIdleInterval        string              `json:"warmIdleInterval,omitempty" description:"idle duration after which the connections are warmed again"`
+	ErrorPolicy             map[string]string   `json:"errorPolicy,omitempty" description:"interrupt or continue, by category of WAF failure"`
+	MaxConcurrentWafCalls   int                 `json:"maxConcurrentWafCalls,omitempty" description:"maximum number of concurrent WAF calls"`
+	MaxWafQueueLength       int                 `json:"maxWafQueueLength,omitempty" description:"maximum number of requests waiting for a WAF slot"`
+	ConnectPolicy           string              `json:"connectPolicy,omitempty" description:"deny or bypass CONNECT requests"`
+	HeadersOnlyPaths        []string            `json:"headersOnlyPaths,omitempty" description:"path patterns whose bodies are not inspected"`
+	AllowedMethods          []MethodRule        `json:"allowedMethods,omitempty" description:"allowed HTTP methods by path"`
+	BotScoreUrl             string              `json:"botScoreUrl,omitempty" description:"URL of the bot scoring service"`
+	BotScoreTimeout         string              `json:"botScoreTimeout,omitempty" description:"timeout of the bot scoring calls"`
+	BotScoreFailOpen        bool                `json:"botScoreFailOpen" description:"continue when the bot scoring service fails"`
+	BotScoreThreshold       float64             `json:"botScoreThreshold,omitempty" description:"bot score at or above which requests are blocked"`
+	ForwardTLSMetadata      bool                `json:"forwardTLSMetadata,omitempty" description:"send the TLS metadata of the client connection to the WAF"`
+	Ja3Header               string              `json:"ja3Header,omitempty" description:"header carrying the JA3 fingerprint"`
+	ErrorLogInterval        string              `json:"errorLogInterval,omitempty" description:"interval of the error log rate limiting"`
+	ErrorLogBurst           int                 `json:"errorLogBurst,omitempty" description:"errors logged per interval before sampling"`
+	DebugDumpFile           string              `json:"debugDumpFile,omitempty" description:"file receiving the debug dumps"`
+	DebugDumpHeader         string              `json:"debugDumpHeader,omitempty" description:"header selecting the requests to dump"`
+	DebugDumpToken          string              `json:"debugDumpToken,omitempty" description:"value of the debug dump header"`
+	DebugDumpIps            []string            `json:"debugDumpIps,omitempty" description:"client IPs and ranges whose requests are dumped"`
+	DebugDumpLimit          int                 `json:"debugDumpLimit,omitempty" description:"maximum number of dumped requests"`
+	Decision                *DecisionConfig     `json:"decision,omitempty" description:"policy deciding the block from the WAF signals"`
+	AnomalyScoreHeader      string              `json:"anomalyScoreHeader,omitempty" description:"WAF response header carrying the anomaly score"`
+	NormalizeFormBody       bool                `json:"normalizeFormBody,omitempty" description:"decode form bodies before inspection"`
+	CollapseDuplicateParams bool                `json:"collapseDuplicateParams,omitempty" description:"collapse duplicated form parameters before inspection"`
+	CanonicalizeJson        bool                `json:"canonicalizeJson,omitempty" description:"canonicalize JSON bodies before inspection"`
+	ControlCharPolicy       string              `json:"controlCharPolicy,omitempty" description:"sanitize or reject requests with control characters"`
+	MaxWafResponseBytes     int64               `json:"maxWafResponseBytes,omitempty" description:"maximum size in bytes of the forwarded WAF block responses"`
+	WafTimeout              string              `json:"wafTimeout,omitempty" description:"timeout of the WAF calls"`
+	ShutdownTimeout         string              `json:"shutdownTimeout,omitempty" description:"time given to in-flight WAF calls on shutdown"`
+	TlsCertFile             string              `json:"tlsCertFile,omitempty" description:"client certificate presented to the WAF"`
+	TlsKeyFile              string              `json:"tlsKeyFile,omitempty" description:"key of the client certificate"`
+	TlsCaFile               string              `json:"tlsCaFile,omitempty" description:"CA bundle verifying the WAF certificate"`
+	TlsReloadInterval       string              `json:"tlsReloadInterval,omitempty" description:"interval of the TLS files change checks"`
+	IpAllowlist             []string            `json:"ipAllowlist,omitempty" description:"client IPs and ranges bypassing the inspection"`
+	Ipv6PrefixLength        int                 `json:"ipv6PrefixLength,omitempty" description:"prefix length grouping IPv6 clients"`
+	AsnDatabase             string              `json:"asnDatabase,omitempty" description:"MaxMind ASN database file"`
+	CountryDatabase         string              `json:"countryDatabase,omitempty" description:"MaxMind country or city database file"`
+	AsnPolicies             []AsnPolicy         `json:"asnPolicies,omitempty" description:"actions by autonomous system number"`
+	HoneypotPaths           []string            `json:"honeypotPaths,omitempty" description:"path patterns banning the clients requesting them"`
+	BanDuration             string              `json:"banDuration,omitempty" description:"duration of the client bans"`
+	DecoyHeaders            map[string]string   `json:"decoyHeaders,omitempty" description:"fake headers added to the block responses"`
+	DecoyPatterns           []string            `json:"decoyPatterns,omitempty" description:"URI patterns targeting the decoy technologies"`
+	DecoyRiskIncrement      float64             `json:"decoyRiskIncrement,omitempty" description:"risk added to clients following the decoys"`
+	RiskBanThreshold        float64             `json:"riskBanThreshold,omitempty" description:"risk at which clients are banned"`
+	AdaptiveInspection      bool                `json:"adaptiveInspection,omitempty" description:"sample the requests of clients with a clean history"`
+	AdaptiveCleanStreak     int                 `json:"adaptiveCleanStreak,omitempty" description:"clean inspections before a client is sampled"`
+	AdaptiveSampleRate      float64             `json:"adaptiveSampleRate,omitempty" description:"share of the requests of clean clients still inspected"`
+	AdaptiveBlockWindow     string              `json:"adaptiveBlockWindow,omitempty" description:"duration during which blocked clients are fully inspected"`
+	ReplayExportDir         string              `json:"replayExportDir,omitempty" description:"directory receiving replayable copies of requests"`
+	ReplayExportUrl         string              `json:"replayExportUrl,omitempty" description:"URL receiving replayable copies of requests"`
+	ReplayExportFormat      string              `json:"replayExportFormat,omitempty" description:"raw or har"`
+	ReplayExportSampleRate  float64             `json:"replayExportSampleRate,omitempty" description:"share of the clean requests exported"`
+	AuditS3Endpoint         string              `json:"auditS3Endpoint,omitempty" description:"S3-compatible endpoint archiving the audit events"`
+	AuditS3Bucket           string              `json:"auditS3Bucket,omitempty" description:"bucket of the audit archive"`
+	AuditS3Prefix           string              `json:"auditS3Prefix,omitempty" description:"object key prefix of the audit archive"`
+	AuditS3Region           string              `json:"auditS3Region,omitempty" description:"region signing the uploads"`
+	AuditS3AccessKey        string              `json:"auditS3AccessKey,omitempty" description:"access key signing the uploads"`
+	AuditS3SecretKey        string              `json:"auditS3SecretKey,omitempty" description:"secret key signing the uploads"`
+	AuditS3Interval         string              `json:"auditS3Interval,omitempty" description:"interval of the audit uploads"`
+	AuditS3BatchSize        int                 `json:"auditS3BatchSize,omitempty" description:"pending events triggering an upload"`
+	NotifyWebhookUrl        string              `json:"notifyWebhookUrl,omitempty" description:"chat webhook notified when critical rules fire"`
+	NotifyWebhookType       string              `json:"notifyWebhookType,omitempty" description:"slack, discord or teams"`
+	NotifyRuleIds           []string            `json:"notifyRuleIds,omitempty" description:"critical rule IDs"`
+	NotifyInterval          string              `json:"notifyInterval,omitempty" description:"minimum interval between notifications of a rule"`
+	AlertWebhookUrl         string              `json:"alertWebhookUrl,omitempty" description:"incident management endpoint alerted on WAF outages"`
+	AlertWebhookType        string              `json:"alertWebhookType,omitempty" description:"pagerduty or opsgenie"`
+	AlertIntegrationKey     string              `json:"alertIntegrationKey,omitempty" description:"routing key or API key of the incident management service"`
+	AlertOutageThreshold    string              `json:"alertOutageThreshold,omitempty" description:"failure duration raising an incident"`
+	MetricsRoutes           []string            `json:"metricsRoutes,omitempty" description:"path prefixes bucketing the histograms"`
+	ExpvarMetrics           bool                `json:"expvarMetrics,omitempty" description:"publish the counters with expvar"`
+	PprofLabels             bool                `json:"pprofLabels,omitempty" description:"label the WAF calls for pprof"`
+	ChaosLatency            string              `json:"chaosLatency,omitempty" description:"latency injected in the WAF calls, testing only"`
+	ChaosErrorRate          float64             `json:"chaosErrorRate,omitempty" description:"share of the WAF calls answered with a 502, testing only"`
+	ChaosDropRate           float64             `json:"chaosDropRate,omitempty" description:"share of the WAF calls dropped, testing only"`
+	SchemaEndpoint          string              `json:"schemaEndpoint,omitempty" description:"path answering with the JSON schema of the configuration"`
+	StrictConfig            bool                `json:"strictConfig,omitempty" description:"reject unknown configuration keys instead of logging them"`
+	// legacyKeys lists the deprecated spellings of option keys used in a JSON configuration.
+	legacyKeys []string
+	// setKeys lists the options set by a JSON configuration, it is nil for the other configurations.
+	setKeys map[string]bool
+	// UnknownFields collects the keys matching no option, Traefik decodes the configuration with mapstructure.
+	UnknownFields                map[string]interface{} `json:"-" mapstructure:",remain"`
+	UseForwardedUri              bool                   `json:"useForwardedUri,omitempty" description:"send the path rewritten by the previous middlewares instead of the client request target"`
+	ForwardedHeadersPolicy       string                 `json:"forwardedHeadersPolicy,omitempty" description:"passthrough, overwrite or strip the X-Forwarded-* headers sent to the WAF"`
+	Profile                      string                 `json:"profile,omitempty" description:"preset: strict, balanced, permissive, api or static-site"`
+	ExclusionPacks               []ExclusionPackRule    `json:"exclusionPacks,omitempty" description:"CRS exclusion packs by path"`
+	ExclusionsHeader             string                 `json:"exclusionsHeader,omitempty" description:"header carrying the exclusion packs"`
+	Pipeline                     []InspectionStage      `json:"pipeline,omitempty" description:"inspection services called after the WAF, in order"`
+	PipelineShortCircuit         string                 `json:"pipelineShortCircuit,omitempty" description:"block or never: stop the pipeline at the first blocking stage"`
+	PipelineAggregation          string                 `json:"pipelineAggregation,omitempty" description:"sum or max of the weighted stage anomaly scores"`
+	BackendProtocol              string                 `json:"backendProtocol,omitempty" description:"http to mirror the requests to the WAF, ext_authz to call an Envoy ext_authz gRPC service, icap to call an ICAP REQMOD service"`
+	OpenApiSpec                  string                 `json:"openApiSpec,omitempty" description:"OpenAPI 3 document in JSON the requests are validated against"`
+	OpenApiBasePath              string                 `json:"openApiBasePath,omitempty" description:"path prefix of the API described by the OpenAPI document"`
+	JwtCheck                     bool                   `json:"jwtCheck,omitempty" description:"check the bearer tokens before the WAF inspection"`
+	JwtAllowedAlgs               []string               `json:"jwtAllowedAlgs,omitempty" description:"accepted JWT signature algorithms"`
+	JwtClockSkew                 string                 `json:"jwtClockSkew,omitempty" description:"tolerance of the expiration checks"`
+	JwtReject                    bool                   `json:"jwtReject,omitempty" description:"reject the requests whose token fails the checks"`
+	JwtStatusHeader              string                 `json:"jwtStatusHeader,omitempty" description:"header carrying the outcome of the checks"`
+	JwtJwksUrl                   string                 `json:"jwtJwksUrl,omitempty" description:"JWKS verifying the token signatures"`
+	JwtJwksRefreshInterval       string                 `json:"jwtJwksRefreshInterval,omitempty" description:"interval of the JWKS reloads"`
+	BypassCorsPreflight          bool                   `json:"bypassCorsPreflight,omitempty" description:"send CORS preflight requests to the service without WAF inspection"`
+	BypassConditionalRequests    bool                   `json:"bypassConditionalRequests,omitempty" description:"send conditional GET revalidation requests without a query string to the service without WAF inspection"`
+	BypassConditionalPaths       []string               `json:"bypassConditionalPaths,omitempty" description:"path patterns of the static routes whose revalidation requests skip the inspection"`
+	RateLimit                    float64                `json:"rateLimit,omitempty" description:"requests per second allowed per client"`
+	RateLimitBurst               int                    `json:"rateLimitBurst,omitempty" description:"requests a client can send at once"`
+	RateLimitKeyHeader           string                 `json:"rateLimitKeyHeader,omitempty" description:"header identifying the clients, instead of their address"`
+	BodyMinRate                  int64                  `json:"bodyMinRate,omitempty" description:"minimum rate, in bytes per second, at which bodies are read"`
+	BodyReadTimeout              string                 `json:"bodyReadTimeout,omitempty" description:"maximum duration of the body buffering"`
+	MaxBufferedBytes             int64                  `json:"maxBufferedBytes,omitempty" description:"ceiling of the memory used by the bodies being buffered"`
+	BufferedBytesPolicy          string                 `json:"bufferedBytesPolicy,omitempty" description:"reject or skipBody when maxBufferedBytes is reached"`
+	SmugglingPolicy              string                 `json:"smugglingPolicy,omitempty" description:"off, log or reject requests looking like request smuggling"`
+	MetricsPathTemplates         []string               `json:"metricsPathTemplates,omitempty" description:"path templates collapsing paths into one route, e.g. /users/:id"`
+	MetricsCollapseIds           bool                   `json:"metricsCollapseIds,omitempty" description:"collapse identifier segments of the other paths"`
+	MetricsMaxRoutes             int                    `json:"metricsMaxRoutes,omitempty" description:"maximum number of routes, further routes count as other"`
+	AccessLogHeaderPrefix        string                 `json:"accessLogHeaderPrefix,omitempty" description:"prefix of the request headers annotating the WAF decision for the access logs"`
+	NormalizeCookies             bool                   `json:"normalizeCookies,omitempty" description:"decode the cookie values before inspection"`
+	ExcludedCookies              []string               `json:"excludedCookies,omitempty" description:"cookies not sent to the WAF, a trailing * matches a prefix"`
+	MaskPii                      bool                   `json:"maskPii,omitempty" description:"mask card numbers and email addresses in logs, events and exports"`
+	PiiPatterns                  []string               `json:"piiPatterns,omitempty" description:"patterns masked in logs, events and exports"`
+	PiiFields                    []string               `json:"piiFields,omitempty" description:"parameters and JSON fields masked in logs, events and exports"`
+	EventAggregationWindow       string                 `json:"eventAggregationWindow,omitempty" description:"window during which identical block events are sent once, then summarized with their count"`
+	GreylistRequests             int                    `json:"greylistRequests,omitempty" description:"number of first requests of new clients treated more strictly"`
+	GreylistParanoiaLevel        int                    `json:"greylistParanoiaLevel,omitempty" description:"paranoia level requested for greylisted clients"`
+	GreylistChallenge            bool                   `json:"greylistChallenge,omitempty" description:"send a JavaScript challenge to greylisted browsers"`
+	ThreatFeeds                  []ThreatFeed           `json:"threatFeeds,omitempty" description:"IP and domain reputation feeds checked before the WAF"`
+	ThreatFeedRefreshInterval    string                 `json:"threatFeedRefreshInterval,omitempty" description:"interval between the reloads of the threat feeds"`
+	ThreatFeedHeader             string                 `json:"threatFeedHeader,omitempty" description:"header listing the score feeds matching the request"`
+	DnsblZones                   []string               `json:"dnsblZones,omitempty" description:"DNS blocklist zones queried for the client addresses"`
+	DnsblScore                   float64                `json:"dnsblScore,omitempty" description:"risk added per blocklist listing the client"`
+	DnsblTimeout                 string                 `json:"dnsblTimeout,omitempty" description:"timeout of the blocklist lookups"`
+	DnsblCacheTtl                string                 `json:"dnsblCacheTtl,omitempty" description:"duration the blocklist answers are cached"`
+	DnsblHeader                  string                 `json:"dnsblHeader,omitempty" description:"header listing the blocklists the client is listed on"`
+	SessionOverrideHeader        string                 `json:"sessionOverrideHeader,omitempty" description:"trusted response header of the application tightening or relaxing the inspection of the session"`
+	SessionOverrideCookie        string                 `json:"sessionOverrideCookie,omitempty" description:"cookie identifying the sessions of the overrides"`
+	SessionOverrideTtl           string                 `json:"sessionOverrideTtl,omitempty" description:"maximum lifetime of the session overrides"`
+	SessionOverrideParanoiaLevel int                    `json:"sessionOverrideParanoiaLevel,omitempty" description:"paranoia level requested for strict sessions"`
+	ClientKeyCookie              string                 `json:"clientKeyCookie,omitempty" description:"session cookie identifying the clients in the bans, risk, adaptive inspection and greylisting, instead of their address"`
+	ClientKeyHeader              string                 `json:"clientKeyHeader,omitempty" description:"session header identifying the clients in the bans, risk, adaptive inspection and greylisting, instead of their address"`
+	LogProtocolAnomalies         bool                   `json:"logProtocolAnomalies,omitempty" description:"log the protocol-version-specific anomalies of the requests, e.g. of HTTP/3 requests"`
+	MeshIdentities               []string               `json:"meshIdentities,omitempty" description:"SPIFFE IDs, or ID prefixes ending with a slash, of the mesh workloads whose requests are trusted"`
+	MeshIdentityHeader           string                 `json:"meshIdentityHeader,omitempty" description:"header carrying the SPIFFE ID of the client, set by the mesh proxies"`
+	MeshProxyIps                 []string               `json:"meshProxyIps,omitempty" description:"IPs and ranges of the mesh proxies allowed to set meshIdentityHeader"`
+	MeshIdentityAction           string                 `json:"meshIdentityAction,omitempty" description:"skip or headers: inspection of the mesh traffic"`
+	OptimisticMode               bool                   `json:"optimisticMode,omitempty" description:"forward the GET and HEAD requests to the service while they are inspected, holding the response until the verdict arrives or optimisticWindow expires"`
+	OptimisticPaths              []string               `json:"optimisticPaths,omitempty" description:"path patterns of the tolerant routes forwarded optimistically, all paths when empty"`
+	OptimisticWindow             string                 `json:"optimisticWindow,omitempty" description:"maximum time the response of the service is held waiting for the verdict"`
+	OptimisticSkipRanges         bool                   `json:"optimisticSkipRanges,omitempty" description:"forward the Range requests once inspected, their partial responses are never held"`
+	VerdictCacheHeader           string                 `json:"verdictCacheHeader,omitempty" description:"WAF response header with the number of seconds its verdict can be reused, e.g. X-Waf-Cache-Ttl"`
+	VerdictCacheMaxTtl           string                 `json:"verdictCacheMaxTtl,omitempty" description:"maximum duration a WAF verdict is reused"`
+	VerdictCacheKeyHeaders       []string               `json:"verdictCacheKeyHeaders,omitempty" description:"request headers whose values distinguish the cached verdicts, in addition to the method, host and URI"`
+	CleanShapeCache              bool                   `json:"cleanShapeCache,omitempty" description:"sample the GET requests whose path and query shape repeatedly passed the inspection"`
+	CleanShapeSampleRate         float64                `json:"cleanShapeSampleRate,omitempty" description:"share of the requests of clean shapes still inspected"`
+	CleanShapeFpRate             float64                `json:"cleanShapeFpRate,omitempty" description:"false positive probability of the clean shape filters"`
+	CleanShapeCapacity           int                    `json:"cleanShapeCapacity,omitempty" description:"number of shapes the clean shape filters are sized for"`
+	CleanShapeRotation           string                 `json:"cleanShapeRotation,omitempty" description:"interval of the rotations of the clean shape filters"`
+	FormMaxParams                int                    `json:"formMaxParams,omitempty" description:"maximum number of parameters of the form bodies"`
+	FormMaxKeyLength             int                    `json:"formMaxKeyLength,omitempty" description:"maximum length in bytes of the parameter names of the form bodies"`
+	FormMaxValueLength           int                    `json:"formMaxValueLength,omitempty" description:"maximum length in bytes of the parameter values of the form bodies"`
+	FormDuplicateKeys            string                 `json:"formDuplicateKeys,omitempty" description:"allow or reject: form bodies with duplicated parameter names"`
+	UnicodeNormalization         string                 `json:"unicodeNormalization,omitempty" description:"off or nfkc: normalization of the request targets sent to the WAF"`
+	HomoglyphPolicy              string                 `json:"homoglyphPolicy,omitempty" description:"off, log or reject: handling of the paths and queries mixing confusable scripts"`
+	DoubleEncodingPolicy         string                 `json:"doubleEncodingPolicy,omitempty" description:"off, decode or reject: handling of the double percent-encoded request targets"`
+	ReportTransformations        bool                   `json:"reportTransformations,omitempty" description:"list the transformations of the request copy in its X-Waf-Transformations header"`
+	ErrorResponseFormat          string                 `json:"errorResponseFormat,omitempty" description:"empty, json or html: body of the errors raised by the plugin itself"`
+	ErrorResponseTemplate        string                 `json:"errorResponseTemplate,omitempty" description:"html/template of the html error responses, with .Status, .StatusText and .CorrelationId"`
+	CorrelationIdHeader          string                 `json:"correlationIdHeader,omitempty" description:"header carrying the correlation ID of the error responses, X-Correlation-Id by default"`
+	ErrorBudget                  float64                `json:"errorBudget,omitempty" description:"rate of the requests allowed to fail in the plugin over a window before switching to errorBudgetMode"`
+	ErrorBudgetWindow            string                 `json:"errorBudgetWindow,omitempty" description:"window of the error budget"`
+	ErrorBudgetMinRequests       int                    `json:"errorBudgetMinRequests,omitempty" description:"requests a window must hold before its error rate is checked"`
+	ErrorBudgetMode              string                 `json:"errorBudgetMode,omitempty" description:"fail-open, detect or bypass: degraded mode of an exhausted error budget"`
+	MetricsStateFile             string                 `json:"metricsStateFile,omitempty" description:"file persisting the cumulative counters across the configuration reloads"`
+	MetricsStateInterval         string                 `json:"metricsStateInterval,omitempty" description:"interval between the saves of metricsStateFile"`
+	OrderingGuard                string                 `json:"orderingGuard,omitempty" description:"off, warn or refuse: check that the body-modifying middlewares run after this one"`
+	MiddlewareChain              []string               `json:"middlewareChain,omitempty" description:"middlewares of the routers using this middleware, in their order"`
+	BodyModifyingHints           []string               `json:"bodyModifyingHints,omitempty" description:"substrings of the names of the body-modifying middlewares, compress and buffering by default"`
+	OrderingHintHeaders          []string               `json:"orderingHintHeaders,omitempty" description:"request headers set by the middlewares which must run after this one"`
+	ShareState                   bool                   `json:"shareState,omitempty" description:"share the verdict cache and the client state, bans included, with the middlewares using the same modSecurityUrl"`
+	TempDirectory                string                 `json:"tempDirectory,omitempty" description:"directory of the bodies spooled to disk, the temporary directory of the system by default"`
+	StatelessMode                bool                   `json:"statelessMode,omitempty" description:"disable the features using the local disk, for read-only deployments"`
+	WafBodyCompression           string                 `json:"wafBodyCompression,omitempty" description:"off, auto to gzip-compress the large bodies sent to the WAF once it advertised gzip, or always"`
+	WafCompressionMinSize        int64                  `json:"wafCompressionMinSize,omitempty" description:"size in bytes from which the bodies sent to the WAF are compressed"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -32,48 +248,775 @@ func CreateConfig() *Config {
 		// Safe default: if the max body size was not specified, use 10MB
 		// Note that this will break any file upload with files > 10MB. Hopefully
 		// the user will configure this parameter during the installation.
-		MaxBodySize:      10 * 1024 * 1024,
-		InterruptOnError: true,
-		Ignore500Error:   false,
+		MaxBodySize:            10 * 1024 * 1024,
+		InterruptOnError:       true,
+		Ignore500Error:         false,
+		RuleIdsHeader:          defaultRuleIdsHeader,
+		ParanoiaLevelHeader:    defaultParanoiaLevelHeader,
+		SpoolMaxSize:           100 * 1024 * 1024,
+		BotScoreTimeout:        "500ms",
+		BotScoreFailOpen:       true,
+		Mode:                   modeEnforce,
+		FingerprintHeader:      defaultFingerprintHeader,
+		ErrorLogInterval:       "1m",
+		ErrorLogBurst:          10,
+		DebugDumpLimit:         100,
+		AnomalyScoreHeader:     defaultAnomalyScoreHeader,
+		MaxWafResponseBytes:    1024 * 1024,
+		WafTimeout:             "2s",
+		ShutdownTimeout:        "5s",
+		TlsReloadInterval:      "30s",
+		Ipv6PrefixLength:       64,
+		BanDuration:            "1h",
+		DecoyRiskIncrement:     1,
+		AdaptiveCleanStreak:    100,
+		AdaptiveSampleRate:     0.1,
+		AdaptiveBlockWindow:    "1h",
+		ReplayExportFormat:     replayFormatRaw,
+		AuditS3Region:          "us-east-1",
+		AuditS3Interval:        "5m",
+		AuditS3BatchSize:       1000,
+		NotifyWebhookType:      webhookTypeSlack,
+		NotifyInterval:         "10m",
+		AlertWebhookType:       alertTypePagerDuty,
+		AlertOutageThreshold:   "1m",
+		ExclusionsHeader:       defaultExclusionsHeader,
+		PipelineShortCircuit:   pipelineShortCircuitBlock,
+		PipelineAggregation:    pipelineAggregationSum,
+		BackendProtocol:        backendProtocolHTTP,
+		JwtClockSkew:           "30s",
+		JwtStatusHeader:        defaultJwtStatusHeader,
+		JwtJwksRefreshInterval: "1h",
+		BufferedBytesPolicy:    bufferedBytesPolicyReject,
+		SmugglingPolicy:        smugglingPolicyOff,
+		MetricsMaxRoutes:       100,
+		ThreatFeedHeader:       defaultThreatFeedHeader,
+		DnsblScore:             10,
+		DnsblHeader:            defaultDnsblHeader,
+		CleanShapeSampleRate:   0.1,
+		CleanShapeFpRate:       0.001,
+		CleanShapeCapacity:     100000,
+		CleanShapeRotation:     "10m",
+		ErrorBudgetWindow:      "5m",
+		ErrorBudgetMinRequests: 100,
+		ErrorBudgetMode:        errorBudgetFailOpen,
+		MetricsStateInterval:   "1m",
+		WafBodyCompression:     wafCompressionOff,
+		WafCompressionMinSize:  262144,
 	}
 }
 
 // Modsecurity a Modsecurity plugin.
 type Modsecurity struct {
-	next             http.Handler
-	modSecurityUrl   string
-	maxBodySize      int64
-	interruptOnError bool
-	ignore500Error   bool
-	name             string
-	logger           *log.Logger
+	next                   http.Handler
+	modSecurityUrl         string
+	maxBodySize            int64
+	interruptOnError       bool
+	ignore500Error         bool
+	maskBlockResponse      bool
+	ruleIdsHeader          string
+	ignoreRuleIds          map[string]bool
+	paranoiaLevels         *paranoiaLevels
+	schedule               *enforcementSchedule
+	fingerprintHeader      string
+	headerFilter           *headerFilter
+	userAgentRules         *userAgentRules
+	methodRules            methodRules
+	connectPolicy          string
+	headersOnlyPaths       []*regexp.Regexp
+	twoPhaseInspection     bool
+	spoolToDisk            bool
+	spoolMaxSize           int64
+	inspectFirstNBytes     int64
+	botScorer              *botScorer
+	errorPolicy            map[string]bool
+	warmer                 *warmer
+	wafPool                *wafPool
+	metrics                *metrics
+	forwardTLSMetadata     bool
+	ja3Header              string
+	logSampler             *logSampler
+	debugDumper            *debugDumper
+	decision               DecisionPolicy
+	anomalyScoreHeader     string
+	bodyNormalizer         *bodyNormalizer
+	controlCharPolicy      string
+	maxWafResponseBytes    int64
+	httpClient             *http.Client
+	lifecycle              *lifecycle
+	tlsReloader            *tlsReloader
+	ipAllowlist            []*net.IPNet
+	ipv6PrefixLength       int
+	asnPolicies            *asnPolicies
+	honeypotPaths          []*regexp.Regexp
+	banDuration            time.Duration
+	clientTracker          *clientTracker
+	decoyHeaders           map[string]string
+	decoyPatterns          []*regexp.Regexp
+	decoyRiskIncrement     float64
+	riskBanThreshold       float64
+	adaptive               *adaptiveInspection
+	replayExporter         *replayExporter
+	eventSinks             []eventSink
+	s3Archiver             *s3Archiver
+	webhooks               *webhookQueue
+	ruleNotifier           *ruleNotifier
+	outageAlerter          *outageAlerter
+	metricsRoutes          []string
+	pprofLabels            bool
+	trackClients           bool
+	schemaEndpoint         string
+	useForwardedUri        bool
+	forwardedHeadersPolicy string
+	exclusions             *exclusions
+	pipeline               *inspectionPipeline
+	backendProtocol        string
+	openAPI                *openAPIValidator
+	jwtChecker             *jwtChecker
+	bypassCorsPreflight    bool
+	revalidationPaths      []*regexp.Regexp
+	rateLimiter            *rateLimiter
+	bodyMinRate            int64
+	bodyReadTimeout        time.Duration
+	maxBufferedBytes       int64
+	bufferedBytesPolicy    string
+	smugglingPolicy        string
+	metricsPathTemplates   []pathTemplate
+	metricsCollapseIds     bool
+	accessLogHeaderPrefix  string
+	cookieFilter           *cookieFilter
+	piiMasker              *piiMasker
+	eventAggregator        *eventAggregator
+	greylist               *greylist
+	countryLookup          *countryLookup
+	threatFeeds            *threatFeeds
+	dnsbl                  *dnsblChecker
+	sessionOverrides       *sessionOverrides
+	clientKeyCookie        string
+	clientKeyHeader        string
+	logProtocolAnomalies   bool
+	meshIdentities         *meshIdentities
+	optimistic             *optimisticForwarding
+	verdictCache           *verdictCache
+	cleanShapes            *cleanShapes
+	formLimits             *formLimits
+	foldUnicode            bool
+	homoglyphPolicy        string
+	doubleEncodingPolicy   string
+	reportTransformations  bool
+	errorResponder         *errorResponder
+	errorBudget            *errorBudget
+	metricsState           *metricsState
+	orderingHintHeaders    []string
+	tempDirectory          string
+	statelessMode          bool
+	wafCompression         *wafCompression
+	channels               *channelClients
+	agents                 *agentClients
+	name                   string
+	logger                 *log.Logger
 }
 
 // New created a new Modsecurity plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	unknownFields := unknownFieldsError(config.UnknownFields)
+	if config.StrictConfig && unknownFields != nil {
+		return nil, unknownFields
+	}
+	config, err := withProfile(config)
+	if err != nil {
+		return nil, err
+	}
 	if len(config.ModSecurityUrl) == 0 {
 		return nil, fmt.Errorf("modSecurityUrl cannot be empty")
 	}
+	if err := validateBackendProtocol(config.BackendProtocol, config.ModSecurityUrl); err != nil {
+		return nil, err
+	}
+
+	userAgentRules, err := newUserAgentRules(config.UserAgentAllow, config.UserAgentAllowSources, config.UserAgentDeny)
+	if err != nil {
+		return nil, err
+	}
 
-	return &Modsecurity{
-		modSecurityUrl:   config.ModSecurityUrl,
-		maxBodySize:      config.MaxBodySize,
-		interruptOnError: config.InterruptOnError,
-		ignore500Error:   config.Ignore500Error,
-		next:             next,
-		name:             name,
-		logger:           log.New(os.Stdout, "", log.LstdFlags),
-	}, nil
+	methodRules, err := newMethodRules(config.AllowedMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	threatFeedRefreshInterval, err := parseDuration("threatFeedRefreshInterval", config.ThreatFeedRefreshInterval, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	threatFeeds, err := newThreatFeeds(config.ThreatFeeds, config.ThreatFeedHeader, threatFeedRefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+	dnsblTimeout, err := parseDuration("dnsblTimeout", config.DnsblTimeout, 200*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	dnsblCacheTtl, err := parseDuration("dnsblCacheTtl", config.DnsblCacheTtl, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	sessionOverrideTtl, err := parseDuration("sessionOverrideTtl", config.SessionOverrideTtl, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	sessionOverrides, err := newSessionOverrides(config.SessionOverrideHeader, config.SessionOverrideCookie, sessionOverrideTtl, config.SessionOverrideParanoiaLevel)
+	if err != nil {
+		return nil, err
+	}
+	countryLookup, err := newCountryLookup(config.CountryDatabase)
+	if err != nil {
+		return nil, err
+	}
+	asnPolicies, err := newAsnPolicies(config.AsnDatabase, config.AsnPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	honeypotPaths, err := compileRegexps("honeypotPaths", config.HoneypotPaths)
+	if err != nil {
+		return nil, err
+	}
+	banDuration, err := parseDuration("banDuration", config.BanDuration, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	decoyPatterns, err := compileRegexps("decoyPatterns", config.DecoyPatterns)
+	if err != nil {
+		return nil, err
+	}
+	notifyInterval, err := parseDuration("notifyInterval", config.NotifyInterval, 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := newWebhookQueue()
+	ruleNotifier, err := newRuleNotifier(config.NotifyWebhookUrl, config.NotifyWebhookType, config.NotifyRuleIds, notifyInterval, webhooks)
+	if err != nil {
+		return nil, err
+	}
+	alertOutageThreshold, err := parseDuration("alertOutageThreshold", config.AlertOutageThreshold, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	outageAlerter, err := newOutageAlerter(config.AlertWebhookUrl, config.AlertWebhookType, config.AlertIntegrationKey, alertOutageThreshold, name, webhooks)
+	if err != nil {
+		return nil, err
+	}
+	auditS3Interval, err := parseDuration("auditS3Interval", config.AuditS3Interval, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	s3Archiver, err := newS3Archiver(config.AuditS3Endpoint, config.AuditS3Bucket, config.AuditS3Prefix, config.AuditS3Region, config.AuditS3AccessKey, config.AuditS3SecretKey, config.AuditS3BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	eventAggregationWindow, err := parseDuration("eventAggregationWindow", config.EventAggregationWindow, 0)
+	if err != nil {
+		return nil, err
+	}
+	replayExporter, err := newReplayExporter(config.ReplayExportDir, config.ReplayExportUrl, config.ReplayExportFormat, config.ReplayExportSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	adaptiveBlockWindow, err := parseDuration("adaptiveBlockWindow", config.AdaptiveBlockWindow, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	adaptive, err := newAdaptiveInspection(config.AdaptiveInspection, config.AdaptiveCleanStreak, config.AdaptiveSampleRate, adaptiveBlockWindow)
+	if err != nil {
+		return nil, err
+	}
+	cleanShapeRotation, err := parseDuration("cleanShapeRotation", config.CleanShapeRotation, 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cleanShapes, err := newCleanShapes(config.CleanShapeCache, config.CleanShapeSampleRate, config.CleanShapeFpRate, config.CleanShapeCapacity)
+	if err != nil {
+		return nil, err
+	}
+	formLimits, err := newFormLimits(config.FormMaxParams, config.FormMaxKeyLength, config.FormMaxValueLength, config.FormDuplicateKeys)
+	if err != nil {
+		return nil, err
+	}
+	wafCompression, err := newWafCompression(config.WafBodyCompression, config.WafCompressionMinSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAllowlist, err := parseCIDRs("ipAllowlist", config.IpAllowlist)
+	if err != nil {
+		return nil, err
+	}
+	meshIdentities, err := newMeshIdentities(config.MeshIdentities, config.MeshIdentityHeader, config.MeshProxyIps, config.MeshIdentityAction)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateIpv6PrefixLength(config.Ipv6PrefixLength); err != nil {
+		return nil, err
+	}
+
+	if err := validateControlCharPolicy(config.ControlCharPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateForwardedHeadersPolicy(config.ForwardedHeadersPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateConnectPolicy(config.ConnectPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateBufferedBytesPolicy(config.BufferedBytesPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateSmugglingPolicy(config.SmugglingPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateUnicodeNormalization(config.UnicodeNormalization); err != nil {
+		return nil, err
+	}
+	if err := validateHomoglyphPolicy(config.HomoglyphPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateDoubleEncodingPolicy(config.DoubleEncodingPolicy); err != nil {
+		return nil, err
+	}
+	errorResponder, err := newErrorResponder(config.ErrorResponseFormat, config.ErrorResponseTemplate, config.CorrelationIdHeader)
+	if err != nil {
+		return nil, err
+	}
+	errorBudgetWindow, err := parseDuration("errorBudgetWindow", config.ErrorBudgetWindow, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	errorBudget, err := newErrorBudget(config.ErrorBudget, errorBudgetWindow, config.ErrorBudgetMinRequests, config.ErrorBudgetMode)
+	if err != nil {
+		return nil, err
+	}
+
+	headersOnlyPaths, err := compileRegexps("headersOnlyPaths", config.HeadersOnlyPaths)
+	if err != nil {
+		return nil, err
+	}
+	var revalidationPaths []*regexp.Regexp
+	if config.BypassConditionalRequests {
+		// the revalidation headers are set by the client, they must not open every path
+		if len(config.BypassConditionalPaths) == 0 {
+			return nil, fmt.Errorf("bypassConditionalRequests requires bypassConditionalPaths")
+		}
+		if revalidationPaths, err = compileRegexps("bypassConditionalPaths", config.BypassConditionalPaths); err != nil {
+			return nil, err
+		}
+	}
+	optimisticPaths, err := compileRegexps("optimisticPaths", config.OptimisticPaths)
+	if err != nil {
+		return nil, err
+	}
+	optimisticWindow, err := parseDuration("optimisticWindow", config.OptimisticWindow, 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	verdictCacheMaxTtl, err := parseDuration("verdictCacheMaxTtl", config.VerdictCacheMaxTtl, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsReloadInterval, err := parseDuration("tlsReloadInterval", config.TlsReloadInterval, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tlsReloader, err := newTLSReloader(config.TlsCertFile, config.TlsKeyFile, config.TlsCaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownTimeout, err := parseDuration("shutdownTimeout", config.ShutdownTimeout, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	wafTimeout, err := parseDuration("wafTimeout", config.WafTimeout, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := newWafClient(wafTimeout)
+	if tlsReloader != nil {
+		httpClient.Transport = tlsReloader
+	}
+	chaosLatency, err := parseDuration("chaosLatency", config.ChaosLatency, 0)
+	if err != nil {
+		return nil, err
+	}
+	chaos, err := newChaosTransport(httpClient.Transport, chaosLatency, config.ChaosErrorRate, config.ChaosDropRate)
+	if err != nil {
+		return nil, err
+	}
+	if chaos != nil {
+		httpClient.Transport = chaos
+	}
+
+	botScoreTimeout, err := parseDuration("botScoreTimeout", config.BotScoreTimeout, 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprintHeader := ""
+	if config.ClientFingerprint {
+		fingerprintHeader = config.FingerprintHeader
+	}
+
+	greylist, err := newGreylist(config.GreylistRequests, config.GreylistParanoiaLevel, config.GreylistChallenge)
+	if err != nil {
+		return nil, err
+	}
+	paranoiaLevels, err := newParanoiaLevels(config.ParanoiaLevelHeader, config.ParanoiaLevel, config.ParanoiaLevels)
+	if err != nil {
+		return nil, err
+	}
+	exclusions, err := newExclusions(config.ExclusionsHeader, config.ExclusionPacks)
+	if err != nil {
+		return nil, err
+	}
+
+	decision, err := newDecisionPolicy(config.Decision)
+	if err != nil {
+		return nil, err
+	}
+	jwtClockSkew, err := parseDuration("jwtClockSkew", config.JwtClockSkew, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	jwtJwksRefreshInterval, err := parseDuration("jwtJwksRefreshInterval", config.JwtJwksRefreshInterval, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if jwtJwksRefreshInterval <= 0 {
+		return nil, fmt.Errorf("jwtJwksRefreshInterval must be positive")
+	}
+	bodyReadTimeout, err := parseDuration("bodyReadTimeout", config.BodyReadTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+	if config.BodyMinRate < 0 {
+		return nil, fmt.Errorf("bodyMinRate must not be negative")
+	}
+	openAPI, err := newOpenAPIValidator(config.OpenApiSpec, config.OpenApiBasePath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := newInspectionPipeline(config.ModSecurityUrl, config.BackendProtocol, config.Pipeline, config.PipelineShortCircuit, config.PipelineAggregation)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := newEnforcementSchedule(config.Mode, config.ScheduleTimezone, config.Schedules)
+	if err != nil {
+		return nil, err
+	}
+
+	errorPolicy, err := newErrorPolicy(config.ErrorPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	warmIdleInterval, err := parseDuration("warmIdleInterval", config.WarmIdleInterval, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	errorLogInterval, err := parseDuration("errorLogInterval", config.ErrorLogInterval, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	piiMasker, err := newPIIMasker(config.MaskPii, config.PiiPatterns, config.PiiFields)
+	if err != nil {
+		return nil, err
+	}
+	debugDumper, err := newDebugDumper(config.DebugDumpFile, config.DebugDumpHeader, config.DebugDumpToken, config.DebugDumpIps, config.DebugDumpLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateOrderingGuard(config.OrderingGuard); err != nil {
+		return nil, err
+	}
+	var orderingError error
+	var orderingHintHeaders []string
+	if len(config.OrderingGuard) > 0 && config.OrderingGuard != orderingGuardOff {
+		hints := config.BodyModifyingHints
+		if len(hints) == 0 {
+			hints = defaultBodyModifyingHints
+		}
+		orderingError = checkMiddlewareOrder(config.MiddlewareChain, name, hints)
+		if orderingError != nil && config.OrderingGuard == orderingGuardRefuse {
+			return nil, orderingError
+		}
+		orderingHintHeaders = config.OrderingHintHeaders
+	}
+	metricsStateInterval, err := parseDuration("metricsStateInterval", config.MetricsStateInterval, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	instanceMetrics := newMetrics()
+	instanceMetrics.maxRoutes = config.MetricsMaxRoutes
+	metricsPathTemplates, err := newPathTemplates(config.MetricsPathTemplates)
+	if err != nil {
+		return nil, err
+	}
+	if config.ExpvarMetrics {
+		publishExpvar(name, instanceMetrics)
+	}
+
+	a := &Modsecurity{
+		modSecurityUrl:         config.ModSecurityUrl,
+		maxBodySize:            config.MaxBodySize,
+		interruptOnError:       config.InterruptOnError,
+		ignore500Error:         config.Ignore500Error,
+		maskBlockResponse:      config.MaskBlockResponse,
+		ruleIdsHeader:          config.RuleIdsHeader,
+		ignoreRuleIds:          newRuleIdSet(config.IgnoreRuleIds),
+		paranoiaLevels:         paranoiaLevels,
+		schedule:               schedule,
+		fingerprintHeader:      fingerprintHeader,
+		headerFilter:           newHeaderFilter(config.ForwardHeaders, config.DropHeaders),
+		userAgentRules:         userAgentRules,
+		methodRules:            methodRules,
+		connectPolicy:          config.ConnectPolicy,
+		headersOnlyPaths:       headersOnlyPaths,
+		twoPhaseInspection:     config.TwoPhaseInspection,
+		spoolToDisk:            config.SpoolToDisk,
+		spoolMaxSize:           config.SpoolMaxSize,
+		inspectFirstNBytes:     config.InspectFirstNBytes,
+		botScorer:              newBotScorer(config.BotScoreUrl, botScoreTimeout, config.BotScoreFailOpen, config.BotScoreThreshold),
+		errorPolicy:            errorPolicy,
+		wafPool:                newWafPool(config.MaxConcurrentWafCalls, config.MaxWafQueueLength, instanceMetrics),
+		metrics:                instanceMetrics,
+		forwardTLSMetadata:     config.ForwardTLSMetadata,
+		ja3Header:              config.Ja3Header,
+		logSampler:             newLogSampler(errorLogInterval, config.ErrorLogBurst),
+		debugDumper:            debugDumper,
+		decision:               decision,
+		anomalyScoreHeader:     config.AnomalyScoreHeader,
+		bodyNormalizer:         newBodyNormalizer(config.NormalizeFormBody, config.CollapseDuplicateParams, config.CanonicalizeJson),
+		controlCharPolicy:      config.ControlCharPolicy,
+		maxWafResponseBytes:    config.MaxWafResponseBytes,
+		httpClient:             httpClient,
+		lifecycle:              newLifecycle(ctx, shutdownTimeout),
+		tlsReloader:            tlsReloader,
+		ipAllowlist:            ipAllowlist,
+		ipv6PrefixLength:       config.Ipv6PrefixLength,
+		asnPolicies:            asnPolicies,
+		honeypotPaths:          honeypotPaths,
+		banDuration:            banDuration,
+		clientTracker:          newClientTracker(),
+		decoyHeaders:           config.DecoyHeaders,
+		decoyPatterns:          decoyPatterns,
+		decoyRiskIncrement:     config.DecoyRiskIncrement,
+		riskBanThreshold:       config.RiskBanThreshold,
+		adaptive:               adaptive,
+		replayExporter:         replayExporter,
+		s3Archiver:             s3Archiver,
+		webhooks:               webhooks,
+		ruleNotifier:           ruleNotifier,
+		outageAlerter:          outageAlerter,
+		metricsRoutes:          config.MetricsRoutes,
+		pprofLabels:            config.PprofLabels,
+		schemaEndpoint:         config.SchemaEndpoint,
+		useForwardedUri:        config.UseForwardedUri,
+		forwardedHeadersPolicy: config.ForwardedHeadersPolicy,
+		exclusions:             exclusions,
+		pipeline:               pipeline,
+		backendProtocol:        config.BackendProtocol,
+		openAPI:                openAPI,
+		jwtChecker:             newJwtChecker(config.JwtCheck, config.JwtAllowedAlgs, jwtClockSkew, config.JwtReject, config.JwtStatusHeader, config.JwtJwksUrl, jwtJwksRefreshInterval),
+		bypassCorsPreflight:    config.BypassCorsPreflight,
+		revalidationPaths:      revalidationPaths,
+		rateLimiter:            newRateLimiter(config.RateLimit, config.RateLimitBurst, config.RateLimitKeyHeader, config.Ipv6PrefixLength),
+		bodyMinRate:            config.BodyMinRate,
+		bodyReadTimeout:        bodyReadTimeout,
+		maxBufferedBytes:       config.MaxBufferedBytes,
+		bufferedBytesPolicy:    config.BufferedBytesPolicy,
+		smugglingPolicy:        config.SmugglingPolicy,
+		metricsPathTemplates:   metricsPathTemplates,
+		metricsCollapseIds:     config.MetricsCollapseIds,
+		accessLogHeaderPrefix:  config.AccessLogHeaderPrefix,
+		cookieFilter:           newCookieFilter(config.NormalizeCookies, config.ExcludedCookies),
+		piiMasker:              piiMasker,
+		eventAggregator:        newEventAggregator(eventAggregationWindow),
+		greylist:               greylist,
+		countryLookup:          countryLookup,
+		threatFeeds:            threatFeeds,
+		dnsbl:                  newDnsblChecker(config.DnsblZones, config.DnsblScore, dnsblTimeout, dnsblCacheTtl, config.DnsblHeader),
+		sessionOverrides:       sessionOverrides,
+		clientKeyCookie:        config.ClientKeyCookie,
+		clientKeyHeader:        config.ClientKeyHeader,
+		logProtocolAnomalies:   config.LogProtocolAnomalies,
+		meshIdentities:         meshIdentities,
+		optimistic:             newOptimisticForwarding(config.OptimisticMode, optimisticPaths, optimisticWindow, config.OptimisticSkipRanges),
+		verdictCache:           newVerdictCache(config.VerdictCacheHeader, verdictCacheMaxTtl, config.VerdictCacheKeyHeaders),
+		cleanShapes:            cleanShapes,
+		formLimits:             formLimits,
+		foldUnicode:            config.UnicodeNormalization == unicodeNormalizationNfkc,
+		homoglyphPolicy:        config.HomoglyphPolicy,
+		doubleEncodingPolicy:   config.DoubleEncodingPolicy,
+		reportTransformations:  config.ReportTransformations,
+		errorResponder:         errorResponder,
+		errorBudget:            errorBudget,
+		metricsState:           newMetricsState(config.MetricsStateFile, name),
+		orderingHintHeaders:    orderingHintHeaders,
+		tempDirectory:          config.TempDirectory,
+		statelessMode:          config.StatelessMode,
+		wafCompression:         wafCompression,
+		channels:               &channelClients{},
+		agents:                 &agentClients{},
+		next:                   next,
+		name:                   name,
+		logger:                 log.New(os.Stdout, "", log.LstdFlags),
+	}
+	for _, key := range config.legacyKeys {
+		a.logEvent("config_deprecated_key", logFields{"key": key, "replacement": legacyConfigKeys[key]})
+	}
+	if unknownFields != nil {
+		a.logEvent("config_unknown_keys", logFields{"error": unknownFields.Error()})
+	}
+	if chaos != nil {
+		a.logEvent("chaos_enabled", logFields{
+			"latency":   chaosLatency.String(),
+			"errorRate": config.ChaosErrorRate,
+			"dropRate":  config.ChaosDropRate,
+		})
+	}
+	if a.statelessMode {
+		a.applyStatelessMode()
+	}
+	a.checkFileFeatures()
+	a.warmer = newWarmer(a, config.WarmConnections, warmIdleInterval)
+	if a.warmer != nil {
+		a.lifecycle.goBackground(a.warmer.run)
+	}
+	if a.tlsReloader != nil && !a.statelessMode {
+		a.lifecycle.goBackground(func(ctx context.Context) {
+			a.watchTLSFiles(ctx, tlsReloadInterval)
+		})
+	}
+	a.trackClients = len(a.honeypotPaths) > 0 || len(a.decoyHeaders) > 0 || a.adaptive != nil || a.greylist != nil
+	if a.trackClients {
+		janitor := func(ctx context.Context) {
+			a.clientTracker.run(ctx, clientJanitorInterval)
+		}
+		if config.ShareState {
+			a.shareClientTracker(janitor)
+		} else {
+			a.lifecycle.goBackground(janitor)
+		}
+	}
+	if config.ShareState && a.verdictCache != nil {
+		a.shareVerdictCache(config)
+	}
+	if a.rateLimiter != nil {
+		a.lifecycle.goBackground(func(ctx context.Context) {
+			a.rateLimiter.run(ctx, clientJanitorInterval)
+		})
+	}
+	if a.cleanShapes != nil {
+		a.lifecycle.goBackground(func(ctx context.Context) {
+			a.cleanShapes.run(ctx, cleanShapeRotation)
+		})
+	}
+	if a.ruleNotifier != nil {
+		a.eventSinks = append(a.eventSinks, a.ruleNotifier)
+	}
+	if a.ruleNotifier != nil || a.outageAlerter != nil {
+		a.lifecycle.goBackground(a.runWebhooks)
+		a.lifecycle.onClose(a.flushWebhooks)
+	}
+	if a.s3Archiver != nil {
+		a.eventSinks = append(a.eventSinks, a.s3Archiver)
+		a.lifecycle.goBackground(func(ctx context.Context) {
+			a.runS3Archiver(ctx, auditS3Interval)
+		})
+		a.lifecycle.onClose(a.flushS3Archiver)
+	}
+	if a.eventAggregator != nil {
+		a.lifecycle.goBackground(a.runEventAggregator)
+		a.lifecycle.onClose(a.flushEventAggregator)
+	}
+	// the channel and agent connections are dialed by the first calls
+	a.lifecycle.onClose(a.channels.close)
+	a.lifecycle.onClose(a.agents.close)
+	if a.threatFeeds != nil {
+		a.shareThreatFeeds(sharedKey("threatFeeds", a.modSecurityUrl, []interface{}{config.ThreatFeeds, config.ThreatFeedHeader, threatFeedRefreshInterval}))
+	}
+	if a.sessionOverrides != nil {
+		a.lifecycle.goBackground(func(ctx context.Context) {
+			a.sessionOverrides.run(ctx, clientJanitorInterval)
+		})
+	}
+	if a.dnsbl != nil {
+		a.lifecycle.goBackground(func(ctx context.Context) {
+			a.dnsbl.run(ctx, clientJanitorInterval)
+		})
+	}
+	if a.jwtChecker != nil && len(a.jwtChecker.jwksUrl) > 0 {
+		a.lifecycle.goBackground(a.runJwksRefresher)
+	}
+	if a.replayExporter != nil {
+		a.lifecycle.goBackground(a.runReplayExporter)
+		a.lifecycle.onClose(a.flushReplayExporter)
+	}
+	if orderingError != nil {
+		a.logEvent("middleware_order_warning", logFields{"error": orderingError.Error()})
+	}
+	if a.metricsState != nil {
+		// a corrupted state only loses the counters, the middleware starts anyway
+		if err := a.metricsState.load(a.metrics); err != nil {
+			a.logEvent("metrics_state_error", logFields{"file": a.metricsState.path, "error": err.Error()})
+		}
+		a.lifecycle.goBackground(func(ctx context.Context) {
+			a.runMetricsState(ctx, metricsStateInterval)
+		})
+		a.lifecycle.onClose(a.saveMetricsState)
+	}
+	a.closeOnDone(ctx)
+
+	return a, nil
+}
+
+// parseDuration parses the duration configured for option, falling back to def when value is empty.
+func parseDuration(option string, value string, def time.Duration) (time.Duration, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", option, value, err.Error())
+	}
+	return d, nil
 }
 
 func (a *Modsecurity) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			a.handleError(rw, req, fmt.Sprintf("Panic. Error: %s", r), http.StatusBadGateway)
-			return
+			a.recoverPanic(rw, req, r)
 		}
 	}()
+	a.recordBudget(false)
+
+	if len(a.schemaEndpoint) > 0 && req.URL.Path == a.schemaEndpoint {
+		a.serveSchema(rw, req)
+		return
+	}
+
+	a.checkProtocol(req)
+	a.stripAnnotations(req)
+	if a.sessionOverrides != nil {
+		w := &overrideWriter{ResponseWriter: rw, a: a, req: req}
+		defer w.finish()
+		rw = exposeSupported(w, rw)
+	}
 
 	// Websocket not supported
 	if isWebsocket(req) {
@@ -81,57 +1024,503 @@ func (a *Modsecurity) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// we need to buffer the body if we want to read it here and send it
-	// in the request.
-	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, a.maxBodySize))
-	if err != nil {
-		if err.Error() == "http: request body too large" {
-			a.handleError(rw, req, fmt.Sprintf("body max limit reached: %s", err.Error()), http.StatusRequestEntityTooLarge)
-		} else {
-			a.handleError(rw, req, fmt.Sprintf("fail to read incoming request: %s", err.Error()), http.StatusBadGateway)
+	if a.controlCharPolicy == controlCharPolicyReject && hasControlChars(req) {
+		a.blockLocally(rw, req, "control characters in request", http.StatusBadRequest)
+		return
+	}
+	a.warnOrderingHints(req)
+	if a.checkHomoglyphs(rw, req) || a.checkDoubleEncoding(rw, req) {
+		return
+	}
+	smuggling := len(a.smugglingPolicy) > 0 && a.smugglingPolicy != smugglingPolicyOff
+	if smuggling && a.suspectSmuggling(rw, req, smugglingHeaderSuspicion(req)) {
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		if a.connectPolicy == connectPolicyBypass {
+			a.next.ServeHTTP(rw, req)
+			return
 		}
+		rw.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		a.blockLocally(rw, req, "CONNECT denied", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// you can reassign the body if you need to parse it as multipart
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if allowed, allow := a.methodRules.allowed(req.URL.Path, req.Method); !allowed {
+		rw.Header().Set("Allow", allow)
+		a.blockLocally(rw, req, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// create a new url from the raw RequestURI sent by the client
-	url := fmt.Sprintf("%s%s", a.modSecurityUrl, req.RequestURI)
+	// the client IP is only parsed when a feature needs it, parsing allocates
+	if len(a.ipAllowlist) > 0 && containsIP(a.ipAllowlist, remoteIP(req)) {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+	meshAction := a.meshAction(req)
+	if meshAction == meshActionSkip {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	a.checkDecoyFollowUp(req)
+	if a.trackClients && a.clientBanned(req, time.Now()) {
+		a.blockLocally(rw, req, "client banned", http.StatusForbidden)
+		return
+	}
+	if a.rateLimiter != nil && a.rateLimited(rw, req) {
+		return
+	}
+	if a.threatFeeds != nil && a.checkThreatFeeds(rw, req) {
+		return
+	}
+	if a.dnsbl != nil {
+		a.checkDnsbl(req)
+	}
+	if matchAny(a.honeypotPaths, req.URL.Path) {
+		a.serveHoneypot(rw, req)
+		return
+	}
 
-	proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
+	if a.asnPolicies != nil {
+		asn := a.asnPolicies.asn(remoteIP(req))
+		switch a.asnPolicies.action(asn) {
+		case asnActionSkip:
+			a.next.ServeHTTP(rw, req)
+			return
+		case asnActionBlock:
+			a.blockLocally(rw, req, fmt.Sprintf("ASN %d denied", asn), http.StatusForbidden)
+			return
+		}
+	}
 
-	if err != nil {
-		a.handleError(rw, req, fmt.Sprintf("fail to prepare forwarded request: %s", err.Error()), http.StatusBadGateway)
+	switch a.userAgentRules.match(req) {
+	case userAgentAllowed:
+		a.next.ServeHTTP(rw, req)
+		return
+	case userAgentDenied:
+		a.blockLocally(rw, req, "user-agent denied", http.StatusForbidden)
+		return
+	}
+
+	greylisted := a.admitClient(req)
+	if greylisted && a.challengeGreylisted(rw, req) {
+		return
+	}
+	// strict sessions are fully inspected, like greylisted clients
+	strict := greylisted || a.sessionOverride(req) == sessionOverrideStrict
+
+	// cache revalidations and preflights carry no body, their inspection is a pointless round trip
+	if !strict && (a.errorBudget.degraded(errorBudgetBypass) || a.skipInspection(req) || a.skipsRevalidation(req) || a.cleanShapes.skips(req)) {
+		a.next.ServeHTTP(rw, req)
 		return
 	}
+	if a.bypassCorsPreflight && isCorsPreflight(req) {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if a.jwtChecker != nil {
+		status := a.jwtChecker.check(req, time.Now())
+		if a.jwtChecker.rejects(status) {
+			rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			a.blockLocally(rw, req, "invalid JWT: "+status, http.StatusUnauthorized)
+			return
+		}
+		req.Header.Del(a.jwtChecker.header)
+		if len(status) > 0 {
+			req.Header.Set(a.jwtChecker.header, status)
+		}
+	}
+
+	failures := &requestFailures{}
+	defer a.logFailures(req, failures)
+
+	botScore := ""
+	if a.botScorer != nil {
+		score, err := a.botScorer.score(req)
+		switch {
+		case err != nil && a.botScorer.failOpen:
+			failures.add("botscore", err)
+			a.logger.Printf("ModSecurity::botScore fail to get bot score, continuing: %s", err.Error())
+		case err != nil:
+			a.logger.Printf("ModSecurity::botScore fail to get bot score: %s", err.Error())
+			a.blockLocally(rw, req, "bot score unavailable", http.StatusServiceUnavailable)
+			return
+		case a.botScorer.isBot(score):
+			a.blockLocally(rw, req, fmt.Sprintf("bot score %s", formatBotScore(score)), http.StatusForbidden)
+			return
+		default:
+			botScore = formatBotScore(score)
+		}
+	}
+
+	headersOnly := !strict && (meshAction == meshActionHeaders || matchAny(a.headersOnlyPaths, req.URL.Path))
+	// past the memory ceiling, bodies are rejected or streamed to the service uninspected
+	if !headersOnly {
+		reserved, ok := a.reserveBodyMemory(req)
+		defer releaseBodyMemory(reserved)
+		if !ok && a.bufferedBytesPolicy == bufferedBytesPolicySkipBody {
+			a.logSampled("buffered_bytes_limit", a.requestFields(req, logFields{"action": "skip_body"}))
+			headersOnly = true
+		} else if !ok {
+			a.blockLocally(rw, req, "buffered bodies memory limit reached", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// with two-phase inspection the request line and headers are submitted right away, while
+	// the body is still being read. A block verdict on headers stops the body buffering.
+	var early *earlyInspection
+	if a.twoPhaseInspection && !headersOnly && hasBody(req) {
+		early = a.startEarlyInspection(req, botScore)
+		defer early.close()
+	}
+
+	// on headers-only routes the body is trusted: it is not buffered and streams
+	// untouched to the service, the WAF only sees the request line and headers.
+	var wafBody *bufferedBody
+	if !headersOnly {
+		var bodyReader io.Reader = req.Body
+		slowBody := a.limitBodyRate(req.Body)
+		if slowBody != nil {
+			bodyReader = slowBody
+		}
+		if early != nil {
+			bodyReader = early.abortOnBlock(bodyReader)
+		}
+
+		// we need to buffer the body if we want to read it here and send it
+		// in the request.
+		body, err := a.readBody(rw, bodyReader)
+		slowBody.release()
+		if err != nil && err != errBlockedOnHeaders {
+			if early != nil {
+				early.discard()
+			}
+			failures.add("body", err)
+			if err == errBodyTooSlow {
+				// the connection can't be reused, the server would otherwise wait for the rest of the body
+				rw.Header().Set("Connection", "close")
+				a.blockLocally(rw, req, "body read too slowly", http.StatusRequestTimeout)
+			} else if err == errBodyTooLarge {
+				a.handleError(rw, req, fmt.Sprintf("body max limit reached: %s", err.Error()), http.StatusRequestEntityTooLarge)
+			} else {
+				a.handleError(rw, req, fmt.Sprintf("fail to read incoming request: %s", err.Error()), http.StatusBadGateway)
+			}
+			return
+		}
+		if body != nil {
+			defer body.close()
+		}
+
+		if early != nil {
+			result := early.wait()
+			if result.err != nil {
+				failures.add("waf", result.err)
+				a.handleWafError(rw, req, result.err)
+				return
+			}
+			if result.blocked {
+				defer result.resp.Body.Close()
+				a.recordVerdict(req, true)
+				if len(a.accessLogHeaderPrefix) > 0 {
+					a.annotate(req, a.signals(req, result.resp, botScore), true)
+				}
+				a.exportReplay(req, nil, result.resp.StatusCode, true)
+				a.audit(req, "waf_block", result.resp.StatusCode, a.ruleIds(result.resp), "")
+				a.applyDecoys(rw, req, result.resp)
+				a.writeBlockResponse(result.resp, rw)
+				return
+			}
+			result.resp.Body.Close()
+		}
+
+		// you can reassign the body if you need to parse it as multipart
+		body.replay(req)
+		wafBody = body
+		if body.truncated() {
+			a.logger.Printf("ModSecurity::inspect body larger than %d bytes, inspecting the first %d bytes only: %s %s", a.maxBodySize, body.inspected, req.Method, a.piiMasker.maskURI(req.RequestURI))
+		}
+	}
 
-	// We may want to filter some headers, otherwise we could just use a shallow copy
-	// proxyReq.Header = req.Header
-	proxyReq.Header = make(http.Header)
-	for h, val := range req.Header {
-		proxyReq.Header[h] = val
+	if smuggling && wafBody != nil && a.suspectSmuggling(rw, req, smugglingBodySuspicion(req, wafBody.mem)) {
+		return
+	}
+	if err := a.openAPI.validate(req, wafBody); err != nil {
+		a.blockLocally(rw, req, "OpenAPI validation failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.formLimits.check(req, wafBody); err != nil {
+		a.blockLocally(rw, req, "form limits exceeded: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	resp, err := httpClient.Do(proxyReq)
+	a.metrics.observeBodySize(a.metricsRoute(req.URL.Path), wafBody)
+	var optimistic *optimisticRequest
+	if a.optimistic.applies(req, strict) {
+		optimistic = a.forwardOptimistically(rw, req)
+	}
+	resp, err := a.inspectCached(req, wafBody, botScore, strict)
 	if err != nil {
-		a.handleError(rw, req, fmt.Sprintf("fail to send HTTP request to modsec: %s", err.Error()), http.StatusBadGateway)
+		failures.add("waf", err)
+		if optimistic == nil {
+			a.handleWafError(rw, req, err)
+		} else if code, interrupt := a.wafErrorPolicy(req, err); !interrupt {
+			optimistic.release()
+		} else if optimistic.abort() {
+			a.interruptOrContinue(rw, req, code, true)
+		}
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		if resp.StatusCode >= 500 {
-			a.logger.Print("OWASP 500 error. Request ", req)
-			a.logger.Print("OWASP 500 error. Response ", resp)
+	if a.debugDumper.selects(req) {
+		if err := a.debugDumper.dump(req, wafBody, resp, a.piiMasker); err != nil {
+			failures.add("debugdump", err)
+			a.logEvent("debug_dump_failed", a.requestFields(req, logFields{"error": err.Error()}))
 		}
-		if resp.StatusCode < 500 || !a.ignore500Error {
-			forwardResponse(resp, rw)
-			return
+	}
+
+	signals := a.signals(req, resp, botScore)
+	verdict := signals.Status < http.StatusInternalServerError && a.decision.Blocks(signals)
+	a.recordVerdict(req, verdict)
+	a.cleanShapes.record(req, verdict)
+	blocked := a.isBlocked(req, resp, signals)
+	a.annotate(req, signals, blocked)
+	a.exportReplay(req, wafBody, resp.StatusCode, blocked)
+	if blocked && optimistic != nil && !optimistic.abort() {
+		a.audit(req, "optimistic_late_block", resp.StatusCode, signals.RuleIds, "")
+		a.logEvent("optimistic_late_block", a.requestFields(req, logFields{"status": resp.StatusCode}))
+		return
+	}
+	if blocked {
+		a.audit(req, "waf_block", resp.StatusCode, signals.RuleIds, "")
+		a.applyDecoys(rw, req, resp)
+		a.writeBlockResponse(resp, rw)
+		return
+	}
+	if optimistic != nil {
+		optimistic.release()
+		return
+	}
+
+	a.next.ServeHTTP(rw, withInspectionResult(req, newInspectionResult(signals, a.decision.Blocks(signals))))
+}
+
+// inspect sends a copy of req with the given body to the WAF, or to the stages of the inspection
+// pipeline, and returns its response. A nil body sends the request line and headers only.
+func (a *Modsecurity) inspect(req *http.Request, body *bufferedBody, botScore string) (*http.Response, error) {
+	if a.pipeline != nil {
+		return a.pipeline.run(a, req, body, botScore)
+	}
+	return a.inspectWith(a.backendProtocol, a.modSecurityUrl, req, body, botScore)
+}
+
+// inspectWith sends a copy of req with the given body to the inspection service at baseURL,
+// speaking protocol.
+func (a *Modsecurity) inspectWith(protocol string, baseURL string, req *http.Request, body *bufferedBody, botScore string) (*http.Response, error) {
+	switch protocol {
+	case backendProtocolExtAuthz:
+		proxyReq, err := a.wafRequest(baseURL, req, body, botScore)
+		if err != nil {
+			return nil, err
+		}
+		return a.checkExtAuthz(baseURL, req, proxyReq)
+	case backendProtocolIcap:
+		// the ICAP service receives the request as it would reach the service
+		proxyReq, err := a.wafRequest("", req, body, botScore)
+		if err != nil {
+			return nil, err
+		}
+		proxyReq.Host = req.Host
+		return a.sendToWaf(req, proxyReq, a.icapClient(baseURL))
+	case backendProtocolChannel:
+		proxyReq, err := a.wafRequest(baseURL, req, body, botScore)
+		if err != nil {
+			return nil, err
+		}
+		client, err := a.channels.client(baseURL, a.httpClient.Timeout)
+		if err != nil {
+			return nil, newWafError("fail to open the channel", err)
+		}
+		return a.sendToWaf(req, proxyReq, client)
+	case backendProtocolAgent:
+		// the agent receives the request as it would reach the service
+		proxyReq, err := a.wafRequest("", req, body, botScore)
+		if err != nil {
+			return nil, err
+		}
+		proxyReq.Host = req.Host
+		client, err := a.agents.client(baseURL, a.httpClient.Timeout)
+		if err != nil {
+			return nil, newWafError("fail to reach the agent", err)
+		}
+		return a.sendToWaf(req, proxyReq, client)
+	default:
+		proxyReq, err := a.wafRequest(baseURL, req, body, botScore)
+		if err != nil {
+			return nil, err
 		}
+		compressed := a.wafCompression.compress(proxyReq)
+		resp, err := a.sendToWaf(req, proxyReq, a.httpClient)
+		if err != nil || !a.wafCompression.observe(resp, compressed) {
+			return resp, err
+		}
+		// the WAF refused the compressed body, it is sent again as is
+		resp.Body.Close()
+		if proxyReq, err = a.wafRequest(baseURL, req, body, botScore); err != nil {
+			return nil, err
+		}
+		return a.sendToWaf(req, proxyReq, a.httpClient)
+	}
+}
+
+// wafRequest returns the copy of req with the given body sent to the inspection service at baseURL.
+func (a *Modsecurity) wafRequest(baseURL string, req *http.Request, body *bufferedBody, botScore string) (*http.Request, error) {
+	transforms := a.newTransformations()
+	// create a new url from the raw RequestURI sent by the client
+	uri, applied := a.transformedURI(req)
+	transforms.add(applied...)
+	url := baseURL + uri
+
+	var bodyReader io.Reader = http.NoBody
+	var normalized []byte
+	if body != nil {
+		bodyReader = body.wafReader()
+		transforms.addIf(transformationBodyTruncated, body.truncated())
+		// only bodies fully held in memory are normalized
+		if !body.truncated() && body.file == nil {
+			if n, changed := a.bodyNormalizer.normalize(req.Header.Get("Content-Type"), body.mem); changed {
+				normalized = n
+				bodyReader = bytes.NewReader(normalized)
+				transforms.add(bodyTransformation(req.Header.Get("Content-Type")))
+			}
+		}
+	}
+	proxyReq, err := http.NewRequest(req.Method, url, bodyReader)
+	if err != nil {
+		return nil, &wafError{category: errorCategoryRequest, message: "fail to prepare forwarded request", err: err}
+	}
+	if ctx, ok := req.Context().Value(wafContextKey).(context.Context); ok {
+		proxyReq = proxyReq.WithContext(ctx)
+	}
+
+	proxyReq.Header = a.headerFilter.filter(req.Header)
+	transforms.addIf(transformationHeadersFiltered, len(proxyReq.Header) < len(req.Header))
+	cookies := proxyReq.Header["Cookie"]
+	a.cookieFilter.apply(proxyReq.Header)
+	transforms.addIf(transformationCookies, !sameValues(cookies, proxyReq.Header["Cookie"]))
+	transforms.addIf(transformationForwarded, forwardedHeadersRewritten(a.forwardedHeadersPolicy, proxyReq.Header))
+	applyForwardedHeadersPolicy(a.forwardedHeadersPolicy, req, proxyReq.Header)
+	transforms.addIf(transformationHeaderControl, hasHeaderControlChars(proxyReq.Header))
+	stripControlChars(proxyReq.Header)
+	a.paranoiaLevels.apply(req.URL.Path, proxyReq.Header)
+	a.greylistParanoiaLevel(req, proxyReq.Header)
+	a.sessionParanoiaLevel(req, proxyReq.Header)
+	a.exclusions.apply(req.URL.Path, proxyReq.Header)
+	a.debugDumper.stripTrigger(proxyReq.Header)
+	if a.forwardTLSMetadata {
+		applyTLSMetadata(req, a.ja3Header, proxyReq.Header)
+	}
+	if len(a.fingerprintHeader) > 0 {
+		// computed on the original request, a value sent by the client is never trusted
+		proxyReq.Header.Set(a.fingerprintHeader, clientFingerprint(req))
+	}
+	if body != nil {
+		proxyReq.ContentLength = body.wafLength()
+		if normalized != nil {
+			proxyReq.ContentLength = int64(len(normalized))
+		}
+		if len(req.Trailer) > 0 && !body.truncated() {
+			// trailers are only sent with chunked bodies, they are known once the body was buffered
+			proxyReq.Trailer = req.Trailer.Clone()
+			proxyReq.ContentLength = -1
+		}
+	}
+	// a score sent by the client never reaches the WAF, also when scoring failed open
+	proxyReq.Header.Del(botScoreHeader)
+	if len(botScore) > 0 {
+		proxyReq.Header.Set(botScoreHeader, botScore)
+	}
+	transforms.apply(proxyReq.Header)
+	return proxyReq, nil
+}
+
+// wafDoer sends the copies of the requests to an inspection service.
+type wafDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// sendToWaf sends proxyReq, the copy of req prepared for the inspection service, with client.
+func (a *Modsecurity) sendToWaf(req *http.Request, proxyReq *http.Request, client wafDoer) (*http.Response, error) {
+	if err := a.wafPool.acquire(req.Context()); err != nil {
+		return nil, newWafError("fail to wait for a WAF slot", err)
+	}
+	defer a.wafPool.release()
+
+	a.warmer.touch()
+	a.lifecycle.begin()
+	defer a.lifecycle.end()
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	a.withPprofLabels(req.Context(), "waf", func(context.Context) {
+		resp, err = client.Do(proxyReq)
+	})
+	a.metrics.observeWafDuration(a.metricsRoute(req.URL.Path), time.Since(start))
+	if err != nil {
+		a.outageAlerter.failure(err, time.Now())
+		return nil, newWafError("fail to send HTTP request to modsec", err)
 	}
+	a.outageAlerter.success()
+	return resp, nil
+}
 
-	a.next.ServeHTTP(rw, req)
+// isBlocked reports whether the WAF response must be returned to the client instead of
+// forwarding the request to the service.
+func (a *Modsecurity) isBlocked(req *http.Request, resp *http.Response, signals Signals) bool {
+	if !a.decision.Blocks(signals) {
+		return false
+	}
+	if resp.StatusCode >= 500 {
+		a.logSampled("waf_5xx", a.requestFields(req, logFields{
+			"status": resp.StatusCode,
+			"server": resp.Header.Get("Server"),
+		}))
+	}
+	if resp.StatusCode >= 500 && a.ignore500Error {
+		return false
+	}
+	if a.onlyIgnoredRules(req.URL.Path, signals.RuleIds) {
+		a.logEvent("waf_rules_ignored", a.requestFields(req, logFields{
+			"status": resp.StatusCode,
+			"rules":  strings.Join(signals.RuleIds, ","),
+		}))
+		return false
+	}
+	if a.sessionOverride(req) == sessionOverrideRelax {
+		a.logEvent("waf_detected", a.requestFields(req, logFields{
+			"status": resp.StatusCode,
+			"reason": "session override",
+		}))
+		return false
+	}
+	if a.schedule.mode(req.URL.Path, time.Now()) == modeDetect || a.errorBudget.degraded(errorBudgetDetect) {
+		a.logEvent("waf_detected", a.requestFields(req, logFields{
+			"status": resp.StatusCode,
+		}))
+		return false
+	}
+	if a.asnPolicies.action(signals.Asn) == asnActionDetect {
+		a.logEvent("waf_detected", a.requestFields(req, logFields{
+			"status": resp.StatusCode,
+			"asn":    signals.Asn,
+		}))
+		return false
+	}
+	return true
 }
 
 func isWebsocket(req *http.Request) bool {
@@ -154,14 +1543,37 @@ func forwardResponse(resp *http.Response, rw http.ResponseWriter) {
 	rw.WriteHeader(resp.StatusCode)
 	// copy body
 	io.Copy(rw, resp.Body)
+	// copy trailers, known once the body was read
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			rw.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// blockLocally rejects a request without involving the WAF.
+func (a *Modsecurity) blockLocally(rw http.ResponseWriter, req *http.Request, reason string, code int) {
+	if a.audit(req, "local_block", code, nil, reason) {
+		a.logger.Printf("ModSecurity::blockLocally %s: %s %s", reason, req.Method, a.piiMasker.maskURI(req.RequestURI))
+	}
+	http.Error(rw, "", code)
 }
 
 func (a *Modsecurity) handleError(rw http.ResponseWriter, req *http.Request, errorMessage string, code int) {
 	a.logger.Printf(errorMessage)
-	a.logger.Print("ModSecurity::handleError Request: ", req)
-	if a.interruptOnError {
-		a.logger.Print("ModSecurity::handleError [Interrupt]")
-		http.Error(rw, "", code)
+	// neither the query nor the headers, they may hold credentials
+	a.logger.Printf("ModSecurity::handleError Request: %s %s", req.Method, a.piiMasker.mask(req.URL.Path))
+	a.interruptOrContinue(rw, req, code, a.interruptOnError)
+}
+
+// interruptOrContinue answers code when interrupt is set, otherwise it forwards the request to the service.
+func (a *Modsecurity) interruptOrContinue(rw http.ResponseWriter, req *http.Request, code int, interrupt bool) {
+	if interrupt {
+		if id := a.errorResponder.write(rw, req, code); len(id) > 0 {
+			a.logger.Printf("ModSecurity::handleError [Interrupt] correlation_id=%s", id)
+		} else {
+			a.logger.Print("ModSecurity::handleError [Interrupt]")
+		}
 	} else {
 		a.logger.Print("ModSecurity::handleError [Continue]")
 		a.next.ServeHTTP(rw, req)
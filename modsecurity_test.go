@@ -3,11 +3,19 @@ package traefik_modsecurity_plugin
 
 import (
 	"bytes"
+	"context"
+	"go/parser"
+	"go/token"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -63,6 +71,7 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 		{
 			name: "Does not forward Websockets",
 			request: http.Request{
+				URL:  &url.URL{Path: "/"},
 				Body: http.NoBody,
 				Header: http.Header{
 					"Upgrade": []string{"Websocket"},
@@ -79,7 +88,9 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 		{
 			name: "Accept payloads smaller than limits",
 			request: http.Request{
-				Body: generateLargeBody(1024),
+				URL:    &url.URL{Path: "/"},
+				Header: http.Header{},
+				Body:   generateLargeBody(1024),
 			},
 			wafResponse: response{
 				StatusCode: 200,
@@ -92,7 +103,9 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 		{
 			name: "Reject too big payloads",
 			request: http.Request{
-				Body: generateLargeBody(1025),
+				URL:    &url.URL{Path: "/"},
+				Header: http.Header{},
+				Body:   generateLargeBody(1025),
 			},
 			wafResponse: response{
 				StatusCode: 200,
@@ -124,13 +137,10 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 				forwardResponse(&resp, w)
 			})
 
-			middleware := &Modsecurity{
-				next:           httpServiceHandler,
-				modSecurityUrl: modsecurityMockServer.URL,
-				maxBodySize:    1024,
-				name:           "modsecurity-middleware",
-				logger:         log.New(io.Discard, "", log.LstdFlags),
-			}
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.MaxBodySize = 1024
+			middleware := newTestModsecurity(t, config, httpServiceHandler)
 
 			rw := httptest.NewRecorder()
 
@@ -145,7 +155,119 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 	}
 }
 
+// newTestModsecurity builds a middleware through New with logging discarded.
+func newTestModsecurity(t testing.TB, config *Config, next http.Handler) *Modsecurity {
+	t.Helper()
+	handler, err := New(context.Background(), next, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := handler.(*Modsecurity)
+	middleware.logger = log.New(io.Discard, "", log.LstdFlags)
+	return middleware
+}
+
 func generateLargeBody(size int) io.ReadCloser {
 	var str = make([]byte, size)
 	return io.NopCloser(bytes.NewReader(str))
 }
+
+func TestModsecurity_ClientPerInstance(t *testing.T) {
+	slowWaf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slowWaf.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fastConfig := CreateConfig()
+	fastConfig.ModSecurityUrl = slowWaf.URL
+	fastConfig.WafTimeout = "50ms"
+	fast := newTestModsecurity(t, fastConfig, next)
+	slowConfig := CreateConfig()
+	slowConfig.ModSecurityUrl = slowWaf.URL
+	slow := newTestModsecurity(t, slowConfig, next)
+
+	assert.NotSame(t, fast.httpClient, slow.httpClient)
+	assert.NotSame(t, fast.httpClient.Transport, slow.httpClient.Transport)
+
+	rw := httptest.NewRecorder()
+	fast.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+
+	rw = httptest.NewRecorder()
+	slow.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestModsecurity_handleErrorLogsNoCredentials(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.MaxBodySize = 4
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+
+	req := httptest.NewRequest(http.MethodPost, "/items?token=s3cr3t", strings.NewReader("too large"))
+	req.Header.Set("Authorization", "Bearer h34d3r")
+	req.Header.Set("Cookie", "session=c00k13")
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Contains(t, buf.String(), "ModSecurity::handleError Request: POST /items\n")
+	for _, secret := range []string{"s3cr3t", "h34d3r", "c00k13"} {
+		assert.NotContains(t, buf.String(), secret)
+	}
+}
+
+// roundTripperFunc answers the WAF calls without network, for benchmarks measuring the middleware itself.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func BenchmarkModsecurity_ServeHTTP(b *testing.B) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf"
+	middleware := newTestModsecurity(b, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	middleware.httpClient.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		io.Copy(io.Discard, req.Body)
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	})
+
+	body := []byte(`{"user":"john","password":"secret"}`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/login?redirect=%2Fhome", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		req.Header.Set("Accept", "*/*")
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// TestModsecurity_YaegiImports checks that the plugin only imports packages Traefik provides: it
+// is interpreted by Yaegi, whose standard library has no syscall, unsafe, os/exec nor cgo, and
+// plugins cannot have dependencies.
+func TestModsecurity_YaegiImports(t *testing.T) {
+	unavailable := map[string]bool{"syscall": true, "unsafe": true, "os/exec": true, "plugin": true, "C": true}
+	files, err := filepath.Glob("*.go")
+	assert.NoError(t, err)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		parsed, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ImportsOnly)
+		assert.NoError(t, err)
+		for _, spec := range parsed.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			assert.False(t, unavailable[path], "%s imports %s, which Yaegi does not provide", file, path)
+			assert.NotContains(t, strings.SplitN(path, "/", 2)[0], ".", "%s imports %s, plugins only have the standard library", file, path)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// bodyNormalizer rewrites the copy of the body sent to the WAF, so that obfuscated payloads
+// (nested percent-encoding, parameter pollution, padded JSON) still match the rules.
+// The service always receives the original body.
+type bodyNormalizer struct {
+	decodeForm     bool
+	collapseParams bool
+	canonicalJSON  bool
+}
+
+func newBodyNormalizer(decodeForm bool, collapseParams bool, canonicalJSON bool) *bodyNormalizer {
+	if !decodeForm && !collapseParams && !canonicalJSON {
+		return nil
+	}
+	return &bodyNormalizer{
+		decodeForm:     decodeForm,
+		collapseParams: collapseParams,
+		canonicalJSON:  canonicalJSON,
+	}
+}
+
+// normalize returns the normalized body and whether it differs from body.
+func (n *bodyNormalizer) normalize(contentType string, body []byte) ([]byte, bool) {
+	if n == nil || len(body) == 0 {
+		return body, false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, false
+	}
+	var normalized []byte
+	switch {
+	case mediaType == "application/x-www-form-urlencoded" && (n.decodeForm || n.collapseParams):
+		normalized = n.normalizeForm(body)
+	case (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && n.canonicalJSON:
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, body); err != nil {
+			// invalid JSON is sent untouched, the WAF reports it on its own
+			return body, false
+		}
+		normalized = compacted.Bytes()
+	default:
+		return body, false
+	}
+	return normalized, !bytes.Equal(normalized, body)
+}
+
+// normalizeForm decodes the percent-encoding of the form parameters and merges the values of
+// duplicate parameters into the first occurrence, separated by commas. The parameter order is kept.
+func (n *bodyNormalizer) normalizeForm(body []byte) []byte {
+	var names []string
+	values := make(map[string][]string)
+	for _, pair := range strings.Split(string(body), "&") {
+		if len(pair) == 0 {
+			continue
+		}
+		name, value := pair, ""
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			name, value = pair[:i], pair[i+1:]
+		}
+		if n.decodeForm {
+			name, value = unescapeFormValue(name), unescapeFormValue(value)
+		}
+		if _, seen := values[name]; !seen || !n.collapseParams {
+			names = append(names, name)
+		}
+		values[name] = append(values[name], value)
+	}
+
+	var normalized bytes.Buffer
+	emitted := make(map[string]int, len(names))
+	for _, name := range names {
+		if normalized.Len() > 0 {
+			normalized.WriteByte('&')
+		}
+		normalized.WriteString(name)
+		normalized.WriteByte('=')
+		if n.collapseParams {
+			normalized.WriteString(strings.Join(values[name], ","))
+			continue
+		}
+		normalized.WriteString(values[name][emitted[name]])
+		emitted[name]++
+	}
+	return normalized.Bytes()
+}
+
+// unescapeFormValue decodes value, repeatedly to undo nested encodings. Malformed escapes are kept as is.
+func unescapeFormValue(value string) string {
+	for i := 0; i < 3 && strings.ContainsAny(value, "%+"); i++ {
+		decoded, err := url.QueryUnescape(value)
+		if err != nil || decoded == value {
+			break
+		}
+		value = decoded
+	}
+	return value
+}
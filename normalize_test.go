@@ -0,0 +1,121 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyNormalizer(t *testing.T) {
+	tests := []struct {
+		name        string
+		normalizer  *bodyNormalizer
+		contentType string
+		body        string
+		expect      string
+		changed     bool
+	}{
+		{
+			name:        "decode form",
+			normalizer:  newBodyNormalizer(true, false, false),
+			contentType: "application/x-www-form-urlencoded",
+			body:        "q=%2527%2520or%25201%253D1&a=b+c",
+			expect:      "q=' or 1=1&a=b c",
+			changed:     true,
+		},
+		{
+			name:        "collapse duplicate parameters",
+			normalizer:  newBodyNormalizer(false, true, false),
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        "id=1&name=x&id=2",
+			expect:      "id=1,2&name=x",
+			changed:     true,
+		},
+		{
+			name:        "keep duplicates without collapse",
+			normalizer:  newBodyNormalizer(true, false, false),
+			contentType: "application/x-www-form-urlencoded",
+			body:        "id=1&id=2",
+			expect:      "id=1&id=2",
+			changed:     false,
+		},
+		{
+			name:        "malformed escape kept",
+			normalizer:  newBodyNormalizer(true, false, false),
+			contentType: "application/x-www-form-urlencoded",
+			body:        "q=%zz",
+			expect:      "q=%zz",
+			changed:     false,
+		},
+		{
+			name:        "canonicalize json",
+			normalizer:  newBodyNormalizer(false, false, true),
+			contentType: "application/vnd.api+json",
+			body:        "{ \"a\" :\n [1, 2] }",
+			expect:      `{"a":[1,2]}`,
+			changed:     true,
+		},
+		{
+			name:        "invalid json untouched",
+			normalizer:  newBodyNormalizer(false, false, true),
+			contentType: "application/json",
+			body:        "{ invalid",
+			expect:      "{ invalid",
+			changed:     false,
+		},
+		{
+			name:        "other content types untouched",
+			normalizer:  newBodyNormalizer(true, true, true),
+			contentType: "text/plain",
+			body:        "a=%27&a=1",
+			expect:      "a=%27&a=1",
+			changed:     false,
+		},
+		{
+			name:        "disabled",
+			normalizer:  newBodyNormalizer(false, false, false),
+			contentType: "application/json",
+			body:        "{ }",
+			expect:      "{ }",
+			changed:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normalized, changed := tt.normalizer.normalize(tt.contentType, []byte(tt.body))
+			assert.Equal(t, tt.expect, string(normalized))
+			assert.Equal(t, tt.changed, changed)
+		})
+	}
+}
+
+func TestModsecurity_NormalizedBodyOnlySentToWaf(t *testing.T) {
+	var wafBody string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		wafBody = string(body)
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+	}))
+	defer wafServer.Close()
+
+	var serviceBody string
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.CanonicalizeJson = true
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		serviceBody = string(body)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{ "a" : 1 }`))
+	req.Header.Set("Content-Type", "application/json")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, `{"a":1}`, wafBody)
+	assert.Equal(t, `{ "a" : 1 }`, serviceBody)
+}
@@ -0,0 +1,99 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Chat services accepted in notifyWebhookType.
+const (
+	webhookTypeSlack   = "slack"
+	webhookTypeDiscord = "discord"
+	webhookTypeTeams   = "teams"
+)
+
+// ruleNotifier posts a chat message when critical rules fire. Each rule notifies at most once per
+// interval, the next message reports how many notifications were suppressed meanwhile.
+type ruleNotifier struct {
+	url      string
+	kind     string
+	rules    map[string]bool
+	sampler  *logSampler
+	webhooks *webhookQueue
+}
+
+func newRuleNotifier(url string, kind string, ruleIds []string, interval time.Duration, webhooks *webhookQueue) (*ruleNotifier, error) {
+	if len(url) == 0 {
+		return nil, nil
+	}
+	switch kind {
+	case webhookTypeSlack, webhookTypeDiscord, webhookTypeTeams:
+	default:
+		return nil, fmt.Errorf("invalid notifyWebhookType %q, expected %s, %s or %s", kind, webhookTypeSlack, webhookTypeDiscord, webhookTypeTeams)
+	}
+	if len(ruleIds) == 0 {
+		return nil, fmt.Errorf("notifyRuleIds is required with notifyWebhookUrl")
+	}
+	return &ruleNotifier{
+		url:      url,
+		kind:     kind,
+		rules:    newRuleIdSet(ruleIds),
+		sampler:  newLogSampler(interval, 1),
+		webhooks: webhooks,
+	}, nil
+}
+
+// send implements eventSink.
+func (n *ruleNotifier) send(event *auditEvent) {
+	if event.Event == "panic" {
+		if allowed, _ := n.sampler.allow(event.Event, event.Time); allowed {
+			n.announce(fmt.Sprintf("WAF middleware recovered from a panic: %s on %s %s%s", event.Reason, event.Method, event.Host, event.URI))
+		}
+		return
+	}
+	if event.Event != "waf_block" {
+		return
+	}
+	for _, id := range event.RuleIds {
+		if !n.rules[id] {
+			continue
+		}
+		allowed, suppressed := n.sampler.allow(id, event.Time)
+		if !allowed {
+			continue
+		}
+		text := fmt.Sprintf("WAF rule %s fired: %s %s%s from %s, answered %d", id, event.Method, event.Host, event.URI, event.Client, event.Status)
+		if suppressed > 0 {
+			text += fmt.Sprintf(" (%d similar notifications suppressed)", suppressed)
+		}
+		n.webhooks.enqueue(n.url, n.payload(text))
+	}
+}
+
+// announce posts text to the chat service, when one is configured.
+func (n *ruleNotifier) announce(text string) {
+	if n != nil {
+		n.webhooks.enqueue(n.url, n.payload(text))
+	}
+}
+
+// payload formats text for the chat service.
+func (n *ruleNotifier) payload(text string) []byte {
+	var message interface{}
+	switch n.kind {
+	case webhookTypeDiscord:
+		message = map[string]string{"content": text}
+	case webhookTypeTeams:
+		message = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  "WAF rule fired",
+			"text":     text,
+		}
+	default:
+		message = map[string]string{"text": text}
+	}
+	payload, _ := json.Marshal(message)
+	return payload
+}
@@ -0,0 +1,114 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRuleNotifier(t *testing.T) {
+	notifier, err := newRuleNotifier("", webhookTypeSlack, nil, time.Minute, nil)
+	assert.Nil(t, notifier)
+	assert.NoError(t, err)
+
+	_, err = newRuleNotifier("http://chat", "irc", []string{"942100"}, time.Minute, nil)
+	assert.Error(t, err)
+
+	_, err = newRuleNotifier("http://chat", webhookTypeSlack, nil, time.Minute, nil)
+	assert.Error(t, err)
+}
+
+func TestRuleNotifier_Payload(t *testing.T) {
+	tests := []struct {
+		kind   string
+		expect string
+	}{
+		{kind: webhookTypeSlack, expect: `{"text":"hello"}`},
+		{kind: webhookTypeDiscord, expect: `{"content":"hello"}`},
+		{kind: webhookTypeTeams, expect: `{"@context":"https://schema.org/extensions","@type":"MessageCard","summary":"WAF rule fired","text":"hello"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			notifier, err := newRuleNotifier("http://chat", tt.kind, []string{"942100"}, time.Minute, nil)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.expect, string(notifier.payload("hello")))
+		})
+	}
+}
+
+func TestRuleNotifier_Send(t *testing.T) {
+	queue := newWebhookQueue()
+	notifier, err := newRuleNotifier("http://chat", webhookTypeSlack, []string{"942100"}, time.Minute, queue)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	event := func(kind string, ruleIds ...string) *auditEvent {
+		return &auditEvent{Time: now, Event: kind, Method: "GET", Host: "example.com", URI: "/?id=1", Client: "192.0.2.1", Status: 403, RuleIds: ruleIds}
+	}
+	notifier.send(event("waf_block", "920350"))
+	notifier.send(event("local_block", "942100"))
+	assert.Len(t, queue.queue, 0)
+
+	notifier.send(event("waf_block", "920350", "942100"))
+	notifier.send(event("waf_block", "942100"))
+	notifier.send(event("waf_block", "942100"))
+	assert.Len(t, queue.queue, 1)
+	message := <-queue.queue
+	assert.JSONEq(t, `{"text":"WAF rule 942100 fired: GET example.com/?id=1 from 192.0.2.1, answered 403"}`, string(message.payload))
+
+	now = now.Add(time.Minute)
+	notifier.send(event("waf_block", "942100"))
+	message = <-queue.queue
+	var payload map[string]string
+	assert.NoError(t, json.Unmarshal(message.payload, &payload))
+	assert.Contains(t, payload["text"], "(2 similar notifications suppressed)")
+
+	panicEvent := &auditEvent{Time: now, Event: "panic", Method: "GET", Host: "example.com", URI: "/items", Status: 502, Reason: "boom"}
+	notifier.send(panicEvent)
+	notifier.send(panicEvent)
+	assert.Len(t, queue.queue, 1, "panics are notified at most once per interval")
+	message = <-queue.queue
+	assert.JSONEq(t, `{"text":"WAF middleware recovered from a panic: boom on GET example.com/items"}`, string(message.payload))
+}
+
+func TestModsecurity_NotifyCriticalRules(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		messages = append(messages, payload["content"])
+		mu.Unlock()
+	}))
+	defer chat.Close()
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Waf-Rule-Ids", "942100")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.NotifyWebhookUrl = chat.URL
+	config.NotifyWebhookType = webhookTypeDiscord
+	config.NotifyRuleIds = []string{"942100"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/?id=1", nil))
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+	}
+	assert.NoError(t, middleware.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "WAF rule 942100 fired")
+}
@@ -0,0 +1,487 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// openAPIMaxDepth bounds the nesting of the validated schemas, so that recursive $ref terminate.
+const openAPIMaxDepth = 32
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// openAPIValidator validates the requests against an OpenAPI 3 document before they are sent to
+// the WAF: the path and method must be declared, the parameters and the JSON body must match their
+// schemas. Only the JSON serialization of documents is supported, and the subset of JSON schema
+// describing the types, required and additional properties, enums, bounds, lengths and patterns.
+type openAPIValidator struct {
+	basePath string
+	document map[string]interface{}
+	paths    []openAPIPath
+	patterns map[string]*regexp.Regexp
+}
+
+type openAPIPath struct {
+	template   string
+	pattern    *regexp.Regexp
+	params     []string
+	parameters []interface{}
+	operations map[string]map[string]interface{}
+}
+
+var openAPIPathParam = regexp.MustCompile(`\{([^}/]+)\}`)
+
+func newOpenAPIValidator(file string, basePath string) (*openAPIValidator, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid openApiSpec: %w", err)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("invalid openApiSpec %s, only JSON documents are supported: %w", file, err)
+	}
+	if version, _ := document["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		return nil, fmt.Errorf("invalid openApiSpec %s: expected an OpenAPI 3 document", file)
+	}
+	v := &openAPIValidator{
+		basePath: strings.TrimSuffix(basePath, "/"),
+		document: document,
+		patterns: map[string]*regexp.Regexp{},
+	}
+	if err := v.compilePatterns(document); err != nil {
+		return nil, fmt.Errorf("invalid openApiSpec %s: %w", file, err)
+	}
+
+	paths, _ := document["paths"].(map[string]interface{})
+	for template, item := range paths {
+		item, _ := v.resolve(item).(map[string]interface{})
+		path := openAPIPath{template: template, operations: map[string]map[string]interface{}{}}
+		path.parameters, _ = item["parameters"].([]interface{})
+		expr := "^"
+		last := 0
+		for _, match := range openAPIPathParam.FindAllStringSubmatchIndex(template, -1) {
+			expr += regexp.QuoteMeta(template[last:match[0]]) + "([^/]+)"
+			path.params = append(path.params, template[match[2]:match[3]])
+			last = match[1]
+		}
+		path.pattern = regexp.MustCompile(expr + regexp.QuoteMeta(template[last:]) + "$")
+		for _, method := range openAPIMethods {
+			if operation, ok := item[method].(map[string]interface{}); ok {
+				path.operations[strings.ToUpper(method)] = operation
+			}
+		}
+		v.paths = append(v.paths, path)
+	}
+	// concrete paths match before templated ones
+	sort.Slice(v.paths, func(i, j int) bool {
+		if len(v.paths[i].params) != len(v.paths[j].params) {
+			return len(v.paths[i].params) < len(v.paths[j].params)
+		}
+		return v.paths[i].template < v.paths[j].template
+	})
+	return v, nil
+}
+
+// compilePatterns compiles the pattern keywords of the document, examples aside.
+func (v *openAPIValidator) compilePatterns(node interface{}) error {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for key, value := range node {
+			if key == "example" || key == "examples" {
+				continue
+			}
+			if pattern, ok := value.(string); ok && key == "pattern" {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid pattern %q: %s", pattern, err.Error())
+				}
+				v.patterns[pattern] = re
+				continue
+			}
+			if err := v.compilePatterns(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, value := range node {
+			if err := v.compilePatterns(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows the local $ref of node, if any.
+func (v *openAPIValidator) resolve(node interface{}) interface{} {
+	for depth := 0; depth < openAPIMaxDepth; depth++ {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return node
+		}
+		ref, ok := object["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#/") {
+			return node
+		}
+		var target interface{} = v.document
+		for _, name := range strings.Split(ref[2:], "/") {
+			name = strings.ReplaceAll(strings.ReplaceAll(name, "~1", "/"), "~0", "~")
+			parent, _ := target.(map[string]interface{})
+			target = parent[name]
+		}
+		node = target
+	}
+	return nil
+}
+
+// validate returns an error describing why req does not match the document. body is nil when it
+// was not buffered, its validation is then skipped, as for bodies not fully held in memory.
+func (v *openAPIValidator) validate(req *http.Request, body *bufferedBody) error {
+	if v == nil {
+		return nil
+	}
+	path := req.URL.Path
+	if len(v.basePath) > 0 {
+		if path != v.basePath && !strings.HasPrefix(path, v.basePath+"/") {
+			return nil
+		}
+		path = strings.TrimPrefix(path, v.basePath)
+	}
+
+	var matched *openAPIPath
+	var values []string
+	for i := range v.paths {
+		if values = v.paths[i].pattern.FindStringSubmatch(path); values != nil {
+			matched = &v.paths[i]
+			break
+		}
+	}
+	if matched == nil {
+		return fmt.Errorf("path %s is not declared", path)
+	}
+	operation, ok := matched.operations[req.Method]
+	if !ok {
+		return fmt.Errorf("method %s is not declared on %s", req.Method, matched.template)
+	}
+	pathValues := make(map[string]string, len(matched.params))
+	for i, name := range matched.params {
+		pathValues[name] = values[i+1]
+	}
+	if err := v.validateParameters(req, matched.parameters, operation, pathValues); err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	return v.validateBody(req, operation, body)
+}
+
+func (v *openAPIValidator) validateParameters(req *http.Request, pathParameters []interface{}, operation map[string]interface{}, pathValues map[string]string) error {
+	// operation parameters override the path ones, by location and name
+	parameters := map[string]map[string]interface{}{}
+	operationParameters, _ := operation["parameters"].([]interface{})
+	for _, list := range [][]interface{}{pathParameters, operationParameters} {
+		for _, parameter := range list {
+			if parameter, ok := v.resolve(parameter).(map[string]interface{}); ok {
+				in, _ := parameter["in"].(string)
+				name, _ := parameter["name"].(string)
+				parameters[in+"/"+name] = parameter
+			}
+		}
+	}
+	keys := make([]string, 0, len(parameters))
+	for key := range parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	query := req.URL.Query()
+	for _, key := range keys {
+		parameter := parameters[key]
+		in, _ := parameter["in"].(string)
+		name, _ := parameter["name"].(string)
+		var present []string
+		switch in {
+		case "path":
+			if value, ok := pathValues[name]; ok {
+				present = []string{value}
+			}
+		case "query":
+			present = query[name]
+		case "header":
+			present = req.Header.Values(name)
+		default:
+			continue
+		}
+		if len(present) == 0 {
+			if required, _ := parameter["required"].(bool); required || in == "path" {
+				return fmt.Errorf("missing required %s parameter %s", in, name)
+			}
+			continue
+		}
+		schema := v.resolve(parameter["schema"])
+		if schema == nil {
+			continue
+		}
+		if err := v.validateSchema(schema, v.parameterValue(schema, present), in+" parameter "+name, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parameterValue converts the raw values of a parameter to the JSON value described by schema.
+// Values which do not convert are kept as strings, failing the type validation.
+func (v *openAPIValidator) parameterValue(schema interface{}, values []string) interface{} {
+	object, _ := schema.(map[string]interface{})
+	if kind, _ := object["type"].(string); kind == "array" {
+		if len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+		items := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			items = append(items, v.parameterValue(v.resolve(object["items"]), []string{value}))
+		}
+		return items
+	}
+	value := values[0]
+	switch kind, _ := object["type"].(string); kind {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+func (v *openAPIValidator) validateBody(req *http.Request, operation map[string]interface{}, body *bufferedBody) error {
+	requestBody, _ := v.resolve(operation["requestBody"]).(map[string]interface{})
+	if requestBody == nil {
+		return nil
+	}
+	if body.size == 0 {
+		if required, _ := requestBody["required"].(bool); required {
+			return fmt.Errorf("missing required body")
+		}
+		return nil
+	}
+	content, _ := requestBody["content"].(map[string]interface{})
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("invalid content type %q", req.Header.Get("Content-Type"))
+	}
+	media, ok := content[mediaType]
+	if !ok {
+		media, ok = content[mediaType[:strings.IndexByte(mediaType+"/", '/')]+"/*"]
+	}
+	if !ok {
+		media, ok = content["*/*"]
+	}
+	if !ok {
+		return fmt.Errorf("content type %s is not declared", mediaType)
+	}
+	isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	if !isJSON || body.truncated() || body.file != nil {
+		return nil
+	}
+	mediaObject, _ := v.resolve(media).(map[string]interface{})
+	schema := v.resolve(mediaObject["schema"])
+	if schema == nil {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(body.mem, &value); err != nil {
+		return fmt.Errorf("invalid JSON body")
+	}
+	return v.validateSchema(schema, value, "body", 0)
+}
+
+// validateSchema validates value against schema, at is the location of value in the messages.
+func (v *openAPIValidator) validateSchema(schema interface{}, value interface{}, at string, depth int) error {
+	if depth > openAPIMaxDepth {
+		return fmt.Errorf("%s: schema nested too deeply", at)
+	}
+	object, ok := v.resolve(schema).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if nullable, _ := object["nullable"].(bool); nullable && value == nil {
+		return nil
+	}
+
+	if allOf, ok := object["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			if err := v.validateSchema(sub, value, at, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := object["anyOf"].([]interface{}); ok && !v.matches(anyOf, value, at, depth, false) {
+		return fmt.Errorf("%s: matches none of anyOf", at)
+	}
+	if oneOf, ok := object["oneOf"].([]interface{}); ok && !v.matches(oneOf, value, at, depth, true) {
+		return fmt.Errorf("%s: must match exactly one of oneOf", at)
+	}
+	if enum, ok := object["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", at)
+		}
+	}
+
+	switch kind, _ := object["type"].(string); kind {
+	case "object":
+		properties, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", at)
+		}
+		return v.validateObject(object, properties, at, depth)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", at)
+		}
+		if min, ok := object["minItems"].(float64); ok && float64(len(items)) < min {
+			return fmt.Errorf("%s: expected at least %v items", at, min)
+		}
+		if max, ok := object["maxItems"].(float64); ok && float64(len(items)) > max {
+			return fmt.Errorf("%s: expected at most %v items", at, max)
+		}
+		if itemSchema, ok := object["items"]; ok {
+			for i, item := range items {
+				if err := v.validateSchema(itemSchema, item, at+"["+strconv.Itoa(i)+"]", depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string", at)
+		}
+		length := float64(utf8.RuneCountInString(s))
+		if min, ok := object["minLength"].(float64); ok && length < min {
+			return fmt.Errorf("%s: expected at least %v characters", at, min)
+		}
+		if max, ok := object["maxLength"].(float64); ok && length > max {
+			return fmt.Errorf("%s: expected at most %v characters", at, max)
+		}
+		if pattern, ok := object["pattern"].(string); ok && v.patterns[pattern] != nil && !v.patterns[pattern].MatchString(s) {
+			return fmt.Errorf("%s: does not match pattern %s", at, pattern)
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (kind == "integer" && n != float64(int64(n))) {
+			return fmt.Errorf("%s: expected %s", at, kind)
+		}
+		return validateBounds(object, n, at)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", at)
+		}
+	case "null":
+		if value != nil {
+			return fmt.Errorf("%s: expected null", at)
+		}
+	case "":
+		// untyped schemas still constrain the properties of objects
+		if properties, ok := value.(map[string]interface{}); ok {
+			return v.validateObject(object, properties, at, depth)
+		}
+	}
+	return nil
+}
+
+func (v *openAPIValidator) validateObject(schema map[string]interface{}, value map[string]interface{}, at string, depth int) error {
+	required, _ := schema["required"].([]interface{})
+	for _, name := range required {
+		if name, ok := name.(string); ok {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", at, name)
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if propertySchema, ok := properties[name]; ok {
+			if err := v.validateSchema(propertySchema, value[name], at+"."+name, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unexpected property %s", at, name)
+			}
+		case map[string]interface{}:
+			if err := v.validateSchema(additional, value[name], at+"."+name, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether value matches at least one of schemas, or exactly one with exactlyOne.
+func (v *openAPIValidator) matches(schemas []interface{}, value interface{}, at string, depth int, exactlyOne bool) bool {
+	matches := 0
+	for _, sub := range schemas {
+		if v.validateSchema(sub, value, at, depth+1) == nil {
+			matches++
+			if !exactlyOne {
+				return true
+			}
+		}
+	}
+	return matches == 1 && exactlyOne
+}
+
+// validateBounds checks n against the minimum and maximum of schema. exclusiveMinimum and
+// exclusiveMaximum are booleans in OpenAPI 3.0 and numbers in OpenAPI 3.1.
+func validateBounds(schema map[string]interface{}, n float64, at string) error {
+	if min, ok := schema["minimum"].(float64); ok {
+		if exclusive, _ := schema["exclusiveMinimum"].(bool); exclusive && n <= min || n < min {
+			return fmt.Errorf("%s: below the minimum %v", at, min)
+		}
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && n <= min {
+		return fmt.Errorf("%s: below the minimum %v", at, min)
+	}
+	if max, ok := schema["maximum"].(float64); ok {
+		if exclusive, _ := schema["exclusiveMaximum"].(bool); exclusive && n >= max || n > max {
+			return fmt.Errorf("%s: above the maximum %v", at, max)
+		}
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && n >= max {
+		return fmt.Errorf("%s: above the maximum %v", at, max)
+	}
+	return nil
+}
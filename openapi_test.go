@@ -0,0 +1,169 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testOpenAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {"title": "users", "version": "1"},
+  "paths": {
+    "/users": {
+      "get": {
+        "parameters": [
+          {"name": "page", "in": "query", "schema": {"type": "integer", "minimum": 1}},
+          {"name": "sort", "in": "query", "schema": {"type": "string", "enum": ["name", "age"]}}
+        ]
+      },
+      "post": {
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}
+        }
+      }
+    },
+    "/users/me": {
+      "get": {}
+    },
+    "/users/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}}],
+      "get": {},
+      "delete": {
+        "parameters": [{"name": "X-Confirm", "in": "header", "required": true, "schema": {"type": "boolean"}}]
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "User": {
+        "type": "object",
+        "required": ["name"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string", "minLength": 1, "maxLength": 20, "pattern": "^[a-z]+$", "example": "john"},
+          "age": {"type": "integer", "minimum": 0, "maximum": 150},
+          "email": {"type": "string", "nullable": true},
+          "tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+          "role": {"oneOf": [{"type": "string", "enum": ["admin"]}, {"type": "integer"}]}
+        }
+      }
+    }
+  }
+}`
+
+func writeOpenAPISpec(t *testing.T, spec string) string {
+	file := filepath.Join(t.TempDir(), "openapi.json")
+	assert.NoError(t, os.WriteFile(file, []byte(spec), 0600))
+	return file
+}
+
+func TestNewOpenAPIValidator(t *testing.T) {
+	v, err := newOpenAPIValidator("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	_, err = newOpenAPIValidator(writeOpenAPISpec(t, "openapi: 3.0.3"), "")
+	assert.Error(t, err)
+	_, err = newOpenAPIValidator(writeOpenAPISpec(t, `{"swagger": "2.0"}`), "")
+	assert.Error(t, err)
+	_, err = newOpenAPIValidator(writeOpenAPISpec(t, `{"openapi": "3.1.0", "components": {"schemas": {"a": {"pattern": "("}}}}`), "")
+	assert.Error(t, err)
+
+	v, err = newOpenAPIValidator(writeOpenAPISpec(t, testOpenAPISpec), "")
+	assert.NoError(t, err)
+	templates := []string{}
+	for _, path := range v.paths {
+		templates = append(templates, path.template)
+	}
+	assert.Equal(t, []string{"/users", "/users/me", "/users/{id}"}, templates)
+}
+
+func TestOpenAPIValidator_validate(t *testing.T) {
+	v, err := newOpenAPIValidator(writeOpenAPISpec(t, testOpenAPISpec), "/api/")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		body   string
+		expect string
+	}{
+		{name: "Outside of the base path", method: http.MethodGet, target: "/health"},
+		{name: "Valid query", method: http.MethodGet, target: "/api/users?page=2&sort=age"},
+		{name: "Invalid query type", method: http.MethodGet, target: "/api/users?page=two", expect: "query parameter page: expected integer"},
+		{name: "Query below the minimum", method: http.MethodGet, target: "/api/users?page=0", expect: "query parameter page: below the minimum 1"},
+		{name: "Query not in enum", method: http.MethodGet, target: "/api/users?sort=email", expect: "query parameter sort: value not in enum"},
+		{name: "Undeclared path", method: http.MethodGet, target: "/api/admin", expect: "path /admin is not declared"},
+		{name: "Undeclared method", method: http.MethodPut, target: "/api/users", expect: "method PUT is not declared on /users"},
+		{name: "Concrete path", method: http.MethodGet, target: "/api/users/me"},
+		{name: "Valid path parameter", method: http.MethodGet, target: "/api/users/42"},
+		{name: "Invalid path parameter", method: http.MethodGet, target: "/api/users/4x", expect: "path parameter id: expected integer"},
+		{name: "Missing header", method: http.MethodDelete, target: "/api/users/42", expect: "missing required header parameter X-Confirm"},
+		{name: "Valid header", method: http.MethodDelete, target: "/api/users/42", header: http.Header{"X-Confirm": {"true"}}},
+		{name: "Valid body", method: http.MethodPost, target: "/api/users", body: `{"name":"john","age":42,"email":null,"tags":["a"],"role":"admin"}`},
+		{name: "Missing body", method: http.MethodPost, target: "/api/users", expect: "missing required body"},
+		{name: "Invalid JSON", method: http.MethodPost, target: "/api/users", body: `{"name":`, expect: "invalid JSON body"},
+		{name: "Missing property", method: http.MethodPost, target: "/api/users", body: `{"age":42}`, expect: "body: missing required property name"},
+		{name: "Additional property", method: http.MethodPost, target: "/api/users", body: `{"name":"john","admin":true}`, expect: "body: unexpected property admin"},
+		{name: "Pattern", method: http.MethodPost, target: "/api/users", body: `{"name":"John'--"}`, expect: "body.name: does not match pattern ^[a-z]+$"},
+		{name: "Non-integer", method: http.MethodPost, target: "/api/users", body: `{"name":"john","age":4.2}`, expect: "body.age: expected integer"},
+		{name: "Too many items", method: http.MethodPost, target: "/api/users", body: `{"name":"john","tags":["a","b","c"]}`, expect: "body.tags: expected at most 2 items"},
+		{name: "Item type", method: http.MethodPost, target: "/api/users", body: `{"name":"john","tags":[1]}`, expect: "body.tags[0]: expected string"},
+		{name: "oneOf", method: http.MethodPost, target: "/api/users", body: `{"name":"john","role":"root"}`, expect: "body.role: must match exactly one of oneOf"},
+		{name: "Undeclared content type", method: http.MethodPost, target: "/api/users", header: http.Header{"Content-Type": {"text/xml"}}, body: `<user/>`, expect: "content type text/xml is not declared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			if len(req.Header.Get("Content-Type")) == 0 {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			body := &bufferedBody{mem: []byte(tt.body), size: int64(len(tt.body))}
+			err := v.validate(req, body)
+			if len(tt.expect) == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.expect)
+			}
+		})
+	}
+}
+
+func TestModsecurity_OpenAPIValidation(t *testing.T) {
+	var wafCalls int
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.OpenApiSpec = writeOpenAPISpec(t, testOpenAPISpec)
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, 0, wafCalls)
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"john"}`))
+	req.Header.Set("Content-Type", "application/json")
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 1, wafCalls)
+}
@@ -0,0 +1,280 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// optimisticMaxBuffer bounds the response of the service held while the verdict is awaited. The
+// service is paused past it, until the verdict arrives or the window expires.
+const optimisticMaxBuffer = 1024 * 1024
+
+var errOptimisticAborted = errors.New("request blocked by the WAF")
+
+// optimisticForwarding forwards the safe requests of tolerant routes to the service while they
+// are inspected. The response of the service is held back until the verdict arrives, at most for
+// window: a block verdict within the window cancels the request of the service and discards its
+// response. Past the window the response is sent to the client, a later block verdict is only
+// logged. Only GET and HEAD requests without a body qualify, the others may have side effects
+// which can't be undone. With skipRanges, the Range requests don't either: their partial
+// responses, e.g. of resumable downloads, are streamed from the first byte once inspected instead
+// of being held.
+type optimisticForwarding struct {
+	paths      []*regexp.Regexp
+	window     time.Duration
+	skipRanges bool
+}
+
+func newOptimisticForwarding(enabled bool, paths []*regexp.Regexp, window time.Duration, skipRanges bool) *optimisticForwarding {
+	if !enabled {
+		return nil
+	}
+	return &optimisticForwarding{paths: paths, window: window, skipRanges: skipRanges}
+}
+
+// applies reports whether req is forwarded optimistically: a GET or HEAD request without a body
+// on one of paths, or on any path when none is configured. Strict requests never are, nor the
+// Range requests with skipRanges.
+func (o *optimisticForwarding) applies(req *http.Request, strict bool) bool {
+	if o == nil || strict || hasBody(req) {
+		return false
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if o.skipRanges && len(req.Header.Get("Range")) > 0 {
+		return false
+	}
+	return len(o.paths) == 0 || matchAny(o.paths, req.URL.Path)
+}
+
+// optimisticRequest is a request forwarded to the service while it is inspected.
+type optimisticRequest struct {
+	writer *optimisticWriter
+	cancel context.CancelFunc
+	timer  *time.Timer
+	done   chan struct{}
+}
+
+// forwardOptimistically starts serving req before its verdict is known. The service receives a
+// copy of req, without the annotations and the inspection result.
+func (a *Modsecurity) forwardOptimistically(rw http.ResponseWriter, req *http.Request) *optimisticRequest {
+	ctx, cancel := context.WithCancel(req.Context())
+	w := newOptimisticWriter(rw)
+	o := &optimisticRequest{writer: w, cancel: cancel, done: make(chan struct{})}
+	o.timer = time.AfterFunc(a.optimistic.window, w.commit)
+	clone := req.Clone(ctx)
+	go func() {
+		defer close(o.done)
+		defer func() {
+			// the reverse proxy aborts with ErrAbortHandler once its response is discarded
+			if r := recover(); r != nil && r != http.ErrAbortHandler {
+				a.logger.Printf("ModSecurity::optimistic panic serving %s %s: %v", req.Method, a.piiMasker.maskURI(req.RequestURI), r)
+			}
+		}()
+		a.next.ServeHTTP(exposeSupported(w, rw), clone)
+	}()
+	return o
+}
+
+// release sends the response of the service to the client and waits for it to complete.
+func (o *optimisticRequest) release() {
+	o.timer.Stop()
+	o.writer.commit()
+	<-o.done
+	o.cancel()
+}
+
+// abort cancels the request of the service and waits for it to return. It reports false when the
+// response was already sent to the client: it is then completed, truncating it would go unnoticed.
+func (o *optimisticRequest) abort() bool {
+	o.timer.Stop()
+	if !o.writer.discard() {
+		<-o.done
+		o.cancel()
+		return false
+	}
+	o.cancel()
+	<-o.done
+	return true
+}
+
+// optimisticWriter holds the response of the service until it is committed to the client or
+// discarded.
+type optimisticWriter struct {
+	rw        http.ResponseWriter
+	header    http.Header
+	mu        sync.Mutex
+	cond      *sync.Cond
+	status    int
+	buf       bytes.Buffer
+	committed bool
+	discarded bool
+}
+
+func newOptimisticWriter(rw http.ResponseWriter) *optimisticWriter {
+	w := &optimisticWriter{rw: rw, header: make(http.Header)}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+func (w *optimisticWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader holds the status code until the response is committed. Informational responses,
+// e.g. 103 Early Hints, are passed through right away, with the header set so far: it is removed
+// from the client response afterwards, a discarded response must not leak into the block response.
+func (w *optimisticWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status != 0 || w.discarded {
+		return
+	}
+	if code >= 100 && code < 200 {
+		if w.committed {
+			w.copyHeader()
+			w.rw.WriteHeader(code)
+			return
+		}
+		header := w.rw.Header()
+		saved := header.Clone()
+		w.copyHeader()
+		w.rw.WriteHeader(code)
+		for name := range header {
+			delete(header, name)
+		}
+		for name, values := range saved {
+			header[name] = values
+		}
+		return
+	}
+	w.status = code
+	if w.committed {
+		w.writeHeader()
+	}
+}
+
+func (w *optimisticWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 && !w.discarded {
+		w.status = http.StatusOK
+		if w.committed {
+			w.writeHeader()
+		}
+	}
+	for !w.committed && !w.discarded && w.buf.Len()+len(b) > optimisticMaxBuffer {
+		w.cond.Wait()
+	}
+	if w.discarded {
+		return 0, errOptimisticAborted
+	}
+	if w.committed {
+		return w.rw.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+// Flush lets streamed responses through once the response is committed.
+func (w *optimisticWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.committed || w.status == 0 {
+		return
+	}
+	if flusher, ok := w.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the upgraded connections through once the verdict allowed the request, or the
+// window expired: the connection can't be taken back afterwards.
+func (w *optimisticWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.committed && !w.discarded {
+		w.cond.Wait()
+	}
+	if w.discarded {
+		return nil, nil, errOptimisticAborted
+	}
+	return hijacker.Hijack()
+}
+
+// Push lets the HTTP/2 server pushes through, the pushed requests are inspected on their own.
+func (w *optimisticWriter) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := w.rw.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	w.mu.Lock()
+	discarded := w.discarded
+	w.mu.Unlock()
+	if discarded {
+		return errOptimisticAborted
+	}
+	return pusher.Push(target, opts)
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (w *optimisticWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
+
+// copyHeader copies the header of the service to the client response. It must be called with mu held.
+func (w *optimisticWriter) copyHeader() {
+	header := w.rw.Header()
+	for name, values := range w.header {
+		header[name] = values
+	}
+}
+
+// writeHeader writes the header of the service to the client. It must be called with mu held.
+func (w *optimisticWriter) writeHeader() {
+	w.copyHeader()
+	w.rw.WriteHeader(w.status)
+}
+
+// commit sends the held response to the client, the next writes go through.
+func (w *optimisticWriter) commit() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed || w.discarded {
+		return
+	}
+	w.committed = true
+	w.cond.Broadcast()
+	if w.status == 0 {
+		return
+	}
+	w.writeHeader()
+	w.rw.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// discard drops the held response and fails the next writes. It reports false when the response
+// was already committed.
+func (w *optimisticWriter) discard() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed {
+		return false
+	}
+	w.discarded = true
+	w.buf.Reset()
+	w.cond.Broadcast()
+	return true
+}
@@ -0,0 +1,213 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimisticForwarding_applies(t *testing.T) {
+	o := newOptimisticForwarding(true, []*regexp.Regexp{regexp.MustCompile("^/static/")}, time.Second, true)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		strict bool
+		ranged bool
+		expect bool
+	}{
+		{name: "GET", method: http.MethodGet, target: "/static/app.js", expect: true},
+		{name: "HEAD", method: http.MethodHead, target: "/static/app.js", expect: true},
+		{name: "Other path", method: http.MethodGet, target: "/api/users"},
+		{name: "POST", method: http.MethodPost, target: "/static/app.js"},
+		{name: "With a body", method: http.MethodGet, target: "/static/app.js", body: "payload"},
+		{name: "Strict", method: http.MethodGet, target: "/static/app.js", strict: true},
+		{name: "Range", method: http.MethodGet, target: "/static/app.js", ranged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.ranged {
+				req.Header.Set("Range", "bytes=1024-")
+			}
+			assert.Equal(t, tt.expect, o.applies(req, tt.strict))
+		})
+	}
+
+	var disabled *optimisticForwarding
+	assert.False(t, disabled.applies(httptest.NewRequest(http.MethodGet, "/", nil), false))
+	assert.True(t, newOptimisticForwarding(true, nil, time.Second, false).applies(httptest.NewRequest(http.MethodGet, "/api", nil), false), "every path qualifies when none is configured")
+	ranged := httptest.NewRequest(http.MethodGet, "/api", nil)
+	ranged.Header.Set("Range", "bytes=0-99")
+	assert.True(t, newOptimisticForwarding(true, nil, time.Second, false).applies(ranged, false), "Range requests qualify unless skipped")
+}
+
+func TestOptimisticWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	w := newOptimisticWriter(recorder)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("held"))
+	assert.Equal(t, 0, recorder.Body.Len(), "the response is held until committed")
+
+	w.commit()
+	w.Write([]byte(" then streamed"))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "text/plain", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "held then streamed", recorder.Body.String())
+	assert.False(t, w.discard(), "a committed response can't be discarded")
+
+	recorder = httptest.NewRecorder()
+	w = newOptimisticWriter(recorder)
+	w.Write([]byte("secret"))
+	assert.True(t, w.discard())
+	_, err := w.Write([]byte("more"))
+	assert.Equal(t, errOptimisticAborted, err)
+	w.commit()
+	assert.Equal(t, 0, recorder.Body.Len(), "a discarded response is never sent")
+}
+
+// hintRecorder is a ResponseRecorder recording the Link header of the informational responses,
+// and supporting hijacking.
+type hintRecorder struct {
+	*httptest.ResponseRecorder
+	hints    []string
+	hijacked bool
+}
+
+func (r *hintRecorder) WriteHeader(code int) {
+	if code >= 100 && code < 200 {
+		r.hints = append(r.hints, r.Header().Get("Link"))
+		return
+	}
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func (r *hintRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func TestOptimisticWriter_Informational(t *testing.T) {
+	recorder := &hintRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := newOptimisticWriter(recorder)
+	w.Header().Set("Link", "</style.css>; rel=preload")
+	w.WriteHeader(http.StatusEarlyHints)
+	assert.Equal(t, []string{"</style.css>; rel=preload"}, recorder.hints, "early hints are sent while the response is held")
+	assert.Empty(t, recorder.Header().Get("Link"), "the held header is not left on the client response")
+
+	assert.True(t, w.discard())
+	w.WriteHeader(http.StatusEarlyHints)
+	assert.Len(t, recorder.hints, 1, "nothing is sent once discarded")
+}
+
+func TestOptimisticWriter_Interfaces(t *testing.T) {
+	recorder := &hintRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := newOptimisticWriter(recorder)
+	exposed := exposeSupported(w, recorder)
+	_, ok := exposed.(http.Pusher)
+	assert.False(t, ok)
+	assert.Same(t, recorder, exposed.(interface{ Unwrap() http.ResponseWriter }).Unwrap())
+	assert.Equal(t, http.ErrNotSupported, w.Push("/style.css", nil))
+
+	hijacked := make(chan error, 1)
+	go func() {
+		_, _, err := exposed.(http.Hijacker).Hijack()
+		hijacked <- err
+	}()
+	select {
+	case <-hijacked:
+		t.Fatal("the connection is hijacked before the verdict")
+	case <-time.After(20 * time.Millisecond):
+	}
+	w.commit()
+	assert.NoError(t, <-hijacked)
+	assert.True(t, recorder.hijacked)
+
+	w = newOptimisticWriter(recorder)
+	w.discard()
+	_, _, err := w.Hijack()
+	assert.Equal(t, errOptimisticAborted, err, "blocked requests are not upgraded")
+}
+
+// optimisticServers returns a WAF answering status once the service received the request,
+// after delay, and the config of a middleware using it with optimistic forwarding.
+func optimisticServers(t *testing.T, status int, delay time.Duration, window string) (*Config, chan struct{}) {
+	started := make(chan struct{}, 1)
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Error("the service did not receive the request during the inspection")
+		}
+		time.Sleep(delay)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(wafServer.Close)
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.OptimisticMode = true
+	config.OptimisticWindow = window
+	return config, started
+}
+
+func TestModsecurity_OptimisticClean(t *testing.T) {
+	config, started := optimisticServers(t, http.StatusOK, 0, "1s")
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		w.Write([]byte("page"))
+	}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "page", rw.Body.String())
+}
+
+func TestModsecurity_OptimisticBlock(t *testing.T) {
+	config, started := optimisticServers(t, http.StatusForbidden, 0, "1s")
+	canceled := make(chan bool, 1)
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		w.Write([]byte("secret"))
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(time.Second):
+			canceled <- false
+		}
+	}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "secret")
+	assert.True(t, <-canceled, "the request of the service is canceled")
+}
+
+func TestModsecurity_OptimisticLateBlock(t *testing.T) {
+	config, started := optimisticServers(t, http.StatusForbidden, 50*time.Millisecond, "1ms")
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		w.Write([]byte("page"))
+	}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code, "the response was sent once the window expired")
+	assert.Equal(t, "page", rw.Body.String())
+	assert.Contains(t, buf.String(), "event=optimistic_late_block")
+}
@@ -0,0 +1,69 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Values accepted in orderingGuard.
+const (
+	orderingGuardOff    = "off"
+	orderingGuardWarn   = "warn"
+	orderingGuardRefuse = "refuse"
+)
+
+// defaultBodyModifyingHints match the names usually given to the Traefik middlewares rewriting or
+// buffering the bodies, which must run after the WAF.
+var defaultBodyModifyingHints = []string{"compress", "buffering"}
+
+func validateOrderingGuard(guard string) error {
+	switch guard {
+	case "", orderingGuardOff, orderingGuardWarn, orderingGuardRefuse:
+		return nil
+	}
+	return fmt.Errorf("invalid orderingGuard %q, expected %s, %s or %s", guard, orderingGuardOff, orderingGuardWarn, orderingGuardRefuse)
+}
+
+// middlewareName returns name without its provider suffix, e.g. waf for waf@file.
+func middlewareName(name string) string {
+	if i := strings.LastIndexByte(name, '@'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// checkMiddlewareOrder returns an error when chain, the middlewares of the routers using the
+// middleware named name in their order, lists a middleware matching one of hints before it.
+// Plugins can't see the router configuration, the chain is declared in the configuration.
+func checkMiddlewareOrder(chain []string, name string, hints []string) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	for i, middleware := range chain {
+		if middlewareName(middleware) != middlewareName(name) {
+			continue
+		}
+		for _, preceding := range chain[:i] {
+			lower := strings.ToLower(preceding)
+			for _, hint := range hints {
+				if strings.Contains(lower, strings.ToLower(hint)) {
+					return fmt.Errorf("middleware %s runs before %s and may modify the bodies it inspects, it should run after it", preceding, name)
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("middlewareChain doesn't list the middleware %s", name)
+}
+
+// warnOrderingHints logs the requests carrying one of orderingHintHeaders, set by the middlewares
+// which should run after this one.
+func (a *Modsecurity) warnOrderingHints(req *http.Request) {
+	for _, header := range a.orderingHintHeaders {
+		if len(req.Header.Values(header)) > 0 {
+			a.logSampled("middleware_order_warning", logFields{"header": header})
+			return
+		}
+	}
+}
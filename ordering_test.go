@@ -0,0 +1,76 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMiddlewareOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		chain []string
+		err   string
+	}{
+		{name: "No chain"},
+		{name: "First", chain: []string{"waf@file", "compress@file"}},
+		{name: "Unrelated middleware before", chain: []string{"ratelimit@file", "waf@file", "compress@file"}},
+		{name: "Without provider", chain: []string{"waf", "buffering"}},
+		{name: "Compress before", chain: []string{"gzip-Compress@docker", "waf@file"}, err: "middleware gzip-Compress@docker runs before waf@file and may modify the bodies it inspects, it should run after it"},
+		{name: "Missing", chain: []string{"compress@file"}, err: "middlewareChain doesn't list the middleware waf@file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMiddlewareOrder(tt.chain, "waf@file", defaultBodyModifyingHints)
+			if len(tt.err) > 0 {
+				assert.EqualError(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestModsecurity_OrderingGuard(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.OrderingGuard = orderingGuardRefuse
+	config.MiddlewareChain = []string{"compress", "modsecurity-middleware"}
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.EqualError(t, err, "middleware compress runs before modsecurity-middleware and may modify the bodies it inspects, it should run after it")
+
+	config.BodyModifyingHints = []string{"buffer"}
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.NoError(t, err, "the hints replace the default ones")
+
+	config.OrderingGuard = "fail"
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.EqualError(t, err, `invalid orderingGuard "fail", expected off, warn or refuse`)
+}
+
+func TestModsecurity_OrderingHintHeaders(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.OrderingGuard = orderingGuardWarn
+	config.OrderingHintHeaders = []string{"X-Buffered"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, buf.String())
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Buffered", "1")
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code, "the requests are still inspected")
+	assert.Contains(t, buf.String(), "event=middleware_order_warning header=X-Buffered")
+}
@@ -0,0 +1,145 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Incident management services accepted in alertWebhookType.
+const (
+	alertTypePagerDuty = "pagerduty"
+	alertTypeOpsgenie  = "opsgenie"
+)
+
+// outageAlerter raises an incident when the WAF keeps failing for longer than a threshold, and
+// resolves it once the WAF answers again: with fail-open policies an outage silently disables
+// the protection. Failures come from WAF calls and from the warm-up health pre-checks.
+type outageAlerter struct {
+	url       string
+	kind      string
+	key       string
+	threshold time.Duration
+	source    string
+	webhooks  *webhookQueue
+
+	mu           sync.Mutex
+	failingSince time.Time
+	lastError    string
+	open         bool
+}
+
+func newOutageAlerter(webhookUrl string, kind string, key string, threshold time.Duration, source string, webhooks *webhookQueue) (*outageAlerter, error) {
+	if len(webhookUrl) == 0 {
+		return nil, nil
+	}
+	switch kind {
+	case alertTypePagerDuty, alertTypeOpsgenie:
+	default:
+		return nil, fmt.Errorf("invalid alertWebhookType %q, expected %s or %s", kind, alertTypePagerDuty, alertTypeOpsgenie)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("alertIntegrationKey is required with alertWebhookUrl")
+	}
+	return &outageAlerter{
+		url:       strings.TrimSuffix(webhookUrl, "/"),
+		kind:      kind,
+		key:       key,
+		threshold: threshold,
+		source:    source,
+		webhooks:  webhooks,
+	}, nil
+}
+
+// failure records a failed call to the WAF, raising the incident once the WAF has been failing
+// for the threshold.
+func (o *outageAlerter) failure(err error, now time.Time) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastError = err.Error()
+	if o.failingSince.IsZero() {
+		o.failingSince = now
+	}
+	if o.open || now.Sub(o.failingSince) < o.threshold {
+		return
+	}
+	o.open = true
+	o.webhooks.enqueueMessage(o.trigger(now))
+}
+
+// success records a WAF answer, resolving the open incident if any.
+func (o *outageAlerter) success() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failingSince = time.Time{}
+	if o.open {
+		o.open = false
+		o.webhooks.enqueueMessage(o.resolve())
+	}
+}
+
+// dedupKey identifies the incident of this middleware, so that repeated triggers and the
+// resolution apply to the same incident.
+func (o *outageAlerter) dedupKey() string {
+	return "traefik-modsecurity-" + o.source
+}
+
+func (o *outageAlerter) trigger(now time.Time) webhookMessage {
+	summary := fmt.Sprintf("ModSecurity WAF of %s failing for %s: %s", o.source, now.Sub(o.failingSince).Round(time.Second), o.lastError)
+	if o.kind == alertTypeOpsgenie {
+		return o.opsgenieMessage(o.url, map[string]interface{}{
+			"message":     summary,
+			"alias":       o.dedupKey(),
+			"source":      o.source,
+			"priority":    "P1",
+			"description": "Requests are not inspected while the WAF is unavailable.",
+		})
+	}
+	return o.pagerDutyMessage("trigger", map[string]interface{}{
+		"summary":  summary,
+		"source":   o.source,
+		"severity": "critical",
+	})
+}
+
+func (o *outageAlerter) resolve() webhookMessage {
+	if o.kind == alertTypeOpsgenie {
+		closeUrl := o.url + "/" + url.PathEscape(o.dedupKey()) + "/close?identifierType=alias"
+		return o.opsgenieMessage(closeUrl, map[string]interface{}{"source": o.source})
+	}
+	return o.pagerDutyMessage("resolve", nil)
+}
+
+// pagerDutyMessage builds a PagerDuty Events API v2 event.
+func (o *outageAlerter) pagerDutyMessage(action string, payload map[string]interface{}) webhookMessage {
+	event := map[string]interface{}{
+		"routing_key":  o.key,
+		"event_action": action,
+		"dedup_key":    o.dedupKey(),
+	}
+	if payload != nil {
+		event["payload"] = payload
+	}
+	body, _ := json.Marshal(event)
+	return webhookMessage{url: o.url, payload: body}
+}
+
+// opsgenieMessage builds a request of the Opsgenie Alert API, authenticated with the API key.
+func (o *outageAlerter) opsgenieMessage(target string, alert map[string]interface{}) webhookMessage {
+	body, _ := json.Marshal(alert)
+	return webhookMessage{
+		url:     target,
+		header:  http.Header{"Authorization": []string{"GenieKey " + o.key}},
+		payload: body,
+	}
+}
@@ -0,0 +1,121 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOutageAlerter(t *testing.T) {
+	alerter, err := newOutageAlerter("", alertTypePagerDuty, "", time.Minute, "waf", nil)
+	assert.Nil(t, alerter)
+	assert.NoError(t, err)
+
+	_, err = newOutageAlerter("http://alerts", "email", "key", time.Minute, "waf", nil)
+	assert.Error(t, err)
+
+	_, err = newOutageAlerter("http://alerts", alertTypePagerDuty, "", time.Minute, "waf", nil)
+	assert.Error(t, err)
+}
+
+func TestOutageAlerter_PagerDuty(t *testing.T) {
+	queue := newWebhookQueue()
+	alerter, err := newOutageAlerter("https://events.pagerduty.com/v2/enqueue", alertTypePagerDuty, "routing", time.Minute, "waf", queue)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	alerter.failure(errors.New("connection refused"), now)
+	alerter.failure(errors.New("connection refused"), now.Add(59*time.Second))
+	assert.Len(t, queue.queue, 0)
+
+	alerter.failure(errors.New("connection refused"), now.Add(time.Minute))
+	alerter.failure(errors.New("connection refused"), now.Add(2*time.Minute))
+	assert.Len(t, queue.queue, 1)
+	message := <-queue.queue
+	assert.Equal(t, "https://events.pagerduty.com/v2/enqueue", message.url)
+	assert.JSONEq(t, `{"routing_key":"routing","event_action":"trigger","dedup_key":"traefik-modsecurity-waf",
+		"payload":{"summary":"ModSecurity WAF of waf failing for 1m0s: connection refused","source":"waf","severity":"critical"}}`, string(message.payload))
+
+	alerter.success()
+	alerter.success()
+	assert.Len(t, queue.queue, 1)
+	message = <-queue.queue
+	assert.JSONEq(t, `{"routing_key":"routing","event_action":"resolve","dedup_key":"traefik-modsecurity-waf"}`, string(message.payload))
+}
+
+func TestOutageAlerter_RecoveryResetsThreshold(t *testing.T) {
+	queue := newWebhookQueue()
+	alerter, err := newOutageAlerter("http://alerts", alertTypePagerDuty, "routing", time.Minute, "waf", queue)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	alerter.failure(errors.New("timeout"), now)
+	alerter.success()
+	alerter.failure(errors.New("timeout"), now.Add(time.Minute))
+	assert.Len(t, queue.queue, 0)
+}
+
+func TestOutageAlerter_Opsgenie(t *testing.T) {
+	queue := newWebhookQueue()
+	alerter, err := newOutageAlerter("https://api.opsgenie.com/v2/alerts/", alertTypeOpsgenie, "genie", 0, "waf", queue)
+	assert.NoError(t, err)
+
+	alerter.failure(errors.New("timeout"), time.Now())
+	message := <-queue.queue
+	assert.Equal(t, "https://api.opsgenie.com/v2/alerts", message.url)
+	assert.Equal(t, "GenieKey genie", message.header.Get("Authorization"))
+	var alert map[string]interface{}
+	assert.NoError(t, json.Unmarshal(message.payload, &alert))
+	assert.Equal(t, "traefik-modsecurity-waf", alert["alias"])
+	assert.Equal(t, "P1", alert["priority"])
+
+	alerter.success()
+	message = <-queue.queue
+	assert.Equal(t, "https://api.opsgenie.com/v2/alerts/traefik-modsecurity-waf/close?identifierType=alias", message.url)
+	assert.Equal(t, "GenieKey genie", message.header.Get("Authorization"))
+}
+
+func TestModsecurity_AlertOnWafOutage(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+	alerts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		actions = append(actions, event["event_action"].(string))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer alerts.Close()
+	var healthy int32
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			panic(http.ErrAbortHandler)
+		}
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.AlertWebhookUrl = alerts.URL
+	config.AlertIntegrationKey = "routing"
+	config.AlertOutageThreshold = "0s"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	atomic.StoreInt32(&healthy, 1)
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, middleware.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"trigger", "resolve"}, actions)
+}
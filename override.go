@@ -0,0 +1,212 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions of the session override header.
+const (
+	sessionOverrideStrict = "strict"
+	sessionOverrideRelax  = "relax"
+	sessionOverrideReset  = "reset"
+)
+
+// sessionOverrides lets the protected application tighten or relax the inspection of the next
+// requests of a session, with a response header such as "strict; path=/admin; ttl=3600":
+//   - strict requests are always fully inspected, at sessionOverrideParanoiaLevel when it is set;
+//   - relax WAF blocks are only logged, as in detect mode;
+//   - reset removes the override of the session.
+//
+// path restricts the override to the requests whose path starts with it, ttl shortens its
+// lifetime in seconds. Sessions are identified by the cookie named cookie, set by the response
+// or sent with the request. The header is trusted: it is removed from the responses and only the
+// application can set it.
+type sessionOverrides struct {
+	header        string
+	cookie        string
+	ttl           time.Duration
+	paranoiaLevel int
+
+	mu       sync.Mutex
+	sessions map[string]*sessionOverride
+}
+
+type sessionOverride struct {
+	action  string
+	path    string
+	expires time.Time
+}
+
+func newSessionOverrides(header string, cookie string, ttl time.Duration, paranoiaLevel int) (*sessionOverrides, error) {
+	if len(header) == 0 {
+		return nil, nil
+	}
+	if len(cookie) == 0 {
+		return nil, fmt.Errorf("sessionOverrideHeader requires sessionOverrideCookie")
+	}
+	if paranoiaLevel != 0 {
+		if err := validateParanoiaLevel(paranoiaLevel); err != nil {
+			return nil, err
+		}
+	}
+	return &sessionOverrides{header: header, cookie: cookie, ttl: ttl, paranoiaLevel: paranoiaLevel, sessions: make(map[string]*sessionOverride)}, nil
+}
+
+// sessionKey identifies the session value in the overrides: the session tokens are not kept in memory.
+func sessionKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseSessionOverride parses the value of the override header.
+func (o *sessionOverrides) parseSessionOverride(value string, now time.Time) (*sessionOverride, error) {
+	parts := strings.Split(value, ";")
+	override := &sessionOverride{action: strings.ToLower(strings.TrimSpace(parts[0])), expires: now.Add(o.ttl)}
+	switch override.action {
+	case sessionOverrideStrict, sessionOverrideRelax, sessionOverrideReset:
+	default:
+		return nil, fmt.Errorf("invalid action %q, expected %s, %s or %s", override.action, sessionOverrideStrict, sessionOverrideRelax, sessionOverrideReset)
+	}
+	for _, part := range parts[1:] {
+		name, param := strings.TrimSpace(part), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, param = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "path":
+			override.path = param
+		case "ttl":
+			seconds, err := strconv.Atoi(param)
+			if err != nil || seconds <= 0 {
+				return nil, fmt.Errorf("invalid ttl %q", param)
+			}
+			// the application can only shorten the configured lifetime
+			if ttl := time.Duration(seconds) * time.Second; ttl < o.ttl {
+				override.expires = now.Add(ttl)
+			}
+		default:
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	return override, nil
+}
+
+// set records the override header value for the session value.
+func (o *sessionOverrides) set(session string, value string, now time.Time) error {
+	override, err := o.parseSessionOverride(value, now)
+	if err != nil {
+		return err
+	}
+	key := sessionKey(session)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if override.action == sessionOverrideReset {
+		delete(o.sessions, key)
+		return nil
+	}
+	if _, ok := o.sessions[key]; !ok && len(o.sessions) >= maxTrackedClients {
+		return fmt.Errorf("too many sessions")
+	}
+	o.sessions[key] = override
+	return nil
+}
+
+// action returns the override applying to req, or an empty string.
+func (o *sessionOverrides) action(req *http.Request, now time.Time) string {
+	if o == nil {
+		return ""
+	}
+	cookie, err := req.Cookie(o.cookie)
+	if err != nil || len(cookie.Value) == 0 {
+		return ""
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	override, ok := o.sessions[sessionKey(cookie.Value)]
+	if !ok || !now.Before(override.expires) || !strings.HasPrefix(req.URL.Path, override.path) {
+		return ""
+	}
+	return override.action
+}
+
+// expire removes the expired overrides.
+func (o *sessionOverrides) expire(now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for key, override := range o.sessions {
+		if !now.Before(override.expires) {
+			delete(o.sessions, key)
+		}
+	}
+}
+
+// run expires the overrides every interval until ctx is done.
+func (o *sessionOverrides) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			o.expire(now)
+		}
+	}
+}
+
+// sessionOverride returns the override of the session of req, or an empty string.
+func (a *Modsecurity) sessionOverride(req *http.Request) string {
+	return a.sessionOverrides.action(req, time.Now())
+}
+
+// sessionParanoiaLevel raises the paranoia level header of the WAF request of strict sessions to
+// sessionOverrideParanoiaLevel.
+func (a *Modsecurity) sessionParanoiaLevel(req *http.Request, header http.Header) {
+	o := a.sessionOverrides
+	if o == nil || o.paranoiaLevel == 0 || len(a.paranoiaLevels.header) == 0 {
+		return
+	}
+	if level, _ := strconv.Atoi(header.Get(a.paranoiaLevels.header)); level >= o.paranoiaLevel {
+		return
+	}
+	if a.sessionOverride(req) == sessionOverrideStrict {
+		header.Set(a.paranoiaLevels.header, strconv.Itoa(o.paranoiaLevel))
+	}
+}
+
+// captureSessionOverride records and removes the override header of the response header of req.
+// The session is the one of the cookie set by the response, e.g. on login, or sent with req.
+func (a *Modsecurity) captureSessionOverride(req *http.Request, header http.Header) {
+	o := a.sessionOverrides
+	value := header.Get(o.header)
+	if len(value) == 0 {
+		return
+	}
+	header.Del(o.header)
+	session := ""
+	for _, cookie := range (&http.Response{Header: header}).Cookies() {
+		if cookie.Name == o.cookie {
+			session = cookie.Value
+		}
+	}
+	if len(session) == 0 {
+		if cookie, err := req.Cookie(o.cookie); err == nil {
+			session = cookie.Value
+		}
+	}
+	if len(session) == 0 {
+		a.logSampled("session_override_ignored", a.requestFields(req, logFields{"error": "no session cookie"}))
+		return
+	}
+	if err := o.set(session, value, time.Now()); err != nil {
+		a.logSampled("session_override_ignored", a.requestFields(req, logFields{"error": err.Error()}))
+	}
+}
@@ -0,0 +1,161 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSessionOverrides(t *testing.T) {
+	overrides, err := newSessionOverrides("", "", time.Hour, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, overrides)
+	assert.Empty(t, overrides.action(httptest.NewRequest(http.MethodGet, "/", nil), time.Now()))
+	_, err = newSessionOverrides("X-Waf-Session", "", time.Hour, 0)
+	assert.Error(t, err)
+	_, err = newSessionOverrides("X-Waf-Session", "sid", time.Hour, 5)
+	assert.Error(t, err)
+}
+
+func TestSessionOverrides_set(t *testing.T) {
+	overrides, err := newSessionOverrides("X-Waf-Session", "sid", time.Hour, 0)
+	assert.NoError(t, err)
+	now := time.Now()
+
+	request := func(path string, session string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(session) > 0 {
+			req.AddCookie(&http.Cookie{Name: "sid", Value: session})
+		}
+		return req
+	}
+
+	invalid := []string{"", "block", "strict; ttl=abc", "strict; ttl=-1", "strict; color=red"}
+	for _, value := range invalid {
+		assert.Error(t, overrides.set("abc", value, now), value)
+	}
+
+	assert.NoError(t, overrides.set("abc", "Strict; path=/admin", now))
+	assert.NoError(t, overrides.set("def", "relax; ttl=60", now))
+	assert.NoError(t, overrides.set("ghi", "strict; ttl=86400", now))
+	assert.Equal(t, sessionOverrideStrict, overrides.action(request("/admin/users", "abc"), now))
+	assert.Empty(t, overrides.action(request("/", "abc"), now), "out of the path")
+	assert.Empty(t, overrides.action(request("/admin", ""), now), "no session")
+	assert.Empty(t, overrides.action(request("/admin", "other"), now), "another session")
+	assert.Equal(t, sessionOverrideRelax, overrides.action(request("/", "def"), now.Add(59*time.Second)))
+	assert.Empty(t, overrides.action(request("/", "def"), now.Add(time.Minute)), "the ttl is over")
+	assert.Empty(t, overrides.action(request("/", "ghi"), now.Add(time.Hour)), "the ttl can't exceed sessionOverrideTtl")
+
+	for key := range overrides.sessions {
+		assert.Len(t, key, 64, "session tokens are hashed")
+	}
+	assert.NoError(t, overrides.set("abc", "reset", now))
+	assert.Empty(t, overrides.action(request("/admin", "abc"), now))
+	overrides.expire(now.Add(2 * time.Hour))
+	assert.Empty(t, overrides.sessions)
+}
+
+func TestModsecurity_SessionOverride(t *testing.T) {
+	var paranoia []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paranoia = append(paranoia, r.Header.Get(defaultParanoiaLevelHeader))
+		if r.URL.Query().Get("attack") == "1" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ParanoiaLevel = 1
+	config.SessionOverrideHeader = "X-Waf-Session"
+	config.SessionOverrideCookie = "sid"
+	config.SessionOverrideParanoiaLevel = 4
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s3cr3t"})
+			w.Header().Set("X-Waf-Session", "strict; path=/admin")
+		case "/debug":
+			w.Header().Set("X-Waf-Session", "relax")
+			w.Write([]byte("ok"))
+		}
+	}))
+
+	serve := func(target string, session string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if len(session) > 0 {
+			req.AddCookie(&http.Cookie{Name: "sid", Value: session})
+		}
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := serve("/login", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Empty(t, rw.Header().Get("X-Waf-Session"), "the header is not sent to the client")
+	serve("/admin", "s3cr3t")
+	serve("/", "s3cr3t")
+	serve("/admin", "other")
+	assert.Equal(t, []string{"1", "4", "1", "1"}, paranoia)
+
+	assert.Equal(t, http.StatusForbidden, serve("/?attack=1", "dev").Code)
+	rw = serve("/debug", "dev")
+	assert.Equal(t, "ok", rw.Body.String())
+	assert.Empty(t, rw.Header().Get("X-Waf-Session"))
+	assert.Equal(t, http.StatusOK, serve("/?attack=1", "dev").Code, "blocks of relaxed sessions are only logged")
+}
+
+func TestModsecurity_SessionOverrideEarlyHints(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.SessionOverrideHeader = "X-Waf-Session"
+	config.SessionOverrideCookie = "sid"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Waf-Session", "strict")
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s3cr3t"})
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("page"))
+	}))
+	server := httptest.NewServer(middleware)
+	defer server.Close()
+
+	var hints []textproto.MIMEHeader
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header)
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "page", string(body))
+	assert.Len(t, hints, 1, "early hints are passed through")
+	assert.Equal(t, "</style.css>; rel=preload; as=style", hints[0].Get("Link"))
+	assert.Empty(t, hints[0].Get("X-Waf-Session"), "the override header is never sent to the client")
+	assert.Empty(t, resp.Header.Get("X-Waf-Session"))
+
+	check := httptest.NewRequest(http.MethodGet, "/", nil)
+	check.AddCookie(&http.Cookie{Name: "sid", Value: "s3cr3t"})
+	assert.Equal(t, sessionOverrideStrict, middleware.sessionOverride(check), "the override applies with the final response")
+}
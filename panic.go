@@ -0,0 +1,34 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// panicStackMax bounds the bytes of the stack trace reported with a panic.
+const panicStackMax = 8 * 1024
+
+// recoverPanic reports a panic raised while serving req and answers it as a WAF error. The
+// report holds the panic value, the method, the path and the stack trace: neither the query, the
+// headers nor the body of the request, which may hold credentials, are part of it. It is logged,
+// sent to the event sinks and to the chat service, when one is configured.
+func (a *Modsecurity) recoverPanic(rw http.ResponseWriter, req *http.Request, recovered interface{}) {
+	if recovered == http.ErrAbortHandler {
+		// the way handlers abort a response, the server handles it
+		panic(recovered)
+	}
+	a.recordBudget(true)
+	stack := debug.Stack()
+	if len(stack) > panicStackMax {
+		stack = stack[:panicStackMax]
+	}
+	message := a.piiMasker.mask(fmt.Sprint(recovered))
+	path := a.piiMasker.mask(req.URL.Path)
+	a.logSampled("panic", logFields{"method": req.Method, "path": path, "panic": message, "stack": string(stack)})
+
+	reported := *req
+	reported.RequestURI = path
+	a.audit(&reported, "panic", http.StatusBadGateway, nil, message)
+	a.interruptOrContinue(rw, req, http.StatusBadGateway, a.interruptOnError)
+}
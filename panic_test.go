@@ -0,0 +1,43 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_recoverPanic(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+
+	req := httptest.NewRequest(http.MethodGet, "/items?token=s3cr3t", nil)
+	req.Header.Set("Authorization", "Bearer h34d3r")
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+
+	logs := buf.String()
+	assert.Contains(t, logs, "event=panic method=GET panic=boom path=/items stack=")
+	assert.Contains(t, logs, "recoverPanic", "the stack trace is reported")
+	assert.NotContains(t, logs, "s3cr3t", "the query is left out")
+	assert.NotContains(t, logs, "h34d3r", "the headers are left out")
+
+	middleware = newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items", nil))
+	}, "aborted responses are left to the server")
+}
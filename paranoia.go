@@ -0,0 +1,80 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// defaultParanoiaLevelHeader is the request header telling the WAF which paranoia level to run.
+// The WAF has to be configured to honor it, e.g. by setting tx.paranoia_level from it.
+const defaultParanoiaLevelHeader = "X-Crs-Paranoia-Level"
+
+// ParanoiaLevelRule sets the paranoia level of the requests whose path matches Path.
+type ParanoiaLevelRule struct {
+	Path  string `json:"path" description:"path pattern"`
+	Level int    `json:"level" description:"paranoia level of the matching requests"`
+}
+
+type compiledParanoiaLevelRule struct {
+	path  *regexp.Regexp
+	level string
+}
+
+// paranoiaLevels maps request paths to the paranoia level communicated to the WAF.
+type paranoiaLevels struct {
+	header       string
+	defaultLevel string
+	rules        []compiledParanoiaLevelRule
+}
+
+func newParanoiaLevels(header string, defaultLevel int, rules []ParanoiaLevelRule) (*paranoiaLevels, error) {
+	levels := &paranoiaLevels{header: header}
+	if defaultLevel != 0 {
+		if err := validateParanoiaLevel(defaultLevel); err != nil {
+			return nil, err
+		}
+		levels.defaultLevel = strconv.Itoa(defaultLevel)
+	}
+	for _, rule := range rules {
+		if err := validateParanoiaLevel(rule.Level); err != nil {
+			return nil, err
+		}
+		paths, err := compileRegexps("paranoiaLevels", []string{rule.Path})
+		if err != nil {
+			return nil, err
+		}
+		levels.rules = append(levels.rules, compiledParanoiaLevelRule{path: paths[0], level: strconv.Itoa(rule.Level)})
+	}
+	return levels, nil
+}
+
+func validateParanoiaLevel(level int) error {
+	if level < 1 || level > 4 {
+		return fmt.Errorf("invalid paranoia level %d, expected 1 to 4", level)
+	}
+	return nil
+}
+
+// level returns the paranoia level of path: the first matching rule, or the default level.
+// An empty string means that no level is configured.
+func (p *paranoiaLevels) level(path string) string {
+	for _, rule := range p.rules {
+		if rule.path.MatchString(path) {
+			return rule.level
+		}
+	}
+	return p.defaultLevel
+}
+
+// apply sets the paranoia level header of the WAF request. A value sent by the client is never trusted.
+func (p *paranoiaLevels) apply(path string, header http.Header) {
+	if len(p.header) == 0 {
+		return
+	}
+	header.Del(p.header)
+	if level := p.level(path); len(level) > 0 {
+		header.Set(p.header, level)
+	}
+}
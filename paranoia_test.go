@@ -0,0 +1,61 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParanoiaLevels_level(t *testing.T) {
+	levels, err := newParanoiaLevels(defaultParanoiaLevelHeader, 1, []ParanoiaLevelRule{
+		{Path: "^/admin", Level: 3},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "3", levels.level("/admin/users"))
+	assert.Equal(t, "1", levels.level("/pricing"))
+}
+
+func TestNewParanoiaLevels_InvalidLevel(t *testing.T) {
+	_, err := newParanoiaLevels(defaultParanoiaLevelHeader, 5, nil)
+	assert.Error(t, err)
+	_, err = newParanoiaLevels(defaultParanoiaLevelHeader, 0, []ParanoiaLevelRule{{Path: "^/", Level: 0}})
+	assert.Error(t, err)
+}
+
+func TestModsecurity_ParanoiaLevel(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		clientLevel string
+		expectLevel string
+	}{
+		{name: "Sends the route level", path: "/admin", expectLevel: "3"},
+		{name: "Overrides the client value", path: "/admin", clientLevel: "1", expectLevel: "3"},
+		{name: "Strips the client value when no level is configured", path: "/", clientLevel: "1", expectLevel: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafLevel := ""
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafLevel = r.Header.Get(defaultParanoiaLevelHeader)
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.ParanoiaLevels = []ParanoiaLevelRule{{Path: "^/admin", Level: 3}}
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if len(tt.clientLevel) > 0 {
+				req.Header.Set(defaultParanoiaLevelHeader, tt.clientLevel)
+			}
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.expectLevel, wafLevel)
+		})
+	}
+}
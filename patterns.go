@@ -0,0 +1,29 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// compileRegexps compiles a list of patterns coming from the configuration option named option.
+func compileRegexps(option string, patterns []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %s", option, pattern, err.Error())
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// matchAny reports whether s matches at least one of regexps.
+func matchAny(regexps []*regexp.Regexp, s string) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
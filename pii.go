@@ -0,0 +1,181 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// cardNumberPattern matches candidate payment card numbers, 13 to 19 digits optionally grouped
+// with spaces or dashes. Candidates are only masked when they pass the Luhn check.
+var cardNumberPattern = regexp.MustCompile(`\b(?:[0-9][ -]?){12,18}[0-9]\b`)
+
+// emailPattern matches email addresses, including their percent-encoded form in URIs.
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+(?:@|%40)[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// piiMasker masks personal data in the request data written outside of the request path: logs,
+// audit events, webhooks, archives, debug dumps and replay exports. It masks card numbers and
+// email addresses when builtin is set, the matches of patterns, and the values of the
+// parameters and JSON fields listed in fields. A field containing a dot is a path from the
+// root of JSON bodies, e.g. card.number, others match at any depth.
+type piiMasker struct {
+	patterns []*regexp.Regexp
+	builtin  bool
+	fields   map[string]bool
+}
+
+func newPIIMasker(builtin bool, patterns []string, fields []string) (*piiMasker, error) {
+	if !builtin && len(patterns) == 0 && len(fields) == 0 {
+		return nil, nil
+	}
+	compiled, err := compileRegexps("piiPatterns", patterns)
+	if err != nil {
+		return nil, err
+	}
+	m := &piiMasker{patterns: compiled, builtin: builtin, fields: make(map[string]bool, len(fields))}
+	for _, field := range fields {
+		m.fields[field] = true
+	}
+	return m, nil
+}
+
+// mask masks the patterns in s.
+func (m *piiMasker) mask(s string) string {
+	if m == nil {
+		return s
+	}
+	if m.builtin {
+		s = cardNumberPattern.ReplaceAllStringFunc(s, func(candidate string) string {
+			if luhnValid(candidate) {
+				return redacted
+			}
+			return candidate
+		})
+		s = emailPattern.ReplaceAllString(s, redacted)
+	}
+	for _, pattern := range m.patterns {
+		s = pattern.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+// maskURI masks the values of the query parameters listed in fields, then the patterns.
+func (m *piiMasker) maskURI(uri string) string {
+	if m == nil {
+		return uri
+	}
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i+1] + m.maskForm(uri[i+1:])
+	}
+	return m.mask(uri)
+}
+
+// maskForm masks the values of the form parameters listed in fields.
+func (m *piiMasker) maskForm(form string) string {
+	if len(m.fields) == 0 {
+		return form
+	}
+	pairs := strings.Split(form, "&")
+	for i, pair := range pairs {
+		j := strings.IndexByte(pair, '=')
+		if j < 0 {
+			continue
+		}
+		name, err := url.QueryUnescape(pair[:j])
+		if err != nil {
+			name = pair[:j]
+		}
+		if m.fields[name] {
+			pairs[i] = pair[:j+1] + url.QueryEscape(redacted)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// maskBody masks the fields of form and JSON bodies, then the patterns.
+func (m *piiMasker) maskBody(contentType string, body []byte) []byte {
+	if m == nil || len(body) == 0 {
+		return body
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case len(m.fields) == 0:
+	case mediaType == "application/x-www-form-urlencoded":
+		body = []byte(m.maskForm(string(body)))
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		if decoder.Decode(&value) == nil && m.maskJSON(value, "") {
+			if masked, err := json.Marshal(value); err == nil {
+				body = masked
+			}
+		}
+	}
+	return []byte(m.mask(string(body)))
+}
+
+// maskJSON replaces the values of the fields of value listed in fields, path being the dotted
+// path of value. It reports whether a field was masked.
+func (m *piiMasker) maskJSON(value interface{}, path string) bool {
+	masked := false
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			fieldPath := name
+			if len(path) > 0 {
+				fieldPath = path + "." + name
+			}
+			if m.fields[name] || m.fields[fieldPath] {
+				value[name] = redacted
+				masked = true
+				continue
+			}
+			masked = m.maskJSON(field, fieldPath) || masked
+		}
+	case []interface{}:
+		for _, item := range value {
+			masked = m.maskJSON(item, path) || masked
+		}
+	}
+	return masked
+}
+
+// maskHeader masks the patterns in the values of a header already sanitized by sanitizeHeader.
+func (m *piiMasker) maskHeader(header http.Header) http.Header {
+	if m == nil {
+		return header
+	}
+	for name, values := range header {
+		for i, value := range values {
+			values[i] = m.mask(value)
+		}
+		header[name] = values
+	}
+	return header
+}
+
+// luhnValid reports whether the digits of s pass the Luhn check of payment card numbers.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
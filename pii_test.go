@@ -0,0 +1,89 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPIIMasker(t *testing.T) {
+	m, err := newPIIMasker(true, []string{`\bFR[0-9]{2}(?: ?[0-9]{4}){5}\b`}, []string{"password", "card.cvv"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "card [REDACTED] ref 4111 1111 1111 1112", m.mask("card 4111-1111-1111-1111 ref 4111 1111 1111 1112"))
+	assert.Equal(t, "from [REDACTED] iban [REDACTED]", m.mask("from john.doe@example.com iban FR76 3000 6000 0112 3456 7890"))
+	assert.Equal(t, "/login?user=[REDACTED]&password=%5BREDACTED%5D&next=/", m.maskURI("/login?user=john%40example.com&password=s3cret&next=/"))
+	assert.Equal(t, "/password", m.maskURI("/password"))
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expect      string
+	}{
+		{name: "Form", contentType: "application/x-www-form-urlencoded", body: "user=john&password=s3cret", expect: "user=john&password=%5BREDACTED%5D"},
+		{name: "JSON", contentType: "application/json; charset=utf-8", body: `{"user":{"password":"s3cret","email":"john@example.com"},"card":{"number":"4111111111111111","cvv":123},"cvv":7}`, expect: `{"card":{"cvv":"[REDACTED]","number":"[REDACTED]"},"cvv":7,"user":{"email":"[REDACTED]","password":"[REDACTED]"}}`},
+		{name: "JSON without field", contentType: "application/json", body: `{ "user": "john" }`, expect: `{ "user": "john" }`},
+		{name: "Text", contentType: "text/plain", body: "password=s3cret john@example.com", expect: "password=s3cret [REDACTED]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, string(m.maskBody(tt.contentType, []byte(tt.body))))
+		})
+	}
+
+	header := m.maskHeader(sanitizeHeader(http.Header{"Referer": {"https://example.com/?email=john@example.com"}, "Authorization": {"Basic c2VjcmV0"}}))
+	assert.Equal(t, http.Header{"Referer": {"https://example.com/?email=[REDACTED]"}, "Authorization": {redacted}}, header)
+
+	var nilMasker *piiMasker
+	assert.Equal(t, "john@example.com", nilMasker.mask("john@example.com"))
+	_, err = newPIIMasker(false, []string{"("}, nil)
+	assert.Error(t, err)
+}
+
+func TestLuhnValid(t *testing.T) {
+	assert.True(t, luhnValid("4111 1111 1111 1111"))
+	assert.True(t, luhnValid("5500-0000-0000-0004"))
+	assert.False(t, luhnValid("1234567812345678"))
+}
+
+func TestModsecurity_MaskPii(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	dir := t.TempDir()
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ReplayExportDir = dir
+	config.MaskPii = true
+	config.PiiFields = []string{"password"}
+	config.AllowedMethods = []MethodRule{{Path: "^/readonly", Methods: []string{"GET"}}}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var logs bytes.Buffer
+	middleware.logger = log.New(&logs, "", 0)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/login?email=john@example.com", strings.NewReader(`{"password":"s3cret"}`))
+	req.Header.Set("Content-Type", "application/json")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/readonly?card=4111111111111111", nil))
+	assert.NoError(t, middleware.Close())
+
+	blocked, _ := filepath.Glob(filepath.Join(dir, "*-blocked.http"))
+	if assert.Len(t, blocked, 1) {
+		content, err := ioutil.ReadFile(blocked[0])
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), "POST /login?email=[REDACTED] HTTP/1.1\r\n")
+		assert.Contains(t, string(content), `{"password":"[REDACTED]"}`)
+	}
+	assert.Contains(t, logs.String(), "/readonly?card=[REDACTED]")
+	assert.NotContains(t, logs.String(), "4111111111111111")
+}
@@ -0,0 +1,189 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Short-circuiting modes accepted in pipelineShortCircuit.
+const (
+	pipelineShortCircuitBlock = "block"
+	pipelineShortCircuitNever = "never"
+)
+
+// Aggregations of the stage anomaly scores accepted in pipelineAggregation.
+const (
+	pipelineAggregationSum = "sum"
+	pipelineAggregationMax = "max"
+)
+
+// InspectionStage is an inspection service called after the WAF at modSecurityUrl, e.g. a
+// custom scorer. It follows the same contract as the WAF: it receives a copy of the request and
+// reports its verdict with the status code, the rule IDs and the anomaly score headers.
+type InspectionStage struct {
+	Name     string  `json:"name,omitempty" description:"name of the stage in the logs"`
+	Url      string  `json:"url" description:"URL of the inspection service"`
+	Protocol string  `json:"protocol,omitempty" description:"http, ext_authz or icap, default http"`
+	Weight   float64 `json:"weight,omitempty" description:"weight of the stage anomaly score, default 1"`
+	Optional bool    `json:"optional,omitempty" description:"skip the stage when it fails instead of failing the inspection"`
+}
+
+type pipelineStage struct {
+	name     string
+	url      string
+	protocol string
+	weight   float64
+	optional bool
+}
+
+// inspectionPipeline runs the WAF and the configured stages in order, and merges their verdicts
+// into a single response: the response of the first blocking stage, or the one with the highest
+// status, carrying the rule IDs of every stage and their aggregated anomaly score.
+type inspectionPipeline struct {
+	stages       []pipelineStage
+	shortCircuit bool
+	maxScore     bool
+}
+
+func newInspectionPipeline(modSecurityUrl string, backendProtocol string, stages []InspectionStage, shortCircuit string, aggregation string) (*inspectionPipeline, error) {
+	if len(stages) == 0 {
+		return nil, nil
+	}
+	p := &inspectionPipeline{stages: []pipelineStage{{name: "modsecurity", url: modSecurityUrl, protocol: backendProtocol, weight: 1}}}
+	switch shortCircuit {
+	case "", pipelineShortCircuitBlock:
+		p.shortCircuit = true
+	case pipelineShortCircuitNever:
+	default:
+		return nil, fmt.Errorf("invalid pipelineShortCircuit %q, expected %s or %s", shortCircuit, pipelineShortCircuitBlock, pipelineShortCircuitNever)
+	}
+	switch aggregation {
+	case "", pipelineAggregationSum:
+	case pipelineAggregationMax:
+		p.maxScore = true
+	default:
+		return nil, fmt.Errorf("invalid pipelineAggregation %q, expected %s or %s", aggregation, pipelineAggregationSum, pipelineAggregationMax)
+	}
+	for i, stage := range stages {
+		if len(stage.Url) == 0 {
+			return nil, fmt.Errorf("pipeline stage %d: url cannot be empty", i)
+		}
+		if stage.Weight < 0 {
+			return nil, fmt.Errorf("pipeline stage %d: invalid weight %v", i, stage.Weight)
+		}
+		if err := validateBackendProtocol(stage.Protocol, stage.Url); err != nil {
+			return nil, fmt.Errorf("pipeline stage %d: %w", i, err)
+		}
+		compiled := pipelineStage{name: stage.Name, url: stage.Url, protocol: stage.Protocol, weight: stage.Weight, optional: stage.Optional}
+		if len(compiled.name) == 0 {
+			compiled.name = "stage" + strconv.Itoa(i+1)
+		}
+		if compiled.weight == 0 {
+			compiled.weight = 1
+		}
+		p.stages = append(p.stages, compiled)
+	}
+	return p, nil
+}
+
+type stageVerdict struct {
+	stage *pipelineStage
+	resp  *http.Response
+}
+
+// run inspects req with every stage, stopping at the first blocking one when short-circuiting.
+// A failing stage fails the inspection, unless it is optional.
+func (p *inspectionPipeline) run(a *Modsecurity, req *http.Request, body *bufferedBody, botScore string) (*http.Response, error) {
+	verdicts := make([]stageVerdict, 0, len(p.stages))
+	blocking := -1
+	for i := range p.stages {
+		stage := &p.stages[i]
+		resp, err := a.inspectWith(stage.protocol, stage.url, req, body, botScore)
+		if err != nil {
+			if stage.optional {
+				a.logSampled("pipeline_stage_failed", a.requestFields(req, logFields{"stage": stage.name, "error": err.Error()}))
+				continue
+			}
+			for _, verdict := range verdicts {
+				discardResponse(verdict.resp)
+			}
+			return nil, err
+		}
+		verdicts = append(verdicts, stageVerdict{stage: stage, resp: resp})
+		if blocking < 0 && a.decision.Blocks(a.signals(req, resp, botScore)) {
+			blocking = len(verdicts) - 1
+			if p.shortCircuit {
+				break
+			}
+		}
+	}
+	return p.merge(a, verdicts, blocking), nil
+}
+
+// merge returns the response deciding the verdict, the blocking one or the one with the highest
+// status, with the rule IDs and the aggregated anomaly score of every stage. The other responses
+// are released.
+func (p *inspectionPipeline) merge(a *Modsecurity, verdicts []stageVerdict, blocking int) *http.Response {
+	if blocking < 0 {
+		blocking = 0
+		for i, verdict := range verdicts {
+			if verdict.resp.StatusCode > verdicts[blocking].resp.StatusCode {
+				blocking = i
+			}
+		}
+	}
+
+	var ruleIds []string
+	seen := map[string]bool{}
+	score, hasScore := 0.0, false
+	for _, verdict := range verdicts {
+		for _, id := range a.ruleIds(verdict.resp) {
+			if !seen[id] {
+				seen[id] = true
+				ruleIds = append(ruleIds, id)
+			}
+		}
+		value := strings.TrimSpace(verdict.resp.Header.Get(a.anomalyScoreHeader))
+		if stageScore, err := strconv.ParseFloat(value, 64); err == nil {
+			stageScore *= verdict.stage.weight
+			switch {
+			case !hasScore:
+				score = stageScore
+			case p.maxScore:
+				if stageScore > score {
+					score = stageScore
+				}
+			default:
+				score += stageScore
+			}
+			hasScore = true
+		}
+	}
+
+	resp := verdicts[blocking].resp
+	for i, verdict := range verdicts {
+		if i != blocking {
+			discardResponse(verdict.resp)
+		}
+	}
+	if len(verdicts) > 1 {
+		resp.Header.Del(a.ruleIdsHeader)
+		if len(ruleIds) > 0 {
+			resp.Header.Set(a.ruleIdsHeader, strings.Join(ruleIds, ","))
+		}
+		if hasScore {
+			resp.Header.Set(a.anomalyScoreHeader, strconv.FormatFloat(score, 'f', -1, 64))
+		}
+	}
+	return resp
+}
+
+// discardResponse drains and closes resp, so that its connection can be reused.
+func discardResponse(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,187 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewInspectionPipeline(t *testing.T) {
+	p, err := newInspectionPipeline("http://waf", "", nil, "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	_, err = newInspectionPipeline("http://waf", "", []InspectionStage{{Url: "http://scorer"}}, "sometimes", "")
+	assert.EqualError(t, err, `invalid pipelineShortCircuit "sometimes", expected block or never`)
+	_, err = newInspectionPipeline("http://waf", "", []InspectionStage{{Url: "http://scorer"}}, "", "avg")
+	assert.EqualError(t, err, `invalid pipelineAggregation "avg", expected sum or max`)
+	_, err = newInspectionPipeline("http://waf", "", []InspectionStage{{Name: "ml"}}, "", "")
+	assert.EqualError(t, err, "pipeline stage 0: url cannot be empty")
+
+	_, err = newInspectionPipeline("http://waf", "", []InspectionStage{{Url: "http://authz", Protocol: backendProtocolExtAuthz}}, "", "")
+	assert.EqualError(t, err, "pipeline stage 0: backendProtocol ext_authz requires an https URL, HTTP/2 is only negotiated over TLS")
+
+	p, err = newInspectionPipeline("http://waf", "", []InspectionStage{{Url: "http://scorer"}}, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []pipelineStage{
+		{name: "modsecurity", url: "http://waf", weight: 1},
+		{name: "stage1", url: "http://scorer", weight: 1},
+	}, p.stages)
+}
+
+// newStageServer answers every request with status, and with the rule ids and anomaly score
+// headers when not empty, counting the requests it received.
+func newStageServer(t *testing.T, status int, ruleIds string, score string, calls *int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(calls, 1)
+		if len(ruleIds) > 0 {
+			w.Header().Set(defaultRuleIdsHeader, ruleIds)
+		}
+		if len(score) > 0 {
+			w.Header().Set(defaultAnomalyScoreHeader, score)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestModsecurity_Pipeline(t *testing.T) {
+	tests := []struct {
+		name          string
+		wafStatus     int
+		scorerStatus  int
+		scorerUrl     string
+		optional      bool
+		shortCircuit  string
+		decision      *DecisionConfig
+		expectStatus  int
+		expectBlocked bool
+		expectScorer  int64
+		expectResult  *InspectionResult
+	}{
+		{
+			name:         "Forwards when every stage allows",
+			wafStatus:    http.StatusOK,
+			scorerStatus: http.StatusOK,
+			expectStatus: http.StatusOK,
+			expectScorer: 1,
+			expectResult: &InspectionResult{Status: http.StatusOK, Score: 8, HasScore: true, RuleIds: []string{"920350", "990001"}},
+		},
+		{
+			name:          "Blocks when a later stage blocks",
+			wafStatus:     http.StatusOK,
+			scorerStatus:  http.StatusForbidden,
+			expectStatus:  http.StatusForbidden,
+			expectBlocked: true,
+			expectScorer:  1,
+		},
+		{
+			name:          "Short-circuits on the first blocking stage",
+			wafStatus:     http.StatusForbidden,
+			scorerStatus:  http.StatusOK,
+			expectStatus:  http.StatusForbidden,
+			expectBlocked: true,
+		},
+		{
+			name:          "Runs every stage without short-circuiting",
+			wafStatus:     http.StatusForbidden,
+			scorerStatus:  http.StatusOK,
+			shortCircuit:  pipelineShortCircuitNever,
+			expectStatus:  http.StatusForbidden,
+			expectBlocked: true,
+			expectScorer:  1,
+		},
+		{
+			name:         "Blocks on the aggregated score",
+			wafStatus:    http.StatusOK,
+			scorerStatus: http.StatusOK,
+			// the stages score 2 and 3 * 2, only their sum reaches the threshold
+			decision:      &DecisionConfig{Type: decisionScore, Threshold: 7},
+			expectStatus:  http.StatusForbidden,
+			expectBlocked: true,
+			expectScorer:  1,
+		},
+		{
+			name:          "Fails when a stage fails",
+			wafStatus:     http.StatusOK,
+			scorerUrl:     "http://127.0.0.1:1",
+			expectStatus:  http.StatusBadGateway,
+			expectBlocked: true,
+		},
+		{
+			name:         "Skips optional stages failing",
+			wafStatus:    http.StatusOK,
+			scorerUrl:    "http://127.0.0.1:1",
+			optional:     true,
+			expectStatus: http.StatusOK,
+			expectResult: &InspectionResult{Status: http.StatusOK, Score: 2, HasScore: true, RuleIds: []string{"920350"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafCalls, scorerCalls int64
+			waf := newStageServer(t, tt.wafStatus, "920350", "2", &wafCalls)
+			scorerUrl := tt.scorerUrl
+			if len(scorerUrl) == 0 {
+				scorerUrl = newStageServer(t, tt.scorerStatus, "990001", "3", &scorerCalls).URL
+			}
+
+			var result *InspectionResult
+			config := CreateConfig()
+			config.ModSecurityUrl = waf.URL
+			config.Pipeline = []InspectionStage{{Name: "ml", Url: scorerUrl, Weight: 2, Optional: tt.optional}}
+			if len(tt.shortCircuit) > 0 {
+				config.PipelineShortCircuit = tt.shortCircuit
+			}
+			config.Decision = tt.decision
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				result, _ = InspectionResultFromContext(r.Context())
+			}))
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectBlocked, result == nil)
+			assert.Equal(t, int64(1), atomic.LoadInt64(&wafCalls))
+			assert.Equal(t, tt.expectScorer, atomic.LoadInt64(&scorerCalls))
+			if tt.expectResult != nil {
+				assert.Equal(t, tt.expectResult, result)
+			}
+		})
+	}
+}
+
+func TestInspectionPipeline_merge(t *testing.T) {
+	middleware := &Modsecurity{ruleIdsHeader: defaultRuleIdsHeader, anomalyScoreHeader: defaultAnomalyScoreHeader}
+	newResponse := func(status int, ruleIds string, score string) *http.Response {
+		rec := httptest.NewRecorder()
+		rec.Header().Set(defaultRuleIdsHeader, ruleIds)
+		rec.Header().Set(defaultAnomalyScoreHeader, score)
+		rec.WriteHeader(status)
+		return rec.Result()
+	}
+	stages := []pipelineStage{{name: "modsecurity", weight: 1}, {name: "ml", weight: 0.5}}
+
+	sum := &inspectionPipeline{stages: stages}
+	resp := sum.merge(middleware, []stageVerdict{
+		{stage: &stages[0], resp: newResponse(http.StatusOK, "920350", "3")},
+		{stage: &stages[1], resp: newResponse(http.StatusNotAcceptable, "920350 990001", "10")},
+	}, -1)
+	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	assert.Equal(t, "920350,990001", resp.Header.Get(defaultRuleIdsHeader))
+	assert.Equal(t, "8", resp.Header.Get(defaultAnomalyScoreHeader))
+
+	max := &inspectionPipeline{stages: stages, maxScore: true}
+	resp = max.merge(middleware, []stageVerdict{
+		{stage: &stages[0], resp: newResponse(http.StatusForbidden, "942100", "3")},
+		{stage: &stages[1], resp: newResponse(http.StatusNotAcceptable, "", "10")},
+	}, 0)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "942100", resp.Header.Get(defaultRuleIdsHeader))
+	assert.Equal(t, "5", resp.Header.Get(defaultAnomalyScoreHeader))
+}
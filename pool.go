@@ -0,0 +1,68 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// errWafQueueFull is returned when the WAF call queue reached its configured length.
+var errWafQueueFull = errors.New("too many requests waiting for the WAF")
+
+// wafPool bounds the number of concurrent calls to the WAF, so that traffic spikes don't
+// exhaust file descriptors toward the ModSecurity service. Calls over the limit wait in a
+// queue of bounded length.
+type wafPool struct {
+	slots          chan struct{}
+	maxQueueLength int64
+	metrics        *metrics
+}
+
+func newWafPool(size int, maxQueueLength int, metrics *metrics) *wafPool {
+	if size <= 0 {
+		return nil
+	}
+	return &wafPool{
+		slots:          make(chan struct{}, size),
+		maxQueueLength: int64(maxQueueLength),
+		metrics:        metrics,
+	}
+}
+
+// acquire reserves a slot for a WAF call, waiting in the queue if all slots are busy.
+// A nil pool never limits calls.
+func (p *wafPool) acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		atomic.AddInt64(&p.metrics.wafInFlight, 1)
+		return nil
+	default:
+	}
+
+	if queued := atomic.AddInt64(&p.metrics.wafQueueLength, 1); p.maxQueueLength > 0 && queued > p.maxQueueLength {
+		atomic.AddInt64(&p.metrics.wafQueueLength, -1)
+		atomic.AddInt64(&p.metrics.wafQueueRejected, 1)
+		return errWafQueueFull
+	}
+	defer atomic.AddInt64(&p.metrics.wafQueueLength, -1)
+
+	select {
+	case p.slots <- struct{}{}:
+		atomic.AddInt64(&p.metrics.wafInFlight, 1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot reserved by acquire.
+func (p *wafPool) release() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.metrics.wafInFlight, -1)
+	<-p.slots
+}
@@ -0,0 +1,74 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWafPool_acquire(t *testing.T) {
+	m := newMetrics()
+	pool := newWafPool(1, 1, m)
+
+	assert.NoError(t, pool.acquire(context.Background()))
+	assert.Equal(t, int64(1), m.snapshot()["waf_in_flight"])
+
+	queued := make(chan error)
+	go func() {
+		queued <- pool.acquire(context.Background())
+	}()
+	for atomic.LoadInt64(&m.wafQueueLength) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, errWafQueueFull, pool.acquire(context.Background()))
+	assert.Equal(t, int64(1), m.snapshot()["waf_queue_rejected"])
+
+	pool.release()
+	assert.NoError(t, <-queued)
+	assert.Equal(t, int64(0), m.snapshot()["waf_queue_length"])
+	pool.release()
+	assert.Equal(t, int64(0), m.snapshot()["waf_in_flight"])
+}
+
+func TestWafPool_acquireCanceled(t *testing.T) {
+	pool := newWafPool(1, 0, newMetrics())
+	assert.NoError(t, pool.acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pool.acquire(ctx))
+}
+
+func TestModsecurity_WafQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer wafServer.Close()
+	defer close(release)
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.MaxConcurrentWafCalls = 1
+	config.MaxWafQueueLength = 1
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	go middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	for atomic.LoadInt64(&middleware.metrics.wafInFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	for atomic.LoadInt64(&middleware.metrics.wafQueueLength) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+}
@@ -0,0 +1,100 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// profiles are the presets selected with the profile option, as JSON configurations. Options set
+// in the configuration win, the others take the value of the profile.
+var profiles = map[string]string{
+	// strict fails closed and rejects anything unusual.
+	"strict": `{
+		"interruptOnError": true,
+		"ignore500Error": false,
+		"botScoreFailOpen": false,
+		"maskBlockResponse": true,
+		"controlCharPolicy": "reject",
+		"connectPolicy": "deny",
+		"forwardedHeadersPolicy": "overwrite",
+		"maxBodySize": 1048576
+	}`,
+	// balanced fails closed, except on WAF timeouts and overloads.
+	"balanced": `{
+		"interruptOnError": true,
+		"errorPolicy": {"timeout": "continue", "queue": "continue"},
+		"maskBlockResponse": true,
+		"controlCharPolicy": "sanitize"
+	}`,
+	// permissive favors availability: it fails open and inspects the beginning of large bodies.
+	"permissive": `{
+		"interruptOnError": false,
+		"ignore500Error": true,
+		"inspectFirstNBytes": 1048576
+	}`,
+	// api suits JSON APIs: bounded bodies, canonicalized before inspection, generic block bodies.
+	"api": `{
+		"interruptOnError": true,
+		"maskBlockResponse": true,
+		"canonicalizeJson": true,
+		"maxBodySize": 1048576,
+		"twoPhaseInspection": true
+	}`,
+	// static-site only serves reads, other methods are rejected without calling the WAF.
+	"static-site": `{
+		"interruptOnError": false,
+		"maskBlockResponse": true,
+		"maxBodySize": 65536,
+		"allowedMethods": [{"path": ".*", "methods": ["GET", "HEAD", "OPTIONS"]}]
+	}`,
+}
+
+// withProfile returns a copy of config completed with the options of its profile. The options set
+// are recorded when decoding JSON. Traefik decodes with mapstructure, which doesn't tell which keys
+// it read: there, an option still at its default value is taken as not set.
+func withProfile(config *Config) (*Config, error) {
+	if len(config.Profile) == 0 {
+		return config, nil
+	}
+	preset, ok := profiles[config.Profile]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("invalid profile %q, expected one of %s", config.Profile, strings.Join(names, ", "))
+	}
+
+	profile := CreateConfig()
+	if err := json.Unmarshal([]byte(preset), profile); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %s", config.Profile, err.Error())
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(preset), &keys); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %s", config.Profile, err.Error())
+	}
+
+	completed := *config
+	target := reflect.ValueOf(&completed).Elem()
+	defaults := reflect.ValueOf(*CreateConfig())
+	values := reflect.ValueOf(*profile)
+	t := target.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if _, ok := keys[name]; !ok {
+			continue
+		}
+		set := config.setKeys[name]
+		if config.setKeys == nil {
+			set = !reflect.DeepEqual(target.Field(i).Interface(), defaults.Field(i).Interface())
+		}
+		if !set {
+			target.Field(i).Set(values.Field(i))
+		}
+	}
+	return &completed, nil
+}
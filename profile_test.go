@@ -0,0 +1,75 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithProfile(t *testing.T) {
+	config := CreateConfig()
+	config.Profile = "permissive"
+	config.InspectFirstNBytes = 4096
+
+	completed, err := withProfile(config)
+	assert.NoError(t, err)
+	assert.False(t, completed.InterruptOnError)
+	assert.True(t, completed.Ignore500Error)
+	// options set in the configuration win
+	assert.Equal(t, int64(4096), completed.InspectFirstNBytes)
+	// the configuration itself is untouched
+	assert.True(t, config.InterruptOnError)
+
+	// an option set to its default value still wins, in JSON configurations
+	config = CreateConfig()
+	assert.NoError(t, json.Unmarshal([]byte(`{"profile": "permissive", "interruptOnError": true, "Ignore500Error": false}`), config))
+	completed, err = withProfile(config)
+	assert.NoError(t, err)
+	assert.True(t, completed.InterruptOnError)
+	assert.False(t, completed.Ignore500Error)
+	assert.Equal(t, int64(1048576), completed.InspectFirstNBytes)
+
+	config.Profile = "paranoid"
+	_, err = withProfile(config)
+	assert.EqualError(t, err, `invalid profile "paranoid", expected one of api, balanced, permissive, static-site, strict`)
+}
+
+func TestNew_Profiles(t *testing.T) {
+	for name := range profiles {
+		t.Run(name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = "http://waf"
+			config.Profile = name
+			handler, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+			assert.NoError(t, err)
+			assert.NoError(t, handler.(*Modsecurity).Close())
+		})
+	}
+}
+
+func TestModsecurity_StaticSiteProfile(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.Profile = "static-site"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/contact", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	assert.Equal(t, 0, wafCalls)
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/index.html", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 1, wafCalls)
+}
@@ -0,0 +1,81 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// connectionSpecificHeaders are forbidden in HTTP/2 and HTTP/3 requests (RFC 9113 section 8.2.2,
+// RFC 9114 section 4.2): the framing belongs to the protocol.
+var connectionSpecificHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// normalizeProtocol smooths over the differences of the requests built by the HTTP/2 and HTTP/3
+// servers of Traefik, so that every feature sees them like HTTP/1.1 requests: the HTTP/3 server
+// may leave RequestURI empty, only filling req.URL from the :path pseudo-header; header names
+// arrive lowercase on the wire and must be canonical for http.Header lookups; the :authority
+// pseudo-header may only be in req.URL. It returns the anomalies found, when requested.
+func normalizeProtocol(req *http.Request, collect bool) []string {
+	var anomalies []string
+	if len(req.RequestURI) == 0 && req.URL != nil {
+		if collect {
+			anomalies = append(anomalies, "empty_request_uri")
+		}
+		req.RequestURI = req.URL.RequestURI()
+	}
+	if len(req.Host) == 0 && req.URL != nil && len(req.URL.Host) > 0 {
+		if collect {
+			anomalies = append(anomalies, "host_from_url")
+		}
+		req.Host = req.URL.Host
+	}
+	var renamed map[string][]string
+	for name, values := range req.Header {
+		if strings.HasPrefix(name, ":") {
+			if collect {
+				anomalies = append(anomalies, "pseudo_header:"+name)
+			}
+			delete(req.Header, name)
+			continue
+		}
+		if canonical := http.CanonicalHeaderKey(name); canonical != name {
+			if collect {
+				anomalies = append(anomalies, "non_canonical_header:"+name)
+			}
+			if renamed == nil {
+				renamed = make(map[string][]string)
+			}
+			renamed[canonical] = append(renamed[canonical], values...)
+			delete(req.Header, name)
+		}
+	}
+	for name, values := range renamed {
+		req.Header[name] = append(req.Header[name], values...)
+	}
+	if collect && req.ProtoMajor >= 2 {
+		for _, name := range connectionSpecificHeaders {
+			if _, ok := req.Header[name]; ok {
+				anomalies = append(anomalies, "connection_specific_header:"+name)
+			}
+		}
+		if te := req.Header.Get("Te"); len(te) > 0 && !strings.EqualFold(strings.TrimSpace(te), "trailers") {
+			anomalies = append(anomalies, "te_not_trailers")
+		}
+		if len(req.Host) == 0 {
+			anomalies = append(anomalies, "missing_authority")
+		}
+	}
+	return anomalies
+}
+
+// checkProtocol normalizes req and, with logProtocolAnomalies, logs its protocol-specific anomalies.
+func (a *Modsecurity) checkProtocol(req *http.Request) {
+	anomalies := normalizeProtocol(req, a.logProtocolAnomalies)
+	if len(anomalies) > 0 {
+		sort.Strings(anomalies)
+		a.logSampled("protocol_anomaly", a.requestFields(req, logFields{
+			"proto":     req.Proto,
+			"anomalies": strings.Join(anomalies, ","),
+		}))
+	}
+}
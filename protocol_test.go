@@ -0,0 +1,94 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newHTTP3Request returns a request as built by an HTTP/3 server which leaves RequestURI and Host
+// empty and keeps the lowercase header names of the wire.
+func newHTTP3Request(method string, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/3.0", 3, 0
+	req.RequestURI = ""
+	req.URL.Host = req.Host
+	req.Host = ""
+	req.Header = http.Header{
+		"content-type": {"application/x-www-form-urlencoded"},
+		"user-agent":   {"curl/8.0"},
+		"Cookie":       {"a=1"},
+		"cookie":       {"b=2"},
+	}
+	return req
+}
+
+func TestNormalizeProtocol(t *testing.T) {
+	req := newHTTP3Request(http.MethodGet, "https://example.com/search?q=1", "")
+	anomalies := normalizeProtocol(req, true)
+	assert.Equal(t, "/search?q=1", req.RequestURI)
+	assert.Equal(t, "example.com", req.Host)
+	assert.Equal(t, "curl/8.0", req.UserAgent())
+	assert.ElementsMatch(t, []string{"a=1", "b=2"}, req.Header["Cookie"])
+	assert.Len(t, req.Header, 3)
+	assert.ElementsMatch(t, []string{"empty_request_uri", "host_from_url", "non_canonical_header:content-type", "non_canonical_header:user-agent", "non_canonical_header:cookie"}, anomalies)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Proto, req.ProtoMajor = "HTTP/2.0", 2
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Te", "gzip")
+	req.Header[":authority"] = []string{"example.com"}
+	anomalies = normalizeProtocol(req, true)
+	assert.ElementsMatch(t, []string{"connection_specific_header:Connection", "te_not_trailers", "pseudo_header::authority"}, anomalies)
+	assert.NotContains(t, req.Header, ":authority")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Connection", "keep-alive")
+	assert.Empty(t, normalizeProtocol(req, true), "connection headers are legitimate in HTTP/1.1")
+	assert.Empty(t, normalizeProtocol(newHTTP3Request(http.MethodGet, "/", ""), false))
+}
+
+func TestModsecurity_HTTP3Request(t *testing.T) {
+	var wafURI, wafContentType, wafBody string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafURI = r.RequestURI
+		wafContentType = r.Header.Get("Content-Type")
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		wafBody = buf.String()
+		if strings.Contains(wafBody, "attack") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.LogProtocolAnomalies = true
+	var serviceContentType string
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceContentType = r.Header.Get("Content-Type")
+	}))
+	var buf bytes.Buffer
+	middleware.logger = log.New(&buf, "", 0)
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, newHTTP3Request(http.MethodPost, "https://example.com/login?next=%2F", "user=john"))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "/login?next=%2F", wafURI)
+	assert.Equal(t, "application/x-www-form-urlencoded", wafContentType)
+	assert.Equal(t, "user=john", wafBody)
+	assert.Equal(t, "application/x-www-form-urlencoded", serviceContentType)
+	assert.Contains(t, buf.String(), "event=protocol_anomaly")
+	assert.Contains(t, buf.String(), "proto=HTTP/3.0")
+	assert.Contains(t, buf.String(), `uri="/login?next=%2F"`)
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, newHTTP3Request(http.MethodPost, "https://example.com/login", "user=attack"))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
@@ -0,0 +1,175 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter enforces a per-client token bucket before the WAF inspection. Clients are identified
+// by their address, and also by the value of keyHeader when set and present: a request takes a
+// token from both buckets, so rotating the value doesn't escape the limit of the address. Like
+// clientTracker, it tracks at most maxTrackedClients clients: past it, a full bucket is evicted
+// for the new client, and when none is, the new clients share the overflow bucket.
+type rateLimiter struct {
+	rate             float64
+	burst            float64
+	keyHeader        string
+	ipv6PrefixLength int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// rateLimitOverflowKey is the key of the bucket shared by the clients which can't be tracked.
+const rateLimitOverflowKey = "overflow"
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when rate, in requests per second, is not positive. A burst below one
+// defaults to the rate, rounded up.
+func newRateLimiter(rate float64, burst int, keyHeader string, ipv6PrefixLength int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	capacity := float64(burst)
+	if burst < 1 {
+		capacity = math.Ceil(rate)
+	}
+	return &rateLimiter{
+		rate:             rate,
+		burst:            capacity,
+		keyHeader:        keyHeader,
+		ipv6PrefixLength: ipv6PrefixLength,
+		buckets:          make(map[string]*tokenBucket),
+	}
+}
+
+// keys returns the keys of the buckets charged for req: the one of its address, and the one of
+// its keyHeader value. The client chooses this value, so it never replaces the address bucket.
+func (l *rateLimiter) keys(req *http.Request) []string {
+	var keys []string
+	if key := clientKey(remoteIP(req), l.ipv6PrefixLength); len(key) > 0 {
+		keys = append(keys, key)
+	}
+	if len(l.keyHeader) > 0 {
+		if value := req.Header.Get(l.keyHeader); len(value) > 0 {
+			keys = append(keys, "header:"+value)
+		}
+	}
+	return keys
+}
+
+// allow takes a token from the buckets of the client of req. When one of them is empty, it
+// returns false and how long until a token is available in all of them.
+func (l *rateLimiter) allow(req *http.Request, now time.Time) (bool, time.Duration) {
+	keys := l.keys(req)
+	if len(keys) == 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buckets := make([]*tokenBucket, 0, len(keys))
+	var wait time.Duration
+	for _, key := range keys {
+		bucket := l.bucket(key, now)
+		if len(buckets) > 0 && buckets[0] == bucket {
+			// both keys overflowed
+			continue
+		}
+		if elapsed := now.Sub(bucket.last); elapsed > 0 {
+			bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed.Seconds()*l.rate)
+			bucket.last = now
+		}
+		if bucket.tokens < 1 {
+			if w := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// bucket returns the bucket of key, created full, or the overflow bucket when no more clients can
+// be tracked. It must be called with mu held.
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	bucket, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxTrackedClients && !l.evict(now) {
+		key = rateLimitOverflowKey
+		bucket, ok = l.buckets[key]
+	}
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// evict forgets one of the clientEvictionSample first buckets which is full again. It reports
+// false when none is. It must be called with mu held.
+func (l *rateLimiter) evict(now time.Time) bool {
+	sampled := 0
+	for key, bucket := range l.buckets {
+		if key != rateLimitOverflowKey && l.full(bucket, now) {
+			delete(l.buckets, key)
+			return true
+		}
+		if sampled++; sampled >= clientEvictionSample {
+			break
+		}
+	}
+	return false
+}
+
+func (l *rateLimiter) full(bucket *tokenBucket, now time.Time) bool {
+	return bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst
+}
+
+// expire forgets the clients whose bucket is full again.
+func (l *rateLimiter) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if l.full(bucket, now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// run expires the full buckets every interval until ctx is done.
+func (l *rateLimiter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.expire(now)
+		}
+	}
+}
+
+// rateLimited rejects req with 429 Too Many Requests when its client exceeded the rate limit.
+func (a *Modsecurity) rateLimited(rw http.ResponseWriter, req *http.Request) bool {
+	allowed, retryAfter := a.rateLimiter.allow(req, time.Now())
+	if allowed {
+		return false
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	a.blockLocally(rw, req, "rate limit exceeded", http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,129 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_allow(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0, 10, "", 64))
+
+	limiter := newRateLimiter(2, 3, "X-Api-Key", 64)
+	now := time.Unix(1700000000, 0)
+	request := func(remoteAddr string, apiKey string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if len(apiKey) > 0 {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		return req
+	}
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.allow(request("10.0.0.1:1234", ""), now)
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter := limiter.allow(request("10.0.0.1:4321", ""), now)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// other clients have their own bucket
+	allowed, _ = limiter.allow(request("10.0.0.2:1234", ""), now)
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow(request("10.0.0.3:1234", "key"), now)
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow(request("10.0.0.1:1234", "key"), now)
+	assert.False(t, allowed, "a key doesn't lift the limit of the address")
+
+	// the bucket refills at the rate
+	allowed, _ = limiter.allow(request("10.0.0.1:1234", ""), now.Add(500*time.Millisecond))
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow(request("10.0.0.1:1234", ""), now.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+
+	limiter.expire(now.Add(time.Second))
+	assert.Len(t, limiter.buckets, 1)
+	limiter.expire(now.Add(2 * time.Second))
+	assert.Empty(t, limiter.buckets)
+
+	// the burst defaults to the rate
+	assert.Equal(t, 3.0, newRateLimiter(2.5, 0, "", 64).burst)
+}
+
+func TestRateLimiter_rotatingKeys(t *testing.T) {
+	limiter := newRateLimiter(1, 2, "X-Api-Key", 64)
+	now := time.Unix(1700000000, 0)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Api-Key", "key"+strconv.Itoa(i))
+		if ok, _ := limiter.allow(req, now); ok {
+			allowed++
+		}
+	}
+	assert.Equal(t, 2, allowed, "a new key per request still counts against the address")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Api-Key", "key0")
+	ok, _ := limiter.allow(req, now)
+	assert.True(t, ok, "the bucket of the key only holds the single request it took")
+	ok, retryAfter := limiter.allow(req, now)
+	assert.False(t, ok, "the key is limited across addresses")
+	assert.Equal(t, time.Second, retryAfter)
+}
+
+func TestRateLimiter_full(t *testing.T) {
+	limiter := newRateLimiter(1, 1, "X-Api-Key", 64)
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < maxTrackedClients; i++ {
+		limiter.buckets["header:"+strconv.Itoa(i)] = &tokenBucket{tokens: 0, last: now}
+	}
+	request := func(apiKey string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		return req
+	}
+
+	allowed, _ := limiter.allow(request("new1"), now)
+	assert.True(t, allowed, "the new clients share the overflow bucket")
+	allowed, _ = limiter.allow(request("new2"), now)
+	assert.False(t, allowed, "they can't escape the limit by creating keys")
+	assert.NotContains(t, limiter.buckets, "header:new2")
+
+	later := now.Add(2 * time.Second)
+	allowed, _ = limiter.allow(request("new3"), later)
+	assert.True(t, allowed)
+	assert.Contains(t, limiter.buckets, "header:new3", "full buckets are evicted for the new clients")
+	assert.Len(t, limiter.buckets, maxTrackedClients+1)
+}
+
+func TestModsecurity_RateLimit(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.RateLimit = 0.1
+	config.RateLimitBurst = 2
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, expected, rw.Code)
+		if expected == http.StatusTooManyRequests {
+			assert.Equal(t, "10", rw.Header().Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, 2, wafCalls)
+}
@@ -0,0 +1,65 @@
+package traefik_modsecurity_plugin
+
+import (
+	"sync"
+	"time"
+)
+
+// logSampler rate limits similar error log lines, so that a WAF outage doesn't flood disks.
+// For each kind of error, at most burst lines are written per interval; the number of suppressed
+// lines is reported with the first line written in a following interval.
+type logSampler struct {
+	interval time.Duration
+	burst    int
+	mu       sync.Mutex
+	windows  map[string]*logWindow
+}
+
+type logWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func newLogSampler(interval time.Duration, burst int) *logSampler {
+	return &logSampler{interval: interval, burst: burst, windows: map[string]*logWindow{}}
+}
+
+// allow reports whether a line of the given kind can be written at now, and how many lines
+// of that kind were suppressed since the last written one.
+// A sampler without interval or burst never suppresses lines.
+func (s *logSampler) allow(kind string, now time.Time) (bool, int) {
+	if s.interval <= 0 || s.burst <= 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	window, ok := s.windows[kind]
+	if !ok || now.Sub(window.start) >= s.interval {
+		suppressed := 0
+		if ok {
+			suppressed = window.suppressed
+		}
+		s.windows[kind] = &logWindow{start: now, count: 1}
+		return true, suppressed
+	}
+	if window.count < s.burst {
+		window.count++
+		return true, 0
+	}
+	window.suppressed++
+	return false, 0
+}
+
+// logSampled writes a structured event unless too many events of the same kind were written recently.
+func (a *Modsecurity) logSampled(event string, fields logFields) {
+	allowed, suppressed := a.logSampler.allow(event, time.Now())
+	if !allowed {
+		return
+	}
+	if suppressed > 0 {
+		fields["suppressed"] = suppressed
+	}
+	a.logEvent(event, fields)
+}
@@ -0,0 +1,34 @@
+package traefik_modsecurity_plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSampler_allow(t *testing.T) {
+	sampler := newLogSampler(time.Minute, 2)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, expect := range []bool{true, true, false, false} {
+		allowed, suppressed := sampler.allow("waf_5xx", start.Add(time.Duration(i)*time.Second))
+		assert.Equal(t, expect, allowed)
+		assert.Equal(t, 0, suppressed)
+	}
+
+	allowed, _ := sampler.allow("waf_error", start)
+	assert.True(t, allowed, "kinds are sampled independently")
+
+	allowed, suppressed := sampler.allow("waf_5xx", start.Add(time.Minute))
+	assert.True(t, allowed)
+	assert.Equal(t, 2, suppressed)
+}
+
+func TestLogSampler_disabled(t *testing.T) {
+	sampler := newLogSampler(0, 0)
+	for i := 0; i < 100; i++ {
+		allowed, _ := sampler.allow("waf_5xx", time.Now())
+		assert.True(t, allowed)
+	}
+}
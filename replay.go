@@ -0,0 +1,357 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Formats accepted in replayExportFormat.
+const (
+	replayFormatRaw = "raw"
+	replayFormatHar = "har"
+)
+
+// replayMaxBody is the maximum number of body bytes exported per request.
+const replayMaxBody = 64 * 1024
+
+// replayQueueLength bounds the requests waiting to be exported. Requests are dropped when it is full.
+const replayQueueLength = 1000
+
+// replayExporter asynchronously exports sanitized copies of requests in a replayable format,
+// to a directory, to an HTTP endpoint accepting PUT requests (e.g. an object store) or both, so
+// they can be re-run against new rulesets offline.
+type replayExporter struct {
+	dir         string
+	url         string
+	format      string
+	client      *http.Client
+	sampleEvery int64
+	clean       int64
+	seq         int64
+	queue       chan *replayRecord
+}
+
+// replayRecord is a sanitized copy of a request.
+type replayRecord struct {
+	time      time.Time
+	method    string
+	scheme    string
+	host      string
+	uri       string
+	header    http.Header
+	body      []byte
+	wafStatus int
+	blocked   bool
+}
+
+func newReplayExporter(dir string, url string, format string, sampleRate float64) (*replayExporter, error) {
+	if len(dir) == 0 && len(url) == 0 {
+		return nil, nil
+	}
+	switch format {
+	case "":
+		format = replayFormatRaw
+	case replayFormatRaw, replayFormatHar:
+	default:
+		return nil, fmt.Errorf("invalid replayExportFormat %q, expected %s or %s", format, replayFormatRaw, replayFormatHar)
+	}
+	if len(dir) > 0 {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replayExportDir: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("invalid replayExportDir: %s is not a directory", dir)
+		}
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("invalid replayExportSampleRate %v, expected a value in [0, 1]", sampleRate)
+	}
+	e := &replayExporter{
+		dir:    dir,
+		url:    strings.TrimSuffix(url, "/"),
+		format: format,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *replayRecord, replayQueueLength),
+	}
+	if sampleRate > 0 {
+		e.sampleEvery = int64(math.Round(1 / sampleRate))
+	}
+	return e, nil
+}
+
+// selects reports whether a request must be exported: every blocked request is, and one clean
+// request out of sampleEvery.
+func (e *replayExporter) selects(blocked bool) bool {
+	if e == nil {
+		return false
+	}
+	if blocked {
+		return true
+	}
+	return e.sampleEvery > 0 && atomic.AddInt64(&e.clean, 1)%e.sampleEvery == 0
+}
+
+// exportReplay queues a sanitized copy of req and of the part of its body sent to the WAF.
+func (a *Modsecurity) exportReplay(req *http.Request, body *bufferedBody, wafStatus int, blocked bool) {
+	if !a.replayExporter.selects(blocked) {
+		return
+	}
+	record := &replayRecord{
+		time:      time.Now(),
+		method:    req.Method,
+		scheme:    "http",
+		host:      req.Host,
+		uri:       a.piiMasker.maskURI(a.wafURI(req)),
+		header:    a.piiMasker.maskHeader(sanitizeHeader(req.Header)),
+		wafStatus: wafStatus,
+		blocked:   blocked,
+	}
+	if req.TLS != nil {
+		record.scheme = "https"
+	}
+	a.debugDumper.stripTrigger(record.header)
+	if body != nil {
+		record.body, _ = ioutil.ReadAll(io.LimitReader(body.wafReader(), replayMaxBody))
+		record.body = a.piiMasker.maskBody(req.Header.Get("Content-Type"), record.body)
+	}
+
+	select {
+	case a.replayExporter.queue <- record:
+	default:
+		a.logSampled("replay_export_dropped", a.requestFields(req, logFields{}))
+	}
+}
+
+// runReplayExporter writes the queued requests until ctx is done.
+func (a *Modsecurity) runReplayExporter(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case record := <-a.replayExporter.queue:
+			a.writeReplay(record)
+		}
+	}
+}
+
+// flushReplayExporter writes the requests still queued, on Close.
+func (a *Modsecurity) flushReplayExporter() {
+	for {
+		select {
+		case record := <-a.replayExporter.queue:
+			a.writeReplay(record)
+		default:
+			return
+		}
+	}
+}
+
+func (a *Modsecurity) writeReplay(record *replayRecord) {
+	if err := a.replayExporter.write(record); err != nil {
+		a.logSampled("replay_export_failed", logFields{"error": err.Error()})
+	}
+}
+
+func (e *replayExporter) write(record *replayRecord) error {
+	content, contentType, ext := record.raw(), "message/http", "http"
+	if e.format == replayFormatHar {
+		var err error
+		if content, err = record.har(); err != nil {
+			return err
+		}
+		contentType, ext = "application/json", "har"
+	}
+	verdict := "clean"
+	if record.blocked {
+		verdict = "blocked"
+	}
+	name := fmt.Sprintf("%s-%06d-%s.%s", record.time.UTC().Format("20060102T150405.000000000Z"), atomic.AddInt64(&e.seq, 1), verdict, ext)
+
+	var dirErr error
+	if len(e.dir) > 0 {
+		dirErr = ioutil.WriteFile(filepath.Join(e.dir, name), content, 0600)
+	}
+	if len(e.url) == 0 {
+		return dirErr
+	}
+	if err := e.upload(name, content, contentType); err != nil {
+		return err
+	}
+	return dirErr
+}
+
+// upload puts the file name to url.
+func (e *replayExporter) upload(name string, content []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPut, e.url+"/"+name, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d uploading %s", resp.StatusCode, name)
+	}
+	return nil
+}
+
+// sortedHeaderNames returns the names of header in a stable order.
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// raw returns the request in HTTP/1.1 wire format, ready to be replayed with e.g. netcat.
+func (r *replayRecord) raw() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.method, r.uri, r.host)
+	for _, name := range sortedHeaderNames(r.header) {
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Content-Length", "Transfer-Encoding":
+			continue
+		}
+		for _, value := range r.header[name] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+		}
+	}
+	if len(r.body) > 0 {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(r.body))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(r.body)
+	return buf.Bytes()
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+	} `json:"content"`
+	RedirectURL string `json:"redirectURL"`
+	HeadersSize int    `json:"headersSize"`
+	BodySize    int    `json:"bodySize"`
+}
+
+type harEntry struct {
+	StartedDateTime string         `json:"startedDateTime"`
+	Time            int            `json:"time"`
+	Request         harRequest     `json:"request"`
+	Response        harResponse    `json:"response"`
+	Cache           struct{}       `json:"cache"`
+	Timings         map[string]int `json:"timings"`
+	Comment         string         `json:"comment,omitempty"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// har returns the request as a HAR 1.2 archive of one entry. The response part holds the WAF verdict.
+func (r *replayRecord) har() ([]byte, error) {
+	request := harRequest{
+		Method:      r.method,
+		URL:         r.scheme + "://" + r.host + r.uri,
+		HTTPVersion: "HTTP/1.1",
+		Headers:     []harNameValue{},
+		QueryString: []harNameValue{},
+		Cookies:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(r.body),
+	}
+	for _, name := range sortedHeaderNames(r.header) {
+		for _, value := range r.header[name] {
+			request.Headers = append(request.Headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	if i := strings.IndexByte(r.uri, '?'); i >= 0 {
+		for _, pair := range strings.Split(r.uri[i+1:], "&") {
+			name, value := pair, ""
+			if j := strings.IndexByte(pair, '='); j >= 0 {
+				name, value = pair[:j], pair[j+1:]
+			}
+			request.QueryString = append(request.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+	if len(r.body) > 0 {
+		request.PostData = &harPostData{MimeType: r.header.Get("Content-Type"), Text: string(r.body)}
+	}
+
+	entry := harEntry{
+		StartedDateTime: r.time.UTC().Format(time.RFC3339Nano),
+		Request:         request,
+		Response: harResponse{
+			Status:      r.wafStatus,
+			StatusText:  http.StatusText(r.wafStatus),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: map[string]int{"send": 0, "wait": 0, "receive": 0},
+		Comment: "WAF status " + strconv.Itoa(r.wafStatus),
+	}
+	var archive harLog
+	archive.Log.Version = "1.2"
+	archive.Log.Creator = harCreator{Name: "traefik-modsecurity-plugin", Version: "1"}
+	archive.Log.Entries = []harEntry{entry}
+	return json.MarshalIndent(archive, "", "  ")
+}
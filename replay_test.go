@@ -0,0 +1,122 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ReplayExportDir(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "attack") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer wafServer.Close()
+
+	dir := t.TempDir()
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ReplayExportDir = dir
+	config.ReplayExportSampleRate = 0.5
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/login?attack=1", strings.NewReader("user=admin'--"))
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+	for i := 0; i < 4; i++ {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	}
+	assert.NoError(t, middleware.Close())
+
+	blocked, _ := filepath.Glob(filepath.Join(dir, "*-blocked.http"))
+	clean, _ := filepath.Glob(filepath.Join(dir, "*-clean.http"))
+	assert.Len(t, blocked, 1)
+	assert.Len(t, clean, 2, "one clean request out of two is exported")
+
+	content, err := ioutil.ReadFile(blocked[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "POST /login?attack=1 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Authorization: [REDACTED]\r\n"+
+		"Content-Type: application/x-www-form-urlencoded\r\n"+
+		"Content-Length: 13\r\n"+
+		"\r\n"+
+		"user=admin'--", string(content))
+}
+
+func TestModsecurity_ReplayExportUrl(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	var mu sync.Mutex
+	uploads := map[string][]byte{}
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		uploads[r.URL.Path] = body
+		mu.Unlock()
+	}))
+	defer store.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ReplayExportUrl = store.URL + "/replays/"
+	config.ReplayExportFormat = replayFormatHar
+	// the requests can be exported to a directory too
+	config.ReplayExportDir = t.TempDir()
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/search?q=%27or&page=2", nil))
+	assert.NoError(t, middleware.Close())
+	saved, _ := filepath.Glob(filepath.Join(config.ReplayExportDir, "*-blocked.har"))
+	assert.Len(t, saved, 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, uploads, 1)
+	for path, body := range uploads {
+		assert.True(t, strings.HasPrefix(path, "/replays/"))
+		assert.True(t, strings.HasSuffix(path, "-blocked.har"))
+
+		var archive harLog
+		assert.NoError(t, json.Unmarshal(body, &archive))
+		assert.Equal(t, "1.2", archive.Log.Version)
+		assert.Len(t, archive.Log.Entries, 1)
+		entry := archive.Log.Entries[0]
+		assert.Equal(t, "http://example.com/search?q=%27or&page=2", entry.Request.URL)
+		assert.Equal(t, []harNameValue{{Name: "q", Value: "%27or"}, {Name: "page", Value: "2"}}, entry.Request.QueryString)
+		assert.Equal(t, http.StatusForbidden, entry.Response.Status)
+	}
+}
+
+func TestNewReplayExporter(t *testing.T) {
+	exporter, err := newReplayExporter("", "", "", 0)
+	assert.NoError(t, err)
+	assert.Nil(t, exporter)
+	assert.False(t, exporter.selects(true))
+
+	for _, tt := range []struct {
+		dir, url, format string
+		sampleRate       float64
+	}{
+		{dir: t.TempDir(), format: "pcap"},
+		{dir: filepath.Join(t.TempDir(), "missing"), format: replayFormatRaw},
+		{url: "http://store", format: replayFormatRaw, sampleRate: 2},
+	} {
+		_, err := newReplayExporter(tt.dir, tt.url, tt.format, tt.sampleRate)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,133 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// overrideWriter captures the override header of the response of the application before the
+// headers are written. It implements http.Flusher, http.Hijacker and http.Pusher on top of the
+// wrapped writer, so that streamed responses, upgraded connections and server pushes keep working.
+// It is handed to the service through exposeSupported.
+type overrideWriter struct {
+	http.ResponseWriter
+	a           *Modsecurity
+	req         *http.Request
+	wroteHeader bool
+}
+
+// WriteHeader captures the override header before the final response header is written.
+// Informational responses, e.g. 103 Early Hints, are passed through right away, without the
+// override header which is kept for the final response.
+func (w *overrideWriter) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		header := w.ResponseWriter.Header()
+		name := http.CanonicalHeaderKey(w.a.sessionOverrides.header)
+		values, ok := header[name]
+		delete(header, name)
+		w.ResponseWriter.WriteHeader(code)
+		if ok {
+			header[name] = values
+		}
+		return
+	}
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.a.captureSessionOverride(w.req, w.ResponseWriter.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *overrideWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish captures the override header of the responses without a body, whose header is written
+// once the middleware returned.
+func (w *overrideWriter) finish() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.a.captureSessionOverride(w.req, w.ResponseWriter.Header())
+	}
+}
+
+// Flush lets streamed responses through.
+func (w *overrideWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the upgraded connections through, e.g. WebSockets, which bypass the inspection.
+func (w *overrideWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	w.finish()
+	return hijacker.Hijack()
+}
+
+// Push lets the HTTP/2 server pushes through.
+func (w *overrideWriter) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := w.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return pusher.Push(target, opts)
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (w *overrideWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// wrappingWriter is a response writer wrapping another one.
+type wrappingWriter interface {
+	http.ResponseWriter
+	http.Flusher
+	Unwrap() http.ResponseWriter
+}
+
+// fullWriter is a wrappingWriter implementing every optional interface.
+type fullWriter interface {
+	wrappingWriter
+	http.Hijacker
+	http.Pusher
+}
+
+type plainWriter struct{ wrappingWriter }
+
+type hijackingWriter struct {
+	wrappingWriter
+	http.Hijacker
+}
+
+type pushingWriter struct {
+	wrappingWriter
+	http.Pusher
+}
+
+// exposeSupported returns w implementing only the optional interfaces wrapped implements, so
+// that the type assertions of the service tell what the connection actually supports.
+func exposeSupported(w fullWriter, wrapped http.ResponseWriter) http.ResponseWriter {
+	_, hijacker := wrapped.(http.Hijacker)
+	_, pusher := wrapped.(http.Pusher)
+	switch {
+	case hijacker && pusher:
+		return w
+	case hijacker:
+		return hijackingWriter{w, w}
+	case pusher:
+		return pushingWriter{w, w}
+	}
+	return plainWriter{w}
+}
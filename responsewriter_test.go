@@ -0,0 +1,167 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pushRecorder is a ResponseRecorder supporting HTTP/2 server pushes.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (r *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	r.pushed = append(r.pushed, target)
+	return nil
+}
+
+func overrideWriterConfig() *Config {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.SessionOverrideHeader = "X-Waf-Session"
+	config.SessionOverrideCookie = "sid"
+	return config
+}
+
+func TestOverrideWriter_Interfaces(t *testing.T) {
+	middleware := newTestModsecurity(t, overrideWriterConfig(), http.NotFoundHandler())
+	recorder := httptest.NewRecorder()
+	w := exposeSupported(&overrideWriter{ResponseWriter: recorder, a: middleware, req: httptest.NewRequest(http.MethodGet, "/", nil)}, recorder)
+
+	_, ok := w.(http.Flusher)
+	assert.True(t, ok)
+	_, ok = w.(http.Hijacker)
+	assert.False(t, ok, "the recorder does not support hijacking")
+	_, ok = w.(http.Pusher)
+	assert.False(t, ok, "the recorder does not support pushes")
+	assert.Same(t, recorder, w.(interface{ Unwrap() http.ResponseWriter }).Unwrap())
+
+	w.(http.Flusher).Flush()
+	assert.True(t, recorder.Flushed)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestOverrideWriter_Push(t *testing.T) {
+	middleware := newTestModsecurity(t, overrideWriterConfig(), http.NotFoundHandler())
+	recorder := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := &overrideWriter{ResponseWriter: recorder, a: middleware, req: httptest.NewRequest(http.MethodGet, "/", nil)}
+
+	assert.NoError(t, w.Push("/style.css", nil))
+	assert.Equal(t, []string{"/style.css"}, recorder.pushed)
+	_, _, err := w.Hijack()
+	assert.Error(t, err, "the recorder does not support hijacking")
+	assert.Equal(t, http.ErrNotSupported, (&overrideWriter{ResponseWriter: httptest.NewRecorder(), a: middleware}).Push("/style.css", nil))
+}
+
+func TestExposeSupported(t *testing.T) {
+	middleware := newTestModsecurity(t, overrideWriterConfig(), http.NotFoundHandler())
+	hijacker := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := exposeSupported(&overrideWriter{ResponseWriter: rw, a: middleware, req: r}, rw)
+		_, hijacking := w.(http.Hijacker)
+		_, pushing := w.(http.Pusher)
+		assert.True(t, hijacking)
+		assert.False(t, pushing, "HTTP/1.1 connections don't push")
+	}))
+	defer hijacker.Close()
+	resp, err := http.Get(hijacker.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	recorder := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := exposeSupported(&overrideWriter{ResponseWriter: recorder, a: middleware}, recorder)
+	_, hijacking := w.(http.Hijacker)
+	assert.False(t, hijacking)
+	assert.NoError(t, w.(http.Pusher).Push("/style.css", nil))
+}
+
+func TestModsecurity_SessionOverrideStreaming(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.SessionOverrideHeader = "X-Waf-Session"
+	config.SessionOverrideCookie = "sid"
+	flushed := make(chan struct{})
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte("second\n"))
+	}))
+	server := httptest.NewServer(middleware)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n", line, "the first chunk is received before the response completes")
+	close(flushed)
+	rest, _ := io.ReadAll(reader)
+	assert.Equal(t, "second\n", string(rest))
+}
+
+func TestModsecurity_SessionOverrideHijack(t *testing.T) {
+	middleware := newTestModsecurity(t, overrideWriterConfig(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello")
+		buf.Flush()
+	}))
+	server := httptest.NewServer(middleware)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	body, _ := io.ReadAll(reader)
+	assert.Equal(t, "hello", string(body), "the upgraded connection is handed over to the service")
+}
+
+func TestModsecurity_SessionOverridePartialContent(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := overrideWriterConfig()
+	config.ModSecurityUrl = wafServer.URL
+	content := strings.Repeat("0123456789", 100)
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, strings.NewReader(content))
+	}))
+	server := httptest.NewServer(middleware)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=500-509")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 500-509/1000", resp.Header.Get("Content-Range"))
+	assert.Equal(t, content[500:510], string(body), "ranged responses are passed through untouched")
+}
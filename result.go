@@ -0,0 +1,60 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+// InspectionResultKey is the request context key under which the outcome of the WAF inspection
+// is stored, for the middlewares and services running after this plugin.
+const InspectionResultKey contextKey = "modsecurity.inspection"
+
+// InspectionResult is the outcome of the WAF inspection of a request which was let through.
+type InspectionResult struct {
+	// Status is the status code answered by the WAF.
+	Status int
+	// Score is the anomaly score reported by the WAF, HasScore is false when it did not report one.
+	Score    float64
+	HasScore bool
+	// RuleIds are the IDs of the rules which triggered.
+	RuleIds []string
+	// BotScore is the score of the bot-detection service, HasBotScore is false when it is not enabled.
+	BotScore    float64
+	HasBotScore bool
+	// Asn is the autonomous system number of the client, zero when unknown.
+	Asn uint
+	// Country is the ISO 3166-1 code of the country of the client, empty when unknown.
+	Country string
+	// Risk is the risk score accumulated by the client.
+	Risk float64
+	// Flagged is true when the decision policy would have blocked the request, but it was let
+	// through anyway: detect mode, ignored rules or ignored WAF errors.
+	Flagged bool
+}
+
+func newInspectionResult(signals Signals, flagged bool) *InspectionResult {
+	return &InspectionResult{
+		Status:      signals.Status,
+		Score:       signals.Score,
+		HasScore:    signals.HasScore,
+		RuleIds:     signals.RuleIds,
+		BotScore:    signals.BotScore,
+		HasBotScore: signals.HasBotScore,
+		Asn:         signals.Asn,
+		Country:     signals.Country,
+		Risk:        signals.Risk,
+		Flagged:     flagged,
+	}
+}
+
+// InspectionResultFromContext returns the inspection result stored in ctx, if any.
+func InspectionResultFromContext(ctx context.Context) (*InspectionResult, bool) {
+	result, ok := ctx.Value(InspectionResultKey).(*InspectionResult)
+	return result, ok
+}
+
+func withInspectionResult(req *http.Request, result *InspectionResult) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), InspectionResultKey, result))
+}
@@ -0,0 +1,44 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_InspectionResultInContext(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Waf-Rule-Ids", "942100")
+		w.Header().Set("X-Waf-Anomaly-Score", "5")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.Mode = modeDetect
+
+	var result *InspectionResult
+	var ok bool
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, ok = InspectionResultFromContext(r.Context())
+	}))
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.True(t, ok)
+	assert.Equal(t, &InspectionResult{
+		Status:   http.StatusForbidden,
+		Score:    5,
+		HasScore: true,
+		RuleIds:  []string{"942100"},
+		Flagged:  true,
+	}, result)
+}
+
+func TestInspectionResultFromContext_Missing(t *testing.T) {
+	_, ok := InspectionResultFromContext(httptest.NewRequest(http.MethodGet, "/", nil).Context())
+	assert.False(t, ok)
+}
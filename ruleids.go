@@ -0,0 +1,43 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultRuleIdsHeader is the WAF response header listing the IDs of the rules which triggered.
+// The WAF has to be configured to set it, e.g. with a ModSecurity rule adding the matched rule IDs.
+const defaultRuleIdsHeader = "X-Waf-Rule-Ids"
+
+// ruleIds returns the IDs of the rules which triggered, parsed from the WAF response metadata.
+func (a *Modsecurity) ruleIds(resp *http.Response) []string {
+	var ids []string
+	for _, value := range resp.Header.Values(a.ruleIdsHeader) {
+		ids = append(ids, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+	return ids
+}
+
+// onlyIgnoredRules reports whether every rule which triggered is listed in ignoreRuleIds, or in
+// the ignored rule IDs of the exclusion packs of path. Verdicts without rule IDs are never ignored.
+func (a *Modsecurity) onlyIgnoredRules(path string, ids []string) bool {
+	if len(ids) == 0 || (len(a.ignoreRuleIds) == 0 && !a.exclusions.ignoresRules()) {
+		return false
+	}
+	for _, id := range ids {
+		if !a.ignoreRuleIds[id] && !a.exclusions.ignored(path, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRuleIdSet(ids []string) map[string]bool {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[strings.TrimSpace(id)] = true
+	}
+	return set
+}
@@ -0,0 +1,51 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ruleIds(t *testing.T) {
+	middleware := &Modsecurity{ruleIdsHeader: defaultRuleIdsHeader}
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Add(defaultRuleIdsHeader, "920350, 942100")
+	resp.Header.Add(defaultRuleIdsHeader, "949110")
+
+	assert.Equal(t, []string{"920350", "942100", "949110"}, middleware.ruleIds(resp))
+}
+
+func TestModsecurity_IgnoreRuleIds(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        string
+		expectStatus int
+	}{
+		{name: "Ignores verdicts triggered by ignored rules only", rules: "920350,949110", expectStatus: http.StatusOK},
+		{name: "Enforces verdicts triggered by other rules", rules: "920350,942100", expectStatus: http.StatusForbidden},
+		{name: "Enforces verdicts without rule IDs", expectStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if len(tt.rules) > 0 {
+					w.Header().Set(defaultRuleIdsHeader, tt.rules)
+				}
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.IgnoreRuleIds = []string{"920350", "949110"}
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// s3Archiver ships batches of audit events to an S3-compatible bucket, as gzipped JSON lines,
+// for long-term retention without a logging stack. Objects are named
+// <prefix><yyyy>/<mm>/<dd>/<time>-<seq>.jsonl.gz and uploaded with path-style requests.
+type s3Archiver struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	batchSize int
+	client    *http.Client
+	seq       int64
+
+	mu      sync.Mutex
+	pending []*auditEvent
+	full    chan struct{}
+}
+
+// s3ArchiveBuffer bounds the events kept when uploads fail, in batches.
+const s3ArchiveBuffer = 10
+
+func newS3Archiver(endpoint string, bucket string, prefix string, region string, accessKey string, secretKey string, batchSize int) (*s3Archiver, error) {
+	if len(endpoint) == 0 && len(bucket) == 0 {
+		return nil, nil
+	}
+	if len(endpoint) == 0 || len(bucket) == 0 {
+		return nil, fmt.Errorf("auditS3Endpoint and auditS3Bucket must be set together")
+	}
+	if len(accessKey) == 0 || len(secretKey) == 0 {
+		return nil, fmt.Errorf("auditS3AccessKey and auditS3SecretKey are required")
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("auditS3BatchSize must be positive")
+	}
+	return &s3Archiver{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		full:      make(chan struct{}, 1),
+	}, nil
+}
+
+// send implements eventSink. A full batch is uploaded right away, without waiting for the interval.
+func (s *s3Archiver) send(event *auditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= s.batchSize*s3ArchiveBuffer {
+		// uploads are failing, the oldest events are dropped
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, event)
+	if len(s.pending) >= s.batchSize {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runS3Archiver uploads the pending events every interval, or as soon as a batch is full,
+// until ctx is done.
+func (a *Modsecurity) runS3Archiver(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.s3Archiver.full:
+		}
+		a.flushS3Archiver()
+	}
+}
+
+// flushS3Archiver uploads all the pending events. Events of failed uploads are kept for the next attempt.
+func (a *Modsecurity) flushS3Archiver() {
+	for {
+		batch := a.s3Archiver.take()
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.s3Archiver.upload(batch, time.Now()); err != nil {
+			a.s3Archiver.restore(batch)
+			a.logSampled("audit_s3_upload_failed", logFields{"error": err.Error(), "events": len(batch)})
+			return
+		}
+	}
+}
+
+func (s *s3Archiver) take() []*auditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.pending)
+	if n > s.batchSize {
+		n = s.batchSize
+	}
+	batch := s.pending[:n:n]
+	s.pending = s.pending[n:]
+	return batch
+}
+
+func (s *s3Archiver) restore(batch []*auditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := append(batch, s.pending...)
+	if max := s.batchSize * s3ArchiveBuffer; len(pending) > max {
+		pending = pending[len(pending)-max:]
+	}
+	s.pending = pending
+}
+
+// upload writes batch as one gzipped JSON lines object.
+func (s *s3Archiver) upload(batch []*auditEvent, now time.Time) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	encoder := json.NewEncoder(gz)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	now = now.UTC()
+	key := fmt.Sprintf("%s%s/%s-%06d.jsonl.gz", s.prefix, now.Format("2006/01/02"), now.Format("20060102T150405Z"), atomic.AddInt64(&s.seq, 1))
+	req, err := http.NewRequest(http.MethodPut, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	signV4(req, s.accessKey, s.secretKey, s.region, "s3", sha256Hex(body.Bytes()), now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d uploading %s", resp.StatusCode, key)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeS3 struct {
+	mu      sync.Mutex
+	fail    bool
+	objects map[string][]auditEvent
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var events []auditEvent
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var event auditEvent
+		json.Unmarshal(scanner.Bytes(), &event)
+		events = append(events, event)
+	}
+	f.objects[r.URL.Path] = events
+}
+
+func (f *fakeS3) events() []auditEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var events []auditEvent
+	for _, object := range f.objects {
+		events = append(events, object...)
+	}
+	return events
+}
+
+func TestModsecurity_AuditS3Archive(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Waf-Rule-Ids", "942100")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+	s3 := &fakeS3{objects: map[string][]auditEvent{}}
+	s3Server := httptest.NewServer(s3)
+	defer s3Server.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.UserAgentDeny = []string{"sqlmap"}
+	config.AuditS3Endpoint = s3Server.URL
+	config.AuditS3Bucket = "audit"
+	config.AuditS3Prefix = "waf/"
+	config.AuditS3AccessKey = "AKID"
+	config.AuditS3SecretKey = "secret"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?id=1'", nil))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "sqlmap/1.5")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, s3.events(), "events are batched")
+
+	assert.NoError(t, middleware.Close())
+
+	assert.Len(t, s3.objects, 1)
+	for key := range s3.objects {
+		assert.True(t, strings.HasPrefix(key, "/audit/waf/"+time.Now().UTC().Format("2006/01/02")+"/"), key)
+		assert.True(t, strings.HasSuffix(key, ".jsonl.gz"), key)
+	}
+	events := s3.events()
+	assert.Len(t, events, 2)
+	assert.Equal(t, "waf_block", events[0].Event)
+	assert.Equal(t, []string{"942100"}, events[0].RuleIds)
+	assert.Equal(t, "local_block", events[1].Event)
+	assert.Equal(t, "user-agent denied", events[1].Reason)
+}
+
+func TestS3Archiver_keepsEventsOfFailedUploads(t *testing.T) {
+	s3 := &fakeS3{fail: true, objects: map[string][]auditEvent{}}
+	s3Server := httptest.NewServer(s3)
+	defer s3Server.Close()
+
+	archiver, err := newS3Archiver(s3Server.URL, "audit", "", "us-east-1", "AKID", "secret", 2)
+	assert.NoError(t, err)
+	middleware := &Modsecurity{s3Archiver: archiver, logSampler: newLogSampler(0, 0), logger: log.New(io.Discard, "", 0)}
+
+	for i := 0; i < 3; i++ {
+		archiver.send(&auditEvent{Event: "waf_block"})
+	}
+	select {
+	case <-archiver.full:
+	default:
+		t.Fatal("a full batch must trigger an upload")
+	}
+	middleware.flushS3Archiver()
+	assert.Len(t, archiver.pending, 3)
+
+	s3.mu.Lock()
+	s3.fail = false
+	s3.mu.Unlock()
+	middleware.flushS3Archiver()
+	assert.Len(t, archiver.pending, 0)
+	assert.Len(t, s3.events(), 3)
+	assert.Len(t, s3.objects, 2, "events are uploaded in batches of auditS3BatchSize")
+}
+
+func TestNewS3Archiver(t *testing.T) {
+	archiver, err := newS3Archiver("", "", "", "", "", "", 0)
+	assert.NoError(t, err)
+	assert.Nil(t, archiver)
+
+	_, err = newS3Archiver("http://s3", "", "", "", "", "", 10)
+	assert.Error(t, err)
+	_, err = newS3Archiver("http://s3", "audit", "", "", "", "", 10)
+	assert.Error(t, err)
+	_, err = newS3Archiver("http://s3", "audit", "", "", "AKID", "secret", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package traefik_modsecurity_plugin
+
+import "net/http"
+
+// redacted replaces sensitive values in everything the plugin writes outside of the request path.
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are never written in clear to dumps, exports and events.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// sanitizeHeader returns a copy of header where sensitive values, and the values of the extra
+// header names, are redacted.
+func sanitizeHeader(header http.Header, extra ...string) http.Header {
+	sanitized := header.Clone()
+	if sanitized == nil {
+		sanitized = http.Header{}
+	}
+	for _, name := range append(sensitiveHeaders, extra...) {
+		if len(name) == 0 {
+			continue
+		}
+		if values := sanitized.Values(name); len(values) > 0 {
+			masked := make([]string, len(values))
+			for i := range masked {
+				masked[i] = redacted
+			}
+			sanitized[http.CanonicalHeaderKey(name)] = masked
+		}
+	}
+	return sanitized
+}
@@ -0,0 +1,25 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeHeader(t *testing.T) {
+	header := http.Header{
+		"Authorization": []string{"Bearer token"},
+		"Cookie":        []string{"a=1", "b=2"},
+		"X-Trigger":     []string{"secret"},
+		"Accept":        []string{"*/*"},
+	}
+
+	sanitized := sanitizeHeader(header, "x-trigger")
+
+	assert.Equal(t, []string{redacted}, sanitized["Authorization"])
+	assert.Equal(t, []string{redacted, redacted}, sanitized["Cookie"])
+	assert.Equal(t, []string{redacted}, sanitized["X-Trigger"])
+	assert.Equal(t, []string{"*/*"}, sanitized["Accept"])
+	assert.Equal(t, "Bearer token", header.Get("Authorization"), "the original header must not be modified")
+}
@@ -0,0 +1,151 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Enforcement modes. In detect mode, block verdicts are logged but requests are forwarded to the service.
+const (
+	modeEnforce = "enforce"
+	modeDetect  = "detect"
+)
+
+// Schedule sets the enforcement mode during a time window, optionally restricted to some days
+// and to the requests whose path matches Path.
+type Schedule struct {
+	Path  string   `json:"path,omitempty" description:"path pattern of the schedule"`
+	Days  []string `json:"days,omitempty" description:"days of the week, every day when empty"`
+	Start string   `json:"start" description:"start time, HH:MM"`
+	End   string   `json:"end" description:"end time, HH:MM"`
+	Mode  string   `json:"mode" description:"mode during the time window"`
+}
+
+type compiledSchedule struct {
+	path *regexp.Regexp
+	days map[time.Weekday]bool
+	// start and end are minutes since midnight. A window with end before start spans midnight.
+	start int
+	end   int
+	mode  string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// enforcementSchedule decides the enforcement mode of each request: the mode of the first
+// schedule matching the request path and the current time, or the default mode.
+type enforcementSchedule struct {
+	defaultMode string
+	location    *time.Location
+	schedules   []compiledSchedule
+}
+
+func newEnforcementSchedule(defaultMode string, timezone string, schedules []Schedule) (*enforcementSchedule, error) {
+	if len(defaultMode) == 0 {
+		defaultMode = modeEnforce
+	}
+	if err := validateMode(defaultMode); err != nil {
+		return nil, err
+	}
+
+	location := time.Local
+	if len(timezone) > 0 {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid scheduleTimezone %q: %s", timezone, err.Error())
+		}
+	}
+
+	e := &enforcementSchedule{defaultMode: defaultMode, location: location}
+	for _, schedule := range schedules {
+		compiled, err := compileSchedule(schedule)
+		if err != nil {
+			return nil, err
+		}
+		e.schedules = append(e.schedules, compiled)
+	}
+	return e, nil
+}
+
+func compileSchedule(schedule Schedule) (compiledSchedule, error) {
+	compiled := compiledSchedule{mode: schedule.Mode}
+	if err := validateMode(schedule.Mode); err != nil {
+		return compiled, err
+	}
+	if len(schedule.Path) > 0 {
+		paths, err := compileRegexps("schedules", []string{schedule.Path})
+		if err != nil {
+			return compiled, err
+		}
+		compiled.path = paths[0]
+	}
+	if len(schedule.Days) > 0 {
+		compiled.days = make(map[time.Weekday]bool, len(schedule.Days))
+		for _, day := range schedule.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return compiled, fmt.Errorf("invalid schedule day %q, expected one of mon, tue, wed, thu, fri, sat, sun", day)
+			}
+			compiled.days[weekday] = true
+		}
+	}
+	var err error
+	if compiled.start, err = parseClock(schedule.Start); err != nil {
+		return compiled, err
+	}
+	if compiled.end, err = parseClock(schedule.End); err != nil {
+		return compiled, err
+	}
+	return compiled, nil
+}
+
+func validateMode(mode string) error {
+	if mode != modeEnforce && mode != modeDetect {
+		return fmt.Errorf("invalid mode %q, expected %s or %s", mode, modeEnforce, modeDetect)
+	}
+	return nil
+}
+
+// parseClock parses a HH:MM time of day into minutes since midnight.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule time %q, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// mode returns the enforcement mode of a request on path at time now.
+func (e *enforcementSchedule) mode(path string, now time.Time) string {
+	now = now.In(e.location)
+	minutes := now.Hour()*60 + now.Minute()
+	for _, schedule := range e.schedules {
+		if schedule.path != nil && !schedule.path.MatchString(path) {
+			continue
+		}
+		if schedule.days != nil && !schedule.days[now.Weekday()] {
+			continue
+		}
+		if schedule.contains(minutes) {
+			return schedule.mode
+		}
+	}
+	return e.defaultMode
+}
+
+func (s compiledSchedule) contains(minutes int) bool {
+	if s.start <= s.end {
+		return minutes >= s.start && minutes < s.end
+	}
+	return minutes >= s.start || minutes < s.end
+}
@@ -0,0 +1,65 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforcementSchedule_mode(t *testing.T) {
+	schedule, err := newEnforcementSchedule(modeEnforce, "UTC", []Schedule{
+		{Path: "^/shop", Days: []string{"sat", "sun"}, Start: "10:00", End: "18:00", Mode: modeDetect},
+		{Start: "22:00", End: "06:00", Mode: modeEnforce},
+		{Start: "09:00", End: "17:00", Mode: modeDetect},
+	})
+	assert.NoError(t, err)
+
+	// 2021-06-05 is a saturday
+	tests := []struct {
+		name   string
+		path   string
+		now    time.Time
+		expect string
+	}{
+		{name: "Weekend sales event", path: "/shop/cart", now: time.Date(2021, 6, 5, 12, 0, 0, 0, time.UTC), expect: modeDetect},
+		{name: "Weekend schedule on another path", path: "/account", now: time.Date(2021, 6, 5, 12, 0, 0, 0, time.UTC), expect: modeDetect},
+		{name: "Weekend evening", path: "/shop/cart", now: time.Date(2021, 6, 5, 19, 0, 0, 0, time.UTC), expect: modeEnforce},
+		{name: "Monday peak", path: "/shop/cart", now: time.Date(2021, 6, 7, 10, 0, 0, 0, time.UTC), expect: modeDetect},
+		{name: "Window spanning midnight", path: "/", now: time.Date(2021, 6, 7, 3, 0, 0, 0, time.UTC), expect: modeEnforce},
+		{name: "Outside every window", path: "/", now: time.Date(2021, 6, 7, 20, 0, 0, 0, time.UTC), expect: modeEnforce},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, schedule.mode(tt.path, tt.now))
+		})
+	}
+}
+
+func TestNewEnforcementSchedule_Invalid(t *testing.T) {
+	_, err := newEnforcementSchedule("block", "", nil)
+	assert.Error(t, err)
+	_, err = newEnforcementSchedule("", "", []Schedule{{Start: "9h", End: "17:00", Mode: modeDetect}})
+	assert.Error(t, err)
+	_, err = newEnforcementSchedule("", "", []Schedule{{Days: []string{"monday"}, Start: "09:00", End: "17:00", Mode: modeDetect}})
+	assert.Error(t, err)
+}
+
+func TestModsecurity_DetectMode(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.Mode = modeDetect
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
@@ -0,0 +1,98 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ConfigSchema returns the JSON schema of Config, with the defaults of CreateConfig and the
+// descriptions of the struct tags, so that tooling can validate the dynamic configuration of the
+// plugin. Nested option types are listed in its definitions.
+func ConfigSchema() ([]byte, error) {
+	definitions := map[string]interface{}{}
+	schema := structSchema(reflect.TypeOf(Config{}), reflect.ValueOf(*CreateConfig()), definitions)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "Traefik ModSecurity plugin configuration"
+	schema["definitions"] = definitions
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// structSchema returns the schema of the struct type t. When defaults is valid, its non-zero
+// fields are the defaults of the properties.
+func structSchema(t reflect.Type, defaults reflect.Value, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); len(tag) > 0 {
+			name = strings.Split(tag, ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+		property := typeSchema(field.Type, definitions)
+		if description := field.Tag.Get("description"); len(description) > 0 {
+			property["description"] = description
+		}
+		if defaults.IsValid() && !defaults.Field(i).IsZero() {
+			property["default"] = defaults.Field(i).Interface()
+		}
+		properties[name] = property
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// typeSchema returns the schema of t. Struct types are added to definitions and referenced.
+func typeSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), definitions)
+	case reflect.Struct:
+		if _, ok := definitions[t.Name()]; !ok {
+			// registered before being built, for recursive types
+			definitions[t.Name()] = nil
+			definitions[t.Name()] = structSchema(t, reflect.Value{}, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), definitions)}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// serveSchema answers the requests of schemaEndpoint with the configuration schema.
+func (a *Modsecurity) serveSchema(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "", http.StatusMethodNotAllowed)
+		return
+	}
+	schema, err := ConfigSchema()
+	if err != nil {
+		http.Error(rw, "", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/schema+json")
+	rw.Write(schema)
+}
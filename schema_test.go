@@ -0,0 +1,66 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigSchema(t *testing.T) {
+	raw, err := ConfigSchema()
+	assert.NoError(t, err)
+
+	var schema struct {
+		Properties           map[string]map[string]interface{} `json:"properties"`
+		AdditionalProperties bool                              `json:"additionalProperties"`
+	}
+	assert.NoError(t, json.Unmarshal(raw, &schema))
+	assert.False(t, schema.AdditionalProperties)
+	assert.Len(t, schema.Properties, len(configKeys()))
+
+	assert.Equal(t, map[string]interface{}{"type": "string", "description": "URL of the ModSecurity server"}, schema.Properties["modSecurityUrl"])
+	assert.Equal(t, "integer", schema.Properties["maxBodySize"]["type"])
+	assert.Equal(t, float64(10*1024*1024), schema.Properties["maxBodySize"]["default"])
+	assert.Equal(t, "2s", schema.Properties["wafTimeout"]["default"])
+	assert.Contains(t, schema.Properties, "interruptOnError")
+	assert.Equal(t, "array", schema.Properties["ignoreRuleIds"]["type"])
+	assert.Equal(t, map[string]interface{}{"type": "string"}, schema.Properties["ignoreRuleIds"]["items"])
+	assert.Equal(t, map[string]interface{}{"type": "string"}, schema.Properties["decoyHeaders"]["additionalProperties"])
+}
+
+func TestConfigSchema_Definitions(t *testing.T) {
+	raw, err := ConfigSchema()
+	assert.NoError(t, err)
+
+	var schema map[string]interface{}
+	assert.NoError(t, json.Unmarshal(raw, &schema))
+	properties := schema["properties"].(map[string]interface{})
+	definitions := schema["definitions"].(map[string]interface{})
+
+	assert.Equal(t, map[string]interface{}{"$ref": "#/definitions/DecisionConfig", "description": "policy deciding the block from the WAF signals"}, properties["decision"])
+	decision := definitions["DecisionConfig"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"$ref": "#/definitions/DecisionConfig"}, decision["policies"].(map[string]interface{})["items"])
+	asns := definitions["AsnPolicy"].(map[string]interface{})["properties"].(map[string]interface{})["asns"]
+	assert.Equal(t, map[string]interface{}{"type": "integer", "minimum": float64(0)}, asns.(map[string]interface{})["items"])
+}
+
+func TestModsecurity_SchemaEndpoint(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf"
+	config.SchemaEndpoint = "/.well-known/modsecurity-schema"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/.well-known/modsecurity-schema", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/schema+json", rw.Header().Get("Content-Type"))
+	expected, _ := ConfigSchema()
+	assert.Equal(t, string(expected), rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/.well-known/modsecurity-schema", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
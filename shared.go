@@ -0,0 +1,113 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// sharedRegistry holds the state and the background jobs shared by the middleware instances of
+// the Traefik process, by key. Instances with the same WAF URL and configuration, e.g. one per
+// router, share one state refreshed by a single job instead of running one job each.
+var sharedRegistry = struct {
+	sync.Mutex
+	groups map[string]*sharedGroup
+}{groups: map[string]*sharedGroup{}}
+
+// sharedGroup is the state shared by the members of a key. The first member runs the job, its
+// lifecycle stops it; when it is closed, the next member is elected and runs it.
+type sharedGroup struct {
+	value   interface{}
+	members []*sharedMember
+}
+
+type sharedMember struct {
+	lifecycle *lifecycle
+	job       func(ctx context.Context)
+	leading   bool
+}
+
+// sharedKey returns the key of the state of kind configured with config, for the WAF at wafUrl.
+func sharedKey(kind string, wafUrl string, config interface{}) string {
+	encoded, _ := json.Marshal(config)
+	return kind + " " + wafUrl + " " + string(encoded)
+}
+
+// share joins the group of key with value and job, and returns the value of the group: value for
+// its first member, the value of the first member otherwise. job runs in a single member at a
+// time and must only use the shared value.
+func (a *Modsecurity) share(key string, value interface{}, job func(ctx context.Context)) interface{} {
+	sharedRegistry.Lock()
+	defer sharedRegistry.Unlock()
+	group, ok := sharedRegistry.groups[key]
+	if !ok {
+		group = &sharedGroup{value: value}
+		sharedRegistry.groups[key] = group
+	}
+	member := &sharedMember{lifecycle: a.lifecycle, job: job}
+	group.members = append(group.members, member)
+	if len(group.members) == 1 {
+		member.lead()
+	}
+	a.lifecycle.onClose(func() {
+		leaveShared(key, member)
+	})
+	return group.value
+}
+
+// leaveShared removes member from the group of key, electing the next member when it was
+// running the job. The group is dropped with its last member.
+func leaveShared(key string, member *sharedMember) {
+	sharedRegistry.Lock()
+	defer sharedRegistry.Unlock()
+	group := sharedRegistry.groups[key]
+	if group == nil {
+		return
+	}
+	for i, m := range group.members {
+		if m == member {
+			group.members = append(group.members[:i:i], group.members[i+1:]...)
+			break
+		}
+	}
+	if len(group.members) == 0 {
+		delete(sharedRegistry.groups, key)
+		return
+	}
+	if !member.leading {
+		return
+	}
+	for _, next := range group.members {
+		// members being closed stop their jobs right away, they will leave too
+		if next.lifecycle.ctx.Err() == nil && next.lead() {
+			return
+		}
+	}
+}
+
+// lead runs the job of the group in the lifecycle of m. The registry lock is held. It reports
+// false when m is being closed and can't run it.
+func (m *sharedMember) lead() bool {
+	if m.job != nil && !m.lifecycle.goBackground(m.job) {
+		return false
+	}
+	m.leading = true
+	return true
+}
+
+// shareClientTracker replaces the client state of a, its bans included, with the one shared by
+// the middlewares using the same WAF, expired by a single janitor.
+func (a *Modsecurity) shareClientTracker(janitor func(ctx context.Context)) {
+	shared := a.share(sharedKey("clientTracker", a.modSecurityUrl, nil), a.clientTracker, janitor).(*clientTracker)
+	if shared != a.clientTracker {
+		// a is not running the janitor, which reads a.clientTracker
+		a.clientTracker = shared
+	}
+}
+
+// shareVerdictCache replaces the verdict cache of a with the one shared by the middlewares with
+// the same configuration: nearly every option changes the copy of the requests sent to the WAF or
+// its verdict, a verdict is only reused by the middlewares which would have gotten it.
+func (a *Modsecurity) shareVerdictCache(config *Config) {
+	a.verdictCache = a.share(sharedKey("verdictCache", a.modSecurityUrl, config), a.verdictCache, nil).(*verdictCache)
+}
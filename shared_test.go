@@ -0,0 +1,148 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShare(t *testing.T) {
+	var running int64
+	job := func(ctx context.Context) {
+		atomic.AddInt64(&running, 1)
+		<-ctx.Done()
+		atomic.AddInt64(&running, -1)
+	}
+	first := &Modsecurity{lifecycle: newLifecycle(context.Background(), time.Second), httpClient: &http.Client{}}
+	second := &Modsecurity{lifecycle: newLifecycle(context.Background(), time.Second), httpClient: &http.Client{}}
+	waitRunning := func() {
+		for i := 0; i < 100 && atomic.LoadInt64(&running) == 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	assert.Equal(t, "first", first.share("test-share", "first", job))
+	assert.Equal(t, "first", second.share("test-share", "second", job), "the value of the first member is shared")
+	waitRunning()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&running), "a single member runs the job")
+
+	first.Close()
+	waitRunning()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&running), "the next member runs the job once the first one is closed")
+	second.Close()
+	assert.Equal(t, int64(0), atomic.LoadInt64(&running))
+
+	sharedRegistry.Lock()
+	_, ok := sharedRegistry.groups["test-share"]
+	sharedRegistry.Unlock()
+	assert.False(t, ok, "the group is dropped with its last member")
+}
+
+func TestModsecurity_SharedThreatFeeds(t *testing.T) {
+	downloads := int64(0)
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&downloads, 1)
+		w.Write([]byte("203.0.113.0/24\n"))
+	}))
+	defer feedServer.Close()
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ThreatFeeds = []ThreatFeed{
+		{Name: "drop", File: writeThreatFeed(t, "192.0.2.0/24\n")},
+		{Name: "abuse", Url: feedServer.URL},
+	}
+	first := newTestModsecurity(t, config, http.NotFoundHandler())
+	defer first.Close()
+	second := newTestModsecurity(t, config, http.NotFoundHandler())
+	defer second.Close()
+	assert.Same(t, first.threatFeeds, second.threatFeeds)
+	for i := 0; i < 100 && !second.threatFeeds.feeds[1].matches(net.ParseIP("203.0.113.1"), nil); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&downloads), "the feed is downloaded once")
+
+	config.ThreatFeeds[0].File = writeThreatFeed(t, "198.51.100.0/24\n")
+	other := newTestModsecurity(t, config, http.NotFoundHandler())
+	defer other.Close()
+	assert.NotSame(t, first.threatFeeds, other.threatFeeds, "instances configured differently don't share their feeds")
+}
+
+func TestModsecurity_ShareState(t *testing.T) {
+	wafCalls := int64(0)
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&wafCalls, 1)
+		w.Header().Set("X-Waf-Cache-Ttl", "60")
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.HoneypotPaths = []string{`^/\.git/`}
+	config.VerdictCacheHeader = "X-Waf-Cache-Ttl"
+	config.ShareState = true
+	api := newTestModsecurity(t, config, http.NotFoundHandler())
+	defer api.Close()
+	shop := newTestModsecurity(t, config, http.NotFoundHandler())
+	defer shop.Close()
+	config.ParanoiaLevel = 4
+	strict := newTestModsecurity(t, config, http.NotFoundHandler())
+	defer strict.Close()
+	config.ParanoiaLevel = 0
+	config.ShareState = false
+	isolated := newTestModsecurity(t, config, http.NotFoundHandler())
+	defer isolated.Close()
+
+	serve := func(middleware *Modsecurity, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusNotFound, serve(api, "/logo.png"))
+	assert.Equal(t, http.StatusNotFound, serve(shop, "/logo.png"))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&wafCalls), "the verdict cached by one middleware is reused by the other")
+	assert.Equal(t, http.StatusNotFound, serve(strict, "/logo.png"))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&wafCalls), "the verdicts are not shared with a middleware inspecting differently")
+
+	serve(api, "/.git/config")
+	assert.Equal(t, http.StatusForbidden, serve(shop, "/"), "a client banned by one middleware is banned by the other")
+	assert.Equal(t, http.StatusNotFound, serve(isolated, "/"), "the state is only shared with shareState")
+}
+
+func TestShare_skipsClosingMembers(t *testing.T) {
+	var leader int32
+	jobOf := func(id int32) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			atomic.StoreInt32(&leader, id)
+			<-ctx.Done()
+		}
+	}
+	members := make([]*Modsecurity, 3)
+	for i := range members {
+		members[i] = &Modsecurity{lifecycle: newLifecycle(context.Background(), time.Second), httpClient: &http.Client{}}
+		members[i].share("test-share-closing", nil, jobOf(int32(i+1)))
+	}
+	// the second member started closing, its context is not cancelled yet
+	members[1].lifecycle.mu.Lock()
+	members[1].lifecycle.closing = true
+	members[1].lifecycle.mu.Unlock()
+
+	members[0].Close()
+	for i := 0; i < 100 && atomic.LoadInt32(&leader) != 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&leader), "a member being closed is not elected")
+	assert.False(t, members[1].lifecycle.goBackground(jobOf(2)), "no goroutine starts once Close started")
+	members[1].Close()
+	members[2].Close()
+}
@@ -0,0 +1,134 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lifecycle tracks what a middleware instance has to stop or wait for when Traefik discards it
+// on a dynamic configuration reload: background goroutines, in-flight WAF calls and the hooks
+// flushing asynchronous queues.
+type lifecycle struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	background   sync.WaitGroup
+	drainTimeout time.Duration
+	closeOnce    sync.Once
+	closeErr     error
+
+	mu       sync.Mutex
+	closing  bool
+	inFlight int
+	idle     chan struct{}
+	hooks    []func()
+}
+
+func newLifecycle(parent context.Context, drainTimeout time.Duration) *lifecycle {
+	ctx, cancel := context.WithCancel(parent)
+	return &lifecycle{ctx: ctx, cancel: cancel, drainTimeout: drainTimeout}
+}
+
+// goBackground runs fn in a goroutine stopped by Close. fn must return once ctx is done. It
+// reports false, without running fn, once Close started: Close may already be waiting for the
+// background goroutines.
+func (l *lifecycle) goBackground(fn func(ctx context.Context)) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return false
+	}
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		fn(l.ctx)
+	}()
+	return true
+}
+
+// onClose registers hook to run on Close, once background goroutines stopped and in-flight
+// WAF calls drained. Hooks run in registration order.
+func (l *lifecycle) onClose(hook func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, hook)
+}
+
+// begin records the start of a WAF call, end its completion.
+func (l *lifecycle) begin() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight++
+}
+
+func (l *lifecycle) end() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.inFlight == 0 && l.idle != nil {
+		close(l.idle)
+		l.idle = nil
+	}
+}
+
+// drain waits for the in-flight WAF calls to complete, at most drainTimeout.
+// It returns the number of calls still in flight.
+func (l *lifecycle) drain() int {
+	l.mu.Lock()
+	if l.inFlight == 0 {
+		l.mu.Unlock()
+		return 0
+	}
+	idle := make(chan struct{})
+	l.idle = idle
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return 0
+	case <-timer.C:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.inFlight
+	}
+}
+
+// Close stops the background goroutines of the middleware, waits for the in-flight WAF calls to
+// complete and flushes the asynchronous queues. It is also called when the context given to New
+// is done. Requests keep being served after Close, without the background work.
+func (a *Modsecurity) Close() error {
+	a.lifecycle.closeOnce.Do(func() {
+		a.lifecycle.mu.Lock()
+		a.lifecycle.closing = true
+		a.lifecycle.mu.Unlock()
+		a.lifecycle.cancel()
+		a.lifecycle.background.Wait()
+		if pending := a.lifecycle.drain(); pending > 0 {
+			a.lifecycle.closeErr = fmt.Errorf("%d WAF calls still in flight after %s", pending, a.lifecycle.drainTimeout)
+			a.logEvent("shutdown_drain_timeout", logFields{"in_flight": pending})
+		}
+
+		a.lifecycle.mu.Lock()
+		hooks := a.lifecycle.hooks
+		a.lifecycle.mu.Unlock()
+		for _, hook := range hooks {
+			hook()
+		}
+		a.httpClient.CloseIdleConnections()
+	})
+	return a.lifecycle.closeErr
+}
+
+// closeOnDone calls Close once the context given to New is done.
+func (a *Modsecurity) closeOnDone(parent context.Context) {
+	if parent.Done() == nil {
+		return
+	}
+	go func() {
+		<-a.lifecycle.ctx.Done()
+		a.Close()
+	}()
+}
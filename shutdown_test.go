@@ -0,0 +1,96 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_CloseDrainsInFlightCalls(t *testing.T) {
+	release := make(chan struct{})
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	served := make(chan struct{})
+	go func() {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(served)
+	}()
+	for {
+		middleware.lifecycle.mu.Lock()
+		inFlight := middleware.lifecycle.inFlight
+		middleware.lifecycle.mu.Unlock()
+		if inFlight == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var hooked int32
+	middleware.lifecycle.onClose(func() { atomic.StoreInt32(&hooked, 1) })
+	closed := make(chan error)
+	go func() { closed <- middleware.Close() }()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the in-flight WAF call completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-closed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hooked))
+	<-served
+}
+
+func TestModsecurity_CloseDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer wafServer.Close()
+	defer close(release)
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ShutdownTimeout = "20ms"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	middleware.lifecycle.begin()
+	defer middleware.lifecycle.end()
+
+	assert.EqualError(t, middleware.Close(), "1 WAF calls still in flight after 20ms")
+	assert.EqualError(t, middleware.Close(), "1 WAF calls still in flight after 20ms", "Close is idempotent")
+}
+
+func TestModsecurity_ClosedWithContext(t *testing.T) {
+	var pings int32
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pings, 1)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.WarmConnections = 1
+	config.WarmIdleInterval = "5ms"
+	ctx, cancel := context.WithCancel(context.Background())
+	handler, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity")
+	assert.NoError(t, err)
+	middleware := handler.(*Modsecurity)
+
+	cancel()
+	middleware.lifecycle.background.Wait()
+	stopped := atomic.LoadInt32(&pings)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&pings), "the warmer must stop with the context")
+}
@@ -0,0 +1,62 @@
+package traefik_modsecurity_plugin
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// errBodyTooSlow stops the body buffering of clients trickling bytes.
+var errBodyTooSlow = errors.New("request body read too slowly")
+
+// slowBodyGracePeriod is how long a body can be read before bodyMinRate is enforced, so that
+// the first bytes, e.g. after a 100-continue, don't count against the client.
+const slowBodyGracePeriod = 2 * time.Second
+
+// slowBodyReader fails with errBodyTooSlow when the body is read slower than minRate bytes per
+// second after slowBodyGracePeriod, or for longer than maxDuration. The checks run whenever a
+// read returns, so a client sending nothing at all is only bounded by the read timeout of the
+// entrypoint. Once released, the reader no longer checks, e.g. while the remainder of a truncated
+// body streams to the service.
+type slowBodyReader struct {
+	body        io.Reader
+	minRate     int64
+	maxDuration time.Duration
+	start       time.Time
+	read        int64
+	released    bool
+}
+
+// limitBodyRate wraps body with the read-rate checks, when they are configured.
+func (a *Modsecurity) limitBodyRate(body io.Reader) *slowBodyReader {
+	if a.bodyMinRate <= 0 && a.bodyReadTimeout <= 0 {
+		return nil
+	}
+	return &slowBodyReader{body: body, minRate: a.bodyMinRate, maxDuration: a.bodyReadTimeout, start: time.Now()}
+}
+
+func (r *slowBodyReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if r.released {
+		return n, err
+	}
+	r.read += int64(n)
+	if err == io.EOF {
+		return n, err
+	}
+	elapsed := time.Since(r.start)
+	if r.maxDuration > 0 && elapsed > r.maxDuration {
+		return n, errBodyTooSlow
+	}
+	if r.minRate > 0 && elapsed > slowBodyGracePeriod && float64(r.read) < float64(r.minRate)*elapsed.Seconds() {
+		return n, errBodyTooSlow
+	}
+	return n, err
+}
+
+// release disables the checks once the body is buffered.
+func (r *slowBodyReader) release() {
+	if r != nil {
+		r.released = true
+	}
+}
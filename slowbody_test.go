@@ -0,0 +1,83 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tricklingReader returns one byte of body per read, after delay.
+type tricklingReader struct {
+	body  string
+	delay time.Duration
+}
+
+func (r *tricklingReader) Read(p []byte) (int, error) {
+	if len(r.body) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	p[0] = r.body[0]
+	r.body = r.body[1:]
+	return 1, nil
+}
+
+func TestSlowBodyReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		minRate     int64
+		maxDuration time.Duration
+		elapsed     time.Duration
+		expect      error
+	}{
+		{name: "Fast enough", body: "0123456789", minRate: 2, elapsed: 3 * time.Second},
+		{name: "Too slow", body: "0123456789", minRate: 10, elapsed: 3 * time.Second, expect: errBodyTooSlow},
+		{name: "Slow within the grace period", body: "0123456789", minRate: 10, elapsed: time.Second},
+		{name: "Within the maximum duration", body: "0123456789", maxDuration: time.Minute, elapsed: 3 * time.Second},
+		{name: "Over the maximum duration", body: "0123456789", maxDuration: time.Second, elapsed: 3 * time.Second, expect: errBodyTooSlow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &slowBodyReader{body: strings.NewReader(tt.body), minRate: tt.minRate, maxDuration: tt.maxDuration, start: time.Now().Add(-tt.elapsed)}
+			_, err := ioutil.ReadAll(r)
+			assert.Equal(t, tt.expect, err)
+		})
+	}
+
+	r := &slowBodyReader{body: strings.NewReader("0123456789"), maxDuration: time.Second, start: time.Now().Add(-time.Minute)}
+	r.release()
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(b))
+}
+
+func TestModsecurity_BodyReadTimeout(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.BodyReadTimeout = "50ms"
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", &tricklingReader{body: "0123456789", delay: 20 * time.Millisecond}))
+	assert.Equal(t, http.StatusRequestTimeout, rw.Code)
+	assert.Equal(t, "close", rw.Header().Get("Connection"))
+	assert.Equal(t, 0, wafCalls)
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789")))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 1, wafCalls)
+}
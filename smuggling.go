@@ -0,0 +1,101 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Values accepted in smugglingPolicy.
+const (
+	smugglingPolicyOff    = "off"
+	smugglingPolicyLog    = "log"
+	smugglingPolicyReject = "reject"
+)
+
+// smuggledRequestLine matches a request line embedded in a body, the payload of a request
+// smuggled behind a front-end that disagrees with the back-end on the end of the body.
+var smuggledRequestLine = regexp.MustCompile(`(?m)^(?:GET|HEAD|POST|PUT|DELETE|OPTIONS|PATCH|TRACE|CONNECT) \S+ HTTP/\d(?:\.\d)?\r?$`)
+
+// chunkedBodyStart and chunkedBodyEnd match the first chunk size line and the last chunk of a
+// body framed with chunked encoding, sent with a Content-Length.
+var (
+	chunkedBodyStart = regexp.MustCompile(`^[0-9a-fA-F]+(?:;[^\r\n]*)?\r?\n`)
+	chunkedBodyEnd   = regexp.MustCompile(`\n0(?:;[^\r\n]*)?\r?\n\r?\n`)
+)
+
+// malformedChunkExtension matches a chunk size line whose extension ends with a bare CR or LF or
+// holds a NUL byte. Servers parse these leniently and disagree on where the chunk starts.
+var malformedChunkExtension = regexp.MustCompile(`(?m)^[0-9a-fA-F]+[ \t]*;[^\r\n\x00]*(?:\r[^\n]|\x00|\n)`)
+
+func validateSmugglingPolicy(policy string) error {
+	switch policy {
+	case "", smugglingPolicyOff, smugglingPolicyLog, smugglingPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("invalid smugglingPolicy %q, expected %s, %s or %s", policy, smugglingPolicyOff, smugglingPolicyLog, smugglingPolicyReject)
+}
+
+// smugglingHeaderSuspicion returns why the framing headers of req look like a request smuggling
+// attempt, or "" when they don't.
+func smugglingHeaderSuspicion(req *http.Request) string {
+	contentLengths := req.Header["Content-Length"]
+	if len(contentLengths) > 1 || (len(contentLengths) == 1 && strings.Contains(contentLengths[0], ",")) {
+		return "duplicate Content-Length"
+	}
+	for _, value := range contentLengths {
+		if len(value) == 0 || strings.Trim(value, "0123456789") != "" {
+			return "malformed Content-Length"
+		}
+	}
+	if len(req.TransferEncoding) > 0 && len(contentLengths) > 0 {
+		return "Content-Length with Transfer-Encoding"
+	}
+	if len(req.TransferEncoding) > 1 || (len(req.TransferEncoding) == 1 && req.TransferEncoding[0] != "chunked") || len(req.Header["Transfer-Encoding"]) > 0 {
+		return "unexpected Transfer-Encoding"
+	}
+	for name := range req.Header {
+		if name == "Content-Length" || name == "Transfer-Encoding" {
+			continue
+		}
+		// back-ends mapping _ to - or trimming spaces would read these as framing headers
+		normalized := strings.ToLower(strings.TrimSpace(strings.Replace(name, "_", "-", -1)))
+		if normalized == "content-length" || normalized == "transfer-encoding" {
+			return "obfuscated framing header " + name
+		}
+	}
+	return ""
+}
+
+// smugglingBodySuspicion returns why the first bytes of the body of req look like a request
+// smuggling payload, or "" when they don't.
+func smugglingBodySuspicion(req *http.Request, body []byte) string {
+	if smuggledRequestLine.Match(body) {
+		return "request line in body"
+	}
+	if len(req.TransferEncoding) > 0 || !chunkedBodyEnd.Match(body) {
+		return ""
+	}
+	if malformedChunkExtension.Match(body) {
+		return "malformed chunk extension in body"
+	}
+	if chunkedBodyStart.Match(body) {
+		return "chunked framing in body"
+	}
+	return ""
+}
+
+// suspectSmuggling applies smugglingPolicy when reason is set. It reports whether req was
+// rejected.
+func (a *Modsecurity) suspectSmuggling(rw http.ResponseWriter, req *http.Request, reason string) bool {
+	if len(reason) == 0 {
+		return false
+	}
+	if a.smugglingPolicy == smugglingPolicyLog {
+		a.logSampled("smuggling_suspected", a.requestFields(req, logFields{"reason": reason}))
+		return false
+	}
+	a.blockLocally(rw, req, "request smuggling suspected: "+reason, http.StatusBadRequest)
+	return true
+}
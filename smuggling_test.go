@@ -0,0 +1,115 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSmugglingPolicy(t *testing.T) {
+	for _, policy := range []string{"", smugglingPolicyOff, smugglingPolicyLog, smugglingPolicyReject} {
+		assert.NoError(t, validateSmugglingPolicy(policy))
+	}
+	assert.EqualError(t, validateSmugglingPolicy("block"), `invalid smugglingPolicy "block", expected off, log or reject`)
+}
+
+func TestSmugglingHeaderSuspicion(t *testing.T) {
+	tests := []struct {
+		name             string
+		headers          http.Header
+		transferEncoding []string
+		expect           string
+	}{
+		{name: "Content-Length", headers: http.Header{"Content-Length": {"12"}}},
+		{name: "Chunked", transferEncoding: []string{"chunked"}},
+		{name: "Duplicate Content-Length", headers: http.Header{"Content-Length": {"12", "12"}}, expect: "duplicate Content-Length"},
+		{name: "Content-Length list", headers: http.Header{"Content-Length": {"12, 13"}}, expect: "duplicate Content-Length"},
+		{name: "Signed Content-Length", headers: http.Header{"Content-Length": {"+12"}}, expect: "malformed Content-Length"},
+		{name: "Content-Length with Transfer-Encoding", headers: http.Header{"Content-Length": {"12"}}, transferEncoding: []string{"chunked"}, expect: "Content-Length with Transfer-Encoding"},
+		{name: "Stacked Transfer-Encoding", transferEncoding: []string{"gzip", "chunked"}, expect: "unexpected Transfer-Encoding"},
+		{name: "Leftover Transfer-Encoding header", headers: http.Header{"Transfer-Encoding": {"xchunked"}}, expect: "unexpected Transfer-Encoding"},
+		{name: "Underscore", headers: http.Header{"Transfer_encoding": {"chunked"}}, expect: "obfuscated framing header Transfer_encoding"},
+		{name: "Trailing space", headers: http.Header{"Content-Length ": {"0"}}, expect: "obfuscated framing header Content-Length "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header = tt.headers
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			req.TransferEncoding = tt.transferEncoding
+			assert.Equal(t, tt.expect, smugglingHeaderSuspicion(req))
+		})
+	}
+}
+
+func TestSmugglingBodySuspicion(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		expect  string
+	}{
+		{name: "Form", body: "user=john&password=secret"},
+		{name: "Text mentioning a method", body: "please GET the report"},
+		{name: "Pipelined request", body: "0\r\n\r\nGET /admin HTTP/1.1\r\nHost: example.com\r\n\r\n", expect: "request line in body"},
+		{name: "Chunked framing", body: "5\r\nhello\r\n0\r\n\r\n", expect: "chunked framing in body"},
+		{name: "Chunked framing of a chunked request", body: "5\r\nhello\r\n0\r\n\r\n", chunked: true},
+		{name: "Bare LF in chunk extension", body: "5;ext\nhello\r\n0\r\n\r\n", expect: "malformed chunk extension in body"},
+		{name: "Bare CR in chunk extension", body: "5;ext\rx\r\nhello\r\n0\r\n\r\n", expect: "malformed chunk extension in body"},
+		{name: "Hex words without terminator", body: "fade;\nbead;\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.chunked {
+				req.TransferEncoding = []string{"chunked"}
+			}
+			assert.Equal(t, tt.expect, smugglingBodySuspicion(req, []byte(tt.body)))
+		})
+	}
+}
+
+func TestModsecurity_SmugglingPolicy(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer wafServer.Close()
+
+	tests := []struct {
+		policy    string
+		expect    int
+		wafCalled bool
+	}{
+		{policy: smugglingPolicyOff, expect: http.StatusOK, wafCalled: true},
+		{policy: smugglingPolicyLog, expect: http.StatusOK, wafCalled: true},
+		{policy: smugglingPolicyReject, expect: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.SmugglingPolicy = tt.policy
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			for _, req := range []*http.Request{
+				httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0\r\n\r\nGET /admin HTTP/1.1\r\n\r\n")),
+				httptest.NewRequest(http.MethodGet, "/", nil),
+			} {
+				if req.Method == http.MethodGet {
+					req.Header.Set("Content_Length", "0")
+				}
+				wafCalls = 0
+				rw := httptest.NewRecorder()
+				middleware.ServeHTTP(rw, req)
+				assert.Equal(t, tt.expect, rw.Code)
+				assert.Equal(t, tt.wafCalled, wafCalls > 0)
+			}
+		})
+	}
+}
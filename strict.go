@@ -0,0 +1,136 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// legacyConfigKeys maps the deprecated spellings of option keys to the current ones. Every option
+// key is lowerCamelCase, these options were first documented in PascalCase.
+var legacyConfigKeys = map[string]string{
+	"InterruptOnError": "interruptOnError",
+	"Ignore500Error":   "ignore500Error",
+}
+
+// UnmarshalJSON decodes the configuration like encoding/json, collecting the keys which are not
+// spelled exactly like an option into UnknownFields. encoding/json matches keys regardless of
+// their case, so these keys may still have been applied. Legacy spellings are honored and recorded
+// to be reported as deprecated. The options set are recorded, for the profiles.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	keys := configKeys()
+	c.setKeys = make(map[string]bool, len(fields))
+	for key, value := range fields {
+		if keys[key] {
+			c.setKeys[key] = true
+			continue
+		}
+		if current, ok := legacyConfigKeys[key]; ok {
+			c.setKeys[current] = true
+			c.legacyKeys = append(c.legacyKeys, key)
+			continue
+		}
+		if option := foldedConfigKey(key, keys); len(option) > 0 {
+			c.setKeys[option] = true
+		}
+		if c.UnknownFields == nil {
+			c.UnknownFields = make(map[string]interface{})
+		}
+		c.UnknownFields[key] = value
+	}
+	return nil
+}
+
+// foldedConfigKey returns the option encoding/json decodes key into, "" when there is none.
+func foldedConfigKey(key string, keys map[string]bool) string {
+	for option := range keys {
+		if strings.EqualFold(option, key) {
+			return option
+		}
+	}
+	return ""
+}
+
+// configKeys returns the keys of the configuration options.
+func configKeys() map[string]bool {
+	t := reflect.TypeOf(Config{})
+	keys := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; len(name) > 0 && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
+
+// unknownFieldsError describes the unknown keys of the configuration, with the option each one
+// is likely a typo of.
+func unknownFieldsError(fields map[string]interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	keys := configKeys()
+	unknown := make([]string, 0, len(fields))
+	for field := range fields {
+		if suggestion := closestConfigKey(field, keys); len(suggestion) > 0 {
+			unknown = append(unknown, fmt.Sprintf("%s (did you mean %s?)", field, suggestion))
+		} else {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown configuration keys: %s", strings.Join(unknown, ", "))
+}
+
+// closestConfigKey returns the option spelled like field regardless of case, or within two edits
+// of it, or "" when none is close.
+func closestConfigKey(field string, keys map[string]bool) string {
+	best, bestDistance := "", 3
+	for key := range keys {
+		if strings.EqualFold(key, field) {
+			return key
+		}
+		if distance := editDistance(strings.ToLower(key), strings.ToLower(field)); distance < bestDistance || (distance == bestDistance && len(best) > 0 && key < best) {
+			best, bestDistance = key, distance
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,78 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_UnmarshalJSON(t *testing.T) {
+	config := CreateConfig()
+	err := json.Unmarshal([]byte(`{"modsecurityUrl": "http://waf", "maxBodySize": 1024, "wafTimout": "1s", "InterruptOnError": false}`), config)
+	assert.NoError(t, err)
+
+	// encoding/json matches keys regardless of case
+	assert.Equal(t, "http://waf", config.ModSecurityUrl)
+	assert.Equal(t, int64(1024), config.MaxBodySize)
+	assert.False(t, config.InterruptOnError)
+	assert.Equal(t, "2s", config.WafTimeout)
+	assert.Equal(t, map[string]interface{}{"modsecurityUrl": "http://waf", "wafTimout": "1s"}, config.UnknownFields)
+	assert.Equal(t, []string{"InterruptOnError"}, config.legacyKeys)
+}
+
+func TestConfig_UnmarshalJSONLegacyKeys(t *testing.T) {
+	tests := []struct {
+		name             string
+		json             string
+		expectInterrupt  bool
+		expectIgnore500  bool
+		expectLegacyKeys []string
+	}{
+		{name: "Current keys", json: `{"interruptOnError": false, "ignore500Error": true}`, expectIgnore500: true},
+		{name: "Legacy keys", json: `{"InterruptOnError": false, "Ignore500Error": true}`, expectIgnore500: true, expectLegacyKeys: []string{"Ignore500Error", "InterruptOnError"}},
+		{name: "Defaults", json: `{}`, expectInterrupt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			assert.NoError(t, json.Unmarshal([]byte(tt.json), config))
+			assert.Equal(t, tt.expectInterrupt, config.InterruptOnError)
+			assert.Equal(t, tt.expectIgnore500, config.Ignore500Error)
+			sort.Strings(config.legacyKeys)
+			assert.Equal(t, tt.expectLegacyKeys, config.legacyKeys)
+			assert.Empty(t, config.UnknownFields)
+		})
+	}
+}
+
+func TestUnknownFieldsError(t *testing.T) {
+	assert.NoError(t, unknownFieldsError(nil))
+
+	err := unknownFieldsError(map[string]interface{}{"modsecurityUrl": "", "wafTimout": "", "colour": ""})
+	assert.EqualError(t, err, "unknown configuration keys: colour, modsecurityUrl (did you mean modSecurityUrl?), wafTimout (did you mean wafTimeout?)")
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("mode", "mode"))
+	assert.Equal(t, 1, editDistance("wafTimout", "wafTimeout"))
+	assert.Equal(t, 2, editDistance("ab", "ba"))
+	assert.Equal(t, 3, editDistance("", "abc"))
+}
+
+func TestNew_StrictConfig(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf"
+	config.UnknownFields = map[string]interface{}{"wafTimout": "1s"}
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.NoError(t, err)
+	assert.NoError(t, handler.(*Modsecurity).Close())
+
+	config.StrictConfig = true
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.EqualError(t, err, "unknown configuration keys: wafTimout (did you mean wafTimeout?)")
+}
@@ -0,0 +1,326 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Types and actions accepted in threatFeeds.
+const (
+	threatFeedTypeIP     = "ip"
+	threatFeedTypeDomain = "domain"
+
+	threatFeedActionBlock = "block"
+	threatFeedActionScore = "score"
+)
+
+// defaultThreatFeedHeader is the request header listing the score feeds matching the request, for
+// the WAF and the service. A value sent by the client is never trusted.
+const defaultThreatFeedHeader = "X-Threat-Feeds"
+
+// threatFeedMaxSize bounds the size of a feed file or download.
+const threatFeedMaxSize = 64 * 1024 * 1024
+
+// ThreatFeed is a reputation feed, loaded from File or downloaded from Url: one IP address or range,
+// or one domain, per line. Anything after the first space, tab, comma or semicolon is ignored, as
+// are the lines starting with # or ;, so that Spamhaus DROP lists or AbuseIPDB exports load as is.
+type ThreatFeed struct {
+	Name   string  `json:"name,omitempty" description:"name of the feed in the logs and headers"`
+	File   string  `json:"file,omitempty" description:"feed file"`
+	Url    string  `json:"url,omitempty" description:"feed URL"`
+	Type   string  `json:"type,omitempty" description:"ip or domain"`
+	Action string  `json:"action,omitempty" description:"block or score"`
+	Score  float64 `json:"score,omitempty" description:"risk added to the requests matching a score feed"`
+}
+
+// threatFeed is a loaded ThreatFeed. entries holds a *threatFeedEntries, replaced on every refresh.
+type threatFeed struct {
+	ThreatFeed
+	entries atomic.Value
+}
+
+type threatFeedEntries struct {
+	ips     ipSet
+	domains map[string]bool
+}
+
+// threatFeeds looks up the clients, and the domains of the Referer and Origin headers, in
+// reputation feeds before the WAF inspection.
+type threatFeeds struct {
+	feeds           []*threatFeed
+	header          string
+	refreshInterval time.Duration
+	client          *http.Client
+}
+
+func newThreatFeeds(feeds []ThreatFeed, header string, refreshInterval time.Duration) (*threatFeeds, error) {
+	if len(feeds) == 0 {
+		return nil, nil
+	}
+	t := &threatFeeds{header: header, refreshInterval: refreshInterval, client: &http.Client{Timeout: 30 * time.Second}}
+	for i, feed := range feeds {
+		if len(feed.Name) == 0 {
+			feed.Name = fmt.Sprintf("feed%d", i)
+		}
+		if (len(feed.File) == 0) == (len(feed.Url) == 0) {
+			return nil, fmt.Errorf("threatFeeds %s requires either a file or an url", feed.Name)
+		}
+		switch feed.Type {
+		case "":
+			feed.Type = threatFeedTypeIP
+		case threatFeedTypeIP, threatFeedTypeDomain:
+		default:
+			return nil, fmt.Errorf("invalid threatFeeds type %q, expected %s or %s", feed.Type, threatFeedTypeIP, threatFeedTypeDomain)
+		}
+		switch feed.Action {
+		case "":
+			feed.Action = threatFeedActionBlock
+		case threatFeedActionBlock, threatFeedActionScore:
+		default:
+			return nil, fmt.Errorf("invalid threatFeeds action %q, expected %s or %s", feed.Action, threatFeedActionBlock, threatFeedActionScore)
+		}
+		f := &threatFeed{ThreatFeed: feed}
+		f.entries.Store(&threatFeedEntries{})
+		// files are loaded right away, a typo fails the configuration; downloads happen in the background
+		if len(feed.File) > 0 {
+			if err := t.load(context.Background(), f); err != nil {
+				return nil, fmt.Errorf("fail to load threatFeeds %s: %w", feed.Name, err)
+			}
+		}
+		t.feeds = append(t.feeds, f)
+	}
+	return t, nil
+}
+
+// shareThreatFeeds replaces the feeds of a with the ones shared under key, downloaded by a single
+// instance.
+func (a *Modsecurity) shareThreatFeeds(key string) {
+	shared := a.share(key, a.threatFeeds, a.runThreatFeeds).(*threatFeeds)
+	if shared != a.threatFeeds {
+		// a is not running the job, which reads a.threatFeeds
+		shared.adopt(a.threatFeeds)
+		a.threatFeeds = shared
+	}
+}
+
+// adopt stores the entries of the file feeds of loaded, configured as t, in t: the configuration
+// reloads sharing t reload the files right away.
+func (t *threatFeeds) adopt(loaded *threatFeeds) {
+	for i, feed := range loaded.feeds {
+		if len(feed.File) > 0 {
+			t.feeds[i].entries.Store(feed.entries.Load())
+		}
+	}
+}
+
+// match returns the first block feed matching req, or the score feeds matching it.
+func (t *threatFeeds) match(req *http.Request) (*threatFeed, []*threatFeed) {
+	if t == nil {
+		return nil, nil
+	}
+	ip := remoteIP(req)
+	var domains []string
+	for _, name := range []string{"Referer", "Origin"} {
+		if u, err := url.Parse(req.Header.Get(name)); err == nil && len(u.Hostname()) > 0 {
+			domains = append(domains, strings.ToLower(u.Hostname()))
+		}
+	}
+	var scored []*threatFeed
+	for _, feed := range t.feeds {
+		if !feed.matches(ip, domains) {
+			continue
+		}
+		if feed.Action == threatFeedActionBlock {
+			return feed, nil
+		}
+		scored = append(scored, feed)
+	}
+	return nil, scored
+}
+
+// matches reports whether ip, or one of domains or of their parent domains, is in the feed.
+func (f *threatFeed) matches(ip net.IP, domains []string) bool {
+	entries := f.entries.Load().(*threatFeedEntries)
+	if f.Type == threatFeedTypeIP {
+		return entries.ips.contains(ip)
+	}
+	for _, domain := range domains {
+		for len(domain) > 0 {
+			if entries.domains[domain] {
+				return true
+			}
+			i := strings.IndexByte(domain, '.')
+			if i < 0 {
+				break
+			}
+			domain = domain[i+1:]
+		}
+	}
+	return false
+}
+
+// risk returns the risk added by the score feeds matching req.
+func (t *threatFeeds) risk(req *http.Request) float64 {
+	_, scored := t.match(req)
+	risk := 0.0
+	for _, feed := range scored {
+		risk += feed.Score
+	}
+	return risk
+}
+
+// checkThreatFeeds blocks the requests matching a block feed and lists the score feeds matching
+// the other ones in the threat feed header. It reports whether req was blocked.
+func (a *Modsecurity) checkThreatFeeds(rw http.ResponseWriter, req *http.Request) bool {
+	blocked, scored := a.threatFeeds.match(req)
+	if blocked != nil {
+		a.blockLocally(rw, req, "threat feed "+blocked.Name, http.StatusForbidden)
+		return true
+	}
+	if len(a.threatFeeds.header) == 0 {
+		return false
+	}
+	req.Header.Del(a.threatFeeds.header)
+	if len(scored) > 0 {
+		names := make([]string, 0, len(scored))
+		for _, feed := range scored {
+			names = append(names, feed.Name)
+		}
+		req.Header.Set(a.threatFeeds.header, strings.Join(names, ","))
+	}
+	return false
+}
+
+// runThreatFeeds downloads the URL feeds, then reloads every feed each refreshInterval, until ctx
+// is done. A feed failing to load keeps its previous entries.
+func (a *Modsecurity) runThreatFeeds(ctx context.Context) {
+	ticker := time.NewTicker(a.threatFeeds.refreshInterval)
+	defer ticker.Stop()
+	first := true
+	for {
+		for _, feed := range a.threatFeeds.feeds {
+			if first && len(feed.File) > 0 {
+				continue
+			}
+			if err := a.threatFeeds.load(ctx, feed); err != nil {
+				a.logSampled("threat_feed_failed", logFields{"feed": feed.Name, "error": err.Error()})
+			}
+		}
+		first = false
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// load reads the entries of feed from its file or URL.
+func (t *threatFeeds) load(ctx context.Context, feed *threatFeed) error {
+	var body io.ReadCloser
+	if len(feed.File) > 0 {
+		file, err := os.Open(feed.File)
+		if err != nil {
+			return err
+		}
+		body = file
+	} else {
+		req, err := http.NewRequest(http.MethodGet, feed.Url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := t.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	entries := &threatFeedEntries{domains: make(map[string]bool)}
+	scanner := bufio.NewScanner(io.LimitReader(body, threatFeedMaxSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t,;"); i >= 0 {
+			line = line[:i]
+		}
+		if feed.Type == threatFeedTypeDomain {
+			entries.domains[strings.ToLower(strings.TrimSuffix(line, "."))] = true
+			continue
+		}
+		// lines which are neither an address nor a range, e.g. CSV headers, are ignored
+		entries.ips.add(strings.Trim(line, `"`))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	feed.entries.Store(entries)
+	return nil
+}
+
+// ipSet is a set of IP addresses and ranges, looked up with one map access per prefix length in use
+// rather than a scan of the ranges: feeds hold tens of thousands of entries.
+type ipSet struct {
+	// networks holds the masked 16 bytes form of the ranges, by prefix length of that form.
+	networks map[int]map[string]bool
+	lengths  []int
+}
+
+// add adds the address or range value, and reports whether it is valid.
+func (s *ipSet) add(value string) bool {
+	var ip net.IP
+	ones := 128
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return false
+		}
+		ip = network.IP
+		var bits int
+		ones, bits = network.Mask.Size()
+		ones += 128 - bits
+	} else if ip = net.ParseIP(value); ip == nil {
+		return false
+	}
+	if s.networks == nil {
+		s.networks = make(map[int]map[string]bool)
+	}
+	if s.networks[ones] == nil {
+		s.networks[ones] = make(map[string]bool)
+		s.lengths = append(s.lengths, ones)
+		sort.Ints(s.lengths)
+	}
+	s.networks[ones][string(ip.To16().Mask(net.CIDRMask(ones, 128)))] = true
+	return true
+}
+
+// contains reports whether ip belongs to the set.
+func (s *ipSet) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	ip = ip.To16()
+	for _, ones := range s.lengths {
+		if s.networks[ones][string(ip.Mask(net.CIDRMask(ones, 128)))] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIpSet(t *testing.T) {
+	var set ipSet
+	assert.False(t, set.contains(net.ParseIP("192.0.2.1")))
+	assert.True(t, set.add("192.0.2.0/24"))
+	assert.True(t, set.add("198.51.100.7"))
+	assert.True(t, set.add("2001:db8::/32"))
+	assert.False(t, set.add("not an address"))
+	assert.False(t, set.add("192.0.2.0/33"))
+
+	tests := []struct {
+		ip     string
+		expect bool
+	}{
+		{ip: "192.0.2.1", expect: true},
+		{ip: "192.0.2.255", expect: true},
+		{ip: "192.0.3.1"},
+		{ip: "198.51.100.7", expect: true},
+		{ip: "198.51.100.8"},
+		{ip: "::ffff:192.0.2.1", expect: true},
+		{ip: "2001:db8:1::1", expect: true},
+		{ip: "2001:db9::1"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, set.contains(net.ParseIP(tt.ip)), tt.ip)
+	}
+	assert.False(t, set.contains(nil))
+}
+
+func writeThreatFeed(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "feed.txt")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestNewThreatFeeds(t *testing.T) {
+	feeds, err := newThreatFeeds(nil, defaultThreatFeedHeader, time.Hour)
+	assert.NoError(t, err)
+	assert.Nil(t, feeds)
+
+	invalid := []ThreatFeed{
+		{Name: "none"},
+		{Name: "both", File: "feed.txt", Url: "http://feeds.invalid/"},
+		{File: writeThreatFeed(t, ""), Type: "asn"},
+		{File: writeThreatFeed(t, ""), Action: "ban"},
+		{File: "/does/not/exist.txt"},
+	}
+	for _, feed := range invalid {
+		_, err := newThreatFeeds([]ThreatFeed{feed}, defaultThreatFeedHeader, time.Hour)
+		assert.Error(t, err, feed)
+	}
+
+	drop := writeThreatFeed(t, "; Spamhaus DROP List\n; Last-Modified: Tue, 1 Oct 2024\n192.0.2.0/24 ; SBL123\n\n198.51.100.0/24 ; SBL456\n")
+	abuseipdb := writeThreatFeed(t, "\"ipAddress\",\"abuseConfidenceScore\"\n\"203.0.113.9\",100\n")
+	domains := writeThreatFeed(t, "# bad referrers\nSpam.example.\n")
+	feeds, err = newThreatFeeds([]ThreatFeed{
+		{Name: "drop", File: drop},
+		{File: abuseipdb, Action: threatFeedActionScore, Score: 5},
+		{Name: "spam", File: domains, Type: threatFeedTypeDomain, Action: threatFeedActionScore, Score: 2},
+	}, defaultThreatFeedHeader, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "feed1", feeds.feeds[1].Name)
+
+	request := func(remoteAddr string, referer string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Referer", referer)
+		return req
+	}
+	blocked, scored := feeds.match(request("198.51.100.1:1234", ""))
+	assert.Equal(t, "drop", blocked.Name)
+	assert.Empty(t, scored)
+	blocked, scored = feeds.match(request("203.0.113.9:1234", "https://www.spam.example/offer"))
+	assert.Nil(t, blocked)
+	assert.Len(t, scored, 2)
+	assert.Equal(t, 7.0, feeds.risk(request("203.0.113.9:1234", "https://www.spam.example/offer")))
+	blocked, scored = feeds.match(request("203.0.113.10:1234", "https://example/"))
+	assert.Nil(t, blocked)
+	assert.Empty(t, scored)
+}
+
+func TestModsecurity_ThreatFeeds(t *testing.T) {
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("203.0.113.0/24\n"))
+	}))
+	defer feedServer.Close()
+
+	var wafFeeds []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafFeeds = append(wafFeeds, r.Header.Get(defaultThreatFeedHeader))
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ThreatFeeds = []ThreatFeed{
+		{Name: "drop", File: writeThreatFeed(t, "192.0.2.0/24\n")},
+		{Name: "abuse", Url: feedServer.URL, Action: threatFeedActionScore, Score: 10},
+	}
+	config.Decision = &DecisionConfig{Type: "any", Policies: []DecisionConfig{{Type: "status"}, {Type: "risk", Threshold: 20}}}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 100 && !middleware.threatFeeds.feeds[1].matches(net.ParseIP("203.0.113.1"), nil); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(defaultThreatFeedHeader, "forged")
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234"))
+	assert.Empty(t, wafFeeds, "block feeds answer before the WAF")
+	assert.Equal(t, http.StatusOK, serve("203.0.113.1:1234"), "the score stays below the risk threshold")
+	assert.Equal(t, http.StatusOK, serve("198.51.100.1:1234"))
+	assert.Equal(t, []string{"abuse", ""}, wafFeeds)
+}
@@ -0,0 +1,58 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// Request headers carrying the TLS connection metadata to the WAF.
+const (
+	tlsVersionHeader = "X-Tls-Version"
+	tlsCipherHeader  = "X-Tls-Cipher"
+	tlsSniHeader     = "X-Tls-Sni"
+	tlsAlpnHeader    = "X-Tls-Alpn"
+	tlsJa3Header     = "X-Tls-Ja3"
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersions[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// applyTLSMetadata forwards the TLS connection state of req to the WAF as headers, so that
+// TLS-anomaly rules can be written against them. Traefik does not expose the ClientHello, so a
+// JA3 fingerprint is only forwarded when a component in front of Traefik computed it in the
+// ja3Header request header. Values sent by the client under the metadata header names are stripped.
+func applyTLSMetadata(req *http.Request, ja3Header string, header http.Header) {
+	for _, name := range []string{tlsVersionHeader, tlsCipherHeader, tlsSniHeader, tlsAlpnHeader, tlsJa3Header} {
+		header.Del(name)
+	}
+	if len(ja3Header) > 0 {
+		if ja3 := req.Header.Get(ja3Header); len(ja3) > 0 {
+			header.Set(tlsJa3Header, ja3)
+		}
+	}
+
+	state := req.TLS
+	if state == nil {
+		return
+	}
+	header.Set(tlsVersionHeader, tlsVersionName(state.Version))
+	header.Set(tlsCipherHeader, tls.CipherSuiteName(state.CipherSuite))
+	if len(state.ServerName) > 0 {
+		header.Set(tlsSniHeader, state.ServerName)
+	}
+	if len(state.NegotiatedProtocol) > 0 {
+		header.Set(tlsAlpnHeader, state.NegotiatedProtocol)
+	}
+}
@@ -0,0 +1,42 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyTLSMetadata(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.TLS = &tls.ConnectionState{
+		Version:            tls.VersionTLS13,
+		CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+		ServerName:         "example.com",
+		NegotiatedProtocol: "h2",
+	}
+	req.Header.Set("X-Ja3-Hash", "771,4865-4866,0-23,29-23,0")
+	req.Header.Set(tlsVersionHeader, "spoofed")
+
+	header := req.Header.Clone()
+	applyTLSMetadata(req, "X-Ja3-Hash", header)
+
+	assert.Equal(t, "TLS1.3", header.Get(tlsVersionHeader))
+	assert.Equal(t, "TLS_AES_128_GCM_SHA256", header.Get(tlsCipherHeader))
+	assert.Equal(t, "example.com", header.Get(tlsSniHeader))
+	assert.Equal(t, "h2", header.Get(tlsAlpnHeader))
+	assert.Equal(t, "771,4865-4866,0-23,29-23,0", header.Get(tlsJa3Header))
+}
+
+func TestApplyTLSMetadata_PlainHTTP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(tlsSniHeader, "spoofed")
+
+	header := req.Header.Clone()
+	applyTLSMetadata(req, "", header)
+
+	assert.Equal(t, "", header.Get(tlsSniHeader))
+	assert.Equal(t, "", header.Get(tlsVersionHeader))
+}
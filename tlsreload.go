@@ -0,0 +1,158 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloader is the transport to the WAF when client certificates or a custom CA are configured.
+// It watches the files and rebuilds the underlying transport when they change, so rotated
+// certificates (e.g. by cert-manager) are picked up without restarting Traefik.
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	transport *http.Transport
+	versions  map[string]fileVersion
+}
+
+// fileVersion identifies the content of a watched file without reading it.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func newTLSReloader(certFile string, keyFile string, caFile string) (*tlsReloader, error) {
+	if len(certFile) == 0 && len(keyFile) == 0 && len(caFile) == 0 {
+		return nil, nil
+	}
+	if (len(certFile) == 0) != (len(keyFile) == 0) {
+		return nil, fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RoundTrip implements http.RoundTripper with the current transport.
+func (r *tlsReloader) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.RLock()
+	transport := r.transport
+	r.mu.RUnlock()
+	return transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the current transport.
+func (r *tlsReloader) CloseIdleConnections() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.transport.CloseIdleConnections()
+}
+
+func (r *tlsReloader) files() []string {
+	var files []string
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// changed reports whether a watched file changed since the last reload.
+func (r *tlsReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// a file being replaced may briefly be missing, it is checked again on the next tick
+			continue
+		}
+		if (fileVersion{modTime: info.ModTime(), size: info.Size()}) != r.versions[file] {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads the TLS materials and swaps the transport. On errors the current transport is kept.
+// It reports whether the transport was replaced.
+func (r *tlsReloader) reload() (bool, error) {
+	versions := make(map[string]fileVersion)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, fmt.Errorf("fail to stat %s: %w", file, err)
+		}
+		versions[file] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(r.certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("fail to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(r.caFile) > 0 {
+		ca, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return false, fmt.Errorf("fail to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return false, fmt.Errorf("no certificate found in CA file %s", r.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := newTransport()
+	transport.TLSClientConfig = tlsConfig
+
+	r.mu.Lock()
+	previous := r.transport
+	r.transport = transport
+	r.versions = versions
+	r.mu.Unlock()
+
+	if previous != nil {
+		// connections in use finish their requests, new ones use the new materials
+		previous.CloseIdleConnections()
+	}
+	return previous != nil, nil
+}
+
+// watchTLSFiles polls the TLS files every interval and reloads the transport when they change,
+// until ctx is done.
+func (a *Modsecurity) watchTLSFiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !a.tlsReloader.changed() {
+				continue
+			}
+			if _, err := a.tlsReloader.reload(); err != nil {
+				a.logEvent("tls_reload_failed", logFields{"error": err.Error()})
+				continue
+			}
+			a.logEvent("tls_reloaded", logFields{})
+		}
+	}
+}
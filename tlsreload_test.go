@@ -0,0 +1,95 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePEMCertificate(t *testing.T, file string, der []byte, modTime time.Time) {
+	t.Helper()
+	assert.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.Chtimes(file, modTime, modTime))
+}
+
+func selfSignedCertificate(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "other-ca"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return der
+}
+
+func TestTLSReloader_reloadsRotatedCA(t *testing.T) {
+	wafServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEMCertificate(t, caFile, selfSignedCertificate(t), time.Now().Add(-time.Minute))
+
+	reloader, err := newTLSReloader("", "", caFile)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: reloader}
+
+	_, err = client.Get(wafServer.URL)
+	assert.Error(t, err, "the WAF certificate is not signed by the configured CA")
+	assert.False(t, reloader.changed())
+
+	writePEMCertificate(t, caFile, wafServer.Certificate().Raw, time.Now())
+	assert.True(t, reloader.changed())
+	replaced, err := reloader.reload()
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.False(t, reloader.changed())
+
+	resp, err := client.Get(wafServer.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestTLSReloader_keepsTransportOnErrors(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEMCertificate(t, caFile, selfSignedCertificate(t), time.Now())
+
+	reloader, err := newTLSReloader("", "", caFile)
+	assert.NoError(t, err)
+	transport := reloader.transport
+
+	assert.NoError(t, ioutil.WriteFile(caFile, []byte("not a certificate"), 0600))
+	_, err = reloader.reload()
+	assert.Error(t, err)
+	assert.Same(t, transport, reloader.transport)
+}
+
+func TestNewTLSReloader(t *testing.T) {
+	reloader, err := newTLSReloader("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, reloader)
+
+	_, err = newTLSReloader("cert.pem", "", "")
+	assert.Error(t, err)
+
+	_, err = newTLSReloader("", "", filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_RequestTrailers(t *testing.T) {
+	wafTrailer := ""
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		wafTrailer = r.Trailer.Get("X-Checksum")
+	}))
+	defer wafServer.Close()
+
+	serviceTrailer := ""
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		serviceTrailer = r.Trailer.Get("X-Checksum")
+	}))
+	server := httptest.NewServer(middleware)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, io.NopCloser(strings.NewReader("payload")))
+	assert.NoError(t, err)
+	req.ContentLength = -1
+	req.Trailer = http.Header{"X-Checksum": []string{"abc"}}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "abc", wafTrailer)
+	assert.Equal(t, "abc", serviceTrailer)
+}
+
+func TestForwardResponse_Trailers(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Rule")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("blocked"))
+		w.Header().Set("X-Rule", "942100")
+	}))
+	defer wafServer.Close()
+
+	resp, err := http.Get(wafServer.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	rw := httptest.NewRecorder()
+	forwardResponse(resp, rw)
+
+	result := rw.Result()
+	io.ReadAll(result.Body)
+	assert.Equal(t, http.StatusForbidden, result.StatusCode)
+	assert.Equal(t, "942100", result.Trailer.Get("X-Rule"))
+}
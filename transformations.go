@@ -0,0 +1,118 @@
+package traefik_modsecurity_plugin
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// transformationsHeader lists, with reportTransformations, the transformations the plugin applied
+// to the copy of the request sent to the WAF, so that rules and auditors know what was changed.
+const transformationsHeader = "X-Waf-Transformations"
+
+// Names of the transformations listed in transformationsHeader.
+const (
+	transformationForwardedURI    = "uri-forwarded"
+	transformationOriginForm      = "uri-origin-form"
+	transformationURIControlChars = "uri-control-chars-escaped"
+	transformationDoubleEncoding  = "uri-double-encoding-collapsed"
+	transformationUnicodeFolding  = "uri-unicode-folded"
+	transformationHeadersFiltered = "headers-filtered"
+	transformationCookies         = "cookies-rewritten"
+	transformationForwarded       = "forwarded-headers-rewritten"
+	transformationHeaderControl   = "header-control-chars-stripped"
+	transformationBodyTruncated   = "body-truncated"
+	transformationFormNormalized  = "body-form-normalized"
+	transformationJSONCompacted   = "body-json-compacted"
+)
+
+// transformations collects the transformations applied to a copy of a request sent to the WAF. Its
+// methods do nothing on a nil collector, used when reportTransformations is disabled.
+type transformations struct {
+	applied []string
+}
+
+func (a *Modsecurity) newTransformations() *transformations {
+	if !a.reportTransformations {
+		return nil
+	}
+	return &transformations{}
+}
+
+// add records the transformations in names.
+func (t *transformations) add(names ...string) {
+	if t != nil {
+		t.applied = append(t.applied, names...)
+	}
+}
+
+// addIf records the transformation name when it was applied.
+func (t *transformations) addIf(name string, applied bool) {
+	if applied {
+		t.add(name)
+	}
+}
+
+// apply sets transformationsHeader in header, the headers sent to the WAF. A value sent by the
+// client is never forwarded.
+func (t *transformations) apply(header http.Header) {
+	if t == nil {
+		return
+	}
+	header.Del(transformationsHeader)
+	if len(t.applied) > 0 {
+		header.Set(transformationsHeader, strings.Join(t.applied, ", "))
+	}
+}
+
+// bodyTransformation returns the name of the normalization applied to a body of contentType.
+func bodyTransformation(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/x-www-form-urlencoded" {
+		return transformationFormNormalized
+	}
+	return transformationJSONCompacted
+}
+
+// forwardedHeadersRewritten reports whether policy changes the proxy headers of header.
+func forwardedHeadersRewritten(policy string, header http.Header) bool {
+	if policy == forwardedHeadersOverwrite {
+		return true
+	}
+	if policy != forwardedHeadersStrip {
+		return false
+	}
+	for _, name := range forwardedHeaders {
+		if len(header.Values(name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHeaderControlChars reports whether stripControlChars changes header.
+func hasHeaderControlChars(header http.Header) bool {
+	for name, values := range header {
+		if containsControlChar(name) {
+			return true
+		}
+		for _, value := range values {
+			if containsControlChar(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameValues reports whether the header values a and b are equal.
+func sameValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransformations(t *testing.T) {
+	var disabled *transformations
+	disabled.add(transformationOriginForm)
+	disabled.addIf(transformationCookies, true)
+	header := http.Header{transformationsHeader: {"forged"}}
+	disabled.apply(header)
+	assert.Equal(t, "forged", header.Get(transformationsHeader))
+
+	transforms := &transformations{}
+	transforms.apply(header)
+	assert.Empty(t, header.Values(transformationsHeader), "a value sent by the client is never forwarded")
+	transforms.add(transformationOriginForm, transformationUnicodeFolding)
+	transforms.addIf(transformationCookies, false)
+	transforms.addIf(transformationBodyTruncated, true)
+	transforms.apply(header)
+	assert.Equal(t, "uri-origin-form, uri-unicode-folded, body-truncated", header.Get(transformationsHeader))
+}
+
+func TestForwardedHeadersRewritten(t *testing.T) {
+	forwarded := http.Header{"X-Forwarded-For": {"10.0.0.1"}}
+	assert.False(t, forwardedHeadersRewritten(forwardedHeadersPassthrough, forwarded))
+	assert.True(t, forwardedHeadersRewritten(forwardedHeadersOverwrite, http.Header{}))
+	assert.True(t, forwardedHeadersRewritten(forwardedHeadersStrip, forwarded))
+	assert.False(t, forwardedHeadersRewritten(forwardedHeadersStrip, http.Header{}))
+}
+
+func TestModsecurity_ReportTransformations(t *testing.T) {
+	var reported []string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reported = r.Header.Values(transformationsHeader)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.ReportTransformations = true
+	config.DoubleEncodingPolicy = doubleEncodingPolicyDecode
+	config.NormalizeCookies = true
+	config.CanonicalizeJson = true
+	var serviceHeader string
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceHeader = r.Header.Get(transformationsHeader)
+	}))
+
+	tests := []struct {
+		name   string
+		req    func() *http.Request
+		expect []string
+	}{
+		{
+			name: "Untouched",
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/items?page=1", nil)
+			},
+		},
+		{
+			name: "URI and cookies",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/files/%252e%252e", nil)
+				req.Header.Set("Cookie", `sid="abc%27"`)
+				return req
+			},
+			expect: []string{"uri-double-encoding-collapsed, cookies-rewritten"},
+		},
+		{
+			name: "JSON body",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(`{ "a": 1 }`))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			expect: []string{"body-json-compacted"},
+		},
+		{
+			name: "Forged",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/items", nil)
+				req.Header.Set(transformationsHeader, "none")
+				return req
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, tt.req())
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, tt.expect, reported)
+		})
+	}
+	assert.Equal(t, "none", serviceHeader, "the service receives the original headers")
+}
@@ -0,0 +1,99 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// errBlockedOnHeaders stops the body buffering once the headers phase returned a block verdict.
+var errBlockedOnHeaders = errors.New("request blocked on headers")
+
+type wafResult struct {
+	resp    *http.Response
+	blocked bool
+	err     error
+}
+
+// wafContextKey is the request context key of the context the WAF call of the request runs in.
+const wafContextKey contextKey = "modsecurity.waf"
+
+// earlyInspection is the headers phase of a two-phase inspection, running while the body is read.
+type earlyInspection struct {
+	results chan wafResult
+	result  *wafResult
+	cancel  context.CancelFunc
+}
+
+func (a *Modsecurity) startEarlyInspection(req *http.Request, botScore string) *earlyInspection {
+	// the WAF call outlives neither a discard nor the request, but a client going away does not
+	// abort it, like the other WAF calls
+	ctx, cancel := context.WithCancel(context.Background())
+	early := &earlyInspection{results: make(chan wafResult, 1), cancel: cancel}
+	inspected := req.WithContext(context.WithValue(req.Context(), wafContextKey, ctx))
+	go func() {
+		resp, err := a.inspect(inspected, nil, botScore)
+		early.results <- wafResult{resp: resp, blocked: err == nil && a.isBlocked(inspected, resp, a.signals(inspected, resp, botScore)), err: err}
+	}()
+	return early
+}
+
+// abortOnBlock wraps body so that reading stops with errBlockedOnHeaders as soon as the
+// headers phase returned a block verdict.
+func (e *earlyInspection) abortOnBlock(body io.Reader) io.Reader {
+	return &earlyAbortReader{early: e, body: body}
+}
+
+// wait returns the result of the headers phase, waiting for it if needed.
+func (e *earlyInspection) wait() wafResult {
+	if e.result == nil {
+		result := <-e.results
+		e.result = &result
+	}
+	return *e.result
+}
+
+// discard cancels the headers phase when the request fails for another reason, and waits for it
+// to return: it reads the request, which the caller may then hand to the service or modify.
+func (e *earlyInspection) discard() {
+	e.cancel()
+	if result := e.wait(); result.err == nil {
+		result.resp.Body.Close()
+	}
+}
+
+// close releases the context of the headers phase, once its response was handled.
+func (e *earlyInspection) close() {
+	if e != nil {
+		e.cancel()
+	}
+}
+
+// poll records the result of the headers phase if it is available, without waiting.
+func (e *earlyInspection) poll() *wafResult {
+	if e.result == nil {
+		select {
+		case result := <-e.results:
+			e.result = &result
+		default:
+		}
+	}
+	return e.result
+}
+
+type earlyAbortReader struct {
+	early *earlyInspection
+	body  io.Reader
+}
+
+func (r *earlyAbortReader) Read(p []byte) (int, error) {
+	if result := r.early.poll(); result != nil && result.blocked {
+		return 0, errBlockedOnHeaders
+	}
+	return r.body.Read(p)
+}
+
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+}
@@ -0,0 +1,116 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowBody returns chunks of data with a delay between each of them, counting what was read.
+type slowBody struct {
+	chunks int
+	read   int32
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if int(atomic.LoadInt32(&b.read)) >= b.chunks {
+		return 0, io.EOF
+	}
+	time.Sleep(5 * time.Millisecond)
+	atomic.AddInt32(&b.read, 1)
+	return copy(p, "x"), nil
+}
+
+func TestModsecurity_TwoPhaseInspection(t *testing.T) {
+	tests := []struct {
+		name             string
+		attackHeader     string
+		expectStatus     int
+		expectWafCalls   int32
+		expectFullyReads bool
+	}{
+		{name: "Blocks on headers without buffering the body", attackHeader: "1", expectStatus: http.StatusForbidden, expectWafCalls: 1},
+		{name: "Inspects the body when headers are clean", expectStatus: http.StatusOK, expectWafCalls: 2, expectFullyReads: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafCalls int32
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&wafCalls, 1)
+				if r.Header.Get("X-Attack") != "" {
+					w.WriteHeader(http.StatusForbidden)
+				}
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.TwoPhaseInspection = true
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			body := &slowBody{chunks: 100}
+			req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(body))
+			req.ContentLength = -1
+			if len(tt.attackHeader) > 0 {
+				req.Header.Set("X-Attack", tt.attackHeader)
+			}
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectWafCalls, atomic.LoadInt32(&wafCalls))
+			assert.Equal(t, tt.expectFullyReads, atomic.LoadInt32(&body.read) == 100)
+		})
+	}
+}
+
+func TestModsecurity_TwoPhaseInspectionSkipsBodylessRequests(t *testing.T) {
+	var wafCalls int32
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&wafCalls, 1)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.TwoPhaseInspection = true
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", strings.NewReader("")))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&wafCalls))
+}
+
+func TestModsecurity_TwoPhaseInspectionCancelsOnBodyError(t *testing.T) {
+	var cancelled int32
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			atomic.StoreInt32(&cancelled, 1)
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.TwoPhaseInspection = true
+	config.MaxBodySize = 4
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(&slowBody{chunks: 10}))
+	req.ContentLength = -1
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	middleware.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cancelled) == 1 }, time.Second, 10*time.Millisecond)
+}
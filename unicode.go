@@ -0,0 +1,201 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Values accepted in unicodeNormalization.
+const (
+	unicodeNormalizationOff  = "off"
+	unicodeNormalizationNfkc = "nfkc"
+)
+
+// Values accepted in homoglyphPolicy.
+const (
+	homoglyphPolicyOff    = "off"
+	homoglyphPolicyLog    = "log"
+	homoglyphPolicyReject = "reject"
+)
+
+func validateUnicodeNormalization(normalization string) error {
+	switch normalization {
+	case "", unicodeNormalizationOff, unicodeNormalizationNfkc:
+		return nil
+	}
+	return fmt.Errorf("invalid unicodeNormalization %q, expected %s or %s", normalization, unicodeNormalizationOff, unicodeNormalizationNfkc)
+}
+
+func validateHomoglyphPolicy(policy string) error {
+	switch policy {
+	case "", homoglyphPolicyOff, homoglyphPolicyLog, homoglyphPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("invalid homoglyphPolicy %q, expected %s, %s or %s", policy, homoglyphPolicyOff, homoglyphPolicyLog, homoglyphPolicyReject)
+}
+
+// nfkcFold returns the ASCII compatibility decomposition of r, as NFKC defines it, for the
+// characters servers fold to ASCII and attackers use to dodge the rules: fullwidth forms, small
+// form variants, dot leaders, spaces, superscript and subscript digits. Plugins only have the Go
+// standard library, which has no normalization tables, hence the subset.
+func nfkcFold(r rune) (string, bool) {
+	switch {
+	case r >= 0xFF01 && r <= 0xFF5E:
+		return string(r - 0xFF01 + '!'), true
+	case r == 0x00A0, r >= 0x2000 && r <= 0x200A, r == 0x202F, r == 0x205F, r == 0x3000:
+		return " ", true
+	case r == 0x2024:
+		return ".", true
+	case r == 0x2025:
+		return "..", true
+	case r == 0x2026:
+		return "...", true
+	case r == 0x00B9:
+		return "1", true
+	case r == 0x00B2, r == 0x00B3:
+		return string(r - 0x00B2 + '2'), true
+	case r == 0x2070, r >= 0x2074 && r <= 0x2079:
+		return string(r - 0x2070 + '0'), true
+	case r >= 0x2080 && r <= 0x2089:
+		return string(r - 0x2080 + '0'), true
+	}
+	if folded, ok := nfkcSmallForms[r]; ok {
+		return folded, true
+	}
+	return "", false
+}
+
+// nfkcSmallForms maps the small form variants block to ASCII.
+var nfkcSmallForms = map[rune]string{
+	0xFE50: ",", 0xFE52: ".", 0xFE54: ";", 0xFE55: ":", 0xFE56: "?", 0xFE57: "!", 0xFE59: "(",
+	0xFE5A: ")", 0xFE5B: "{", 0xFE5C: "}", 0xFE5F: "#", 0xFE60: "&", 0xFE61: "*", 0xFE62: "+",
+	0xFE63: "-", 0xFE64: "<", 0xFE65: ">", 0xFE66: "=", 0xFE68: "\\", 0xFE69: "$", 0xFE6A: "%",
+	0xFE6B: "@",
+}
+
+// isUnreservedURIByte reports whether c can appear unescaped in a request target.
+func isUnreservedURIByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) >= 0
+}
+
+// foldUnicodeURI folds the compatibility characters of uri, raw or percent-encoded, to ASCII.
+// Folded characters are percent-encoded, except the unreserved ones, so that the structure of
+// the target is kept: a fullwidth solidus becomes %2F, which the rules decode to a slash.
+func foldUnicodeURI(uri string) string {
+	var folded strings.Builder
+	changed := false
+	for i := 0; i < len(uri); {
+		var encoded [utf8.UTFMax]byte
+		n, end := 0, i
+		for end < len(uri) && n < utf8.UTFMax && !utf8.FullRune(encoded[:n]) {
+			if uri[end] == '%' && end+2 < len(uri) && isHex(uri[end+1]) && isHex(uri[end+2]) {
+				encoded[n] = unhex(uri[end+1])<<4 | unhex(uri[end+2])
+				end += 3
+			} else {
+				encoded[n] = uri[end]
+				end++
+			}
+			n++
+			if encoded[0] < utf8.RuneSelf {
+				break
+			}
+		}
+		r, size := utf8.DecodeRune(encoded[:n])
+		ascii, ok := "", false
+		if r != utf8.RuneError && size == n {
+			ascii, ok = nfkcFold(r)
+		}
+		if !ok {
+			folded.WriteByte(uri[i])
+			i++
+			continue
+		}
+		for j := 0; j < len(ascii); j++ {
+			if isUnreservedURIByte(ascii[j]) {
+				folded.WriteByte(ascii[j])
+			} else {
+				fmt.Fprintf(&folded, "%%%02X", ascii[j])
+			}
+		}
+		changed = true
+		i = end
+	}
+	if !changed {
+		return uri
+	}
+	return folded.String()
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// confusableScripts are the scripts whose letters look like Latin ones. Mixing other scripts,
+// e.g. Han and Katakana, is common in legitimate text.
+var confusableScripts = map[string]*unicode.RangeTable{
+	"Latin":    unicode.Latin,
+	"Greek":    unicode.Greek,
+	"Cyrillic": unicode.Cyrillic,
+	"Armenian": unicode.Armenian,
+	"Cherokee": unicode.Cherokee,
+}
+
+// mixedScriptWord returns the first word of the decoded path and query of req mixing letters of
+// several confusable scripts, e.g. a Latin "admin" spelled with a Cyrillic "а", empty when there
+// is none.
+func mixedScriptWord(req *http.Request) string {
+	target := wafRequestURI(req)
+	if decoded, err := url.PathUnescape(target); err == nil {
+		target = decoded
+	}
+	words := strings.FieldsFunc(target, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		script := ""
+		for _, r := range word {
+			for name, table := range confusableScripts {
+				if !unicode.Is(table, r) {
+					continue
+				}
+				if len(script) > 0 && script != name {
+					return word
+				}
+				script = name
+			}
+		}
+	}
+	return ""
+}
+
+// checkHomoglyphs applies homoglyphPolicy to the requests mixing confusable scripts in a word of
+// their path or query. It reports whether the request was rejected.
+func (a *Modsecurity) checkHomoglyphs(rw http.ResponseWriter, req *http.Request) bool {
+	if len(a.homoglyphPolicy) == 0 || a.homoglyphPolicy == homoglyphPolicyOff {
+		return false
+	}
+	word := mixedScriptWord(req)
+	if len(word) == 0 {
+		return false
+	}
+	if a.homoglyphPolicy == homoglyphPolicyLog {
+		a.logSampled("homoglyph_detected", a.requestFields(req, logFields{"word": word}))
+		return false
+	}
+	a.blockLocally(rw, req, "mixed-script homoglyphs", http.StatusBadRequest)
+	return true
+}
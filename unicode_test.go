@@ -0,0 +1,106 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFoldUnicodeURI(t *testing.T) {
+	tests := []struct {
+		name   string
+		uri    string
+		expect string
+	}{
+		{name: "ASCII", uri: "/a/b?c=d%2F", expect: "/a/b?c=d%2F"},
+		{name: "Encoded fullwidth traversal", uri: "/files/%EF%BC%8E%EF%BC%8E%EF%BC%8Fetc/passwd", expect: "/files/..%2Fetc/passwd"},
+		{name: "Raw fullwidth letters", uri: "/ｓｅｌｅｃｔ", expect: "/select"},
+		{name: "Fullwidth quote", uri: "/q?id=1%EF%BC%87or%EF%BC%871", expect: "/q?id=1%27or%271"},
+		{name: "Small form variants", uri: "/q?a=%EF%B9%A4script%EF%B9%A5", expect: "/q?a=%3Cscript%3E"},
+		{name: "One dot leader", uri: "/%E2%80%A4%E2%80%A4/etc", expect: "/../etc"},
+		{name: "Superscript digit", uri: "/v%C2%B2", expect: "/v2"},
+		{name: "Other characters are kept", uri: "/caf%C3%A9/%E6%97%A5", expect: "/caf%C3%A9/%E6%97%A5"},
+		{name: "Truncated sequence", uri: "/a%EF%BC", expect: "/a%EF%BC"},
+		{name: "Invalid escape", uri: "/a%E%", expect: "/a%E%"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, foldUnicodeURI(tt.uri))
+		})
+	}
+}
+
+func TestMixedScriptWord(t *testing.T) {
+	tests := []struct {
+		uri    string
+		expect string
+	}{
+		{uri: "/admin/users?id=1", expect: ""},
+		{uri: "/%D0%B0dmin", expect: "аdmin"},
+		{uri: "/search?q=p%CE%B1ypal", expect: "pαypal"},
+		{uri: "/%D0%BC%D0%BE%D1%81%D0%BA%D0%B2%D0%B0/news", expect: ""},
+		{uri: "/caf%C3%A9", expect: ""},
+		{uri: "/%E6%97%A5%E6%9C%AC%E3%82%AB%E3%82%BF", expect: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			assert.Equal(t, tt.expect, mixedScriptWord(httptest.NewRequest(http.MethodGet, tt.uri, nil)))
+		})
+	}
+}
+
+func TestModsecurity_UnicodeNormalization(t *testing.T) {
+	var wafURI string
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafURI = r.RequestURI
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.UnicodeNormalization = unicodeNormalizationNfkc
+	var serviceURI string
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceURI = r.RequestURI
+	}))
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/files/%EF%BC%8E%EF%BC%8E%EF%BC%8Fetc", nil))
+	assert.Equal(t, "/files/..%2Fetc", wafURI)
+	assert.Equal(t, "/files/%EF%BC%8E%EF%BC%8E%EF%BC%8Fetc", serviceURI, "the service receives the original target")
+
+	config.UnicodeNormalization = "nfd"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.EqualError(t, err, `invalid unicodeNormalization "nfd", expected off or nfkc`)
+}
+
+func TestModsecurity_HomoglyphPolicy(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer wafServer.Close()
+
+	for _, policy := range []string{homoglyphPolicyLog, homoglyphPolicyReject} {
+		config := CreateConfig()
+		config.ModSecurityUrl = wafServer.URL
+		config.HomoglyphPolicy = policy
+		middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		var buf bytes.Buffer
+		middleware.logger = log.New(&buf, "", 0)
+
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/%D0%B0dmin", nil))
+		if policy == homoglyphPolicyReject {
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+		} else {
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Contains(t, buf.String(), "event=homoglyph_detected")
+		}
+
+		rw = httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin", nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+}
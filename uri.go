@@ -0,0 +1,86 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Values accepted in connectPolicy.
+const (
+	connectPolicyDeny   = "deny"
+	connectPolicyBypass = "bypass"
+)
+
+func validateConnectPolicy(policy string) error {
+	switch policy {
+	case "", connectPolicyDeny, connectPolicyBypass:
+		return nil
+	}
+	return fmt.Errorf("invalid connectPolicy %q, expected %s or %s", policy, connectPolicyDeny, connectPolicyBypass)
+}
+
+// wafRequestURI returns the request target sent to the WAF. It is the raw RequestURI sent by the
+// client, normalized to origin-form: absolute-form targets (http://host/path) are reduced to their
+// path and query so that they can be appended to the WAF URL. Control characters are escaped,
+// they can't break out of the request line.
+func wafRequestURI(req *http.Request) string {
+	uri := escapeControlChars(req.RequestURI)
+	if strings.HasPrefix(uri, "/") {
+		return uri
+	}
+	if req.URL != nil {
+		uri = req.URL.RequestURI()
+	}
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return uri
+}
+
+// wafURI returns the request target sent to the WAF. With useForwardedUri it is the target of
+// req.URL, as rewritten by the middlewares running before this one (StripPrefix, ReplacePath...),
+// so that rules match the path routed to the service. Otherwise it is the target sent by the client.
+// Its nested percent-encodings are collapsed with the decode doubleEncodingPolicy, and its
+// compatibility characters folded to ASCII with unicodeNormalization.
+func (a *Modsecurity) wafURI(req *http.Request) string {
+	uri, _ := a.transformedURI(req)
+	return uri
+}
+
+// transformedURI returns wafURI and the transformations it applied to the target sent by the
+// client.
+func (a *Modsecurity) transformedURI(req *http.Request) (string, []string) {
+	var applied []string
+	uri := ""
+	if a.useForwardedUri && req.URL != nil {
+		if forwarded := req.URL.RequestURI(); strings.HasPrefix(forwarded, "/") {
+			uri = escapeControlChars(forwarded)
+			if forwarded != req.RequestURI {
+				applied = append(applied, transformationForwardedURI)
+			}
+		}
+	}
+	if len(uri) == 0 {
+		uri = wafRequestURI(req)
+		if !strings.HasPrefix(req.RequestURI, "/") {
+			applied = append(applied, transformationOriginForm)
+		}
+	}
+	if escapeControlChars(req.RequestURI) != req.RequestURI {
+		applied = append(applied, transformationURIControlChars)
+	}
+	if a.doubleEncodingPolicy == doubleEncodingPolicyDecode {
+		if collapsed := collapseEncoding(uri); collapsed != uri {
+			uri = collapsed
+			applied = append(applied, transformationDoubleEncoding)
+		}
+	}
+	if a.foldUnicode {
+		if folded := foldUnicodeURI(uri); folded != uri {
+			uri = folded
+			applied = append(applied, transformationUnicodeFolding)
+		}
+	}
+	return uri, applied
+}
@@ -0,0 +1,94 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWafRequestURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		expect  string
+	}{
+		{name: "Origin-form", request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n", expect: "/path?q=1"},
+		{name: "Absolute-form", request: "GET http://example.com/path?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n", expect: "/path?q=1"},
+		{name: "Absolute-form without path", request: "GET http://example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", expect: "/"},
+		{name: "Asterisk-form", request: "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n", expect: "/*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, wafRequestURI(req))
+		})
+	}
+}
+
+func TestModsecurity_UseForwardedUri(t *testing.T) {
+	tests := []struct {
+		name            string
+		useForwardedUri bool
+		expect          string
+	}{
+		{name: "Sends the client request target", expect: "/api/users?id=1"},
+		{name: "Sends the rewritten request target", useForwardedUri: true, expect: "/users?id=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafURI string
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafURI = r.RequestURI
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.UseForwardedUri = tt.useForwardedUri
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			// a StripPrefix middleware running before this one rewrites req.URL only
+			req := httptest.NewRequest(http.MethodGet, "/api/users?id=1", nil)
+			req.URL.Path = "/users"
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.expect, wafURI)
+		})
+	}
+}
+
+func TestModsecurity_ConnectPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		expectStatus int
+	}{
+		{name: "Denies CONNECT by default", expectStatus: http.StatusMethodNotAllowed},
+		{name: "Bypasses the WAF", policy: connectPolicyBypass, expectStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("CONNECT requests must not reach the WAF")
+			}))
+			defer wafServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = wafServer.URL
+			config.ConnectPolicy = tt.policy
+			middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")))
+			assert.NoError(t, err)
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+)
+
+type userAgentVerdict int
+
+const (
+	userAgentUnmatched userAgentVerdict = iota
+	userAgentAllowed
+	userAgentDenied
+)
+
+// userAgentRules is a local pre-filter on the User-Agent header evaluated before the WAF round trip.
+// Allowed user agents skip the WAF, denied user agents are rejected. Allow rules are evaluated first.
+// Anyone can send any User-Agent, so the allow rules only apply to the clients of allowSources.
+type userAgentRules struct {
+	allow        []*regexp.Regexp
+	allowSources []*net.IPNet
+	deny         []*regexp.Regexp
+}
+
+func newUserAgentRules(allow []string, allowSources []string, deny []string) (*userAgentRules, error) {
+	allowRegexps, err := compileRegexps("userAgentAllow", allow)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := parseCIDRs("userAgentAllowSources", allowSources)
+	if err != nil {
+		return nil, err
+	}
+	if len(allowRegexps) > 0 && len(sources) == 0 {
+		return nil, fmt.Errorf("userAgentAllow requires userAgentAllowSources")
+	}
+	denyRegexps, err := compileRegexps("userAgentDeny", deny)
+	if err != nil {
+		return nil, err
+	}
+	return &userAgentRules{allow: allowRegexps, allowSources: sources, deny: denyRegexps}, nil
+}
+
+func (r *userAgentRules) match(req *http.Request) userAgentVerdict {
+	userAgent := req.UserAgent()
+	if matchAny(r.allow, userAgent) && containsIP(r.allowSources, remoteIP(req)) {
+		return userAgentAllowed
+	}
+	if matchAny(r.deny, userAgent) {
+		return userAgentDenied
+	}
+	return userAgentUnmatched
+}
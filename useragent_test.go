@@ -0,0 +1,69 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAgentRules_match(t *testing.T) {
+	rules, err := newUserAgentRules([]string{"^UptimeRobot/"}, []string{"198.51.100.0/24"}, []string{"^$", "(?i)sqlmap|nikto"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		userAgent  string
+		remoteAddr string
+		expect     userAgentVerdict
+	}{
+		{name: "Regular browser", userAgent: "Mozilla/5.0", expect: userAgentUnmatched},
+		{name: "Empty user agent", userAgent: "", expect: userAgentDenied},
+		{name: "Known scanner", userAgent: "sqlmap/1.5", expect: userAgentDenied},
+		{name: "Monitoring agent", userAgent: "UptimeRobot/2.0", remoteAddr: "198.51.100.7:1234", expect: userAgentAllowed},
+		{name: "Forged monitoring agent", userAgent: "UptimeRobot/2.0", remoteAddr: "203.0.113.9:1234", expect: userAgentUnmatched},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			if len(tt.remoteAddr) > 0 {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			assert.Equal(t, tt.expect, rules.match(req))
+		})
+	}
+}
+
+func TestNewUserAgentRules_InvalidPattern(t *testing.T) {
+	_, err := newUserAgentRules(nil, nil, []string{"("})
+	assert.Error(t, err)
+	_, err = newUserAgentRules([]string{"^UptimeRobot/"}, nil, nil)
+	assert.EqualError(t, err, "userAgentAllow requires userAgentAllowSources")
+}
+
+func TestModsecurity_UserAgentAllow(t *testing.T) {
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.UserAgentAllow = []string{"^UptimeRobot/"}
+	config.UserAgentAllowSources = []string{"198.51.100.0/24"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/?id=1'%20OR%201=1", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "UptimeRobot/2.0")
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	// the allowed user agent skips the WAF, the request reaches the service uninspected
+	assert.Equal(t, http.StatusOK, serve("198.51.100.7:1234"))
+	assert.Equal(t, http.StatusForbidden, serve("203.0.113.9:1234"), "a forged user agent is inspected")
+}
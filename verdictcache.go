@@ -0,0 +1,156 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verdictCacheMaxEntries bounds the memory used by the verdict cache. New verdicts are not cached
+// once it is reached and no entry expired.
+const verdictCacheMaxEntries = 10000
+
+// verdictCacheMaxBody is the largest WAF response body cached with its verdict.
+const verdictCacheMaxBody = 64 * 1024
+
+// verdictCache caches the WAF verdicts which the WAF marked as cacheable, with the number of
+// seconds they can be reused in the header response header, e.g. for static assets. Only the
+// verdicts of requests without a body are cached, keyed by their method, host, URI and the values
+// of keyHeaders: the WAF is trusted to only mark verdicts which don't depend on the other headers.
+type verdictCache struct {
+	header     string
+	maxTtl     time.Duration
+	keyHeaders []string
+	mu         sync.Mutex
+	entries    map[string]*cachedVerdict
+}
+
+type cachedVerdict struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newVerdictCache(header string, maxTtl time.Duration, keyHeaders []string) *verdictCache {
+	if len(header) == 0 {
+		return nil
+	}
+	return &verdictCache{
+		header:     header,
+		maxTtl:     maxTtl,
+		keyHeaders: keyHeaders,
+		entries:    make(map[string]*cachedVerdict),
+	}
+}
+
+// key returns the cache key of req, sent to the WAF with uri.
+func (c *verdictCache) key(req *http.Request, uri string) string {
+	hash := sha256.New()
+	io.WriteString(hash, req.Method+"\n"+req.Host+"\n"+uri)
+	for _, name := range c.keyHeaders {
+		io.WriteString(hash, "\n"+strings.Join(req.Header.Values(name), ","))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ttl returns how long the verdict resp can be reused: its hint, at most maxTtl. It is zero when
+// the WAF did not mark the verdict as cacheable.
+func (c *verdictCache) ttl(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get(c.header)))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl > c.maxTtl {
+		ttl = c.maxTtl
+	}
+	return ttl
+}
+
+// get returns a copy of the verdict cached under key, nil when there is none.
+func (c *verdictCache) get(key string, now time.Time) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return &http.Response{
+		StatusCode:    entry.status,
+		Header:        entry.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+	}
+}
+
+// put caches the verdict resp under key when it is cacheable, buffering its body. resp stays
+// readable.
+func (c *verdictCache) put(key string, resp *http.Response, now time.Time) {
+	ttl := c.ttl(resp)
+	if ttl == 0 {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, verdictCacheMaxBody+1))
+	resp.Body = cachedBody{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil || len(body) > verdictCacheMaxBody {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= verdictCacheMaxEntries {
+		c.expire(now)
+		if len(c.entries) >= verdictCacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = &cachedVerdict{status: resp.StatusCode, header: resp.Header.Clone(), body: body, expires: now.Add(ttl)}
+}
+
+// cachedBody replays the part of a response body read to be cached, followed by the rest of it.
+type cachedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// expire forgets the expired verdicts. It must be called with mu held.
+func (c *verdictCache) expire(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// inspectCached returns the cached verdict of req when there is one, and inspects it otherwise,
+// caching the verdict when the WAF marked it as cacheable. Requests with a body and strict
+// requests are always inspected.
+func (a *Modsecurity) inspectCached(req *http.Request, body *bufferedBody, botScore string, strict bool) (*http.Response, error) {
+	if a.verdictCache == nil || strict || (body != nil && body.size > 0) || hasBody(req) {
+		return a.inspect(req, body, botScore)
+	}
+	key := a.verdictCache.key(req, a.wafURI(req))
+	now := time.Now()
+	if resp := a.verdictCache.get(key, now); resp != nil {
+		a.metrics.incVerdictCacheHit()
+		return resp, nil
+	}
+	resp, err := a.inspect(req, body, botScore)
+	if err != nil {
+		return nil, err
+	}
+	a.verdictCache.put(key, resp, now)
+	return resp, nil
+}
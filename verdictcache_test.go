@@ -0,0 +1,114 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerdictCache_ttl(t *testing.T) {
+	c := newVerdictCache("X-Waf-Cache-Ttl", time.Minute, nil)
+	tests := []struct {
+		value  string
+		expect time.Duration
+	}{
+		{value: "", expect: 0},
+		{value: "30", expect: 30 * time.Second},
+		{value: " 30 ", expect: 30 * time.Second},
+		{value: "3600", expect: time.Minute},
+		{value: "0", expect: 0},
+		{value: "-5", expect: 0},
+		{value: "soon", expect: 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if len(tt.value) > 0 {
+			resp.Header.Set("X-Waf-Cache-Ttl", tt.value)
+		}
+		assert.Equal(t, tt.expect, c.ttl(resp), tt.value)
+	}
+	assert.Nil(t, newVerdictCache("", time.Minute, nil))
+}
+
+func TestVerdictCache_expire(t *testing.T) {
+	c := newVerdictCache("X-Waf-Cache-Ttl", time.Minute, nil)
+	now := time.Now()
+	resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"X-Waf-Cache-Ttl": {"10"}}, Body: io.NopCloser(strings.NewReader("denied"))}
+	c.put("key", resp, now)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "denied", string(body), "the cached response stays readable")
+
+	cached := c.get("key", now.Add(5*time.Second))
+	if assert.NotNil(t, cached) {
+		body, _ = io.ReadAll(cached.Body)
+		assert.Equal(t, http.StatusForbidden, cached.StatusCode)
+		assert.Equal(t, "denied", string(body))
+	}
+	assert.Nil(t, c.get("key", now.Add(10*time.Second)))
+	assert.Empty(t, c.entries)
+}
+
+func TestModsecurity_VerdictCache(t *testing.T) {
+	wafCalls := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/static/"):
+			w.Header().Set("X-Waf-Cache-Ttl", "60")
+		case strings.HasPrefix(r.URL.Path, "/wp-admin"):
+			w.Header().Set("X-Waf-Cache-Ttl", "60")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("denied"))
+		}
+	}))
+	defer wafServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = wafServer.URL
+	config.VerdictCacheHeader = "X-Waf-Cache-Ttl"
+	config.VerdictCacheKeyHeaders = []string{"Accept-Language"}
+	middleware := newTestModsecurity(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("page"))
+	}))
+
+	serve := func(method string, target string, body string, language string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(language) > 0 {
+			req.Header.Set("Accept-Language", language)
+		}
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw
+	}
+
+	for i := 0; i < 3; i++ {
+		rw := serve(http.MethodGet, "/static/app.js", "", "en")
+		assert.Equal(t, "page", rw.Body.String())
+	}
+	assert.Equal(t, 1, wafCalls, "the verdicts marked as cacheable are reused")
+	serve(http.MethodGet, "/static/app.js", "", "fr")
+	assert.Equal(t, 2, wafCalls, "the key headers distinguish the verdicts")
+	serve(http.MethodGet, "/static/app.js?v=2", "", "en")
+	assert.Equal(t, 3, wafCalls)
+
+	for i := 0; i < 2; i++ {
+		rw := serve(http.MethodGet, "/wp-admin", "", "")
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.Equal(t, "denied", rw.Body.String())
+	}
+	assert.Equal(t, 4, wafCalls, "block verdicts are replayed with their response")
+
+	wafCalls = 0
+	serve(http.MethodGet, "/index.html", "", "")
+	serve(http.MethodGet, "/index.html", "", "")
+	assert.Equal(t, 2, wafCalls, "verdicts without a hint are not cached")
+	serve(http.MethodPost, "/static/upload", "payload", "")
+	serve(http.MethodPost, "/static/upload", "payload", "")
+	assert.Equal(t, 4, wafCalls, "requests with a body are always inspected")
+	assert.Equal(t, int64(3), middleware.metrics.snapshot()["verdict_cache_hits"])
+}
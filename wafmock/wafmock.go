@@ -0,0 +1,191 @@
+// Package wafmock provides a configurable mock of the ModSecurity server used by the plugin, to
+// integration-test Traefik configurations and the failure modes of the plugin without a real WAF.
+//
+//	waf := wafmock.NewServer(wafmock.Config{
+//		Rules: []wafmock.Rule{{PathPrefix: "/admin", RuleIds: []string{"949110"}}},
+//		Chaos: wafmock.Chaos{ErrorRate: 0.1},
+//	})
+//	defer waf.Close()
+//	// use waf.URL as modSecurityUrl
+package wafmock
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying the matched rule IDs and the anomaly score, the plugin defaults.
+const (
+	RuleIdsHeader      = "X-Waf-Rule-Ids"
+	AnomalyScoreHeader = "X-Waf-Anomaly-Score"
+)
+
+// Rule blocks the requests it matches. A rule matches when the path starts with PathPrefix and the
+// raw request URI or the body contains Contains, empty fields match every request.
+type Rule struct {
+	PathPrefix string
+	Contains   string
+	// Status of the block response, 403 when zero.
+	Status  int
+	RuleIds []string
+	// Score is sent in AnomalyScoreHeader when positive.
+	Score float64
+}
+
+// Chaos injects faults in the WAF answers. Rates are probabilities in [0, 1] applied to every request.
+type Chaos struct {
+	// Latency is added to every answer, plus a random duration up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the share of requests answered with a 502.
+	ErrorRate float64
+	// DropRate is the share of connections closed without answer.
+	DropRate float64
+	// HangRate is the share of requests never answered, until the client gives up.
+	HangRate float64
+}
+
+// Config configures the mock. Requests matching no rule are allowed with a 200.
+type Config struct {
+	Rules []Rule
+	Chaos Chaos
+	// Seed makes the chaos decisions reproducible, a time-based seed is used when zero.
+	Seed int64
+}
+
+// Request is a request received by the mock.
+type Request struct {
+	Method string
+	URI    string
+	Header http.Header
+	Body   []byte
+}
+
+// Handler is the http.Handler of the mock, to serve it from any HTTP server.
+type Handler struct {
+	mu       sync.Mutex
+	config   Config
+	rand     *rand.Rand
+	requests []Request
+}
+
+// NewHandler returns the handler of a mock configured with config.
+func NewHandler(config Config) *Handler {
+	h := &Handler{}
+	h.SetConfig(config)
+	return h
+}
+
+// SetConfig replaces the configuration of the mock, for instance to start an outage during a test.
+func (h *Handler) SetConfig(config Config) {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+	h.rand = rand.New(rand.NewSource(seed))
+}
+
+// Requests returns the requests received so far.
+func (h *Handler) Requests() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Request(nil), h.requests...)
+}
+
+// Reset forgets the received requests.
+func (h *Handler) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	h.mu.Lock()
+	h.requests = append(h.requests, Request{Method: r.Method, URI: r.RequestURI, Header: r.Header.Clone(), Body: body})
+	config := h.config
+	delay := config.Chaos.Latency
+	if config.Chaos.Jitter > 0 {
+		delay += time.Duration(h.rand.Int63n(int64(config.Chaos.Jitter)))
+	}
+	fault := h.rand.Float64()
+	h.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	chaos := config.Chaos
+	switch {
+	case fault < chaos.HangRate:
+		<-r.Context().Done()
+		return
+	case fault < chaos.HangRate+chaos.DropRate:
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	case fault < chaos.HangRate+chaos.DropRate+chaos.ErrorRate:
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	if rule := match(config.Rules, r, body); rule != nil {
+		if len(rule.RuleIds) > 0 {
+			w.Header().Set(RuleIdsHeader, strings.Join(rule.RuleIds, ","))
+		}
+		if rule.Score > 0 {
+			w.Header().Set(AnomalyScoreHeader, strconv.FormatFloat(rule.Score, 'f', -1, 64))
+		}
+		status := rule.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, http.StatusText(status))
+	}
+}
+
+func match(rules []Rule, r *http.Request, body []byte) *Rule {
+	for i, rule := range rules {
+		if !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+			continue
+		}
+		if len(rule.Contains) > 0 && !strings.Contains(r.RequestURI, rule.Contains) && !bytes.Contains(body, []byte(rule.Contains)) {
+			continue
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// Server is a mock served on a local listener, its URL is the modSecurityUrl of the plugin.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a mock configured with config. It must be closed.
+func NewServer(config Config) *Server {
+	handler := NewHandler(config)
+	return &Server{Server: httptest.NewServer(handler), Handler: handler}
+}
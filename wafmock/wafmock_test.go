@@ -0,0 +1,80 @@
+package wafmock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Rules(t *testing.T) {
+	waf := NewServer(Config{Rules: []Rule{
+		{PathPrefix: "/admin", RuleIds: []string{"949110"}},
+		{Contains: "union", Status: http.StatusNotAcceptable, RuleIds: []string{"942100", "949110"}, Score: 10},
+	}})
+	defer waf.Close()
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		expectStatus  int
+		expectRuleIds string
+		expectScore   string
+	}{
+		{name: "Allows", method: http.MethodGet, path: "/", expectStatus: http.StatusOK},
+		{name: "Blocks by path", method: http.MethodGet, path: "/admin/users", expectStatus: http.StatusForbidden, expectRuleIds: "949110"},
+		{name: "Blocks by query", method: http.MethodGet, path: "/?q=union%20select", expectStatus: http.StatusNotAcceptable, expectRuleIds: "942100,949110", expectScore: "10"},
+		{name: "Blocks by body", method: http.MethodPost, path: "/search", body: "q=1 union select", expectStatus: http.StatusNotAcceptable, expectRuleIds: "942100,949110", expectScore: "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, waf.URL+tt.path, strings.NewReader(tt.body))
+			assert.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.expectStatus, resp.StatusCode)
+			assert.Equal(t, tt.expectRuleIds, resp.Header.Get(RuleIdsHeader))
+			assert.Equal(t, tt.expectScore, resp.Header.Get(AnomalyScoreHeader))
+		})
+	}
+
+	requests := waf.Requests()
+	assert.Len(t, requests, 4)
+	assert.Equal(t, "q=1 union select", string(requests[3].Body))
+	waf.Reset()
+	assert.Empty(t, waf.Requests())
+}
+
+func TestServer_Chaos(t *testing.T) {
+	waf := NewServer(Config{Chaos: Chaos{ErrorRate: 1}})
+	defer waf.Close()
+
+	resp, err := http.Get(waf.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	waf.SetConfig(Config{Chaos: Chaos{DropRate: 1}})
+	_, err = http.Get(waf.URL)
+	assert.Error(t, err)
+
+	waf.SetConfig(Config{Chaos: Chaos{HangRate: 1}})
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	_, err = client.Get(waf.URL)
+	assert.Error(t, err)
+
+	waf.SetConfig(Config{Chaos: Chaos{Latency: 20 * time.Millisecond}})
+	start := time.Now()
+	resp, err = http.Get(waf.URL)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Empty(t, body)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+}
@@ -0,0 +1,96 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warmer pre-establishes connections to the WAF on startup and after idle periods, so the first
+// requests after a lull don't pay the dial and TLS handshake cost inside the WAF timeout.
+// Warm-up requests double as a health pre-check of the WAF.
+type warmer struct {
+	modsecurity  *Modsecurity
+	connections  int
+	idleInterval time.Duration
+	// lastUsed is the unix time in nanoseconds of the last WAF call.
+	lastUsed int64
+}
+
+func newWarmer(a *Modsecurity, connections int, idleInterval time.Duration) *warmer {
+	if connections <= 0 {
+		return nil
+	}
+	return &warmer{modsecurity: a, connections: connections, idleInterval: idleInterval}
+}
+
+// touch records a WAF call.
+func (w *warmer) touch() {
+	if w != nil {
+		atomic.StoreInt64(&w.lastUsed, time.Now().UnixNano())
+	}
+}
+
+// run warms the connections once, then again whenever no WAF call happened during idleInterval,
+// until ctx is done.
+func (w *warmer) run(ctx context.Context) {
+	w.warm(ctx)
+	if w.idleInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(w.idleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&w.lastUsed))) >= w.idleInterval {
+				w.warm(ctx)
+			}
+		}
+	}
+}
+
+// warm opens connections to the WAF with concurrent HEAD requests. Their connections stay in the
+// idle pool of the HTTP client.
+func (w *warmer) warm(ctx context.Context) {
+	var wg sync.WaitGroup
+	var failures int64
+	for i := 0; i < w.connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.ping(ctx); err != nil {
+				if atomic.AddInt64(&failures, 1) == 1 {
+					w.modsecurity.logEvent("waf_warmup_failed", logFields{"url": w.modsecurity.modSecurityUrl, "error": err.Error()})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	w.touch()
+}
+
+func (w *warmer) ping(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodHead, w.modsecurity.modSecurityUrl+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.modsecurity.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == nil {
+			w.modsecurity.outageAlerter.failure(err, time.Now())
+		}
+		return err
+	}
+	w.modsecurity.outageAlerter.success()
+	// the body must be drained for the connection to be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
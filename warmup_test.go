@@ -0,0 +1,66 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmer_warm(t *testing.T) {
+	var mu sync.Mutex
+	connections := map[string]bool{}
+	wafServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		time.Sleep(10 * time.Millisecond)
+	}))
+	wafServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections[conn.RemoteAddr().String()] = true
+			mu.Unlock()
+		}
+	}
+	wafServer.Start()
+	defer wafServer.Close()
+
+	middleware := &Modsecurity{modSecurityUrl: wafServer.URL, httpClient: newWafClient(time.Second), logger: log.New(io.Discard, "", 0)}
+	newWarmer(middleware, 3, 0).warm(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, connections, 3)
+}
+
+func TestWarmer_runRewarmsAfterIdlePeriods(t *testing.T) {
+	var mu sync.Mutex
+	pings := 0
+	wafServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pings++
+		mu.Unlock()
+	}))
+	defer wafServer.Close()
+
+	middleware := &Modsecurity{modSecurityUrl: wafServer.URL, httpClient: newWafClient(time.Second), logger: log.New(io.Discard, "", 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		newWarmer(middleware, 1, 20*time.Millisecond).run(ctx)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Greater(t, pings, 1)
+}
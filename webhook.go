@@ -0,0 +1,100 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// webhookQueueLength bounds the webhook messages waiting to be posted. Messages are dropped when it is full.
+const webhookQueueLength = 100
+
+// webhookQueue posts JSON messages to webhooks (chat, incident management) in the background,
+// so slow endpoints never delay requests.
+type webhookQueue struct {
+	client *http.Client
+	queue  chan webhookMessage
+}
+
+type webhookMessage struct {
+	url     string
+	header  http.Header
+	payload []byte
+}
+
+func newWebhookQueue() *webhookQueue {
+	return &webhookQueue{
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan webhookMessage, webhookQueueLength),
+	}
+}
+
+// enqueue queues payload to be posted to url. It reports false when the queue is full.
+func (q *webhookQueue) enqueue(url string, payload []byte) bool {
+	return q.enqueueMessage(webhookMessage{url: url, payload: payload})
+}
+
+// enqueueMessage queues message, reporting false when the queue is full.
+func (q *webhookQueue) enqueueMessage(message webhookMessage) bool {
+	select {
+	case q.queue <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *webhookQueue) post(message webhookMessage) error {
+	req, err := http.NewRequest(http.MethodPost, message.url, bytes.NewReader(message.payload))
+	if err != nil {
+		return err
+	}
+	for name, values := range message.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// runWebhooks posts the queued messages until ctx is done.
+func (a *Modsecurity) runWebhooks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-a.webhooks.queue:
+			a.postWebhook(message)
+		}
+	}
+}
+
+// flushWebhooks posts the messages still queued, on Close.
+func (a *Modsecurity) flushWebhooks() {
+	for {
+		select {
+		case message := <-a.webhooks.queue:
+			a.postWebhook(message)
+		default:
+			return
+		}
+	}
+}
+
+func (a *Modsecurity) postWebhook(message webhookMessage) {
+	if err := a.webhooks.post(message); err != nil {
+		a.logSampled("webhook_failed", logFields{"error": err.Error()})
+	}
+}